@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The entries queued for network sinks, the next ones are dropped till the sink catches up
+const accessLogQueue = 10000
+
+var accessLogDropped = newCounter("auto_proxy_access_log_dropped_total",
+	"Number of access log entries dropped because the sink was full or failed", "sink")
+var accessLogBatches = newCounter("auto_proxy_access_log_batches_total",
+	"Number of access log batches sent by sinks", "sink", "result")
+
+// accessLogEntry is the access log line of request, the line ends with new line
+type accessLogEntry struct {
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	Line string    `json:"line"`
+
+	// VirtualHost is the matched route, it is empty for unknown hosts
+	VirtualHost string `json:"-"`
+}
+
+func (e *accessLogEntry) message() string {
+	return strings.TrimSuffix(e.Line, "\n")
+}
+
+// accessLogSink writes the access log entries, Write must not block the request
+type accessLogSink interface {
+	Write(entry *accessLogEntry)
+	Close() error
+}
+
+// accessLogSinks writes each entry to all sinks of -access-log
+type accessLogSinks []accessLogSink
+
+var accessLog accessLogSinks
+
+func (s accessLogSinks) Write(entry *accessLogEntry) {
+	for _, sink := range s {
+		sink.Write(entry)
+	}
+}
+
+// Close flushes the pending entries of sinks, it is called once the listeners are drained
+func (s accessLogSinks) Close() {
+	for _, sink := range s {
+		if err := sink.Close(); err != nil {
+			logrus.WithError(err).Warningln("Failed to flush access log")
+		}
+	}
+}
+
+// parseAccessLog opens the comma separated sinks, ie. stdout,loki+http://loki:3100/loki/api/v1/push
+func parseAccessLog(value string) (accessLogSinks, error) {
+	var sinks accessLogSinks
+	for _, target := range strings.Split(value, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" || target == "off" {
+			continue
+		}
+		sink, err := newAccessLogSink(target)
+		if err != nil {
+			sinks.Close()
+			return nil, errors.New("access-log: " + target + ": " + err.Error())
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func newAccessLogSink(target string) (accessLogSink, error) {
+	if target == "stdout" {
+		return &writerSink{file: os.Stdout}, nil
+	} else if filepath.IsAbs(target) {
+		return newFileSink(target)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileSink(localPath(u))
+	case "syslog", "syslog+udp", "syslog+tcp":
+		return newSyslogSink(u)
+	case "kafka":
+		return newKafkaSink(u)
+	case "http", "https":
+		return newBatchSink(target, &httpBulkSink{url: target}), nil
+	case "loki+http", "loki+https":
+		u.Scheme = strings.TrimPrefix(u.Scheme, "loki+")
+		return newBatchSink(target, &httpBulkSink{url: u.String(), loki: true}), nil
+	}
+	return nil, errors.New("unknown sink, expected stdout, file, syslog, kafka, http or loki+http")
+}
+
+// writerSink writes the lines to stdout or file as they come
+type writerSink struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+func newFileSink(path string) (accessLogSink, error) {
+	os.MkdirAll(filepath.Dir(path), 0700)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{file: file}, nil
+}
+
+func (w *writerSink) Write(entry *accessLogEntry) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fmt.Fprint(w.file, entry.Line)
+}
+
+func (w *writerSink) Close() error {
+	if w.file == os.Stdout {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// batchWriter sends the batch of entries to network sink
+type batchWriter interface {
+	send(entries []*accessLogEntry) error
+	close()
+}
+
+// batchSink queues the entries and sends them in batches of -access-log-batch at least every -access-log-flush,
+// the batch which failed to send is dropped
+type batchSink struct {
+	name    string
+	writer  batchWriter
+	entries chan *accessLogEntry
+	done    chan struct{}
+	stopped bool
+	lock    sync.RWMutex
+}
+
+func newBatchSink(name string, writer batchWriter) *batchSink {
+	if u, err := url.Parse(name); err == nil {
+		// Don't expose credentials in metrics
+		u.User = nil
+		name = u.String()
+	}
+	sink := &batchSink{
+		name:    name,
+		writer:  writer,
+		entries: make(chan *accessLogEntry, accessLogQueue),
+		done:    make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (s *batchSink) Write(entry *accessLogEntry) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.stopped {
+		accessLogDropped.Inc(s.name)
+		return
+	}
+	select {
+	case s.entries <- entry:
+	default:
+		accessLogDropped.Inc(s.name)
+	}
+}
+
+func (s *batchSink) run() {
+	defer close(s.done)
+	defer s.writer.close()
+
+	var batch []*accessLogEntry
+	ticker := time.NewTicker(*accessLogFlush)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.writer.send(batch); err != nil {
+			accessLogBatches.Inc(s.name, "error")
+			accessLogDropped.Add(float64(len(batch)), s.name)
+			logrus.WithError(err).WithField("sink", s.name).WithField("entries", len(batch)).
+				Warningln("Failed to send access log batch")
+		} else {
+			accessLogBatches.Inc(s.name, "ok")
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case entry, ok := <-s.entries:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= *accessLogBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close sends the queued entries, the entries written after are dropped
+func (s *batchSink) Close() error {
+	s.lock.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.entries)
+	}
+	s.lock.Unlock()
+
+	<-s.done
+	return nil
+}
+
+// httpBulkSink posts the batch as JSON lines, or as the streams of Loki push API labeled by the virtual host of route.
+// The requested host is kept only in the line, so the clients can't create unbounded number of streams.
+type httpBulkSink struct {
+	url  string
+	loki bool
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (h *httpBulkSink) send(entries []*accessLogEntry) error {
+	var body bytes.Buffer
+	contentType := "application/x-ndjson"
+	if h.loki {
+		contentType = "application/json"
+		streams := make(map[string]*lokiStream)
+		var list []*lokiStream
+		for _, entry := range entries {
+			host := entry.VirtualHost
+			if host == "" {
+				host = "unknown"
+			}
+			stream := streams[host]
+			if stream == nil {
+				stream = &lokiStream{Stream: map[string]string{"job": "auto-proxy", "host": host}}
+				streams[host] = stream
+				list = append(list, stream)
+			}
+			stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.Time.UnixNano(), 10), entry.message()})
+		}
+		json.NewEncoder(&body).Encode(map[string]interface{}{"streams": list})
+	} else {
+		encoder := json.NewEncoder(&body)
+		for _, entry := range entries {
+			encoder.Encode(accessLogEntry{Time: entry.Time, Host: entry.Host, Line: entry.message()})
+		}
+	}
+
+	resp, err := webhookClient.Post(h.url, contentType, &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *httpBulkSink) close() {}
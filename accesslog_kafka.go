@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The versions of Kafka protocol used by the sink, supported since Kafka 1.0
+const (
+	kafkaProduceKey      = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadataKey     = 3
+	kafkaMetadataVersion = 4
+)
+
+const kafkaTimeout = 10 * time.Second
+
+var kafkaCRC = crc32.MakeTable(crc32.Castagnoli)
+
+var errKafkaShort = errors.New("kafka: short response")
+
+// kafkaSink produces the entries keyed by host to the topic, ie. kafka://10.0.0.1:9092/access-log,
+// each batch goes to the next partition
+type kafkaSink struct {
+	bootstrap   string
+	topic       string
+	leaders     map[int32]string
+	partitions  []int32
+	next        int
+	conns       map[string]net.Conn
+	correlation int32
+}
+
+func newKafkaSink(u *url.URL) (accessLogSink, error) {
+	topic := strings.Trim(u.Path, "/")
+	if u.Host == "" || topic == "" {
+		return nil, errors.New("expected kafka://broker:9092/topic")
+	}
+	bootstrap := u.Host
+	if u.Port() == "" {
+		bootstrap = net.JoinHostPort(u.Host, "9092")
+	}
+	return newBatchSink(u.String(), &kafkaSink{bootstrap: bootstrap, topic: topic, conns: make(map[string]net.Conn)}), nil
+}
+
+func (k *kafkaSink) send(entries []*accessLogEntry) error {
+	if len(k.partitions) == 0 {
+		if err := k.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	partition := k.partitions[k.next%len(k.partitions)]
+	k.next++
+
+	body := binary.BigEndian.AppendUint16(nil, 0xffff) // no transactional id
+	body = binary.BigEndian.AppendUint16(body, 1)      // acks of leader
+	body = binary.BigEndian.AppendUint32(body, uint32(kafkaTimeout.Milliseconds()))
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, k.topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	batch := kafkaRecordBatch(entries)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batch)))
+	body = append(body, batch...)
+
+	resp, err := k.request(k.leaders[partition], kafkaProduceKey, kafkaProduceVersion, body)
+	if err != nil {
+		k.partitions = nil
+		return err
+	}
+
+	topics := resp.int32()
+	for i := int32(0); i < topics && resp.err == nil; i++ {
+		resp.string()
+		for j, partitions := int32(0), resp.int32(); j < partitions && resp.err == nil; j++ {
+			index, code := resp.int32(), resp.int16()
+			resp.int64()
+			resp.int64()
+			if code != 0 {
+				// The leader could have moved, ie. NOT_LEADER_OR_FOLLOWER
+				k.partitions = nil
+				return fmt.Errorf("kafka: partition %d failed with error code %d", index, code)
+			}
+		}
+	}
+	return resp.err
+}
+
+// refreshMetadata finds the leaders of topic partitions
+func (k *kafkaSink) refreshMetadata() error {
+	body := binary.BigEndian.AppendUint32(nil, 1)
+	body = appendKafkaString(body, k.topic)
+	body = append(body, 0) // don't create the topic
+
+	resp, err := k.request(k.bootstrap, kafkaMetadataKey, kafkaMetadataVersion, body)
+	if err != nil {
+		return err
+	}
+
+	resp.int32() // throttle time
+	brokers := make(map[int32]string)
+	for i, count := int32(0), resp.int32(); i < count && resp.err == nil; i++ {
+		node, host, port := resp.int32(), resp.string(), resp.int32()
+		resp.string() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.string() // cluster id
+	resp.int32()  // controller id
+
+	k.leaders = make(map[int32]string)
+	k.partitions = nil
+	for i, topics := int32(0), resp.int32(); i < topics && resp.err == nil; i++ {
+		code, _ := resp.int16(), resp.string()
+		resp.next(1)
+		if code != 0 && resp.err == nil {
+			return fmt.Errorf("kafka: topic %s failed with error code %d", k.topic, code)
+		}
+		for j, partitions := int32(0), resp.int32(); j < partitions && resp.err == nil; j++ {
+			code, index, leader := resp.int16(), resp.int32(), resp.int32()
+			resp.int32Array()
+			resp.int32Array()
+			if addr, ok := brokers[leader]; ok && code == 0 {
+				k.leaders[index] = addr
+				k.partitions = append(k.partitions, index)
+			}
+		}
+	}
+	if resp.err == nil && len(k.partitions) == 0 {
+		return errors.New("kafka: no partition of topic " + k.topic + " has a leader")
+	}
+	return resp.err
+}
+
+// request sends the request to broker and reads its response, the connections are kept open
+func (k *kafkaSink) request(addr string, key, version int16, body []byte) (*kafkaReader, error) {
+	conn := k.conns[addr]
+	if conn == nil {
+		var err error
+		conn, err = net.DialTimeout("tcp", addr, kafkaTimeout)
+		if err != nil {
+			return nil, err
+		}
+		k.conns[addr] = conn
+	}
+
+	k.correlation++
+	header := binary.BigEndian.AppendUint16(nil, uint16(key))
+	header = binary.BigEndian.AppendUint16(header, uint16(version))
+	header = binary.BigEndian.AppendUint32(header, uint32(k.correlation))
+	header = appendKafkaString(header, "auto-proxy")
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(header)+len(body)))
+	message = append(append(message, header...), body...)
+
+	conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	response, err := func() ([]byte, error) {
+		if _, err := conn.Write(message); err != nil {
+			return nil, err
+		}
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint32(size))
+		_, err := io.ReadFull(conn, response)
+		return response, err
+	}()
+	if err != nil {
+		conn.Close()
+		delete(k.conns, addr)
+		return nil, err
+	}
+
+	resp := &kafkaReader{data: response}
+	if resp.int32() != k.correlation {
+		conn.Close()
+		delete(k.conns, addr)
+		return nil, errors.New("kafka: unexpected correlation id of response")
+	}
+	return resp, nil
+}
+
+func (k *kafkaSink) close() {
+	for addr, conn := range k.conns {
+		conn.Close()
+		delete(k.conns, addr)
+	}
+}
+
+// kafkaRecordBatch encodes the entries as uncompressed record batch (magic 2) keyed by host
+func kafkaRecordBatch(entries []*accessLogEntry) []byte {
+	first := entries[0].Time.UnixMilli()
+	last := first
+	var records []byte
+	for idx, entry := range entries {
+		timestamp := entry.Time.UnixMilli()
+		last = max(last, timestamp)
+
+		record := []byte{0} // attributes
+		record = binary.AppendVarint(record, timestamp-first)
+		record = binary.AppendVarint(record, int64(idx))
+		host := stripPort(entry.Host)
+		record = binary.AppendVarint(record, int64(len(host)))
+		record = append(record, host...)
+		message := entry.message()
+		record = binary.AppendVarint(record, int64(len(message)))
+		record = append(record, message...)
+		record = binary.AppendVarint(record, 0) // headers
+
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	// The checksum covers the batch from attributes to the end
+	var tail []byte
+	tail = binary.BigEndian.AppendUint16(tail, 0)
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(entries)-1))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(first))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(last))
+	tail = binary.BigEndian.AppendUint64(tail, 0xffffffffffffffff) // no producer id
+	tail = binary.BigEndian.AppendUint16(tail, 0xffff)             // no producer epoch
+	tail = binary.BigEndian.AppendUint32(tail, 0xffffffff)         // no base sequence
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(entries)))
+	tail = append(tail, records...)
+
+	batch := binary.BigEndian.AppendUint64(nil, 0)                        // base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(tail))) // the length of rest
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff)              // partition leader epoch
+	batch = append(batch, 2)                                              // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, kafkaCRC))
+	return append(batch, tail...)
+}
+
+func appendKafkaString(data []byte, s string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(s)))
+	return append(data, s...)
+}
+
+// kafkaReader decodes the response, the first error is kept and the later reads return zeros
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.data) < n {
+		r.err = errKafkaShort
+		return make([]byte, max(n, 0))
+	}
+	data := r.data[:n]
+	r.data = r.data[n:]
+	return data
+}
+
+func (r *kafkaReader) int16() int16 {
+	return int16(binary.BigEndian.Uint16(r.next(2)))
+}
+
+func (r *kafkaReader) int32() int32 {
+	return int32(binary.BigEndian.Uint32(r.next(4)))
+}
+
+func (r *kafkaReader) int64() int64 {
+	return int64(binary.BigEndian.Uint64(r.next(8)))
+}
+
+// string reads the string, the null one is empty
+func (r *kafkaReader) string() string {
+	size := r.int16()
+	if size < 0 {
+		return ""
+	}
+	return string(r.next(int(size)))
+}
+
+func (r *kafkaReader) int32Array() {
+	count := r.int32()
+	if count > 0 {
+		r.next(4 * int(count))
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+// syslogSink sends the lines to local syslog (syslog:) or to remote one, ie. syslog+tcp://10.0.0.1:514
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(u *url.URL) (accessLogSink, error) {
+	network := strings.TrimPrefix(strings.TrimPrefix(u.Scheme, "syslog"), "+")
+	if network == "" && u.Host != "" {
+		network = "udp"
+	}
+	writer, err := syslog.Dial(network, u.Host, syslog.LOG_INFO|syslog.LOG_LOCAL0, "auto-proxy")
+	if err != nil {
+		return nil, err
+	}
+	return newBatchSink(u.String(), &syslogSink{writer}), nil
+}
+
+func (s *syslogSink) send(entries []*accessLogEntry) error {
+	for _, entry := range entries {
+		if err := s.writer.Info(entry.message()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) close() {
+	s.writer.Close()
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+func newSyslogSink(u *url.URL) (accessLogSink, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
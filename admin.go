@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+type adminToken struct {
+	token string
+	scope string
+}
+
+type adminAPI struct {
+	app    *theApp
+	mux    *http.ServeMux
+	tokens []adminToken
+}
+
+// parseAdminToken reads token in form of token[:scope], the scope defaults to read
+func parseAdminToken(value string) (adminToken, error) {
+	tokenScope := strings.SplitN(strings.TrimSpace(value), ":", 2)
+	token := adminToken{token: tokenScope[0], scope: ScopeRead}
+	if len(tokenScope) == 2 {
+		token.scope = tokenScope[1]
+	}
+	if token.token == "" {
+		return token, errors.New("admin: empty token")
+	} else if token.scope != ScopeRead && token.scope != ScopeWrite {
+		return token, errors.New("admin: unknown token scope " + token.scope)
+	}
+	return token, nil
+}
+
+func (a *adminAPI) loadTokens(tokens, tokensFile string) error {
+	for _, value := range strings.Split(tokens, ",") {
+		if value == "" {
+			continue
+		}
+		token, err := parseAdminToken(value)
+		if err != nil {
+			return err
+		}
+		a.tokens = append(a.tokens, token)
+	}
+
+	// The file can be a Docker secret with token[:scope] per line
+	for _, fileName := range strings.Split(tokensFile, ",") {
+		if fileName == "" {
+			continue
+		}
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			token, err := parseAdminToken(line)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			a.tokens = append(a.tokens, token)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorize returns 401 for missing or unknown token and 403 for token without the scope, 0 if authorized
+func (a *adminAPI) authorize(r *http.Request, scope string) int {
+	if len(a.tokens) == 0 {
+		return 0
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized
+	}
+	bearer := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	for _, token := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.token), bearer) != 1 {
+			continue
+		} else if token.scope != ScopeWrite && token.scope != scope {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	return http.StatusUnauthorized
+}
+
+// handle registers endpoint, all non-GET endpoints require write scope
+func (a *adminAPI) handle(pattern string, handler http.HandlerFunc) {
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		scope := ScopeWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			scope = ScopeRead
+		}
+		switch a.authorize(r, scope) {
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="auto-proxy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case http.StatusForbidden:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="auto-proxy", error="insufficient_scope"`)
+			http.Error(w, "token requires "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// profileApp returns the app of ?profile=, the default one if empty. The unknown profile is answered with 404.
+func (a *adminAPI) profileApp(w http.ResponseWriter, r *http.Request) *theApp {
+	profile := r.URL.Query().Get("profile")
+	if profile == "" {
+		return a.app
+	}
+	app := profileApps[profile]
+	if app == nil {
+		http.Error(w, "unknown profile", http.StatusNotFound)
+	}
+	return app
+}
+
+// adminTrigger describes who changed the state with admin API for the audit log
+func adminTrigger(r *http.Request) string {
+	trigger := r.Method + " " + r.URL.Path + " from " + stripPort(r.RemoteAddr)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		trigger += " (" + r.TLS.PeerCertificates[0].Subject.CommonName + ")"
+	}
+	return trigger
+}
+
+func (a *adminAPI) getRoutes(w http.ResponseWriter, r *http.Request) {
+	app := a.profileApp(w, r)
+	if app == nil {
+		return
+	}
+
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	writeJSON(w, app.routes)
+}
+
+func (a *adminAPI) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"stale":        a.app.isStale(),
+		"staleSources": a.app.staleSourceNames(),
+	})
+}
+
+func newAdminAPI(app *theApp) (*adminAPI, error) {
+	a := &adminAPI{
+		app: app,
+		mux: http.NewServeMux(),
+	}
+
+	err := a.loadTokens(*adminTokens, *adminTokensFile)
+	if err != nil {
+		return nil, err
+	}
+	if *adminName != "" && *adminCert != "" {
+		return nil, errors.New("admin: -admin-name and -admin-crt can't be used together")
+	} else if *adminClientCA != "" && *adminCert == "" && *adminName == "" {
+		// The client certificates are verified only by TLS listener
+		return nil, errors.New("admin: -admin-client-ca requires -admin-crt or -admin-name")
+	} else if *adminName != "" && len(a.tokens) == 0 && *adminClientCA == "" {
+		// The routable host name is reachable by anyone
+		return nil, errors.New("admin: -admin-name requires -admin-tokens, -admin-tokens-file or -admin-client-ca")
+	} else if len(a.tokens) == 0 {
+		logrus.Warningln("Admin API is not protected by any token, use -admin-tokens or -admin-tokens-file")
+	}
+
+	a.handle("GET /admin/status", a.getStatus)
+	a.handle("GET /admin/routes", a.getRoutes)
+	a.handle("GET /admin/tail", a.getTail)
+	a.handle("GET /admin/containers", a.getContainers)
+	a.handle("GET /admin/sources", a.getSources)
+	a.handle("GET /admin/upstreams/{host}", a.getUpstreams)
+	a.handle("GET /admin/overrides", overrides.get)
+	a.handle("PUT /admin/routes/{host}/override", overrides.put(a))
+	a.handle("DELETE /admin/routes/{host}/override", overrides.delete(a))
+	a.handle("GET /admin/faults", faults.get)
+	a.handle("PUT /admin/routes/{host}/fault", faults.put(a))
+	a.handle("DELETE /admin/routes/{host}/fault", faults.delete(a))
+	a.handle("GET /admin/certificates", a.getCertificates)
+	a.handle("GET /admin/flapping", a.getFlapping)
+	a.handle("GET /admin/conflicts", a.getConflicts)
+	a.handle("GET /admin/listeners", a.getListeners)
+	a.handle("POST /admin/reload", a.postReload)
+	a.handle("GET /admin/schedules", a.getSchedules)
+	a.handle("POST /admin/schedules", a.addSchedule)
+	a.handle("DELETE /admin/schedules/{id}", a.deleteSchedule)
+	a.handle("POST /admin/cache/purge", a.purgeCache)
+	a.handle("GET /admin/banners", a.getBanners)
+	a.handle("PUT /admin/banners/{name}", a.putBanner)
+	a.handle("POST /admin/banners/{name}/on", a.toggleBanner(true))
+	a.handle("POST /admin/banners/{name}/off", a.toggleBanner(false))
+	a.handle("DELETE /admin/banners/{name}", a.deleteBanner)
+	a.handle("GET /admin/captures", a.getCaptures)
+	a.handle("POST /admin/captures", a.addCapture)
+	a.handle("GET /admin/captures/{id}", a.getCapture)
+	a.handle("DELETE /admin/captures/{id}", a.deleteCapture)
+	a.handle("GET /admin/snapshot", a.getSnapshot)
+	a.handle("POST /admin/restore", a.postRestore)
+	a.handle("GET /admin/prometheus/targets", a.getScrapeTargets)
+	a.handle("GET /metrics", metrics.ServeHTTP)
+
+	if *enablePprof {
+		a.registerPprof()
+	}
+	return a, nil
+}
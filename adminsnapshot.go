@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const stateSnapshotVersion = 1
+
+// stateSnapshot is the dynamic state of proxy, which is not part of flags and -config: the routes of all sources
+// of each profile, the schedules added with admin API, the upstream overrides, faults and banners.
+// The missing lists of older snapshots keep the current state.
+type stateSnapshot struct {
+	Version   int                          `json:"version"`
+	Time      time.Time                    `json:"time"`
+	Routes    map[string]map[string]Routes `json:"routes"`
+	Schedules []*Schedule                  `json:"schedules"`
+	Overrides []*Override                  `json:"overrides"`
+	Faults    []*Fault                     `json:"faults"`
+	Banners   []*Banner                    `json:"banners"`
+}
+
+// Dynamic returns the schedules added with admin API
+func (s *scheduler) Dynamic() (list []*Schedule) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, schedule := range s.list {
+		if schedule.dynamic {
+			list = append(list, schedule)
+		}
+	}
+	return
+}
+
+// ReplaceDynamic replaces the schedules added with admin API, the schedules from config are kept.
+// It returns the replaced schedules.
+func (s *scheduler) ReplaceDynamic(list []*Schedule) (replaced []*Schedule, err error) {
+	ids := make(map[string]bool)
+	for _, schedule := range list {
+		if err := schedule.compile(); err != nil {
+			return nil, err
+		} else if ids[schedule.ID] {
+			return nil, errors.New("schedule: duplicate id " + schedule.ID)
+		}
+		ids[schedule.ID] = true
+		schedule.dynamic = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var kept []*Schedule
+	for _, schedule := range s.list {
+		if schedule.dynamic {
+			replaced = append(replaced, schedule)
+			continue
+		} else if ids[schedule.ID] {
+			return nil, errors.New("schedule: id " + schedule.ID + " is defined in config")
+		}
+		kept = append(kept, schedule)
+	}
+	s.list = append(kept, list...)
+	return replaced, nil
+}
+
+func (a *adminAPI) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot := stateSnapshot{
+		Version:   stateSnapshotVersion,
+		Time:      time.Now().UTC(),
+		Routes:    make(map[string]map[string]Routes),
+		Schedules: schedules.Dynamic(),
+		Overrides: overrides.List(),
+		Faults:    faults.List(),
+		Banners:   banners.List(),
+	}
+	if snapshot.Schedules == nil {
+		snapshot.Schedules = []*Schedule{}
+	}
+	for name, app := range profileApps {
+		app.lock.RLock()
+		sources := make(map[string]Routes, len(app.sources))
+		for source, routes := range app.sources {
+			sources[source] = routes
+		}
+		app.lock.RUnlock()
+		snapshot.Routes[name] = sources
+	}
+	writeJSON(w, snapshot)
+}
+
+// postRestore applies the snapshot, the restored routes are stale till their sources send fresh ones
+func (a *adminAPI) postRestore(w http.ResponseWriter, r *http.Request) {
+	var snapshot stateSnapshot
+	err := json.NewDecoder(r.Body).Decode(&snapshot)
+	if err == nil && snapshot.Version != stateSnapshotVersion {
+		err = errors.New("restore: unsupported snapshot version " + strconv.Itoa(snapshot.Version))
+	}
+	if err == nil {
+		for name := range snapshot.Routes {
+			if profileApps[name] == nil {
+				err = errors.New("restore: unknown profile " + name)
+				break
+			}
+		}
+	}
+	var restoredOverrides []*Override
+	var restoredFaults []*Fault
+	if err == nil && snapshot.Overrides != nil {
+		restoredOverrides, err = overrides.compileRestored(snapshot.Overrides)
+	}
+	if err == nil && snapshot.Faults != nil {
+		restoredFaults, err = faults.compileRestored(snapshot.Faults)
+	}
+	for _, banner := range snapshot.Banners {
+		if err == nil {
+			err = banner.validate()
+		}
+	}
+	var replaced []*Schedule
+	if err == nil {
+		replaced, err = schedules.ReplaceDynamic(snapshot.Schedules)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restored := 0
+	trigger := "admin restore of snapshot from " + snapshot.Time.Format(time.RFC3339)
+	for _, schedule := range replaced {
+		auditSchedule(adminTrigger(r)+", "+trigger, "removed", schedule)
+	}
+	for _, schedule := range snapshot.Schedules {
+		auditSchedule(adminTrigger(r)+", "+trigger, "added", schedule)
+	}
+	if snapshot.Overrides != nil {
+		overrides.restore(adminTrigger(r)+", "+trigger, restoredOverrides)
+	}
+	if snapshot.Faults != nil {
+		faults.restore(adminTrigger(r)+", "+trigger, restoredFaults)
+	}
+	for _, banner := range snapshot.Banners {
+		banners.Set(banner)
+	}
+	for name, sources := range snapshot.Routes {
+		app := profileApps[name]
+		for source, routes := range sources {
+			app.updateSource(source, routes, trigger)
+			app.markStale(source)
+			restored += len(routes)
+		}
+	}
+	writeJSON(w, map[string]int{
+		"routes":    restored,
+		"schedules": len(snapshot.Schedules),
+		"overrides": len(restoredOverrides),
+		"faults":    len(restoredFaults),
+		"banners":   len(snapshot.Banners),
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const affinityKeyPrefix = "auto-proxy:affinity:"
+
+type affinityEntry struct {
+	upstream string
+	expires  time.Time
+}
+
+// affinityMap remembers which upstream serves the session, it is shared by replicas when -redis is used
+type affinityMap struct {
+	list  map[string]affinityEntry
+	lock  sync.Mutex
+	clean time.Time
+}
+
+var sessionAffinity affinityMap
+
+func (m *affinityMap) get(key string) (string, bool) {
+	if redis != nil {
+		value, ok, err := redis.String("GET", affinityKeyPrefix+key)
+		if err != nil {
+			logrus.WithError(err).Warningln("Failed to read session affinity")
+		}
+		return value, ok
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry, ok := m.list[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.upstream, true
+}
+
+func (m *affinityMap) set(key, upstream string, ttl time.Duration) {
+	if redis != nil {
+		_, err := redis.Do("SET", affinityKeyPrefix+key, upstream, "EX", strconv.Itoa(int(ttl.Seconds())))
+		if err != nil {
+			logrus.WithError(err).Warningln("Failed to store session affinity")
+		}
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	if m.list == nil {
+		m.list = make(map[string]affinityEntry)
+	}
+	m.list[key] = affinityEntry{upstream: upstream, expires: now.Add(ttl)}
+
+	// Remove expired sessions from time to time
+	if now.Sub(m.clean) > time.Minute {
+		for key, entry := range m.list {
+			if now.After(entry.expires) {
+				delete(m.list, key)
+			}
+		}
+		m.clean = now
+	}
+}
+
+func newSessionID() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// pickStickyUpstream routes all requests of the session to the same upstream
+func (r *Route) pickStickyUpstream(w http.ResponseWriter, req *http.Request) Upstream {
+	if r.StickyCookie == "" {
+		return r.pickUpstream()
+	}
+
+	session := ""
+	if cookie, err := req.Cookie(r.StickyCookie); err == nil {
+		session = cookie.Value
+	}
+
+	if session != "" {
+		if key, ok := sessionAffinity.get(r.VirtualHost + ":" + session); ok {
+			weights := upstreamsState.Weights(r)
+			for idx, upstream := range r.Servers {
+				if upstream.String() == key && weights[idx] > 0 {
+					return upstream
+				}
+			}
+		}
+	} else {
+		session = newSessionID()
+		http.SetCookie(w, &http.Cookie{
+			Name:     r.StickyCookie,
+			Value:    session,
+			Path:     "/",
+			MaxAge:   int(r.StickyTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   req.TLS != nil,
+		})
+	}
+
+	upstream := r.pickUpstream()
+	sessionAffinity.set(r.VirtualHost+":"+session, upstream.String(), r.StickyTTL)
+	return upstream
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+)
+
+const alertRepeatInterval = 24 * time.Hour
+
+type alert struct {
+	Event    string     `json:"event"`
+	Name     string     `json:"name"`
+	Error    string     `json:"error,omitempty"`
+	Failures int        `json:"failures"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// sendAlert logs at error level and notifies -alert-webhook
+func sendAlert(event string, certificate *Certificate, err error) {
+	a := alert{
+		Event:    event,
+		Name:     certificate.Name,
+		Failures: certificate.Failures,
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	if certificate.X509 != nil {
+		a.Expires = &certificate.X509.NotAfter
+	}
+
+	certificate.log().WithField("event", event).WithField("failures", a.Failures).
+		WithField("expires", a.Expires).WithError(err).Errorln("Certificate alert")
+
+	if *alertWebhook == "" {
+		return
+	}
+	go func() {
+		if err := postWebhook(*alertWebhook, a); err != nil {
+			certificate.log().WithError(err).Warningln("Failed to send alert")
+		}
+	}()
+}
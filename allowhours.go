@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDays expands Mon-Fri ranges and comma separated days to the days of Schedule
+func parseDays(value string) (string, error) {
+	var days []string
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return "", errors.New("allow-hours: unknown day " + bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return "", errors.New("allow-hours: unknown day " + bounds[1])
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days = append(days, weekdayNames[day])
+			if day == to {
+				break
+			}
+		}
+	}
+	return strings.Join(days, ","), nil
+}
+
+// compileAllowHours parses windows like Mon-Fri 08:00-18:00 Europe/Berlin separated by semicolons,
+// the days default to every day and the timezone to UTC. The routes keep the compiled windows.
+func compileAllowHours(value string) ([]*Schedule, error) {
+	var windows []*Schedule
+	for _, spec := range strings.Split(value, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+
+		window := &Schedule{}
+		if !strings.Contains(fields[0], ":") {
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.Days = days
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New("allow-hours: expected [days] HH:MM-HH:MM [timezone], got " + spec)
+		}
+		hours := strings.SplitN(fields[0], "-", 2)
+		if len(hours) != 2 {
+			return nil, errors.New("allow-hours: expected HH:MM-HH:MM, got " + fields[0])
+		}
+		window.Start, window.End = hours[0], hours[1]
+		if len(fields) == 2 {
+			window.Timezone = fields[1]
+		}
+		if err := window.compileWeekly(); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("allow-hours: no windows")
+	}
+	return windows, nil
+}
+
+func parseAllowHoursStatus(value string) (int, error) {
+	switch value {
+	case "403":
+		return http.StatusForbidden, nil
+	case "503":
+		return http.StatusServiceUnavailable, nil
+	}
+	return 0, errors.New("expected 403 or 503")
+}
+
+// allowedNow checks whether any window of auto-proxy.allow-hours is active, the invalid windows allow nothing
+func allowedNow(route *Route, now time.Time) bool {
+	if route.AllowHours == "" {
+		return true
+	}
+	var windows []*Schedule
+	if route.state != nil {
+		windows = route.state.allowHours
+	} else {
+		windows, _ = compileAllowHours(route.AllowHours)
+	}
+	for _, window := range windows {
+		if active, _ := window.Active(now); active {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictHours rejects the requests outside of the allowed hours of route
+func restrictHours(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if allowedNow(route, time.Now()) {
+		return true
+	}
+	status := route.AllowHoursStatus
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	serveErrorStatus(w, r, ErrorOutsideHours, status, r.Host+" is not available at this time")
+	return false
+}
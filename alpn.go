@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// The protocols always served by the proxy itself
+var httpProtocols = map[string]bool{"h2": true, "http/1.1": true, "http/1.0": true}
+
+// parseALPN validates the comma separated protocols of auto-proxy.alpn
+func parseALPN(value string) (string, error) {
+	var protocols []string
+	for _, protocol := range strings.Split(value, ",") {
+		protocol = strings.TrimSpace(protocol)
+		if protocol == "" {
+			continue
+		} else if httpProtocols[protocol] {
+			return "", errors.New("the HTTP protocols are served by the proxy")
+		} else if len(protocol) > 255 {
+			return "", errors.New("too long protocol " + protocol)
+		}
+		protocols = append(protocols, protocol)
+	}
+	if len(protocols) == 0 {
+		return "", errors.New("expected comma separated protocols")
+	}
+	return strings.Join(protocols, ","), nil
+}
+
+func (u *Upstream) speaks(protocol string) bool {
+	for _, value := range strings.Split(u.ALPN, ",") {
+		if value == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// FindALPN returns the route with upstreams speaking the protocol offered by the client,
+// the clients offering any HTTP protocol are always served by the proxy
+func (a *theApp) FindALPN(serverName string, protocols []string) (*Route, string) {
+	for _, protocol := range protocols {
+		if httpProtocols[protocol] {
+			return nil, ""
+		}
+	}
+
+	route := a.routes.Find(serverName)
+	if route == nil || len(route.ALPNServers) == 0 {
+		return nil, ""
+	}
+	for _, protocol := range protocols {
+		var servers []Upstream
+		for _, upstream := range route.ALPNServers {
+			if upstream.speaks(protocol) {
+				servers = append(servers, upstream)
+			}
+		}
+		if len(servers) > 0 {
+			copied := *route
+			copied.Servers = servers
+			return &copied, protocol
+		}
+	}
+	return nil, ""
+}
+
+// alpnConnection terminates TLS negotiating the protocol and copies the decrypted stream to upstream
+func alpnConnection(conn net.Conn, route *Route, protocol string, handler TLSHandler) {
+	defer conn.Close()
+
+	upstream := route.pickUpstream()
+	log := logrus.WithField("host", route.VirtualHost).WithField("upstream", upstream.String()).
+		WithField("remote", conn.RemoteAddr().String()).WithField("alpn", protocol)
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: handler.ServeTLS,
+		NextProtos:     []string{protocol},
+	})
+	tlsConn.SetDeadline(time.Now().Add(clientHelloTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.WithError(err).Debugln("TLS handshake failed")
+		return
+	} else if tlsConn.ConnectionState().NegotiatedProtocol != protocol {
+		log.Debugln("Protocol was not negotiated")
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	if !streamLimits.Acquire(route) {
+		log.Debugln("Too many ALPN connections")
+		return
+	}
+	defer streamLimits.Release(route)
+
+	upstreamConn, err := dialStream(route, upstream)
+	if err != nil {
+		log.WithError(err).Warningln("Failed to connect to ALPN upstream")
+		return
+	}
+	defer upstreamConn.Close()
+
+	log.Debugln("Passing decrypted ALPN connection...")
+	if err := copyStream(route, tlsConn, upstreamConn); err != nil {
+		log.WithError(err).Debugln("ALPN connection aborted")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Trigger string    `json:"trigger"`
+	RouteChange
+
+	// Details is the admin API state which changed the route, ie. the override
+	Details interface{} `json:"details,omitempty"`
+}
+
+// audit is an append-only log of all route changes, one JSON entry per line
+type audit struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+var auditLog audit
+
+func (a *audit) Open(fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	a.file = file
+	return nil
+}
+
+func (a *audit) Record(source, trigger string, changes []RouteChange) {
+	now := time.Now()
+	entries := make([]auditEntry, 0, len(changes))
+	for _, change := range changes {
+		entries = append(entries, auditEntry{Time: now, Source: source, Trigger: trigger, RouteChange: change})
+	}
+	a.write(entries)
+}
+
+// RecordDetails records the change made with admin API together with the changed state
+func (a *audit) RecordDetails(source, trigger string, change RouteChange, details interface{}) {
+	a.write([]auditEntry{{Time: time.Now(), Source: source, Trigger: trigger, RouteChange: change, Details: details}})
+}
+
+func (a *audit) write(entries []auditEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+
+		_, err = a.file.Write(append(data, '\n'))
+		if err != nil {
+			logrus.WithError(err).Errorln("Failed to write audit log")
+			return
+		}
+	}
+	a.file.Sync()
+}
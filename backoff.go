@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff returns exponentially growing delays with jitter, so replicas don't retry in lockstep
+type backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt uint
+}
+
+func (b *backoff) Next() time.Duration {
+	delay := b.Min << b.attempt
+	if delay > b.Max || delay <= 0 {
+		delay = b.Max
+	} else {
+		b.attempt++
+	}
+
+	// Use "equal jitter": half of the delay is fixed, the other half is random
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+)
+
+// The balancing of requests across upstreams of route
+const (
+	BalanceRandom        = "random"
+	BalanceLeastRequests = "least-requests"
+)
+
+func parseBalance(value string) (string, error) {
+	if value != BalanceRandom && value != BalanceLeastRequests {
+		return "", errors.New("expected random or least-requests")
+	}
+	return value, nil
+}
+
+// pickUpstream selects a server by auto-proxy.balance, taking into account the weights
+func (r *Route) pickUpstream() Upstream {
+	weights := upstreamsState.Weights(r)
+	if r.Balance == BalanceLeastRequests {
+		return r.pickLeastRequests(weights)
+	}
+
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total <= 0 {
+		return r.Servers[rand.Intn(len(r.Servers))]
+	}
+
+	value := rand.Float64() * total
+	for idx, weight := range weights {
+		value -= weight
+		if value < 0 {
+			return r.Servers[idx]
+		}
+	}
+	return r.Servers[len(r.Servers)-1]
+}
+
+// pickLeastRequests selects the server with the fewest in-flight requests relative to its weight,
+// the ties are broken randomly, so the idle servers share the load
+func (r *Route) pickLeastRequests(weights []float64) Upstream {
+	var best []int
+	bestScore := 0.0
+	for idx, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		score := float64(upstreamConns.Active(r.Servers[idx].inFlightKey())+1) / weight
+		if len(best) == 0 || score < bestScore {
+			best, bestScore = []int{idx}, score
+		} else if score == bestScore {
+			best = append(best, idx)
+		}
+	}
+	if len(best) == 0 {
+		return r.Servers[rand.Intn(len(r.Servers))]
+	}
+	return r.Servers[best[rand.Intn(len(best))]]
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const throttleChunk = 16 * 1024
+
+var bandwidthUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"gbps", 1e9 / 8},
+	{"mbps", 1e6 / 8},
+	{"kbps", 1e3 / 8},
+	{"bps", 1.0 / 8},
+}
+
+// parseBandwidth converts 5mbps into bytes per second
+func parseBandwidth(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, err := strconv.ParseFloat(strings.TrimSuffix(value, unit.suffix), 64)
+			if err != nil {
+				return 0, err
+			} else if number < 0 {
+				return 0, errors.New("negative bandwidth")
+			}
+			return int64(number * unit.factor), nil
+		}
+	}
+	return 0, errors.New("missing bandwidth unit: bps, kbps, mbps or gbps")
+}
+
+// throttle is a simple token bucket allowing to transfer rate bytes per second
+type throttle struct {
+	rate   int64
+	tokens int64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (t *throttle) wait(n int) {
+	if t == nil || t.rate <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.tokens += int64(now.Sub(t.last).Seconds() * float64(t.rate))
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+
+	t.tokens -= int64(n)
+	if t.tokens < 0 {
+		time.Sleep(time.Duration(float64(-t.tokens) / float64(t.rate) * float64(time.Second)))
+	}
+}
+
+type routeThrottles struct {
+	list map[string]*throttle
+	lock sync.Mutex
+}
+
+var aggregateThrottles routeThrottles
+
+// get returns throttle shared by all requests of the virtual host
+func (r *routeThrottles) get(vhost string, rate int64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.list == nil {
+		r.list = make(map[string]*throttle)
+	}
+	t := r.list[vhost]
+	if t == nil || t.rate != rate {
+		t = newThrottle(rate)
+		r.list[vhost] = t
+	}
+	return t
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	throttles []*throttle
+}
+
+func (t *throttledResponseWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		for _, throttle := range t.throttles {
+			throttle.wait(len(chunk))
+		}
+
+		written, err := t.ResponseWriter.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		data = data[written:]
+	}
+	return
+}
+
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	throttles []*throttle
+}
+
+func (t *throttledReader) Read(data []byte) (n int, err error) {
+	if len(data) > throttleChunk {
+		data = data[:throttleChunk]
+	}
+	n, err = t.ReadCloser.Read(data)
+	for _, throttle := range t.throttles {
+		throttle.wait(n)
+	}
+	return
+}
+
+// throttleRequest limits the transfer rate of request and response bodies
+func throttleRequest(w http.ResponseWriter, r *http.Request, route *Route) http.ResponseWriter {
+	var throttles []*throttle
+	if route.Bandwidth > 0 {
+		throttles = append(throttles, newThrottle(route.Bandwidth))
+	}
+	if t := aggregateThrottles.get(route.VirtualHost, route.RouteBandwidth); t != nil {
+		throttles = append(throttles, t)
+	}
+	if len(throttles) == 0 {
+		return w
+	}
+
+	if r.Body != nil {
+		r.Body = &throttledReader{ReadCloser: r.Body, throttles: throttles}
+	}
+	return &throttledResponseWriter{ResponseWriter: w, throttles: throttles}
+}
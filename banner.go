@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The banner is injected only if the body tag is found in this prefix of the response
+const bannerScanLimit = 64 * 1024
+
+const defaultBannerTemplate = `<div id="auto-proxy-banner" style="position:relative;z-index:2147483647;padding:8px 16px;` +
+	`background:#ffcc00;color:#000;font:14px/1.4 sans-serif;text-align:center">%s</div>`
+
+var bannerResponses = newCounter("auto_proxy_banner_responses_total",
+	"Number of HTML responses with injected banner", "host", "banner")
+
+// Banner is the HTML injected after the body tag of HTML responses, the routes select it with
+// auto-proxy.banner=<name> or by the host patterns of banner
+type Banner struct {
+	Name    string   `json:"name"`
+	Message string   `json:"message,omitempty"`
+	HTML    string   `json:"html,omitempty"`
+	Hosts   []string `json:"hosts,omitempty"`
+	Enabled bool     `json:"enabled"`
+}
+
+type bannerList struct {
+	list map[string]*Banner
+	lock sync.RWMutex
+}
+
+var banners bannerList
+
+type bannerKey struct{}
+
+func parseBannerName(value string) (string, error) {
+	if value == "" || strings.ContainsAny(value, "/ ") {
+		return "", errors.New("invalid banner name " + value)
+	}
+	return value, nil
+}
+
+func (b *Banner) validate() error {
+	if _, err := parseBannerName(b.Name); err != nil {
+		return err
+	} else if b.Message == "" && b.HTML == "" {
+		return errors.New("banner: message or html is required")
+	}
+	for _, pattern := range b.Hosts {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.New("banner: invalid host pattern " + pattern)
+		}
+	}
+	return nil
+}
+
+// content returns the raw HTML or the escaped message in the default banner
+func (b *Banner) content() []byte {
+	if b.HTML != "" {
+		return []byte(b.HTML)
+	}
+	return []byte(fmt.Sprintf(defaultBannerTemplate, html.EscapeString(b.Message)))
+}
+
+func (b *Banner) matches(host string) bool {
+	host = stripPort(host)
+	for _, pattern := range b.Hosts {
+		if matched, _ := filepath.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *bannerList) Set(banner *Banner) error {
+	if err := banner.validate(); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.list == nil {
+		l.list = make(map[string]*Banner)
+	}
+	l.list[banner.Name] = banner
+	return nil
+}
+
+// Toggle enables or disables the banner without changing its content
+func (l *bannerList) Toggle(name string, enabled bool) *Banner {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	banner := l.list[name]
+	if banner == nil {
+		return nil
+	}
+	copied := *banner
+	copied.Enabled = enabled
+	l.list[name] = &copied
+	return &copied
+}
+
+func (l *bannerList) Remove(name string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.list[name]; !ok {
+		return false
+	}
+	delete(l.list, name)
+	return true
+}
+
+func (l *bannerList) List() []*Banner {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	list := []*Banner{}
+	for _, banner := range l.list {
+		list = append(list, banner)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Find returns the enabled banner of route or the first one matching the host
+func (l *bannerList) Find(route *Route, host string) *Banner {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if banner := l.list[route.Banner]; banner != nil && banner.Enabled {
+		return banner
+	}
+	var found *Banner
+	for _, banner := range l.list {
+		if banner.Enabled && banner.matches(host) && (found == nil || banner.Name < found.Name) {
+			found = banner
+		}
+	}
+	return found
+}
+
+// injectsBanner is true if the response body is rewritten, so the upstream gzip is decoded for it
+func injectsBanner(r *http.Request) bool {
+	injects, _ := r.Context().Value(bannerKey{}).(bool)
+	return injects
+}
+
+// bannerWriter buffers the beginning of HTML response till the body tag and injects the banner after it
+type bannerWriter struct {
+	http.ResponseWriter
+	route    *Route
+	banner   *Banner
+	inject   bool
+	buffer   []byte
+	injected bool
+	head     bool
+	written  bool
+}
+
+func (w *bannerWriter) WriteHeader(status int) {
+	if isInformational(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	} else if w.written {
+		return
+	}
+	w.written = true
+
+	header := w.Header()
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	encoding := header.Get("Content-Encoding")
+	w.inject = status == http.StatusOK && !w.head && strings.HasPrefix(contentType, "text/html") &&
+		(encoding == "" || strings.EqualFold(encoding, "identity"))
+	if w.inject {
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *bannerWriter) Write(data []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.inject || w.injected {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buffer = append(w.buffer, data...)
+	lower := bytes.ToLower(w.buffer)
+	if idx := bytes.Index(lower, []byte("<body")); idx >= 0 {
+		if end := bytes.IndexByte(lower[idx:], '>'); end >= 0 {
+			at := idx + end + 1
+			content := append(append(append([]byte{}, w.buffer[:at]...), w.banner.content()...), w.buffer[at:]...)
+			w.injected = true
+			w.buffer = nil
+			bannerResponses.Inc(w.route.VirtualHost, w.banner.Name)
+			if _, err := w.ResponseWriter.Write(content); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}
+	}
+	if len(w.buffer) >= bannerScanLimit {
+		return len(data), w.flushBuffer()
+	}
+	return len(data), nil
+}
+
+// flushBuffer passes the buffered response unchanged, no banner is injected once it was flushed
+func (w *bannerWriter) flushBuffer() error {
+	w.injected = true
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(buffer)
+	return err
+}
+
+func (w *bannerWriter) Flush() {
+	// Keep the beginning of response till the body tag is received
+	if !w.inject || w.injected {
+		if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// wrapBanner injects the enabled banner of route into its HTML responses
+func wrapBanner(route *Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		banner := banners.Find(route, r.Host)
+		if banner == nil || isUpgradeRequest(r) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		// The response has to be readable, the gzip of auto-proxy.upstream.gzip is decoded by proxy
+		r.Header.Del("Accept-Encoding")
+		r = r.WithContext(context.WithValue(r.Context(), bannerKey{}, true))
+
+		w := &bannerWriter{ResponseWriter: rw, route: route, banner: banner, head: r.Method == "HEAD"}
+		next.ServeHTTP(w, r)
+		w.flushBuffer()
+	})
+}
+
+func (a *adminAPI) getBanners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, banners.List())
+}
+
+// putBanner adds or replaces the banner, it is enabled unless the body says otherwise
+func (a *adminAPI) putBanner(w http.ResponseWriter, r *http.Request) {
+	banner := &Banner{Enabled: true}
+	err := json.NewDecoder(r.Body).Decode(banner)
+	banner.Name = r.PathValue("name")
+	if err == nil {
+		err = banners.Set(banner)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, banner)
+}
+
+func (a *adminAPI) toggleBanner(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		banner := banners.Toggle(r.PathValue("name"), enabled)
+		if banner == nil {
+			http.Error(w, fmt.Sprintf("banner %s not found", r.PathValue("name")), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, banner)
+	}
+}
+
+func (a *adminAPI) deleteBanner(w http.ResponseWriter, r *http.Request) {
+	if !banners.Remove(r.PathValue("name")) {
+		http.Error(w, fmt.Sprintf("banner %s not found", r.PathValue("name")), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
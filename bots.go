@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BotsBlock     = "block"
+	BotsChallenge = "challenge"
+)
+
+const botChallengeCookie = "auto_proxy_challenge"
+const botVerificationTTL = time.Hour
+
+// The DNS lookups of verification hold the request, the failed lookups are retried after botVerificationRetry
+const (
+	botVerificationTimeout = 2 * time.Second
+	botVerificationRetry   = 5 * time.Minute
+)
+
+var botRequests = newCounter("auto_proxy_bot_requests_total",
+	"Number of requests blocked or challenged as bots", "host", "action")
+
+// The AI scrapers and aggressive crawlers blocked by default
+var defaultDeniedBots = []string{
+	"GPTBot", "ChatGPT-User", "OAI-SearchBot", "CCBot", "ClaudeBot", "Claude-Web", "anthropic-ai",
+	"Bytespider", "Amazonbot", "PerplexityBot", "meta-externalagent", "Diffbot", "ImagesiftBot",
+	"Omgilibot", "cohere-ai", "Timpibot", "YouBot", "PetalBot", "SemrushBot", "AhrefsBot", "MJ12bot",
+}
+
+// The search engines allowed only if reverse DNS of client resolves to one of the domains
+var defaultVerifiedBots = map[string][]string{
+	"Googlebot":   {"googlebot.com", "google.com"},
+	"bingbot":     {"search.msn.com"},
+	"DuckDuckBot": {"duckduckgo.com"},
+	"Applebot":    {"applebot.apple.com"},
+	"YandexBot":   {"yandex.ru", "yandex.net", "yandex.com"},
+}
+
+type BotsConfig struct {
+	Deny     []string            `json:"deny"`
+	Verified map[string][]string `json:"verified"`
+
+	deny *regexp.Regexp
+}
+
+func (c *BotsConfig) compile() (err error) {
+	if c.Deny == nil {
+		c.Deny = defaultDeniedBots
+	}
+	if c.Verified == nil {
+		c.Verified = defaultVerifiedBots
+	}
+
+	var patterns []string
+	for _, name := range c.Deny {
+		// The empty alternative would match every User-Agent
+		if name = strings.TrimSpace(name); name != "" {
+			patterns = append(patterns, regexp.QuoteMeta(name))
+		}
+	}
+	if len(patterns) > 0 {
+		c.deny, err = regexp.Compile("(?i)(" + strings.Join(patterns, "|") + ")")
+	}
+	return
+}
+
+type botVerification struct {
+	verified bool
+	expires  time.Time
+}
+
+// botVerifier caches results of reverse DNS verification
+type botVerifier struct {
+	list map[string]botVerification
+	lock sync.Mutex
+}
+
+var verifiedBots botVerifier
+
+// verify checks that the address resolves to one of domains and back
+func (v *botVerifier) verify(ip string, domains []string) bool {
+	key := ip + " " + strings.Join(domains, ",")
+	v.lock.Lock()
+	result, ok := v.list[key]
+	v.lock.Unlock()
+	if ok && time.Now().Before(result.expires) {
+		return result.verified
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), botVerificationTimeout)
+	defer cancel()
+
+	verified := false
+	ttl := botVerificationTTL
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil {
+		ttl = botVerificationRetry
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if !matchesDomains(name, domains) {
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			ttl = botVerificationRetry
+		}
+		for _, addr := range addrs {
+			if addr == ip {
+				verified = true
+			}
+		}
+	}
+	if verified {
+		ttl = botVerificationTTL
+	}
+
+	// The failed verifications are cached as well, so the fake bots don't cause lookups on each request
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.list == nil || len(v.list) > 10000 {
+		v.list = make(map[string]botVerification)
+	}
+	v.list[key] = botVerification{verified: verified, expires: time.Now().Add(ttl)}
+	return verified
+}
+
+func matchesDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBot returns true if the client is a denied bot or pretends to be a verified one
+func isBot(r *http.Request, route *Route) bool {
+	userAgent := r.UserAgent()
+	if userAgent == "" {
+		return false
+	}
+	bots := &config.Bots
+	if bots.deny != nil && bots.deny.MatchString(userAgent) {
+		return true
+	}
+	for _, name := range route.BotsDeny {
+		if strings.Contains(strings.ToLower(userAgent), strings.ToLower(name)) {
+			return true
+		}
+	}
+
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	for name, domains := range bots.Verified {
+		if strings.Contains(userAgent, name) {
+			return !verifiedBots.verify(clientIP, domains)
+		}
+	}
+	return false
+}
+
+const botChallengeSecretKey = "bots/challenge-secret"
+
+var botChallengeSecret []byte
+var botChallengeSecretOnce sync.Once
+
+// loadBotChallengeSecret shares the secret with other replicas, otherwise the clients would be challenged by each one
+func loadBotChallengeSecret() {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	if sharedStore != nil {
+		stored, err := sharedStore.Get(botChallengeSecretKey)
+		if err == nil && len(stored) == len(secret) {
+			secret = stored
+		} else if err = sharedStore.Put(botChallengeSecretKey, secret); err != nil {
+			logrus.WithError(err).Warningln("Failed to store bot challenge secret")
+		}
+	}
+	botChallengeSecret = secret
+}
+
+func botChallengeToken(r *http.Request) string {
+	botChallengeSecretOnce.Do(loadBotChallengeSecret)
+
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	mac := hmac.New(sha256.New, botChallengeSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", r.Host, clientIP, r.UserAgent())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveBotChallenge requires the client to run JavaScript, which the most simple scrapers don't do
+func serveBotChallenge(w http.ResponseWriter, r *http.Request) bool {
+	token := botChallengeToken(r)
+	if cookie, err := r.Cookie(botChallengeCookie); err == nil && hmac.Equal([]byte(cookie.Value), []byte(token)) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><title>Checking your browser</title></head><body>
+<noscript>Please enable JavaScript to continue.</noscript>
+<script>document.cookie = "%s=" + "%s".split("").reverse().join("") + "; path=/; max-age=86400; SameSite=Lax"; location.reload();</script>
+</body></html>`, botChallengeCookie, reverseString(token))
+	return true
+}
+
+func reverseString(value string) string {
+	data := []byte(value)
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return string(data)
+}
+
+// filterBots blocks or challenges bots, it returns false if the request was handled
+func filterBots(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if route.Bots == "" || !isBot(r, route) {
+		return true
+	}
+
+	switch route.Bots {
+	case BotsChallenge:
+		if !serveBotChallenge(w, r) {
+			return true
+		}
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}
+
+	botRequests.Inc(route.VirtualHost, route.Bots)
+	logrus.WithField("host", r.Host).WithField("remote", r.RemoteAddr).WithField("agent", r.UserAgent()).
+		WithField("action", route.Bots).Debugln("Request from bot")
+	return false
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest response body stored in the cache
+const cacheEntryLimit = 1024 * 1024
+
+var cacheRequests = newCounter("auto_proxy_cache_requests_total",
+	"Number of cacheable requests", "host", "result")
+
+type cacheEntry struct {
+	key     string
+	url     string
+	status  int
+	header  http.Header
+	body    []byte
+	tags    []string
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is in-memory LRU cache of responses, the entries are indexed by URL and tags for purging
+type responseCache struct {
+	entries map[string]*list.Element
+	urls    map[string]map[string]bool
+	tags    map[string]map[string]bool
+	lru     list.List
+	size    int64
+	lock    sync.Mutex
+}
+
+var cache responseCache
+
+func cacheURL(r *http.Request) string {
+	return stripPort(r.Host) + r.URL.RequestURI()
+}
+
+// The entries vary only by scheme and encoding, the responses with other Vary are not cached.
+// The purge by URL removes the entries of both schemes.
+func cacheKey(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "\n" + cacheURL(r) + "\n" + r.Header.Get("Accept-Encoding")
+}
+
+func isCacheableRequest(r *http.Request, route *Route) bool {
+	if !route.Cache || r.Method != "GET" && r.Method != "HEAD" || isUpgradeRequest(r) {
+		return false
+	} else if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return false
+	}
+	return true
+}
+
+// cacheTTL returns how long the response can be stored, zero if it can't be cached. The responses to requests
+// with credentials are shared only when they are explicitly public.
+func cacheTTL(r *http.Request, status int, header http.Header, route *Route) time.Duration {
+	if status != http.StatusOK && status != http.StatusMovedPermanently && status != http.StatusNotFound {
+		return 0
+	} else if header.Get("Set-Cookie") != "" {
+		return 0
+	} else if vary := header.Get("Vary"); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return 0
+	}
+
+	ttl := route.CacheTTL
+	public := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "private" || directive == "no-store" || directive == "no-cache":
+			return 0
+		case directive == "public":
+			public = true
+		case strings.HasPrefix(directive, "s-maxage="):
+			public = true
+			fallthrough
+		case strings.HasPrefix(directive, "max-age=") && ttl == route.CacheTTL:
+			seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			if err == nil {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if !public && (r.Header.Get("Cookie") != "" || r.Header.Get("Authorization") != "") {
+		return 0
+	}
+	return ttl
+}
+
+func (c *responseCache) Get(r *http.Request) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element := c.entries[cacheKey(r)]
+	if element == nil {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+func (c *responseCache) Put(entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.urls = make(map[string]map[string]bool)
+		c.tags = make(map[string]map[string]bool)
+	}
+	if element := c.entries[entry.key]; element != nil {
+		c.remove(element)
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	index(c.urls, entry.url, entry.key)
+	for _, tag := range entry.tags {
+		index(c.tags, tag, entry.key)
+	}
+
+	for c.size > *cacheSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func index(list map[string]map[string]bool, name, key string) {
+	if list[name] == nil {
+		list[name] = make(map[string]bool)
+	}
+	list[name][key] = true
+}
+
+func unindex(list map[string]map[string]bool, name, key string) {
+	delete(list[name], key)
+	if len(list[name]) == 0 {
+		delete(list, name)
+	}
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+	unindex(c.urls, entry.url, entry.key)
+	for _, tag := range entry.tags {
+		unindex(c.tags, tag, entry.key)
+	}
+}
+
+func (c *responseCache) purge(keys map[string]bool) (count int) {
+	for key := range keys {
+		if element := c.entries[key]; element != nil {
+			c.remove(element)
+			count++
+		}
+	}
+	return
+}
+
+// PurgeURL removes all variants of the URL (host with path and query)
+func (c *responseCache) PurgeURL(url string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.purge(c.urls[url])
+}
+
+// PurgeTag removes all entries tagged with Surrogate-Key or Cache-Tag
+func (c *responseCache) PurgeTag(tag string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.purge(c.tags[tag])
+}
+
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	for name, values := range e.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	if r.Method != "HEAD" {
+		w.Write(e.body)
+	}
+}
+
+// cachingResponseWriter captures the response to store it in the cache
+type cachingResponseWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	route   *Route
+	entry   *cacheEntry
+}
+
+func (c *cachingResponseWriter) WriteHeader(status int) {
+	if isInformational(status) {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	header := c.Header()
+	tags := strings.Fields(header.Get("Surrogate-Key") + " " + strings.Replace(header.Get("Cache-Tag"), ",", " ", -1))
+	header.Del("Surrogate-Key")
+	header.Del("Cache-Tag")
+
+	if ttl := cacheTTL(c.request, status, header, c.route); ttl > 0 && c.entry == nil {
+		c.entry = &cacheEntry{
+			key:     cacheKey(c.request),
+			url:     cacheURL(c.request),
+			status:  status,
+			header:  header.Clone(),
+			tags:    tags,
+			stored:  time.Now(),
+			expires: time.Now().Add(ttl),
+		}
+	}
+	header.Set("X-Cache", "MISS")
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cachingResponseWriter) Write(data []byte) (int, error) {
+	if c.entry != nil {
+		if len(c.entry.body)+len(data) > cacheEntryLimit {
+			c.entry = nil
+		} else {
+			c.entry.body = append(c.entry.body, data...)
+		}
+	}
+	return c.ResponseWriter.Write(data)
+}
+
+func (c *cachingResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *cachingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Store saves the response if it was complete
+func (c *cachingResponseWriter) Store() {
+	if c.entry != nil && c.request.Method == "GET" {
+		cache.Put(c.entry)
+	}
+}
+
+// serveCached serves response from the cache, otherwise it returns the writer capturing the response
+func serveCached(w http.ResponseWriter, r *http.Request, route *Route) (*cachingResponseWriter, bool) {
+	if !isCacheableRequest(r, route) {
+		return nil, false
+	}
+	if entry := cache.Get(r); entry != nil {
+		cacheRequests.Inc(route.VirtualHost, "hit")
+		entry.serve(w, r)
+		return nil, true
+	}
+	cacheRequests.Inc(route.VirtualHost, "miss")
+	return &cachingResponseWriter{ResponseWriter: w, request: r, route: route}, false
+}
+
+// isPurgeAllowed accepts PURGE requests only from -cache-purge-allow networks
+func isPurgeAllowed(r *http.Request) bool {
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(clientIP)
+	for _, cidr := range strings.Split(*cachePurgeAllow, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// servePurge handles PURGE method for the URL of request
+func servePurge(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "PURGE" {
+		return false
+	}
+	if !isPurgeAllowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return true
+	}
+	writeJSON(w, map[string]int{"purged": cache.PurgeURL(cacheURL(r))})
+	return true
+}
+
+type purgeRequest struct {
+	URLs []string `json:"urls"`
+	Tags []string `json:"tags"`
+}
+
+func (a *adminAPI) purgeCache(w http.ResponseWriter, r *http.Request) {
+	var request purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	for _, url := range request.URLs {
+		purged += cache.PurgeURL(strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"))
+	}
+	for _, tag := range request.Tags {
+		purged += cache.PurgeTag(tag)
+	}
+	writeJSON(w, map[string]int{"purged": purged})
+}
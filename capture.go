@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultCaptureCount = 10
+	maxCaptureCount     = 1000
+	maxCaptureBody      = 64 * 1024
+	defaultCaptureTTL   = 10 * time.Minute
+	maxCaptureTTL       = 24 * time.Hour
+
+	// The finished captures can be downloaded till they are pruned
+	captureRetention = time.Hour
+)
+
+// The headers with credentials are redacted unless the capture keeps secrets
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Capture records the next requests of host for debugging, it is started with POST /admin/captures
+type Capture struct {
+	ID          string    `json:"id"`
+	Host        string    `json:"host"`
+	Count       int       `json:"count"`
+	BodyBytes   int       `json:"bodyBytes,omitempty"`
+	TTL         string    `json:"ttl,omitempty"`
+	File        bool      `json:"file,omitempty"`
+	KeepSecrets bool      `json:"keepSecrets,omitempty"`
+	Started     time.Time `json:"started"`
+	Expires     time.Time `json:"expires"`
+	Captured    int       `json:"captured"`
+	Active      bool      `json:"active"`
+
+	exchanges []*capturedExchange
+	started   int
+	file      *os.File
+}
+
+// capturedBody is the body truncated to bodyBytes, the binary bodies are base64 encoded
+type capturedBody struct {
+	Data      string `json:"data"`
+	Base64    bool   `json:"base64,omitempty"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	data []byte
+}
+
+// capturedExchange is the request as received and sent to upstream with the response sent to client
+type capturedExchange struct {
+	Time            time.Time     `json:"time"`
+	RequestID       string        `json:"requestId"`
+	Remote          string        `json:"remote"`
+	Method          string        `json:"method"`
+	URI             string        `json:"uri"`
+	Proto           string        `json:"proto"`
+	RequestHeaders  http.Header   `json:"requestHeaders"`
+	RequestBody     *capturedBody `json:"requestBody,omitempty"`
+	Upstream        string        `json:"upstream,omitempty"`
+	UpstreamHeaders http.Header   `json:"upstreamHeaders,omitempty"`
+	Status          int           `json:"status"`
+	ResponseHeaders http.Header   `json:"responseHeaders"`
+	ResponseBody    *capturedBody `json:"responseBody,omitempty"`
+	Duration        float64       `json:"durationSeconds"`
+	Message         string        `json:"message,omitempty"`
+
+	capture *Capture
+	lock    sync.Mutex
+}
+
+type captureList struct {
+	list   []*Capture
+	active int32
+	lock   sync.Mutex
+}
+
+var captures captureList
+
+func (b *capturedBody) record(data []byte, limit int) {
+	b.Size += int64(len(data))
+	if free := limit - len(b.data); free < len(data) {
+		b.Truncated = true
+		data = data[:free]
+	}
+	b.data = append(b.data, data...)
+}
+
+func (b *capturedBody) encode() {
+	if utf8.Valid(b.data) {
+		b.Data = string(b.data)
+	} else {
+		b.Data, b.Base64 = base64.StdEncoding.EncodeToString(b.data), true
+	}
+}
+
+// captureBody tees the request body read by upstream into the capture
+type captureBody struct {
+	io.ReadCloser
+	exchange *capturedExchange
+}
+
+func (b *captureBody) Read(data []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(data)
+	b.exchange.lock.Lock()
+	b.exchange.RequestBody.record(data[:n], b.exchange.capture.BodyBytes)
+	b.exchange.lock.Unlock()
+	return
+}
+
+func (c *Capture) redact(header http.Header) http.Header {
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if !c.KeepSecrets {
+		for _, name := range secretHeaders {
+			if _, ok := header[name]; ok {
+				header[name] = []string{"[redacted]"}
+			}
+		}
+	}
+	return header
+}
+
+// stop closes the file of capture, it has to be called with lock held
+func (l *captureList) stop(capture *Capture) {
+	if !capture.Active {
+		return
+	}
+	capture.Active = false
+	atomic.AddInt32(&l.active, -1)
+	if capture.file != nil {
+		capture.file.Close()
+		capture.file = nil
+	}
+	logrus.WithField("host", capture.Host).WithField("capture", capture.ID).
+		WithField("captured", capture.Captured).Infoln("Capture finished")
+}
+
+func (l *captureList) Add(capture *Capture) error {
+	capture.Host = strings.ToLower(stripPort(capture.Host))
+	if capture.Host == "" {
+		return errors.New("capture: host is required")
+	}
+	if capture.Count == 0 {
+		capture.Count = defaultCaptureCount
+	} else if capture.Count < 0 || capture.Count > maxCaptureCount {
+		return fmt.Errorf("capture: expected count up to %d", maxCaptureCount)
+	}
+	if capture.BodyBytes < 0 || capture.BodyBytes > maxCaptureBody {
+		return fmt.Errorf("capture: expected bodyBytes up to %d", maxCaptureBody)
+	}
+	ttl := defaultCaptureTTL
+	if capture.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(capture.TTL)
+		if err != nil || ttl <= 0 || ttl > maxCaptureTTL {
+			return errors.New("capture: expected ttl up to 24h")
+		}
+	}
+
+	capture.ID = newSessionID()[:12]
+	capture.Started = time.Now()
+	capture.Expires = capture.Started.Add(ttl)
+	capture.Captured, capture.Active = 0, true
+	capture.exchanges = nil
+	if capture.File {
+		if *captureDirectory == "" {
+			return errors.New("capture: -capture-dir is not configured")
+		}
+		os.MkdirAll(*captureDirectory, 0700)
+		file, err := os.OpenFile(filepath.Join(*captureDirectory, capture.ID+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		capture.file = file
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(capture.Started)
+	l.list = append(l.list, capture)
+	atomic.AddInt32(&l.active, 1)
+
+	logrus.WithField("host", capture.Host).WithField("capture", capture.ID).
+		WithField("count", capture.Count).WithField("expires", capture.Expires).Warningln("Capturing requests")
+	return nil
+}
+
+// prune stops the expired captures and forgets the finished ones after retention
+func (l *captureList) prune(now time.Time) {
+	list := l.list[:0]
+	for _, capture := range l.list {
+		if !now.Before(capture.Expires) {
+			l.stop(capture)
+		}
+		if capture.Active || now.Sub(capture.Expires) < captureRetention {
+			list = append(list, capture)
+		}
+	}
+	l.list = list
+}
+
+// Start returns the exchange if the request is captured, it is fast when nothing is captured
+func (l *captureList) Start(r *http.Request) *capturedExchange {
+	if atomic.LoadInt32(&l.active) == 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	host := strings.ToLower(stripPort(r.Host))
+	for _, capture := range l.list {
+		// The capture which started all its exchanges is stopped once they finish
+		if !capture.Active || capture.Host != host || capture.started >= capture.Count {
+			continue
+		} else if !now.Before(capture.Expires) {
+			l.stop(capture)
+			continue
+		}
+		capture.started++
+
+		exchange := &capturedExchange{
+			Time:           now,
+			RequestID:      r.Header.Get(requestIDHeader),
+			Remote:         r.RemoteAddr,
+			Method:         r.Method,
+			URI:            r.RequestURI,
+			Proto:          r.Proto,
+			RequestHeaders: capture.redact(r.Header),
+			capture:        capture,
+		}
+		if capture.BodyBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+			exchange.RequestBody = &capturedBody{}
+			r.Body = &captureBody{ReadCloser: r.Body, exchange: exchange}
+		}
+		if capture.BodyBytes > 0 {
+			exchange.ResponseBody = &capturedBody{}
+		}
+		return exchange
+	}
+	return nil
+}
+
+// Proxied records the request after it was rewritten for upstream
+func (e *capturedExchange) Proxied(r *http.Request, upstream *Upstream) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Upstream = upstream.String()
+	e.UpstreamHeaders = e.capture.redact(r.Header)
+}
+
+func (e *capturedExchange) Write(data []byte) {
+	if e.ResponseBody == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.ResponseBody.record(data, e.capture.BodyBytes)
+}
+
+// Finish stores the exchange in capture and appends it to the file of capture
+func (e *capturedExchange) Finish(w *loggingResponseWriter) {
+	e.lock.Lock()
+	e.Status = w.status
+	e.ResponseHeaders = e.capture.redact(w.Header())
+	e.Duration = time.Since(w.started).Seconds()
+	e.Message = w.Message
+	if e.RequestBody != nil {
+		e.RequestBody.encode()
+	}
+	if e.ResponseBody != nil {
+		e.ResponseBody.encode()
+	}
+	e.lock.Unlock()
+
+	captures.lock.Lock()
+	defer captures.lock.Unlock()
+
+	capture := e.capture
+	capture.exchanges = append(capture.exchanges, e)
+	capture.Captured++
+	if capture.file != nil {
+		data, _ := json.Marshal(e)
+		if _, err := capture.file.Write(append(data, '\n')); err != nil {
+			logrus.WithError(err).WithField("capture", capture.ID).Warningln("Failed to write captured request")
+		}
+	}
+	if capture.Captured >= capture.Count {
+		captures.stop(capture)
+	}
+}
+
+func (l *captureList) List() []Capture {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(time.Now())
+
+	list := make([]Capture, 0, len(l.list))
+	for _, capture := range l.list {
+		copied := *capture
+		copied.exchanges, copied.file = nil, nil
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+func (l *captureList) Get(id string) (*Capture, []*capturedExchange) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(time.Now())
+
+	for _, capture := range l.list {
+		if capture.ID == id {
+			copied := *capture
+			copied.exchanges, copied.file = nil, nil
+			return &copied, append([]*capturedExchange{}, capture.exchanges...)
+		}
+	}
+	return nil, nil
+}
+
+func (l *captureList) Remove(id string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for idx, capture := range l.list {
+		if capture.ID == id {
+			l.stop(capture)
+			l.list = append(l.list[:idx], l.list[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adminAPI) getCaptures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, captures.List())
+}
+
+func (a *adminAPI) addCapture(w http.ResponseWriter, r *http.Request) {
+	var capture Capture
+	err := json.NewDecoder(r.Body).Decode(&capture)
+	if err == nil {
+		err = captures.Add(&capture)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	copied, _ := captures.Get(capture.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, copied)
+}
+
+// getCapture returns the capture with the exchanges recorded so far
+func (a *adminAPI) getCapture(w http.ResponseWriter, r *http.Request) {
+	capture, exchanges := captures.Get(r.PathValue("id"))
+	if capture == nil {
+		http.Error(w, fmt.Sprintf("capture %s not found", r.PathValue("id")), http.StatusNotFound)
+		return
+	}
+	if exchanges == nil {
+		exchanges = []*capturedExchange{}
+	}
+	writeJSON(w, struct {
+		*Capture
+		Exchanges []*capturedExchange `json:"exchanges"`
+	}{capture, exchanges})
+}
+
+func (a *adminAPI) deleteCapture(w http.ResponseWriter, r *http.Request) {
+	if !captures.Remove(r.PathValue("id")) {
+		http.Error(w, fmt.Sprintf("capture %s not found", r.PathValue("id")), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -9,12 +12,18 @@ import (
 	"encoding/pem"
 	"errors"
 	"github.com/Sirupsen/logrus"
+	"github.com/ericchiang/letsencrypt"
 	"io/ioutil"
 	"math/big"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
+const certificateLockTTL = 10 * time.Minute
+
 const intermediateCerts = `
 -----BEGIN CERTIFICATE-----
 MIIEqDCCA5CgAwIBAgIRAJgT9HUT5XULQ+dDHpceRL0wDQYJKoZIhvcNAQELBQAw
@@ -72,26 +81,54 @@ g28RGPVnHzHk2XV1nZGy9T+NYQ91vWWJr1pzNEFZ0cnA2xGwTeJ+zZ3URCfw3Z1U
 -----END CERTIFICATE-----
 `
 
+const (
+	KeyRSA   = "rsa"
+	KeyECDSA = "ecdsa"
+)
+
 type Certificate struct {
 	TLS             *tls.Certificate
 	X509            *x509.Certificate
 	UpdateTime      time.Time
 	Requesting      bool
+	Failures        int
+	LastError       string
+	LastErrorTime   time.Time
+	AlertTime       time.Time
 	Name            string
+	KeyType         string
+	Policy          IssuancePolicy
 	CertificateFile string
 	KeyFile         string
+
+	// Batch are related certificates requested together as a single SAN certificate
+	Batch []*Certificate
 }
 
 var defaultCertificate *Certificate
 
-func NewCertificate(serverName string) *Certificate {
+// certificateID distinguishes certificates of the same name with different key types
+func certificateID(serverName, keyType string) string {
+	if keyType == KeyECDSA {
+		return serverName + ".ecdsa"
+	}
+	return serverName
+}
+
+func NewCertificate(directory, serverName, keyType string) *Certificate {
+	id := certificateID(serverName, keyType)
 	return &Certificate{
 		Name:            serverName,
-		CertificateFile: filepath.Join(*certsDirectory, serverName+".crt"),
-		KeyFile:         filepath.Join(*certsDirectory, serverName+".key"),
+		KeyType:         keyType,
+		CertificateFile: filepath.Join(directory, id+".crt"),
+		KeyFile:         filepath.Join(directory, id+".key"),
 	}
 }
 
+func (c *Certificate) ID() string {
+	return certificateID(c.Name, c.KeyType)
+}
+
 type CertificateChallenge interface {
 	AddCertificate(name string, certificate *tls.Certificate)
 	RemoveCertificate(name string)
@@ -100,7 +137,7 @@ type CertificateChallenge interface {
 }
 
 func (c *Certificate) log() *logrus.Entry {
-	return logrus.WithField("name", c.Name)
+	return logrus.WithField("name", c.ID())
 }
 
 func (c *Certificate) getX509() (*x509.Certificate, error) {
@@ -128,6 +165,20 @@ func (c *Certificate) IsExpiring(duration time.Duration) bool {
 	return false
 }
 
+// NeedsRenewal returns true once the jittered renewal window of the certificate starts
+func (c *Certificate) NeedsRenewal() bool {
+	return c.IsExpiring(*requestBefore + renewalJitter(c.ID()))
+}
+
+// Names returns all names of the requested certificate including the batched ones
+func (c *Certificate) Names() []string {
+	names := []string{c.Name}
+	for _, other := range c.Batch {
+		names = append(names, other.Name)
+	}
+	return names
+}
+
 func (c *Certificate) Matches(serverName string) bool {
 	if c.Name == serverName {
 		return true
@@ -137,7 +188,15 @@ func (c *Certificate) Matches(serverName string) bool {
 
 func (c *Certificate) Load() error {
 	c.log().WithField("certificate", c.CertificateFile).WithField("key", c.KeyFile).Debugln("Loading X509KeyPair...")
-	tls, err := tls.LoadX509KeyPair(c.CertificateFile, c.KeyFile)
+	certData, err := ioutil.ReadFile(c.CertificateFile)
+	if err != nil {
+		return err
+	}
+	keyData, err := readKeyFile(c.KeyFile)
+	if err != nil {
+		return err
+	}
+	tls, err := tls.X509KeyPair(certData, keyData)
 	if err != nil {
 		return err
 	}
@@ -177,26 +236,38 @@ func (c *Certificate) rebuildChains() error {
 	return nil
 }
 
-func (c *Certificate) generateKey() (*rsa.PrivateKey, error) {
-	if *useDefaultKey && defaultCertificate != nil && defaultCertificate.TLS != nil && defaultCertificate.TLS.PrivateKey != nil {
-		return defaultCertificate.TLS.PrivateKey.(*rsa.PrivateKey), nil
+func (c *Certificate) generateKey() (crypto.Signer, error) {
+	if c.KeyType == KeyECDSA {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+
+	// The configured default certificate doesn't have to use RSA key
+	if *useDefaultKey && defaultCertificate != nil && defaultCertificate.TLS != nil {
+		if key, ok := defaultCertificate.TLS.PrivateKey.(*rsa.PrivateKey); ok {
+			return key, nil
+		}
 	}
 
 	return rsa.GenerateKey(rand.Reader, 2048)
 }
 
-func (c *Certificate) createCertificateRequest() (*x509.CertificateRequest, *rsa.PrivateKey, error) {
+func (c *Certificate) createCertificateRequest() (*x509.CertificateRequest, crypto.Signer, error) {
 	certKey, err := c.generateKey()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	signatureAlgorithm, publicKeyAlgorithm := x509.SHA256WithRSA, x509.RSA
+	if c.KeyType == KeyECDSA {
+		signatureAlgorithm, publicKeyAlgorithm = x509.ECDSAWithSHA256, x509.ECDSA
+	}
+
 	template := &x509.CertificateRequest{
-		SignatureAlgorithm: x509.SHA256WithRSA,
-		PublicKeyAlgorithm: x509.RSA,
-		PublicKey:          &certKey.PublicKey,
+		SignatureAlgorithm: signatureAlgorithm,
+		PublicKeyAlgorithm: publicKeyAlgorithm,
+		PublicKey:          certKey.Public(),
 		Subject:            pkix.Name{CommonName: c.Name},
-		DNSNames:           []string{c.Name},
+		DNSNames:           c.Names(),
 	}
 	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, certKey)
 	if err != nil {
@@ -246,7 +317,22 @@ func (c *Certificate) CanUpdate(duration time.Duration) bool {
 	return !c.Requesting && time.Since(c.UpdateTime) > duration
 }
 
-func (c *Certificate) finish(cert *x509.Certificate, key *rsa.PrivateKey) error {
+func marshalPrivateKey(key crypto.Signer) (*pem.Block, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		data, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}, nil
+	default:
+		return nil, errors.New("unsupported private key")
+	}
+}
+
+func (c *Certificate) finish(cert *x509.Certificate, key crypto.Signer) error {
 	// Create TLS certificate
 	c.TLS = &tls.Certificate{
 		Certificate: [][]byte{
@@ -268,10 +354,15 @@ func (c *Certificate) finish(cert *x509.Certificate, key *rsa.PrivateKey) error
 	}
 
 	// Write private key to file
-	err = ioutil.WriteFile(c.KeyFile, pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}), 0600)
+	keyBlock, err := marshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyData, err := encryptPEM(keyBlock)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(c.KeyFile, keyData, 0600)
 	if err != nil {
 		logrus.WithField("name", c.Name).WithField("file", c.CertificateFile).WithError(err).Warningln("Failed to write private key:")
 		return err
@@ -280,27 +371,197 @@ func (c *Certificate) finish(cert *x509.Certificate, key *rsa.PrivateKey) error
 	return nil
 }
 
-func (c *Certificate) Request(certificateChallenge CertificateChallenge) error {
-	if certificateChallenge == nil {
-		return errors.New("missing certificate challenge handler")
+func (c *Certificate) storeKey(ext string) string {
+	return "certs/" + c.ID() + ext
+}
+
+// publish shares the certificate with other replicas
+func (c *Certificate) publish() error {
+	if sharedStore == nil {
+		return nil
 	}
 
-	c.UpdateTime = time.Now()
-	le := &LetsEncrypt{}
-	c.log().Infoln("Requesting a new certificate...")
+	certData, err := ioutil.ReadFile(c.CertificateFile)
+	if err != nil {
+		return err
+	}
+	keyData, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return err
+	}
 
-	uriPath, resource, challenge, err := le.requestHttp(c.Name)
+	// Key goes first, so the certificate is never visible without its key
+	err = sharedStore.Put(c.storeKey(".key"), keyData)
 	if err != nil {
 		return err
 	}
+	return sharedStore.Put(c.storeKey(".crt"), certData)
+}
 
-	certificateChallenge.AddHttpUri(uriPath, resource)
-	defer certificateChallenge.RemoveHttpUri(uriPath)
+// fetch loads the certificate from other replicas if it is newer than the one we have
+func (c *Certificate) fetch() (bool, error) {
+	if sharedStore == nil {
+		return false, nil
+	}
 
-	c.log().Debugln("Finishing certificate request challenge...")
-	err = le.finishChallenge(challenge)
+	certData, err := sharedStore.Get(c.storeKey(".crt"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	keyData, err := sharedStore.Get(c.storeKey(".key"))
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	plainKeyData, err := decryptPEM(keyData)
+	if err != nil {
+		return false, err
+	}
+	tls, err := tls.X509KeyPair(certData, plainKeyData)
+	if err != nil {
+		return false, err
+	}
+	x509Cert, err := x509.ParseCertificate(tls.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	if c.X509 != nil && !x509Cert.NotAfter.After(c.X509.NotAfter) {
+		return false, nil
+	}
+
+	c.log().Infoln("Received certificate from shared store.")
+	err = ioutil.WriteFile(c.CertificateFile, certData, 0600)
+	if err != nil {
+		return false, err
+	}
+	err = ioutil.WriteFile(c.KeyFile, keyData, 0600)
+	if err != nil {
+		return false, err
+	}
+	return true, c.Load()
+}
+
+// authorize proves the control of the name, the returned function cleans up the challenge
+func (c *Certificate) authorize(le *LetsEncrypt, name string, certificateChallenge CertificateChallenge) (func(), error) {
+	var challenge letsencrypt.Challenge
+	var cleanups []func()
+	cleanup := func() {
+		for idx := len(cleanups) - 1; idx >= 0; idx-- {
+			cleanups[idx]()
+		}
+	}
+	hook := challengeHook{Type: *acmeChallenge, Domain: name}
+
+	switch *acmeChallenge {
+	case letsencrypt.ChallengeDNS:
+		if !hasChallengeHooks() {
+			return nil, errors.New("dns-01 challenge requires -acme-hook or -acme-webhook")
+		}
+
+		subdomain, txt, dnsChallenge, err := le.requestDNS(name)
+		if err != nil {
+			return nil, err
+		}
+		challenge = dnsChallenge
+		hook.Name, hook.Value = subdomain+"."+name, txt
+
+	case letsencrypt.ChallengeHTTP:
+		uriPath, resource, httpChallenge, err := le.requestHttp(name)
+		if err != nil {
+			return nil, err
+		}
+		challenge = httpChallenge
+		hook.Name, hook.Value = uriPath, resource
+
+		certificateChallenge.AddHttpUri(uriPath, resource)
+		cleanups = append(cleanups, func() {
+			certificateChallenge.RemoveHttpUri(uriPath)
+		})
+
+	default:
+		return nil, errors.New("unsupported challenge " + *acmeChallenge)
+	}
+
+	// Delegate the challenge to external automation
+	if hasChallengeHooks() {
+		c.log().WithField("domain", name).Debugln("Presenting challenge to hooks...")
+		err := hook.Present()
+		if err != nil {
+			return cleanup, err
+		}
+		cleanups = append(cleanups, func() {
+			if err := hook.Cleanup(); err != nil {
+				c.log().WithField("domain", name).WithError(err).Warningln("Failed to cleanup challenge")
+			}
+		})
+	}
+
+	c.log().WithField("domain", name).Debugln("Finishing certificate request challenge...")
+	return cleanup, le.finishChallenge(challenge)
+}
+
+// authorizationError lists the names of certificate which failed to authorize
+type authorizationError struct {
+	names []string
+	err   error
+}
+
+func (e *authorizationError) Error() string {
+	return "failed to authorize " + strings.Join(e.names, ", ") + ": " + e.err.Error()
+}
+
+func (e *authorizationError) Unwrap() error {
+	return e.err
+}
+
+func (e *authorizationError) failed(name string) bool {
+	return slices.Contains(e.names, name)
+}
+
+func (c *Certificate) Request(certificateChallenge CertificateChallenge) error {
+	if certificateChallenge == nil {
+		return errors.New("missing certificate challenge handler")
+	}
+
+	c.UpdateTime = time.Now()
+
+	// Make sure that only one replica requests the certificate
+	if sharedStore != nil {
+		locked, err := sharedStore.Lock(c.storeKey(""), certificateLockTTL)
+		if err != nil {
+			return err
+		} else if !locked {
+			return errStoreLocked
+		}
+		defer sharedStore.Unlock(c.storeKey(""))
+
+		// Other replica could already finish the request
+		if fetched, _ := c.fetch(); fetched && !c.NeedsRenewal() {
+			return nil
+		}
+	}
+
+	le := NewLetsEncrypt(c.Policy)
+	c.log().WithField("names", c.Names()).Infoln("Requesting a new certificate...")
+
+	// Authorize all names, so the request can be retried without the failed ones
+	var failed *authorizationError
+	for _, name := range c.Names() {
+		cleanup, err := c.authorize(le, name, certificateChallenge)
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err != nil && failed == nil {
+			failed = &authorizationError{err: err}
+		}
+		if err != nil {
+			failed.names = append(failed.names, name)
+		}
+	}
+	if failed != nil {
+		return failed
 	}
 
 	c.log().Debugln("Creating ceritifcate request...")
@@ -316,5 +577,26 @@ func (c *Certificate) Request(certificateChallenge CertificateChallenge) error {
 	}
 
 	c.log().Infoln("Generated a new certificate.")
-	return c.finish(certificate.Certificate, key)
+	err = c.finish(certificate.Certificate, key)
+	if err != nil {
+		return err
+	}
+
+	err = c.publish()
+	if err != nil {
+		c.log().WithError(err).Warningln("Failed to publish certificate to shared store")
+	}
+
+	// The batched certificates share the same SAN certificate
+	for _, other := range c.Batch {
+		err = other.finish(certificate.Certificate, key)
+		if err != nil {
+			return err
+		}
+		err = other.publish()
+		if err != nil {
+			other.log().WithError(err).Warningln("Failed to publish certificate to shared store")
+		}
+	}
+	return nil
 }
@@ -2,33 +2,52 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"github.com/Sirupsen/logrus"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
+var certificateExpiry = newGauge("auto_proxy_certificate_expiry_days",
+	"Days till the certificate expires", "name")
+var certificateFailures = newCounter("auto_proxy_certificate_request_failures_total",
+	"Number of failed certificate requests", "name")
+
 type Certificates struct {
-	list map[string]*Certificate
-	lock sync.RWMutex
+	// Directory overrides -certs-dir, used by profiles
+	Directory string
+
+	list    map[string]*Certificate
+	pending map[string][]*Certificate
+	lock    sync.RWMutex
+}
+
+func (c *Certificates) directory() string {
+	if c.Directory != "" {
+		return c.Directory
+	}
+	return *certsDirectory
 }
 
 func (c *Certificates) add(certificate *Certificate) {
 	if c.list == nil {
 		c.list = make(map[string]*Certificate)
 	}
-	c.list[certificate.Name] = certificate
+	c.list[certificate.ID()] = certificate
 }
 
 func (c *Certificates) remove(name string) {
 	delete(c.list, name)
 }
 
-func (c *Certificates) load(name string, challenge CertificateChallenge) (tls *tls.Certificate, err error) {
-	logrus.WithField("name", name).Debugln("Loading certificate...")
+func (c *Certificates) load(name, keyType string, policy IssuancePolicy, challenge CertificateChallenge) (tls *tls.Certificate, err error) {
+	id := certificateID(name, keyType)
+	logrus.WithField("name", id).Debugln("Loading certificate...")
 
 	// Just in case if certificate was added by other entity
-	tls = c.find(name)
+	tls = c.find(id)
 	if tls != nil {
 		return tls, nil
 	}
@@ -37,11 +56,12 @@ func (c *Certificates) load(name string, challenge CertificateChallenge) (tls *t
 	if c.list == nil {
 		c.list = make(map[string]*Certificate)
 	}
-	certificate := c.list[name]
+	certificate := c.list[id]
 	if certificate == nil {
-		certificate = NewCertificate(name)
-		c.list[name] = certificate
+		certificate = NewCertificate(c.directory(), name, keyType)
+		c.list[id] = certificate
 	}
+	certificate.Policy = policy
 	tls = certificate.TLS
 
 	// Should we update (re-read?) the certificate?
@@ -59,24 +79,129 @@ func (c *Certificates) load(name string, challenge CertificateChallenge) (tls *t
 		return
 	}
 
+	// Maybe other replica already has that certificate
+	if fetched, err := certificate.fetch(); fetched {
+		tls = certificate.TLS
+		return tls, err
+	} else if err != nil {
+		certificate.log().WithError(err).Warningln("Failed to fetch certificate from shared store")
+	}
+
 	// Should we re-request the certificate?
-	if !certificate.CanUpdate(time.Minute) {
+	if policy.Mode == ACMEOff || !certificate.CanUpdate(time.Minute) || acmeRateLimits.Blocked(id) {
 		return
 	}
 
 	certificate.Requesting = true
-	go func() {
-		err := certificate.Request(challenge)
+	if group := sanGroup(name); group != "" {
+		c.queueGroup(group, certificate, challenge)
+		return
+	}
+	go c.request(certificate, challenge)
+	return
+}
+
+func (c *Certificates) request(certificate *Certificate, challenge CertificateChallenge) {
+	results := make(map[*Certificate]error)
+	pending := append([]*Certificate{certificate}, certificate.Batch...)
+	for len(pending) > 0 {
+		leader := pending[0]
+		leader.Batch = pending[1:]
+		err := leader.Request(challenge)
+		leader.Batch = nil
+
+		// Retry the SAN certificate without the names which failed, so they don't block the others
+		var failed *authorizationError
+		if errors.As(err, &failed) && len(failed.names) < len(pending) {
+			var rest []*Certificate
+			for _, other := range pending {
+				if failed.failed(other.Name) {
+					results[other] = err
+				} else {
+					rest = append(rest, other)
+				}
+			}
+			leader.log().WithError(err).Warningln("Retrying certificate request without the failed names")
+			pending = rest
+			continue
+		}
+		for _, other := range pending {
+			results[other] = err
+		}
+		break
+	}
+
+	var succeeded []string
+	for certificate, err := range results {
 		certificate.Requesting = false
-		if err != nil {
+		if err == errStoreLocked {
+			certificate.log().Debugln("Certificate is requested by other replica")
+			continue
+		} else if err != nil {
 			certificate.log().WithError(err).Warningln("Failed to request a new certificate")
+			acmeRateLimits.Failed([]string{certificate.ID()}, err)
+			certificate.Failures++
+			certificate.LastError = err.Error()
+			certificate.LastErrorTime = time.Now()
+			certificateFailures.Inc(certificate.ID())
+			if certificate.Failures >= *alertFailures {
+				sendAlert("certificate-renewal-failed", certificate, err)
+			}
+		} else {
+			certificate.Failures = 0
+			certificate.LastError = ""
+			succeeded = append(succeeded, certificate.ID())
 		}
-	}()
+	}
+	if len(succeeded) > 0 {
+		acmeRateLimits.Succeeded(succeeded)
+	}
+}
+
+// renewable returns true if the certificate should be renewed now
+func (c *Certificates) renewable(certificate *Certificate) bool {
+	return certificate.Policy.Mode != ACMEOff && certificate.NeedsRenewal() &&
+		certificate.CanUpdate(*retryInterval) && !acmeRateLimits.Blocked(certificate.ID())
+}
 
+// batch finds related certificates which can be renewed together with the certificate,
+// all certificates of -san-group are renewed together, so they keep sharing the SAN certificate
+func (c *Certificates) batch(certificate *Certificate) (batch []*Certificate) {
+	group := sanGroup(certificate.Name)
+	limit := *sanBatch
+	if group != "" {
+		limit = *sanGroupSize
+	}
+	if limit <= 1 {
+		return nil
+	}
+
+	var ids []string
+	for id := range c.list {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	domain := registeredDomain(certificate.Name)
+	for _, id := range ids {
+		other := c.list[id]
+		if len(batch)+1 >= limit {
+			break
+		} else if other == certificate || other.KeyType != certificate.KeyType || other.Policy != certificate.Policy {
+			continue
+		} else if group != "" {
+			if sanGroup(other.Name) != group || other.Requesting || other.Policy.Mode == ACMEOff {
+				continue
+			}
+		} else if registeredDomain(other.Name) != domain || !c.renewable(other) {
+			continue
+		}
+		batch = append(batch, other)
+	}
 	return
 }
 
-func (c Certificates) find(serverName string) *tls.Certificate {
+func (c *Certificates) find(serverName string) *tls.Certificate {
 	if certificate, ok := c.list[serverName]; ok && certificate != nil {
 		if certificate.Requesting && certificate.TLS == nil {
 			return nil
@@ -86,20 +211,43 @@ func (c Certificates) find(serverName string) *tls.Certificate {
 	return nil
 }
 
-func (c Certificates) tick(challenge CertificateChallenge) {
+func (c *Certificates) tick(challenge CertificateChallenge) {
 	for _, certificate := range c.list {
 		if certificate.Requesting {
 			continue
 		}
-		if certificate.IsExpiring(*requestBefore) && certificate.CanUpdate(*retryInterval) {
-			certificate.Requesting = true
-			go func(certificate *Certificate) {
-				err := certificate.Request(challenge)
-				certificate.Requesting = false
-				if err != nil {
-					certificate.log().WithError(err).Warningln("Failed to request a new certificate")
-				}
-			}(certificate)
+		if certificate.IsExpiring(*alertExpiry) && time.Since(certificate.AlertTime) > alertRepeatInterval {
+			certificate.AlertTime = time.Now()
+			sendAlert("certificate-expiring", certificate, nil)
+		}
+		if !c.renewable(certificate) {
+			continue
+		}
+		certificate.Batch = c.batch(certificate)
+		certificate.Requesting = true
+		for _, other := range certificate.Batch {
+			other.Requesting = true
+		}
+		go c.request(certificate, challenge)
+	}
+}
+
+func (c *Certificates) collect() {
+	for _, certificate := range c.list {
+		if certificate.X509 != nil {
+			certificateExpiry.Set(time.Until(certificate.X509.NotAfter).Hours()/24, certificate.ID())
+		}
+	}
+	c.collectStates()
+}
+
+func (c *Certificates) sync() {
+	for _, certificate := range c.list {
+		if certificate.Requesting {
+			continue
+		}
+		if _, err := certificate.fetch(); err != nil {
+			certificate.log().WithError(err).Warningln("Failed to fetch certificate from shared store")
 		}
 	}
 }
@@ -116,20 +264,32 @@ func (c *Certificates) Remove(name string) {
 	c.remove(name)
 }
 
-func (c *Certificates) Load(name string, challenge CertificateChallenge) (*tls.Certificate, error) {
+func (c *Certificates) Load(name, keyType string, policy IssuancePolicy, challenge CertificateChallenge) (*tls.Certificate, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	return c.load(name, challenge)
+	return c.load(name, keyType, policy, challenge)
 }
 
-func (c Certificates) Find(serverName string) *tls.Certificate {
+func (c *Certificates) Find(serverName string) *tls.Certificate {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c.find(serverName)
 }
 
-func (c Certificates) Tick(challenge CertificateChallenge) {
+func (c *Certificates) Tick(challenge CertificateChallenge) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	c.tick(challenge)
 }
+
+func (c *Certificates) Sync() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sync()
+}
+
+func (c *Certificates) Collect() {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	c.collect()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The states of certificates exposed by admin API and metrics
+const (
+	CertificateNone          = "none"
+	CertificateSelfSigned    = "self-signed"
+	CertificatePending       = "pending"
+	CertificateIssued        = "issued"
+	CertificateExpired       = "expired"
+	CertificateRenewalFailed = "renewal-failed"
+)
+
+var certificateStates = newGauge("auto_proxy_certificate_state",
+	"The state of certificate: none, self-signed, pending, issued, expired or renewal-failed", "name", "state")
+
+type certificateStatus struct {
+	Host      string     `json:"host"`
+	KeyType   string     `json:"keyType"`
+	State     string     `json:"state"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+	Failures  int        `json:"failures,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ErrorTime *time.Time `json:"errorTime,omitempty"`
+}
+
+// State tells whether the certificate was issued and the last request succeeded
+func (c *Certificate) State() string {
+	switch {
+	case c.Requesting:
+		return CertificatePending
+	case c.Failures > 0:
+		return CertificateRenewalFailed
+	case c.X509 == nil:
+		return CertificateNone
+	case bytes.Equal(c.X509.RawIssuer, c.X509.RawSubject) && c.X509.CheckSignatureFrom(c.X509) == nil:
+		return CertificateSelfSigned
+	case time.Now().After(c.X509.NotAfter):
+		return CertificateExpired
+	default:
+		return CertificateIssued
+	}
+}
+
+func (c *Certificate) status() certificateStatus {
+	status := certificateStatus{
+		Host:     c.Name,
+		KeyType:  c.KeyType,
+		State:    c.State(),
+		Failures: c.Failures,
+		Error:    c.LastError,
+	}
+	if c.X509 != nil {
+		status.NotAfter = &c.X509.NotAfter
+	}
+	if !c.LastErrorTime.IsZero() {
+		status.ErrorTime = &c.LastErrorTime
+	}
+	return status
+}
+
+// Status returns the state of certificates of hosts, the hosts which didn't request any certificate yet are none
+func (c *Certificates) Status(routes Routes) (list []certificateStatus) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, certificate := range c.list {
+		list = append(list, certificate.status())
+		seen[certificate.Name] = true
+	}
+	for _, route := range routes {
+		if route.Wildcard || route.CanonicalHost != "" || seen[route.VirtualHost] {
+			continue
+		}
+		list = append(list, certificateStatus{Host: route.VirtualHost, KeyType: KeyRSA, State: CertificateNone})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Host != list[j].Host {
+			return list[i].Host < list[j].Host
+		}
+		return list[i].KeyType < list[j].KeyType
+	})
+	return
+}
+
+func (c *Certificates) collectStates() {
+	for _, certificate := range c.list {
+		certificateStates.Set(1, certificate.ID(), certificate.State())
+	}
+}
+
+func (a *adminAPI) getCertificates(w http.ResponseWriter, r *http.Request) {
+	app := a.app
+	if profile := r.URL.Query().Get("profile"); profile != "" {
+		app = profileApps[profile]
+		if app == nil {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+	}
+
+	app.lock.RLock()
+	routes := app.routes
+	app.lock.RUnlock()
+
+	list := app.certificates.Status(routes)
+	if state := r.URL.Query().Get("state"); state != "" {
+		filtered := []certificateStatus{}
+		for _, status := range list {
+			if strings.EqualFold(status.State, state) {
+				filtered = append(filtered, status)
+			}
+		}
+		list = filtered
+	}
+	if list == nil {
+		list = []certificateStatus{}
+	}
+	writeJSON(w, list)
+}
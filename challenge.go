@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const challengeHookTimeout = 2 * time.Minute
+
+// challengeHook describes the challenge passed to external hooks:
+// for http-01 the name is URI path and the value is the resource,
+// for dns-01 the name is the TXT record name and the value is its content
+type challengeHook struct {
+	Action string `json:"action"`
+	Type   string `json:"type"`
+	Domain string `json:"domain"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+}
+
+func hasChallengeHooks() bool {
+	return *acmeHook != "" || *acmeWebhook != ""
+}
+
+func (h challengeHook) run(action string) error {
+	h.Action = action
+
+	if *acmeHook != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), challengeHookTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, *acmeHook, h.Action, h.Type, h.Domain, h.Name, h.Value)
+		cmd.Env = append(os.Environ(),
+			"ACME_ACTION="+h.Action,
+			"ACME_TYPE="+h.Type,
+			"ACME_DOMAIN="+h.Domain,
+			"ACME_NAME="+h.Name,
+			"ACME_VALUE="+h.Value,
+		)
+		cmd.Env = append(cmd.Env, outboundEnv()...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return errors.New("acme hook: " + err.Error() + ": " + string(output))
+		}
+	}
+
+	if *acmeWebhook != "" {
+		err := postWebhook(*acmeWebhook, h)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Present asks hooks to fulfill the challenge
+func (h challengeHook) Present() error {
+	return h.run("present")
+}
+
+// Cleanup asks hooks to remove the challenge
+func (h challengeHook) Cleanup() error {
+	return h.run("cleanup")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var upstreamGzipResponses = newCounter("auto_proxy_upstream_gzip_responses_total",
+	"Number of gzip responses received from upstreams", "host", "decoded")
+
+type upstreamGzipKey struct{}
+
+// acceptsGzip checks the Accept-Encoding of the client, gzip;q=0 refuses the encoding
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					return err == nil && q > 0
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// requestUpstreamGzip asks the upstream of routes with auto-proxy.upstream.gzip=on for gzip response,
+// the compressed bytes are passed to clients accepting gzip untouched and decoded only when
+// the client doesn't accept it or the banner is injected into the response body
+func requestUpstreamGzip(r *http.Request, route *Route) *http.Request {
+	if !route.UpstreamGzip || r.Header.Get("Range") != "" || isUpgradeRequest(r) {
+		return r
+	}
+
+	readsBody := injectsBanner(r)
+	if acceptsGzip(r.Header) && !readsBody {
+		return r
+	}
+
+	if readsBody {
+		// The banner is injected into either gzip decoded by proxy or identity
+		r.Header.Set("Accept-Encoding", "gzip")
+	} else if value := r.Header.Get("Accept-Encoding"); value != "" {
+		r.Header.Set("Accept-Encoding", value+", gzip")
+	} else {
+		r.Header.Set("Accept-Encoding", "gzip")
+	}
+	return r.WithContext(context.WithValue(r.Context(), upstreamGzipKey{}, true))
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decodeUpstreamGzip removes the gzip encoding added by requestUpstreamGzip
+func (r *Route) decodeUpstreamGzip(resp *http.Response) error {
+	if !r.UpstreamGzip || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	decode, _ := resp.Request.Context().Value(upstreamGzipKey{}).(bool)
+	upstreamGzipResponses.Inc(r.VirtualHost, strconv.FormatBool(decode))
+	if !decode || resp.Request.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = &gzipBody{Reader: reader, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	// The strong validator belongs to the compressed representation
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Config is read from -config file, it holds settings which are too complex for flags
+type Config struct {
+	// Middlewares are named sets of labels (without auto-proxy. prefix) referenced by auto-proxy.middlewares
+	Middlewares map[string]map[string]string `json:"middlewares"`
+
+	// Rules are named rule sets referenced by auto-proxy.rules, the global ones are applied to all routes
+	Rules       map[string][]Rule `json:"rules"`
+	GlobalRules []string          `json:"globalRules"`
+
+	// Schedules are maintenance windows and label overrides of routes
+	Schedules []*Schedule `json:"schedules"`
+
+	// Bots are user agents blocked or challenged on routes with auto-proxy.bots
+	Bots BotsConfig `json:"bots"`
+
+	// Banners are injected into HTML responses of routes selecting them, they can be toggled with admin API
+	Banners []*Banner `json:"banners"`
+
+	// Secrets are Docker secrets or files the middlewares of allowed hosts reference with secret:<name>
+	Secrets map[string]*Secret `json:"secrets"`
+
+	// ShutdownHooks are called once the proxy starts draining, ie. to deregister it from DNS or load balancer
+	ShutdownHooks []*ShutdownHook `json:"shutdownHooks"`
+
+	// Profiles are logical proxies with own listeners and certificates, selected by auto-proxy.profile
+	Profiles map[string]Profile `json:"profiles"`
+
+	compiledRules map[string][]Rule
+}
+
+var config Config
+
+func loadConfig(fileName string) (config Config, err error) {
+	if fileName == "" {
+		config.compiledRules, err = compileRules(nil)
+		if err == nil {
+			err = config.Bots.compile()
+		}
+		return
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return
+	}
+
+	config.compiledRules, err = compileRules(config.Rules)
+	if err != nil {
+		return
+	}
+	err = config.Bots.compile()
+	if err != nil {
+		return
+	}
+	for _, schedule := range config.Schedules {
+		err = schedules.Add(schedule)
+		if err != nil {
+			return
+		}
+	}
+	for name, secret := range config.Secrets {
+		err = secret.validate(name)
+		if err != nil {
+			return
+		}
+	}
+	for _, hook := range config.ShutdownHooks {
+		err = hook.compile()
+		if err != nil {
+			return
+		}
+	}
+	for _, banner := range config.Banners {
+		err = banners.Set(banner)
+		if err != nil {
+			return
+		}
+	}
+	for _, name := range config.GlobalRules {
+		if _, ok := config.compiledRules[name]; !ok {
+			return config, errors.New("config: unknown global rules " + name)
+		}
+	}
+
+	for name, labels := range config.Middlewares {
+		if _, ok := registeredMiddlewares[name]; ok {
+			return config, errors.New("config: middleware " + name + " is already registered by extension")
+		} else if _, ok := labels["middlewares"]; ok {
+			return config, errors.New("config: middleware " + name + " can't reference other middlewares")
+		}
+	}
+	return
+}
+
+// applyMiddlewares parses labels of comma separated middlewares, the later ones override the former
+func (r *RouteBuilder) applyMiddlewares(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		labels, ok := config.Middlewares[name]
+		if _, registered := registeredMiddlewares[name]; !ok && registered {
+			r.Middlewares = append(r.Middlewares, name)
+			continue
+		} else if !ok {
+			return errors.New("unknown middleware " + name)
+		}
+
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			r.ParseLabel(LabelPrefix+key, labels[key])
+		}
+	}
+	return nil
+}
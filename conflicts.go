@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+var hostConflicts = newGauge("auto_proxy_host_conflicts",
+	"Number of hosts claimed by containers with incompatible options")
+
+type hostConflict struct {
+	Profile    string   `json:"profile,omitempty"`
+	Host       string   `json:"host"`
+	Containers []string `json:"containers"`
+	Options    []string `json:"options"`
+}
+
+// optionConflicts returns the names of options which differ between claims of the same host
+func optionConflicts(a, b *RouteOptions) (names []string) {
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	for idx := 0; idx < va.NumField(); idx++ {
+		if !reflect.DeepEqual(va.Field(idx).Interface(), vb.Field(idx).Interface()) {
+			names = append(names, va.Type().Field(idx).Name)
+		}
+	}
+	return
+}
+
+func (r *Route) addConflicts(names []string) {
+	for _, name := range names {
+		idx := sort.SearchStrings(r.Conflicts, name)
+		if idx < len(r.Conflicts) && r.Conflicts[idx] == name {
+			continue
+		}
+		r.Conflicts = append(r.Conflicts, "")
+		copy(r.Conflicts[idx+1:], r.Conflicts[idx:])
+		r.Conflicts[idx] = name
+	}
+}
+
+// listConflicts returns the conflicting hosts of all profiles
+func listConflicts() []hostConflict {
+	list := []hostConflict{}
+	for name, app := range profileApps {
+		app.lock.RLock()
+		for _, route := range app.routes {
+			if len(route.Conflicts) == 0 {
+				continue
+			}
+			conflict := hostConflict{Profile: name, Host: route.VirtualHost, Options: route.Conflicts}
+			for _, upstream := range route.Servers {
+				conflict.Containers = append(conflict.Containers, upstream.Container)
+			}
+			list = append(list, conflict)
+		}
+		app.lock.RUnlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Profile != list[j].Profile {
+			return list[i].Profile < list[j].Profile
+		}
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+func collectConflicts() {
+	hostConflicts.Set(float64(len(listConflicts())))
+}
+
+func (a *adminAPI) getConflicts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listConflicts())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// dockerDaemon is the Docker endpoint of -docker-host, the routes of each daemon are a separate source
+type dockerDaemon struct {
+	// Name is empty when watching single daemon, the routes then keep the docker source
+	Name     string
+	Endpoint string
+
+	// Address is the host of off-host daemon, its containers are reached on ports published on this address
+	Address string
+
+	resync atomic.Bool
+}
+
+var dockerDaemons []*dockerDaemon
+
+// parseDockerHosts reads the comma separated endpoints, ie. east=tcp://10.0.0.5:2375,west=tcp://10.0.1.5:2375,
+// the name defaults to the host of endpoint
+func parseDockerHosts(value string) ([]*dockerDaemon, error) {
+	if !strings.Contains(value, ",") && !strings.Contains(value, "=") {
+		endpoint := value
+		if endpoint == "" {
+			endpoint = os.Getenv("DOCKER_HOST")
+		}
+		return []*dockerDaemon{{Endpoint: value, Address: remoteDockerAddress(endpoint)}}, nil
+	}
+
+	var list []*dockerDaemon
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		name, endpoint, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			name, endpoint = "", name
+		}
+		if endpoint == "" {
+			return nil, errors.New("docker-host: missing endpoint of " + entry)
+		}
+		if name == "" {
+			name = dockerHostName(endpoint)
+		}
+		if names[name] || strings.ContainsAny(name, ": ") {
+			return nil, errors.New("docker-host: duplicate or invalid daemon name " + name)
+		}
+		names[name] = true
+		list = append(list, &dockerDaemon{Name: name, Endpoint: endpoint, Address: remoteDockerAddress(endpoint)})
+	}
+	return list, nil
+}
+
+// dockerHostName is the host of TCP endpoint, or local for sockets and named pipes
+func dockerHostName(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Hostname() != "" && u.Scheme != "unix" && u.Scheme != "npipe" {
+		return u.Hostname()
+	}
+	return "local"
+}
+
+// remoteDockerAddress returns the host of daemon not running on this host, ie. tcp://10.0.0.5:2375
+func remoteDockerAddress(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "unix" || u.Scheme == "npipe" {
+		return ""
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "" || host == "localhost" || ip != nil && ip.IsLoopback() {
+		return ""
+	}
+	return host
+}
+
+// Source is the name of reconciler source delivering the routes of daemon
+func (d *dockerDaemon) Source() string {
+	if d.Name == "" {
+		return SourceDocker
+	}
+	return SourceDocker + ":" + d.Name
+}
+
+// Client connects to the endpoint, the default is DOCKER_HOST, the Podman socket with -provider=podman
+// or the unix socket (named pipe on Windows)
+func (d *dockerDaemon) Client() (*docker.Client, error) {
+	if d.Endpoint != "" {
+		return docker.NewClient(d.Endpoint)
+	} else if *provider == ProviderPodman && os.Getenv("DOCKER_HOST") == "" {
+		return docker.NewClient(podmanSocket())
+	}
+	return docker.NewClientFromEnv()
+}
+
+func (d *dockerDaemon) log() *logrus.Entry {
+	if d.Name == "" {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return logrus.WithField("daemon", d.Name)
+}
+
+// dockerClientOf connects to the daemon the upstream was discovered on
+func dockerClientOf(upstream *Upstream) (*docker.Client, error) {
+	for _, daemon := range dockerDaemons {
+		if daemon.Name == upstream.Daemon {
+			return daemon.Client()
+		}
+	}
+	return nil, errors.New("unknown docker daemon " + upstream.Daemon)
+}
+
+// resyncDaemons makes the watchers of all daemons enumerate their containers on next ping, the hold-downs
+// and stop grace periods are tracked by container ID regardless of daemon
+func resyncDaemons() {
+	for _, daemon := range dockerDaemons {
+		daemon.resync.Store(true)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"reflect"
+	"strings"
+)
+
+// changedOptions returns the names of route options which differ
+func changedOptions(before, after *Route) (names []string) {
+	b, a := reflect.ValueOf(before.RouteOptions), reflect.ValueOf(after.RouteOptions)
+	for idx := 0; idx < b.NumField(); idx++ {
+		if !reflect.DeepEqual(b.Field(idx).Interface(), a.Field(idx).Interface()) {
+			names = append(names, b.Type().Field(idx).Name)
+		}
+	}
+	if before.CanonicalHost != after.CanonicalHost {
+		names = append(names, "CanonicalHost")
+	}
+	if before.Wildcard != after.Wildcard {
+		names = append(names, "Wildcard")
+	}
+	return
+}
+
+// changedServers returns the upstreams which were added and removed
+func changedServers(before, after *Route) (added, removed []string) {
+	servers := func(route *Route) map[string]bool {
+		list := make(map[string]bool)
+		if route != nil {
+			for _, upstream := range route.Servers {
+				list[upstream.String()] = true
+			}
+		}
+		return list
+	}
+	b, a := servers(before), servers(after)
+	for name := range a {
+		if !b[name] {
+			added = append(added, name)
+		}
+	}
+	for name := range b {
+		if !a[name] {
+			removed = append(removed, name)
+		}
+	}
+	return
+}
+
+// logRouteChanges logs each change of the route table with the trigger which caused it
+func logRouteChanges(source, trigger string, changes []RouteChange) {
+	for _, change := range changes {
+		log := logrus.WithField("source", source).WithField("trigger", trigger).
+			WithField("host", change.Host).WithField("action", change.Action)
+
+		added, removed := changedServers(change.Before, change.After)
+		if len(added) > 0 {
+			log = log.WithField("added", strings.Join(added, ", "))
+		}
+		if len(removed) > 0 {
+			log = log.WithField("removed", strings.Join(removed, ", "))
+		}
+		if change.Before != nil && change.After != nil {
+			if options := changedOptions(change.Before, change.After); len(options) > 0 {
+				log = log.WithField("options", strings.Join(options, ", "))
+			}
+		}
+		log.Infoln("Route " + change.Action)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+var earlyHints = newCounter("auto_proxy_early_hints_total",
+	"Number of 103 Early Hints responses of upstreams passed to or stripped for clients", "host", "result")
+
+func parseEarlyHints(value string) (bool, error) {
+	if value != "on" && value != "off" {
+		return false, errors.New("expected on or off")
+	}
+	return value == "off", nil
+}
+
+// isInformational tells the 1xx responses which precede the final one, the 101 switches protocols instead
+func isInformational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+// earlyHintsWriter passes 103 Early Hints of upstream to clients speaking HTTP/1.1 or HTTP/2, the other
+// informational responses and the hints for HTTP/1.0 clients are stripped. The proxy clears the header
+// after each informational response, so the headers of upstream are kept apart till the final response.
+type earlyHintsWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	route   *Route
+	pending http.Header
+	final   bool
+}
+
+func (e *earlyHintsWriter) Header() http.Header {
+	if e.final {
+		return e.ResponseWriter.Header()
+	}
+	return e.pending
+}
+
+// flushHeader merges the headers of final response into the ones set by proxy
+func (e *earlyHintsWriter) flushHeader() {
+	if e.final {
+		return
+	}
+	e.final = true
+	header := e.ResponseWriter.Header()
+	for name, values := range e.pending {
+		header[name] = append(header[name], values...)
+	}
+}
+
+func (e *earlyHintsWriter) WriteHeader(status int) {
+	if !isInformational(status) {
+		e.flushHeader()
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if e.final {
+		return
+	}
+
+	if status != http.StatusEarlyHints {
+		return
+	} else if !e.request.ProtoAtLeast(1, 1) || e.route.EarlyHintsOff {
+		earlyHints.Inc(e.route.VirtualHost, "stripped")
+		return
+	}
+
+	// Only the hints are sent, the headers set by proxy are kept for final response
+	header := e.ResponseWriter.Header()
+	saved := header.Clone()
+	clear(header)
+	for name, values := range e.pending {
+		header[name] = values
+	}
+	e.ResponseWriter.WriteHeader(status)
+	clear(header)
+	for name, values := range saved {
+		header[name] = values
+	}
+	earlyHints.Inc(e.route.VirtualHost, "forwarded")
+}
+
+func (e *earlyHintsWriter) Write(data []byte) (int, error) {
+	e.flushHeader()
+	return e.ResponseWriter.Write(data)
+}
+
+func (e *earlyHintsWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// passEarlyHints wraps the writer passed to proxy, the upgrade responses are written by proxy with header as is
+func passEarlyHints(w http.ResponseWriter, r *http.Request, route *Route) http.ResponseWriter {
+	if isUpgradeRequest(r) {
+		return w
+	}
+	return &earlyHintsWriter{ResponseWriter: w, request: r, route: route, pending: make(http.Header)}
+}
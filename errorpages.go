@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// The classes of errors, sent in X-Proxy-Error header
+const (
+	ErrorNoRoute           = "no_route"
+	ErrorNoUpstreams       = "no_upstreams"
+	ErrorOverloaded        = "overloaded"
+	ErrorUpstreamRefused   = "upstream_connection_refused"
+	ErrorUpstreamTimeout   = "upstream_timeout"
+	ErrorUpstreamTLS       = "upstream_tls_failure"
+	ErrorUpstreamError     = "upstream_error"
+	ErrorClientCanceled    = "client_canceled"
+	ErrorExternalProcessor = "external_processor_failure"
+	ErrorHeadersTooLarge   = "request_headers_too_large"
+	ErrorOutsideHours      = "outside_allowed_hours"
+	ErrorRateLimited       = "rate_limited"
+	ErrorSecretUnavailable = "secret_unavailable"
+	ErrorHTTPDisabled      = "http_disabled"
+	ErrorFaultInjected     = "fault_injected"
+	proxyErrorHeader       = "X-Proxy-Error"
+	requestIDHeader        = "X-Request-Id"
+	clientClosedStatusCode = 499
+)
+
+var errorStatusCodes = map[string]int{
+	ErrorNoRoute:           http.StatusNotFound,
+	ErrorNoUpstreams:       http.StatusServiceUnavailable,
+	ErrorOverloaded:        http.StatusServiceUnavailable,
+	ErrorUpstreamRefused:   http.StatusBadGateway,
+	ErrorUpstreamTimeout:   http.StatusGatewayTimeout,
+	ErrorUpstreamTLS:       http.StatusBadGateway,
+	ErrorUpstreamError:     http.StatusBadGateway,
+	ErrorClientCanceled:    clientClosedStatusCode,
+	ErrorExternalProcessor: http.StatusServiceUnavailable,
+	ErrorHeadersTooLarge:   http.StatusRequestHeaderFieldsTooLarge,
+	ErrorOutsideHours:      http.StatusForbidden,
+	ErrorRateLimited:       http.StatusTooManyRequests,
+	ErrorSecretUnavailable: http.StatusServiceUnavailable,
+	ErrorHTTPDisabled:      http.StatusForbidden,
+	ErrorFaultInjected:     http.StatusInternalServerError,
+}
+
+var proxyErrors = newCounter("auto_proxy_errors_total",
+	"Number of requests failed by the proxy or upstream connection", "host", "error")
+
+type errorBody struct {
+	Error     string    `json:"error"`
+	Message   string    `json:"message"`
+	Host      string    `json:"host"`
+	RequestID string    `json:"requestId,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// ensureRequestID passes X-Request-Id of client or generates a new one, it is returned to client as well
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = newSessionID()
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// serveError responds with status code of the class, the body is JSON with -json-errors
+func serveError(w http.ResponseWriter, r *http.Request, class, message string) {
+	serveErrorStatus(w, r, class, errorStatusCodes[class], message)
+}
+
+// serveErrorStatus responds with the error class using other than its default status
+func serveErrorStatus(w http.ResponseWriter, r *http.Request, class string, status int, message string) {
+	proxyErrors.Inc(stripPort(r.Host), class)
+	w.Header().Set(proxyErrorHeader, class)
+	if class == ErrorClientCanceled {
+		// nobody is listening
+		w.WriteHeader(status)
+		return
+	}
+
+	if !*jsonErrors {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, message)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, errorBody{
+		Error:     class,
+		Message:   message,
+		Host:      r.Host,
+		RequestID: r.Header.Get(requestIDHeader),
+		Time:      time.Now().UTC(),
+	})
+}
+
+// classifyUpstreamError tells apart why the request couldn't be proxied
+func classifyUpstreamError(err error) string {
+	var netErr net.Error
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var verificationErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClientCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorUpstreamRefused
+	case errors.Is(err, errPinMismatch), errors.As(err, &hostnameErr), errors.As(err, &authorityErr),
+		errors.As(err, &invalidErr), errors.As(err, &verificationErr), errors.As(err, &recordErr):
+		return ErrorUpstreamTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorUpstreamTimeout
+	default:
+		return ErrorUpstreamError
+	}
+}
+
+// proxyErrorHandler is used by reverse proxy when upstream fails
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	class := classifyUpstreamError(err)
+	serveError(w, r, class, "upstream failed for "+r.Host+": "+err.Error())
+}
@@ -1,20 +1,113 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const PingInterval = 10 * time.Second
+const WaitForDockerInterval = time.Second
+
+// ExitDockerUnavailable is the exit code when Docker daemon doesn't appear within -wait-for-docker
+const ExitDockerUnavailable = 3
 const ReconnectTime = 10 * time.Second
 
-type RoutesHandleFunc func(routes Routes)
+// The backoff of reconnections is reset once the connection stays up for dockerStableTime
+const dockerStableTime = time.Minute
+
+var dockerConnected = newGauge("auto_proxy_docker_connected",
+	"Whether the connection to docker daemon is established", "daemon")
+var dockerReconnects = newCounter("auto_proxy_docker_reconnects_total",
+	"Number of reconnections to docker daemon", "daemon")
+var dockerEventOverflows = newCounter("auto_proxy_docker_event_overflows_total",
+	"Number of times the docker event buffer was full and all containers were resynced", "daemon")
+var dockerDisconnectedSeconds = newCounter("auto_proxy_docker_disconnected_seconds_total",
+	"Time spent without connection to docker daemon", "daemon")
+
+type dockerConnection struct {
+	daemon            *dockerDaemon
+	backoff           backoff
+	disconnectedSince time.Time
+	connectedSince    time.Time
+	onDisconnect      func()
+}
+
+// connected is called once the events are watched, the backoff is kept till the connection proves stable
+func (c *dockerConnection) connected() {
+	c.connectedSince = time.Now()
+	dockerConnected.Set(1, c.daemon.Name)
+	if c.disconnectedSince.IsZero() {
+		return
+	}
+
+	disconnected := time.Since(c.disconnectedSince)
+	c.disconnectedSince = time.Time{}
+	dockerReconnects.Inc(c.daemon.Name)
+	dockerDisconnectedSeconds.Add(disconnected.Seconds(), c.daemon.Name)
+	c.daemon.log().WithField("disconnected", disconnected.String()).Infoln("Reconnected to docker daemon")
+}
+
+// failed waits before the next connection attempt
+func (c *dockerConnection) failed() {
+	if !c.connectedSince.IsZero() && time.Since(c.connectedSince) >= dockerStableTime {
+		c.backoff.Reset()
+	}
+	c.connectedSince = time.Time{}
+	dockerConnected.Set(0, c.daemon.Name)
+	if c.disconnectedSince.IsZero() {
+		c.disconnectedSince = time.Now()
+
+		// Keep serving the last known routes till reconnected
+		if c.onDisconnect != nil {
+			c.onDisconnect()
+		}
+	}
+
+	delay := c.backoff.Next()
+	c.daemon.log().WithField("retry", delay.String()).
+		WithField("disconnected", time.Since(c.disconnectedSince).String()).
+		Debugln("Waiting before reconnecting to docker daemon...")
+	time.Sleep(delay)
+}
+
+// Ports which are usually serving HTTP
+var httpPorts = map[int]bool{
+	80: true, 81: true, 3000: true, 4000: true, 5000: true, 8000: true, 8008: true, 8080: true, 8081: true, 8888: true, 9000: true,
+}
+
+// pickExposedPort returns the lowest HTTP-ish TCP port, or the lowest TCP port if there's none
+func pickExposedPort(exposed map[docker.Port]struct{}) string {
+	best, bestHTTP := 0, false
+	for port := range exposed {
+		number, err := strconv.Atoi(strings.TrimSuffix(string(port), "/tcp"))
+		if err != nil {
+			// not a TCP port
+			continue
+		}
+		isHTTP := httpPorts[number]
+		if best == 0 || isHTTP && !bestHTTP || isHTTP == bestHTTP && number < best {
+			best, bestHTTP = number, isHTTP
+		}
+	}
+	if best == 0 {
+		return ""
+	}
+	return strconv.Itoa(best)
+}
+
+// createRoutes enumerates the containers of daemon, their upstreams record the daemon they run on
+func createRoutes(client *docker.Client, daemon *dockerDaemon) (routes Routes, err error) {
+	log := daemon.log()
 
-func createRoutes(client *docker.Client) (routes Routes, err error) {
 	opts := docker.ListContainersOptions{}
 	containers, err := client.ListContainers(opts)
 	if err != nil {
@@ -23,14 +116,19 @@ func createRoutes(client *docker.Client) (routes Routes, err error) {
 
 	wg := sync.WaitGroup{}
 	ch := make(chan *docker.Container)
+	var failed int32
 
 	for _, container := range containers {
 		wg.Add(1)
 		go func(id string) {
 			defer wg.Done()
 			container, err := client.InspectContainer(id)
-			if err != nil {
-				logrus.WithField("id", id).WithError(err).Errorln("Failed inspecing container")
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				// removed in the meantime
+				return
+			} else if err != nil {
+				log.WithField("id", id).WithError(err).Errorln("Failed inspecing container")
+				atomic.AddInt32(&failed, 1)
 				return
 			}
 			ch <- container
@@ -42,11 +140,59 @@ func createRoutes(client *docker.Client) (routes Routes, err error) {
 		close(ch)
 	}()
 
-	routes = make(Routes)
+	profiled := make(ProfileRoutes)
+	var targets []scrapeTarget
+	var validations []containerValidation
 
 	for container := range ch {
+		if restartStorms.Suppressed(container.ID) {
+			log.WithField("name", container.Name).WithField("id", container.ID[0:7]).
+				Debugln("Container is flapping, skipping its routes...")
+			continue
+		}
+		if terminating.Stopping(container.ID) {
+			log.WithField("name", container.Name).WithField("id", container.ID[0:7]).
+				Debugln("Container is stopping, skipping its routes...")
+			continue
+		}
+
+		// Keep the reasons why the route is not served for the admin API
+		proxied := isProxied(container.Config.Env, container.Config.Labels)
+		validated := func(route *RouteBuilder, served bool) {
+			if proxied {
+				validations = append(validations, containerValidation{
+					Name:   container.Name,
+					ID:     container.ID[0:12],
+					Daemon: daemon.Name,
+					Schema: route.Schema,
+					Hosts:  route.VirtualHost,
+					Served: served,
+					Errors: route.Validate(),
+				})
+			}
+		}
+
 		route := NewRouteBuilder()
+		route.ParseSchema(container.Config.Env, container.Config.Labels)
 		route.ParseAll(container.Config.Env...)
+		route.ParseLabels(container.Config.Labels)
+		route.Upstream.Container = container.Name
+		route.Upstream.Daemon = daemon.Name
+		route.Upstream.Labels = selectMetricsLabels(container.Config.Labels)
+		route.applyResourceWeight(container)
+
+		// Follow the same discovery for Prometheus targets
+		if target, ok := newScrapeTarget(container, &route, daemon); ok {
+			targets = append(targets, target)
+		}
+
+		// Upstreams listening on unix socket don't need any address
+		if route.Upstream.Socket != "" && route.isValid() {
+			log.WithField("name", container.Name).WithField("id", container.ID[0:7]).WithField("route", route).
+				Debugln("Adding route...")
+			validated(&route, profiled.Add(route))
+			continue
+		}
 
 		// Try to find first suitable port if not specified from list of ports
 		if route.Upstream.Port == "" {
@@ -59,87 +205,167 @@ func createRoutes(client *docker.Client) (routes Routes, err error) {
 			}
 		}
 
+		// Fallback to ports exposed by the image
+		if route.Upstream.Port == "" && *exposePorts && container.Config != nil {
+			route.Upstream.Port = pickExposedPort(container.Config.ExposedPorts)
+		}
+
 		// Fail if we can't find a port
 		if route.Upstream.Port == "" {
-			logrus.WithField("name", container.Name).WithField("id", container.ID[0:7]).
+			log.WithField("name", container.Name).WithField("id", container.ID[0:7]).
 				Debugln("Couldn't find a port to expose...")
+			validated(&route, false)
 			continue
 		}
 
-		route.Upstream.Container = container.Name
-
-		// Try to find bindings for specified ports
-		portDef := fmt.Sprintf("%s/tcp", route.Upstream.Port)
-		bindings := container.NetworkSettings.Ports[docker.Port(portDef)]
-
-		// Try to use bindings in order to access host (useful for Swarm nodes)
-		for _, binding := range bindings {
-			if binding.HostIP != "0.0.0.0" {
-				route.Upstream.IP = binding.HostIP
-				route.Upstream.Port = binding.HostPort
-				break
-			}
-		}
-
-		// Try to use address when connected to local bridge
-		if container.Node == nil && route.Upstream.IP == "" {
-			// This address make sense only when accessing locally
-			route.Upstream.IP = container.NetworkSettings.IPAddress
-		}
-
-		// Try to use address when connected to other network
-		if container.Node == nil && route.Upstream.IP == "" {
-			for _, network := range container.NetworkSettings.Networks {
-				if network.IPAddress != "" {
-					route.Upstream.IP = network.IPAddress
-					break
-				}
-			}
-		}
+		// Pick the address in order of -upstream-prefer
+		route.Upstream.IP, route.Upstream.Port = pickUpstreamAddress(container, route.Upstream.Port, upstreamPreference, daemon.Address)
 
 		if route.Upstream.IP == "" {
-			logrus.WithField("name", container.Name).WithField("id", container.ID[0:7]).
+			log.WithField("name", container.Name).WithField("id", container.ID[0:7]).
 				Debugln("Couldn't find an IP to access container...")
+			validated(&route, false)
 			continue
 		}
 
 		if !route.isValid() {
+			validated(&route, false)
 			continue
 		}
 
-		logrus.WithField("name", container.Name).WithField("id", container.ID[0:7]).WithField("route", route).
+		log.WithField("name", container.Name).WithField("id", container.ID[0:7]).WithField("route", route).
 			Debugln("Adding route...")
-		routes.Add(route)
+		validated(&route, profiled.Add(route))
 	}
+	routes = profiled.Join()
 
+	// Keep the last routes if no container could be inspected, ie. when daemon is restarting,
+	// otherwise the containers which failed are skipped till the next enumeration
+	if failed > 0 && int(failed) == len(containers) {
+		return nil, fmt.Errorf("failed to inspect %d containers", failed)
+	} else if failed > 0 {
+		log.WithField("failed", failed).Warningln("Skipping routes of containers which failed to inspect")
+	}
+	scrapeTargets.Update(daemon.Name, targets)
+	discoveredContainers.Update(daemon.Name, validations)
 	return
 }
 
-func watchEvents(updateFunc RoutesHandleFunc) {
+func isUnspecifiedIP(s string) bool {
+	ip := net.ParseIP(s)
+	return s == "" || ip != nil && ip.IsUnspecified()
+}
+
+// waitForDocker blocks till all Docker daemons answer to ping
+func waitForDocker(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, daemon := range dockerDaemons {
+		for {
+			client, err := daemon.Client()
+			if err == nil {
+				err = client.Ping()
+			}
+			if err == nil {
+				break
+			} else if time.Now().After(deadline) {
+				return err
+			}
+
+			daemon.log().WithError(err).Debugln("Waiting for docker daemon...")
+			time.Sleep(WaitForDockerInterval)
+		}
+	}
+	return nil
+}
+
+// gateOnDocker exits the proxy with distinct code if the Docker daemon never appears
+func gateOnDocker(timeout time.Duration) {
+	err := waitForDocker(timeout)
+	if err != nil {
+		logrus.WithError(err).WithField("timeout", timeout.String()).Errorln("Docker daemon is not available")
+		os.Exit(ExitDockerUnavailable)
+	}
+}
+
+// trackEvent updates the state of containers by the event, it returns the trigger if the routes have to be rebuilt
+func trackEvent(event *docker.APIEvents) (string, bool) {
+	// The container reconnected to network has a new address, repoint its routes
+	if container, ok := networkEventContainer(event); ok {
+		logrus.Debugln("Received network", event.Action, "event for container", container[:12])
+		return fmt.Sprintf("docker network %s event for container %s", event.Action, container[:12]), true
+	}
+
+	if !normalizeEvent(event) {
+		return "", false
+	}
+
+	if event.Status == "die" {
+		restartStorms.Died(event.ID, event.Actor.Attributes["name"])
+	}
+	if event.Status == "die" || event.Status == "start" {
+		terminating.Forget(event.ID)
+	}
+
+	// Remove routes at the start of stop grace period, not once the container died
+	killed := event.Status == "kill" &&
+		terminating.Killed(event.ID, event.Actor.Attributes["name"], event.Actor.Attributes["signal"])
+
+	if event.Status == "start" || event.Status == "stop" || event.Status == "die" || killed {
+		logrus.Debugln("Received event", event.Status, "for container", event.ID[:12])
+		return fmt.Sprintf("docker %s event for container %s", event.Status, event.ID[:12]), true
+	}
+	return "", false
+}
+
+// drainEvents returns the events waiting in the buffer without blocking
+func drainEvents(eventChan chan *docker.APIEvents) (list []*docker.APIEvents) {
+	for {
+		select {
+		case event := <-eventChan:
+			if event == nil {
+				return
+			}
+			list = append(list, event)
+		default:
+			return
+		}
+	}
+}
+
+// watchEvents keeps the routes of daemon up to date, each daemon of -docker-host has its own watcher
+func watchEvents(daemon *dockerDaemon, source *routeSource) {
 	var client *docker.Client
 	var err error
 	var routes Routes
+	log := daemon.log()
+	connection := dockerConnection{
+		daemon:  daemon,
+		backoff: backoff{Min: ReconnectTime, Max: *dockerBackoffMax},
+		onDisconnect: func() {
+			source.Disconnected(errors.New("disconnected from docker daemon"))
+		},
+	}
 
 	for {
 		if client == nil || client.Ping() == nil {
-			client, err = docker.NewClientFromEnv()
+			client, err = daemon.Client()
 			if err != nil {
-				logrus.Errorln("Unable to connect to docker daemon:", err)
-				time.Sleep(ReconnectTime)
+				log.Errorln("Unable to connect to docker daemon:", err)
+				connection.failed()
 				continue
 			}
 
-			logrus.Debugln("Connected to docker daemon...")
-			routes, err = createRoutes(client)
+			log.Debugln("Connected to docker daemon...")
+			routes, err = createRoutes(client, daemon)
 			if err != nil {
-				logrus.Errorln("Error enumerating routes:", err)
-			}
-			if err == nil && updateFunc != nil {
-				updateFunc(routes)
+				log.Errorln("Error enumerating routes:", err)
+				source.Failed(err)
+			} else {
+				source.Update(routes, "docker connected")
 			}
 		}
 
-		eventChan := make(chan *docker.APIEvents, 100)
+		eventChan := make(chan *docker.APIEvents, *dockerEventBuffer)
 		defer close(eventChan)
 
 		watching := false
@@ -149,25 +375,26 @@ func watchEvents(updateFunc RoutesHandleFunc) {
 			}
 			err := client.Ping()
 			if err != nil {
-				logrus.Errorln("Unable to ping docker daemon:", err)
+				log.Errorln("Unable to ping docker daemon:", err)
 				if watching {
 					client.RemoveEventListener(eventChan)
 					watching = false
 					client = nil
 				}
-				time.Sleep(ReconnectTime)
+				connection.failed()
 				break
 			}
 
 			if !watching {
 				err = client.AddEventListener(eventChan)
 				if err != nil && err != docker.ErrListenerAlreadyExists {
-					logrus.Errorln("Error registering docker event listener:", err)
-					time.Sleep(ReconnectTime)
+					log.Errorln("Error registering docker event listener:", err)
+					connection.failed()
 					continue
 				}
 				watching = true
-				logrus.Infoln("Watching docker events...")
+				connection.connected()
+				log.Infoln("Watching docker events...")
 			}
 
 			select {
@@ -181,18 +408,51 @@ func watchEvents(updateFunc RoutesHandleFunc) {
 					break
 				}
 
-				if event.Status == "start" || event.Status == "stop" || event.Status == "die" {
-					logrus.Debugln("Received event", event.Status, "for container", event.ID[:12])
-					routes, err = createRoutes(client)
+				// The client drops the events once the buffer is full, the lost ones are recovered by enumerating all containers.
+				// The received event freed one slot, so the buffer of at least 2 was full when cap-1 events are still waiting.
+				if len(eventChan) >= cap(eventChan)-1 {
+					pending := drainEvents(eventChan)
+					dockerEventOverflows.Inc(daemon.Name)
+					log.WithField("pending", len(pending)+1).WithField("buffer", cap(eventChan)).
+						Warningln("Docker event buffer is full, events could be lost, resyncing all containers")
+					for _, other := range append([]*docker.APIEvents{event}, pending...) {
+						trackEvent(other)
+					}
+					routes, err = createRoutes(client, daemon)
+					if err != nil {
+						log.Errorln("Error enumerating routes:", err)
+					}
+					if err == nil {
+						source.Update(routes, "docker event buffer overflow")
+					}
+					continue
+				}
+
+				if trigger, rebuild := trackEvent(event); rebuild {
+					routes, err = createRoutes(client, daemon)
 					if err != nil {
-						logrus.Errorln("Error enumerating routes:", err)
+						log.Errorln("Error enumerating routes:", err)
 					}
-					if err == nil && updateFunc != nil {
-						updateFunc(routes)
+					if err == nil {
+						source.Update(routes, trigger)
 					}
 				}
 			case <-time.After(PingInterval):
 				// check for docker liveness
+
+				// add routes of containers which are no longer suppressed or survived the stop signal
+				if released, expired := restartStorms.Released(), terminating.Expired(); released || expired {
+					resyncDaemons()
+				}
+				if daemon.resync.Swap(false) {
+					routes, err = createRoutes(client, daemon)
+					if err != nil {
+						log.Errorln("Error enumerating routes:", err)
+					}
+					if err == nil {
+						source.Update(routes, "container hold-down or stop grace period ended")
+					}
+				}
 			}
 		}
 	}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The expressions are a small subset of CEL, ie. !has(header["X-Token"]) && path.startsWith("/admin")
+//
+//	operators:  || && ! == != < <= > >= in
+//	literals:   "string" 'string' 42 true false ["list", "of", "values"]
+//	variables:  method host path uri scheme remote_ip ja3 header[name] query[name] cookie[name]
+//	functions:  has(x) size(x) int(x) cidr(ip, "10.0.0.0/8")
+//	methods:    startsWith endsWith contains matches("literal") lower upper size
+type exprNode func(env *exprEnv) (interface{}, error)
+
+// exprMap is a lazy lookup of request values, missing keys are nil
+type exprMap func(key string) (string, bool)
+
+type exprEnv struct {
+	r *http.Request
+}
+
+type exprToken struct {
+	kind  byte // i: ident, s: string, n: number, p: punctuation
+	value string
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func tokenizeExpr(source string) (tokens []exprToken, err error) {
+	for idx := 0; idx < len(source); {
+		c := source[idx]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			idx++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := idx
+			for idx < len(source) && (source[idx] == '_' || source[idx] >= 'a' && source[idx] <= 'z' ||
+				source[idx] >= 'A' && source[idx] <= 'Z' || source[idx] >= '0' && source[idx] <= '9') {
+				idx++
+			}
+			tokens = append(tokens, exprToken{'i', source[start:idx]})
+		case c >= '0' && c <= '9':
+			start := idx
+			for idx < len(source) && (source[idx] >= '0' && source[idx] <= '9' || source[idx] == '.') {
+				idx++
+			}
+			tokens = append(tokens, exprToken{'n', source[start:idx]})
+		case c == '"' || c == '\'':
+			end := idx + 1
+			for end < len(source) && source[end] != c {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, errors.New("expr: unterminated string")
+			}
+			literal := source[idx+1 : end]
+			if c == '\'' {
+				literal = strings.ReplaceAll(strings.ReplaceAll(literal, `"`, `\"`), `\'`, `'`)
+			}
+			value, err := strconv.Unquote(`"` + literal + `"`)
+			if err != nil {
+				return nil, errors.New("expr: invalid string " + source[idx:end+1])
+			}
+			tokens = append(tokens, exprToken{'s', value})
+			idx = end + 1
+		default:
+			if idx+1 < len(source) {
+				switch two := source[idx : idx+2]; two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					tokens = append(tokens, exprToken{'p', two})
+					idx += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[],.!<>", rune(c)) {
+				return nil, fmt.Errorf("expr: unexpected character %q", c)
+			}
+			tokens = append(tokens, exprToken{'p', string(c)})
+			idx++
+		}
+	}
+	return
+}
+
+// compileExpr parses the expression, the rules and routes keep the compiled ones
+func compileExpr(source string) (exprNode, error) {
+	tokens, err := tokenizeExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.tokens) {
+		return nil, errors.New("expr: unexpected " + p.tokens[p.pos].value)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek(value string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != 's' && p.tokens[p.pos].value == value
+}
+
+func (p *exprParser) accept(value string) bool {
+	if p.peek(value) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(value string) error {
+	if !p.accept(value) {
+		return errors.New("expr: expected " + value)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right exprNode
+		right, err = p.parseAnd()
+		left = logicalNode(left, right, true)
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseRelation()
+	for err == nil && p.accept("&&") {
+		var right exprNode
+		right, err = p.parseRelation()
+		left = logicalNode(left, right, false)
+	}
+	return left, err
+}
+
+// logicalNode short-circuits, so has() can guard the following conditions
+func logicalNode(left, right exprNode, or bool) exprNode {
+	return func(env *exprEnv) (interface{}, error) {
+		value, err := evalBool(left, env)
+		if err != nil || value == or {
+			return value, err
+		}
+		return evalBool(right, env)
+	}
+}
+
+func (p *exprParser) parseRelation() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			a, err := left(env)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(env)
+			if err != nil {
+				return nil, err
+			}
+			return compareValues(op, a, b)
+		}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			value, err := evalBool(node, env)
+			return !value, err
+		}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	for err == nil {
+		if p.accept("[") {
+			var key exprNode
+			key, err = p.parseOr()
+			if err == nil {
+				err = p.expect("]")
+			}
+			node = indexNode(node, key)
+		} else if p.accept(".") {
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != 'i' {
+				return nil, errors.New("expr: expected method name")
+			}
+			name := p.tokens[p.pos].value
+			p.pos++
+			if name == "matches" {
+				node, err = p.parseMatches(node)
+				continue
+			}
+			var args []exprNode
+			args, err = p.parseArgs()
+			if err == nil {
+				node, err = methodNode(name, node, args)
+			}
+		} else {
+			break
+		}
+	}
+	return node, err
+}
+
+func (p *exprParser) parseArgs() (args []exprNode, err error) {
+	if err = p.expect("("); err != nil {
+		return
+	}
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err = p.expect(","); err != nil {
+				return
+			}
+		}
+		var arg exprNode
+		if arg, err = p.parseOr(); err != nil {
+			return
+		}
+		args = append(args, arg)
+	}
+	return
+}
+
+// parseMatches compiles the pattern of matches() once, it has to be a string literal,
+// so the requests can't choose the compiled expressions
+func (p *exprParser) parseMatches(target exprNode) (exprNode, error) {
+	if p.pos+2 >= len(p.tokens) || !p.peek("(") || p.tokens[p.pos+1].kind != 's' ||
+		p.tokens[p.pos+2].kind != 'p' || p.tokens[p.pos+2].value != ")" {
+		return nil, errors.New("expr: matches() expects a string literal")
+	}
+	re, err := regexp.Compile(p.tokens[p.pos+1].value)
+	if err != nil {
+		return nil, errors.New("expr: invalid pattern of matches(): " + err.Error())
+	}
+	p.pos += 3
+
+	return func(env *exprEnv) (interface{}, error) {
+		value, err := evalString(target, env)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(value), nil
+	}, nil
+}
+
+func constNode(value interface{}) exprNode {
+	return func(*exprEnv) (interface{}, error) {
+		return value, nil
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("expr: unexpected end")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case 's':
+		return constNode(token.value), nil
+	case 'n':
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, errors.New("expr: invalid number " + token.value)
+		}
+		return constNode(number), nil
+	case 'i':
+		switch token.value {
+		case "true", "false":
+			return constNode(token.value == "true"), nil
+		}
+		if p.peek("(") {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return functionNode(token.value, args)
+		}
+		variable, ok := exprVariables[token.value]
+		if !ok {
+			return nil, errors.New("expr: unknown variable " + token.value)
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			return variable(env.r), nil
+		}, nil
+	}
+
+	switch token.value {
+	case "(":
+		node, err := p.parseOr()
+		if err == nil {
+			err = p.expect(")")
+		}
+		return node, err
+	case "[":
+		var items []exprNode
+		for !p.accept("]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			list := make([]interface{}, len(items))
+			for idx, item := range items {
+				value, err := item(env)
+				if err != nil {
+					return nil, err
+				}
+				list[idx] = value
+			}
+			return list, nil
+		}, nil
+	}
+	return nil, errors.New("expr: unexpected " + token.value)
+}
+
+var exprVariables = map[string]func(r *http.Request) interface{}{
+	"method": func(r *http.Request) interface{} { return r.Method },
+	"host":   func(r *http.Request) interface{} { return stripPort(r.Host) },
+	"path":   func(r *http.Request) interface{} { return r.URL.Path },
+	"uri":    func(r *http.Request) interface{} { return r.URL.RequestURI() },
+	"ja3":    func(r *http.Request) interface{} { return requestFingerprint(r) },
+	"scheme": func(r *http.Request) interface{} {
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	},
+	"remote_ip": func(r *http.Request) interface{} {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return ip
+		}
+		return r.RemoteAddr
+	},
+	"header": func(r *http.Request) interface{} {
+		return exprMap(func(key string) (string, bool) {
+			values, ok := r.Header[http.CanonicalHeaderKey(key)]
+			return strings.Join(values, ","), ok
+		})
+	},
+	"query": func(r *http.Request) interface{} {
+		query := r.URL.Query()
+		return exprMap(func(key string) (string, bool) {
+			values, ok := query[key]
+			return strings.Join(values, ","), ok
+		})
+	},
+	"cookie": func(r *http.Request) interface{} {
+		return exprMap(func(key string) (string, bool) {
+			cookie, err := r.Cookie(key)
+			if err != nil {
+				return "", false
+			}
+			return cookie.Value, true
+		})
+	},
+}
+
+func indexNode(node, key exprNode) exprNode {
+	return func(env *exprEnv) (interface{}, error) {
+		container, err := node(env)
+		if err != nil {
+			return nil, err
+		}
+		index, err := key(env)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := index.(string)
+		if !ok {
+			return nil, errors.New("expr: index has to be string")
+		}
+		lookup, ok := container.(exprMap)
+		if !ok {
+			return nil, errors.New("expr: only header, query and cookie can be indexed")
+		}
+		if value, ok := lookup(name); ok {
+			return value, nil
+		}
+		return nil, nil
+	}
+}
+
+func functionNode(name string, args []exprNode) (exprNode, error) {
+	switch name {
+	case "has":
+		if len(args) != 1 {
+			return nil, errors.New("expr: has() expects 1 argument")
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			value, err := args[0](env)
+			return value != nil, err
+		}, nil
+	case "size", "int":
+		if len(args) != 1 {
+			return nil, errors.New("expr: " + name + "() expects 1 argument")
+		}
+		return methodNode(name, args[0], nil)
+	case "cidr":
+		if len(args) != 2 {
+			return nil, errors.New("expr: cidr() expects 2 arguments")
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			ip, err := evalString(args[0], env)
+			if err != nil {
+				return nil, err
+			}
+			network, err := evalString(args[1], env)
+			if err != nil {
+				return nil, err
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, err
+			}
+			parsed := net.ParseIP(ip)
+			return parsed != nil && ipNet.Contains(parsed), nil
+		}, nil
+	}
+	return nil, errors.New("expr: unknown function " + name)
+}
+
+func methodNode(name string, target exprNode, args []exprNode) (exprNode, error) {
+	var fn func(value string, arg string) (interface{}, error)
+	switch name {
+	case "startsWith":
+		fn = func(value, arg string) (interface{}, error) { return strings.HasPrefix(value, arg), nil }
+	case "endsWith":
+		fn = func(value, arg string) (interface{}, error) { return strings.HasSuffix(value, arg), nil }
+	case "contains":
+		fn = func(value, arg string) (interface{}, error) { return strings.Contains(value, arg), nil }
+	case "lower":
+		fn = func(value, _ string) (interface{}, error) { return strings.ToLower(value), nil }
+	case "upper":
+		fn = func(value, _ string) (interface{}, error) { return strings.ToUpper(value), nil }
+	case "size":
+		fn = func(value, _ string) (interface{}, error) { return float64(len(value)), nil }
+	case "int":
+		fn = func(value, _ string) (interface{}, error) { return strconv.ParseFloat(strings.TrimSpace(value), 64) }
+	default:
+		return nil, errors.New("expr: unknown method " + name)
+	}
+
+	expected := 1
+	switch name {
+	case "lower", "upper", "size", "int":
+		expected = 0
+	}
+	if len(args) != expected {
+		return nil, fmt.Errorf("expr: %s() expects %d arguments", name, expected)
+	}
+
+	return func(env *exprEnv) (interface{}, error) {
+		value, err := evalString(target, env)
+		if err != nil {
+			return nil, err
+		}
+		arg := ""
+		if expected == 1 {
+			if arg, err = evalString(args[0], env); err != nil {
+				return nil, err
+			}
+		}
+		return fn(value, arg)
+	}, nil
+}
+
+func evalBool(node exprNode, env *exprEnv) (bool, error) {
+	value, err := node(env)
+	if err != nil {
+		return false, err
+	}
+	flag, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expr: expected bool, got %v", value)
+	}
+	return flag, nil
+}
+
+// evalString treats missing values as empty strings
+func evalString(node exprNode, env *exprEnv) (string, error) {
+	value, err := node(env)
+	if err != nil {
+		return "", err
+	}
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("expr: expected string, got %v", value)
+}
+
+func compareValues(op string, a, b interface{}) (interface{}, error) {
+	if op == "==" || op == "!=" {
+		for _, value := range []interface{}{a, b} {
+			switch value.(type) {
+			case exprMap, []interface{}:
+				return nil, errors.New("expr: header, query, cookie and lists can't be compared")
+			}
+		}
+	}
+
+	switch op {
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "in":
+		switch b := b.(type) {
+		case []interface{}:
+			for _, item := range b {
+				if item == a {
+					return true, nil
+				}
+			}
+			return false, nil
+		case exprMap:
+			key, ok := a.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = b(key)
+			return ok, nil
+		}
+		return nil, errors.New("expr: in expects list, header, query or cookie")
+	}
+
+	var cmp int
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return nil, errors.New("expr: can't compare number with other type")
+		}
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return nil, errors.New("expr: can't compare string with other type")
+		}
+		cmp = strings.Compare(a, b)
+	default:
+		return nil, fmt.Errorf("expr: can't compare %v", a)
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// evalExpr returns true if the expression holds for the request
+func evalExpr(node exprNode, r *http.Request) (bool, error) {
+	return evalBool(node, &exprEnv{r: r})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The external processor implements the service below, the messages are encoded by hand
+// to avoid depending on the gRPC and protobuf libraries:
+//
+//	service ExternalProcessor {
+//	  rpc Process(ProcessRequest) returns (ProcessResponse);
+//	}
+//	message Header { string name = 1; string value = 2; }
+//	message ProcessRequest {
+//	  string method = 1; string host = 2; string path = 3; repeated Header headers = 4;
+//	  string remote_addr = 5; bytes body = 6; bool body_truncated = 7;
+//	}
+//	message ProcessResponse {
+//	  repeated Header set_headers = 1; repeated string remove_headers = 2;
+//	  int32 status = 3; bytes body = 4; repeated Header response_headers = 5;
+//	}
+//
+// The non-zero status rejects the request with the body and response headers.
+const extProcMethod = "/auto_proxy.ExternalProcessor/Process"
+
+const (
+	ExtProcAllow = "allow"
+	ExtProcDeny  = "deny"
+)
+
+var extProcDuration = newHistogram("auto_proxy_ext_proc_duration_seconds",
+	"Duration of external processor calls", defaultBuckets, "host", "result")
+
+var extProcClients = struct {
+	list map[string]*http.Client
+	lock sync.Mutex
+}{list: make(map[string]*http.Client)}
+
+type extProcHeader struct {
+	name, value string
+}
+
+type extProcResponse struct {
+	setHeaders      []extProcHeader
+	removeHeaders   []string
+	status          int
+	body            []byte
+	responseHeaders []extProcHeader
+}
+
+// parseExtProcURL accepts grpc://host:port (h2c) and grpcs://host:port
+func parseExtProcURL(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	} else if (u.Scheme != "grpc" && u.Scheme != "grpcs") || u.Host == "" {
+		return "", errors.New("expected grpc://host:port or grpcs://host:port")
+	}
+	return value, nil
+}
+
+func extProcClient(target string) (*http.Client, string) {
+	u, _ := url.Parse(target)
+
+	extProcClients.lock.Lock()
+	defer extProcClients.lock.Unlock()
+
+	scheme := "https"
+	if u.Scheme == "grpc" {
+		scheme = "http"
+	}
+	client := extProcClients.list[target]
+	if client == nil {
+		transport := &http.Transport{
+			TLSClientConfig:     &tls.Config{},
+			TLSHandshakeTimeout: 10 * time.Second,
+			ForceAttemptHTTP2:   true,
+			Protocols:           new(http.Protocols),
+		}
+		if scheme == "http" {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		} else {
+			transport.Protocols.SetHTTP2(true)
+		}
+		client = &http.Client{Transport: transport}
+		extProcClients.list[target] = client
+	}
+	return client, scheme + "://" + u.Host + extProcMethod
+}
+
+func appendVarint(data []byte, field int, value uint64) []byte {
+	data = binary.AppendUvarint(data, uint64(field<<3))
+	return binary.AppendUvarint(data, value)
+}
+
+func appendBytes(data []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return data
+	}
+	data = binary.AppendUvarint(data, uint64(field<<3|2))
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendHeader(data []byte, field int, name, value string) []byte {
+	var header []byte
+	header = appendBytes(header, 1, []byte(name))
+	header = appendBytes(header, 2, []byte(value))
+	return appendBytes(data, field, header)
+}
+
+// readFields calls fn with the number and value of each field, the varints are passed as num
+func readFields(data []byte, fn func(field int, num uint64, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("ext-proc: invalid field")
+		}
+		data = data[n:]
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			num, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("ext-proc: invalid varint")
+			}
+			data = data[n:]
+			if err := fn(field, num, nil); err != nil {
+				return err
+			}
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errors.New("ext-proc: invalid length")
+			}
+			value := data[n : n+int(size)]
+			data = data[n+int(size):]
+			if err := fn(field, 0, value); err != nil {
+				return err
+			}
+		default:
+			return errors.New("ext-proc: unsupported wire type")
+		}
+	}
+	return nil
+}
+
+func readHeader(data []byte) (header extProcHeader, err error) {
+	err = readFields(data, func(field int, _ uint64, value []byte) error {
+		switch field {
+		case 1:
+			header.name = string(value)
+		case 2:
+			header.value = string(value)
+		}
+		return nil
+	})
+	return
+}
+
+func encodeProcessRequest(r *http.Request, body []byte, truncated bool) []byte {
+	var data []byte
+	data = appendBytes(data, 1, []byte(r.Method))
+	data = appendBytes(data, 2, []byte(r.Host))
+	data = appendBytes(data, 3, []byte(r.URL.RequestURI()))
+	for name, values := range r.Header {
+		for _, value := range values {
+			data = appendHeader(data, 4, name, value)
+		}
+	}
+	data = appendBytes(data, 5, []byte(r.RemoteAddr))
+	data = appendBytes(data, 6, body)
+	if truncated {
+		data = appendVarint(data, 7, 1)
+	}
+	return data
+}
+
+func decodeProcessResponse(data []byte) (resp extProcResponse, err error) {
+	err = readFields(data, func(field int, num uint64, value []byte) error {
+		switch field {
+		case 1, 5:
+			header, err := readHeader(value)
+			if err != nil {
+				return err
+			}
+			if field == 1 {
+				resp.setHeaders = append(resp.setHeaders, header)
+			} else {
+				resp.responseHeaders = append(resp.responseHeaders, header)
+			}
+		case 2:
+			resp.removeHeaders = append(resp.removeHeaders, string(value))
+		case 3:
+			resp.status = int(int32(num))
+		case 4:
+			resp.body = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	return
+}
+
+// callExtProc makes the unary gRPC call, the message is prefixed by compression flag and length
+func callExtProc(ctx context.Context, target string, message []byte) ([]byte, error) {
+	client, uri := extProcClient(target)
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ext-proc: unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The trailers-only responses carry the status in headers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return nil, fmt.Errorf("ext-proc: grpc status %s %s", status, message)
+	}
+
+	if len(data) < 5 {
+		return nil, errors.New("ext-proc: missing response message")
+	} else if data[0] != 0 {
+		return nil, errors.New("ext-proc: compressed responses are not supported")
+	}
+	size := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < size {
+		return nil, errors.New("ext-proc: truncated response message")
+	}
+	return data[5 : 5+size], nil
+}
+
+// readExtProcBody reads up to limit bytes of body, the request still receives the whole body
+func readExtProcBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody || limit <= 0 {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	truncated := int64(len(body)) > limit
+	if truncated {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		body = body[:limit]
+	} else {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return body, truncated, nil
+}
+
+// externalProcess lets the external processor of route mutate or reject the request,
+// it returns false if the request was answered
+func externalProcess(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if route.ExtProc == "" {
+		return true
+	}
+	host := stripPort(r.Host)
+	start := time.Now()
+
+	fail := func(err error) bool {
+		extProcDuration.Observe(time.Since(start).Seconds(), host, "error")
+		if route.ExtProcFailure == ExtProcAllow {
+			logrus.WithField("vhost", host).WithError(err).Warningln("External processor failed, passing request")
+			return true
+		}
+		serveError(w, r, ErrorExternalProcessor, "external processor failed for "+r.Host)
+		return false
+	}
+
+	body, truncated, err := readExtProcBody(r, route.ExtProcBody)
+	if err != nil {
+		serveError(w, r, ErrorClientCanceled, err.Error())
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), route.ExtProcTimeout)
+	defer cancel()
+	data, err := callExtProc(ctx, route.ExtProc, encodeProcessRequest(r, body, truncated))
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := decodeProcessResponse(data)
+	if err == nil && resp.status != 0 && (resp.status < 100 || resp.status > 599) {
+		err = fmt.Errorf("ext-proc: invalid status %d", resp.status)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if resp.status != 0 {
+		extProcDuration.Observe(time.Since(start).Seconds(), host, "rejected")
+		for _, header := range resp.responseHeaders {
+			w.Header().Add(header.name, header.value)
+		}
+		w.WriteHeader(resp.status)
+		w.Write(resp.body)
+		return false
+	}
+
+	extProcDuration.Observe(time.Since(start).Seconds(), host, "passed")
+	for _, name := range resp.removeHeaders {
+		r.Header.Del(name)
+	}
+	for _, header := range resp.setHeaders {
+		r.Header.Set(header.name, header.value)
+	}
+	for _, header := range resp.responseHeaders {
+		w.Header().Add(header.name, header.value)
+	}
+	return true
+}
+
+func parseExtProcFailure(value string) (string, error) {
+	if value != ExtProcAllow && value != ExtProcDeny {
+		return "", errors.New("expected allow or deny")
+	}
+	return value, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultFaultTTL = 15 * time.Minute
+	maxFaultTTL     = 24 * time.Hour
+	maxFaultDelay   = time.Minute
+)
+
+var injectedFaults = newCounter("auto_proxy_injected_faults_total",
+	"Number of requests failed or delayed by the fault injected into host", "host", "fault")
+
+// Fault fails the given percentages of requests to host during its time window, so clients can be tested
+// for resilience against the real edge
+type Fault struct {
+	hostEntry
+	AbortPercent float64   `json:"abortPercent,omitempty"`
+	AbortStatus  int       `json:"abortStatus,omitempty"`
+	Delay        string    `json:"delay,omitempty"`
+	DelayPercent float64   `json:"delayPercent,omitempty"`
+	DropPercent  float64   `json:"dropPercent,omitempty"`
+	Start        time.Time `json:"start,omitempty"`
+	TTL          string    `json:"ttl,omitempty"`
+
+	delay time.Duration
+}
+
+var faults = hostRegistry[*Fault]{
+	name:     "fault",
+	newEntry: func() *Fault { return &Fault{} },
+	added:    "Fault injected into host",
+	removed:  "Injected fault removed",
+	expired:  "Injected fault expired",
+}
+
+func (f *Fault) compile() (err error) {
+	for _, percent := range []float64{f.AbortPercent, f.DelayPercent, f.DropPercent} {
+		if percent < 0 || percent > 100 {
+			return errors.New("fault: expected percent from 0 to 100")
+		}
+	}
+	if f.AbortStatus == 0 {
+		f.AbortStatus = http.StatusInternalServerError
+	} else if f.AbortStatus < 400 || f.AbortStatus > 599 {
+		return errors.New("fault: expected abortStatus from 400 to 599")
+	}
+	if f.Delay != "" {
+		f.delay, err = time.ParseDuration(f.Delay)
+		if err != nil || f.delay <= 0 || f.delay > maxFaultDelay {
+			return errors.New("fault: expected delay up to 1m")
+		}
+		if f.DelayPercent == 0 {
+			f.DelayPercent = 100
+		}
+	}
+	if f.AbortPercent == 0 && f.DropPercent == 0 && f.delay == 0 {
+		return errors.New("fault: expected abortPercent, delay or dropPercent")
+	}
+
+	ttl := defaultFaultTTL
+	if f.TTL != "" {
+		ttl, err = time.ParseDuration(f.TTL)
+		if err != nil || ttl <= 0 || ttl > maxFaultTTL {
+			return errors.New("fault: expected ttl up to 24h")
+		}
+	}
+	f.Created = time.Now()
+	if f.Start.IsZero() || f.Start.Before(f.Created) {
+		f.Start = f.Created
+	} else if f.Start.After(f.Created.Add(maxFaultTTL)) {
+		return errors.New("fault: expected start within 24h")
+	}
+	f.Expires = f.Start.Add(ttl)
+	return nil
+}
+
+func (f *Fault) logFields() logrus.Fields {
+	return logrus.Fields{"abort": f.AbortPercent, "delay": f.Delay, "drop": f.DropPercent, "start": f.Start}
+}
+
+// apply returns the route unchanged, the fault is injected into its requests
+func (f *Fault) apply(route *Route) *Route {
+	return route
+}
+
+func (f *Fault) active(now time.Time) bool {
+	return !now.Before(f.Start) && now.Before(f.Expires)
+}
+
+func rollPercent(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// Inject delays, drops or fails the request by the active fault of host, it returns false once responded.
+// The dropped connection aborts the handler.
+func injectFault(w *loggingResponseWriter, r *http.Request, profile string, route *Route) bool {
+	fault, ok := faults.Get(profile, route.VirtualHost)
+	if !ok || !fault.active(time.Now()) {
+		return true
+	}
+
+	if rollPercent(fault.DelayPercent) {
+		injectedFaults.Inc(route.VirtualHost, "delay")
+		select {
+		case <-time.After(fault.delay):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	if rollPercent(fault.DropPercent) {
+		injectedFaults.Inc(route.VirtualHost, "drop")
+		w.Message = "fault: dropped connection"
+		panic(http.ErrAbortHandler)
+	}
+	if rollPercent(fault.AbortPercent) {
+		injectedFaults.Inc(route.VirtualHost, "abort")
+		w.Message = "fault: aborted"
+		serveErrorStatus(w, r, ErrorFaultInjected, fault.AbortStatus,
+			"fault injected into "+route.VirtualHost+" with status "+strconv.Itoa(fault.AbortStatus))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var flappingContainers = newGauge("auto_proxy_flapping_containers",
+	"Number of crash-looping containers with suppressed routes")
+
+type flappingContainer struct {
+	ID        string
+	Name      string
+	Deaths    int
+	LastDeath time.Time
+	HeldUntil time.Time
+	holdDown  backoff
+	died      []time.Time
+}
+
+// flapDetector suppresses routes of crash-looping containers with exponential hold-down
+type flapDetector struct {
+	list     map[string]*flappingContainer
+	released bool
+	lock     sync.Mutex
+}
+
+var restartStorms flapDetector
+
+// Died records the death of container and starts the hold-down if it dies too often
+func (d *flapDetector) Died(id, name string) {
+	if *flapThreshold <= 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.list == nil {
+		d.list = make(map[string]*flappingContainer)
+	}
+	container := d.list[id]
+	if container == nil {
+		container = &flappingContainer{
+			ID:       id,
+			holdDown: backoff{Min: *flapHoldDown, Max: *flapHoldDownMax},
+		}
+		d.list[id] = container
+	}
+
+	now := time.Now()
+	container.Name = name
+	container.Deaths++
+	container.LastDeath = now
+	container.died = append(container.died, now)
+	for len(container.died) > 0 && now.Sub(container.died[0]) > *flapWindow {
+		container.died = container.died[1:]
+	}
+
+	if len(container.died) >= *flapThreshold && now.After(container.HeldUntil) {
+		container.HeldUntil = now.Add(container.holdDown.Next())
+		container.died = nil
+		logrus.WithField("name", name).WithField("id", id[:12]).WithField("until", container.HeldUntil).
+			Warningln("Container is restarting too often, suppressing its routes")
+	}
+}
+
+// Suppressed returns true if the routes of container should not be added
+func (d *flapDetector) Suppressed(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	container := d.list[id]
+	return container != nil && time.Now().Before(container.HeldUntil)
+}
+
+// Released returns true once some hold-down ended and routes have to be rebuilt
+func (d *flapDetector) Released() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	released := false
+	for id, container := range d.list {
+		if !container.HeldUntil.IsZero() && now.After(container.HeldUntil) {
+			container.HeldUntil = time.Time{}
+			released = true
+		}
+
+		// Forget containers which are stable for long enough, so the hold-down starts from minimum again
+		if container.HeldUntil.IsZero() && now.Sub(container.LastDeath) > *flapHoldDownMax {
+			delete(d.list, id)
+		}
+	}
+	return released
+}
+
+func (d *flapDetector) List() (list []flappingContainer) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, container := range d.list {
+		list = append(list, *container)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return
+}
+
+func (d *flapDetector) Collect() {
+	count := 0
+	for _, container := range d.List() {
+		if time.Now().Before(container.HeldUntil) {
+			count++
+		}
+	}
+	flappingContainers.Set(float64(count))
+}
+
+func (a *adminAPI) getFlapping(w http.ResponseWriter, r *http.Request) {
+	list := restartStorms.List()
+	if list == nil {
+		list = []flappingContainer{}
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Header combinations expected by upstream frameworks to detect the original scheme, host and port
+const (
+	ForwardedDefault = ""
+	ForwardedRails   = "rails"
+	ForwardedDjango  = "django"
+	ForwardedExpress = "express"
+	ForwardedRFC7239 = "rfc7239"
+	ForwardedAll     = "all"
+)
+
+func isValidForwarded(value string) bool {
+	switch value {
+	case ForwardedDefault, ForwardedRails, ForwardedDjango, ForwardedExpress, ForwardedRFC7239, ForwardedAll:
+		return true
+	}
+	return false
+}
+
+// forwardedFor quotes IPv6 addresses as required by RFC 7239
+func forwardedFor(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// setForwardedHeaders replaces the headers possibly sent by client with the ones describing the original request
+func setForwardedHeaders(r *http.Request, route *Route) {
+	if route.Forwarded == ForwardedDefault {
+		return
+	}
+
+	proto, port := "http", "80"
+	if r.TLS != nil {
+		proto, port = "https", "443"
+	}
+	host := r.Host
+	if h, p, err := net.SplitHostPort(r.Host); err == nil {
+		host, port = h, p
+	}
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	mode := route.Forwarded
+	all := mode == ForwardedAll
+
+	r.Header.Set("X-Forwarded-Proto", proto)
+
+	// Express reads the port from X-Forwarded-Host, the others use X-Forwarded-Port
+	if mode == ForwardedExpress {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	} else {
+		r.Header.Set("X-Forwarded-Host", host)
+		r.Header.Set("X-Forwarded-Port", port)
+	}
+
+	// Rack also checks X-Forwarded-Ssl and X-Forwarded-Scheme
+	if mode == ForwardedRails || all {
+		r.Header.Set("X-Forwarded-Scheme", proto)
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Ssl", "on")
+		} else {
+			r.Header.Set("X-Forwarded-Ssl", "off")
+		}
+	}
+
+	if mode == ForwardedRFC7239 || all {
+		forwarded := "proto=" + proto + `;host="` + r.Host + `"`
+		if clientIP != "" {
+			forwarded = "for=" + forwardedFor(clientIP) + ";" + forwarded
+		}
+		r.Header.Set("Forwarded", forwarded)
+	}
+}
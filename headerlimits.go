@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// checkHeaderLimits returns the exceeded limit of auto-proxy.headers.max-* labels,
+// each header line counts separately and its size is the name with the value
+func checkHeaderLimits(r *http.Request, route *Route) string {
+	if route.HeadersMaxSize <= 0 && route.HeadersMaxTotal <= 0 && route.HeadersMaxCount <= 0 {
+		return ""
+	}
+
+	count, total := 0, 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			size := len(name) + len(value)
+			if route.HeadersMaxSize > 0 && size > route.HeadersMaxSize {
+				return fmt.Sprintf("header %s is larger than %d bytes", name, route.HeadersMaxSize)
+			}
+			count++
+			total += size + len(": \r\n")
+		}
+	}
+
+	if route.HeadersMaxCount > 0 && count > route.HeadersMaxCount {
+		return fmt.Sprintf("more than %d headers", route.HeadersMaxCount)
+	} else if route.HeadersMaxTotal > 0 && total > route.HeadersMaxTotal {
+		return fmt.Sprintf("headers are larger than %d bytes", route.HeadersMaxTotal)
+	}
+	return ""
+}
+
+// limitHeaders responds with 431 to requests exceeding the header limits of route
+func limitHeaders(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	message := checkHeaderLimits(r, route)
+	if message == "" {
+		return true
+	}
+	serveError(w, r, ErrorHeadersTooLarge, message)
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	requestHeaderLabel  = "headers.request."
+	responseHeaderLabel = "headers.response."
+)
+
+// parseHeaderLabel reads headers.request.<name> and headers.response.<name>, the empty value removes the header
+func (r *RouteBuilder) parseHeaderLabel(key, value string) bool {
+	switch {
+	case strings.HasPrefix(key, requestHeaderLabel):
+		if r.RequestHeaders == nil {
+			r.RequestHeaders = make(map[string]string)
+		}
+		r.RequestHeaders[http.CanonicalHeaderKey(strings.TrimPrefix(key, requestHeaderLabel))] = value
+	case strings.HasPrefix(key, responseHeaderLabel):
+		if r.ResponseHeaders == nil {
+			r.ResponseHeaders = make(map[string]string)
+		}
+		r.ResponseHeaders[http.CanonicalHeaderKey(strings.TrimPrefix(key, responseHeaderLabel))] = value
+	case strings.HasPrefix(key, ruleLabel):
+		return r.parseRuleLabel(strings.TrimPrefix(key, ruleLabel), value)
+	case strings.HasPrefix(key, middlewareOptionLabel):
+		return r.parseMiddlewareLabel(strings.TrimPrefix(key, middlewareOptionLabel), value)
+	case strings.HasPrefix(key, tlsHeaderLabel):
+		return r.parseTLSHeaderLabel(strings.TrimPrefix(key, tlsHeaderLabel), value)
+	default:
+		return false
+	}
+	return true
+}
+
+func setHeaders(header http.Header, headers map[string]string) {
+	for name, value := range headers {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+}
+
+func (r *Route) modifyResponse(resp *http.Response) error {
+	if err := r.decodeUpstreamGzip(resp); err != nil {
+		return err
+	}
+	setHeaders(resp.Header, r.ResponseHeaders)
+	r.disableChunking(resp)
+	return nil
+}
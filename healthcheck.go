@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The consecutive failed checks marking the upstream down
+const healthFailThreshold = 3
+
+var healthChecks = newCounter("auto_proxy_health_checks_total",
+	"Number of active health checks of upstreams", "host", "upstream", "result")
+var healthRestarts = newCounter("auto_proxy_health_restarts_total",
+	"Number of containers restarted because of failing health checks", "container", "result")
+
+type healthEvent struct {
+	Event    string    `json:"event"`
+	Host     string    `json:"host"`
+	Upstream string    `json:"upstream"`
+	Since    time.Time `json:"since"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// upstreamHealth tracks the active checks of upstream, it is kept in upstreamState
+type upstreamHealth struct {
+	checking  bool
+	checkedAt time.Time
+	failures  int
+	lastError string
+	downSince time.Time
+	acted     bool
+}
+
+// restartBudget limits the restarts of each container within -health-restart-window
+type restartBudget struct {
+	list map[string][]time.Time
+	lock sync.Mutex
+}
+
+var restartBudgets restartBudget
+
+func (b *restartBudget) Take(container string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.list == nil {
+		b.list = make(map[string][]time.Time)
+	}
+	now := time.Now()
+	restarts := b.list[container]
+	for len(restarts) > 0 && now.Sub(restarts[0]) > *healthRestartWindow {
+		restarts = restarts[1:]
+	}
+	if len(restarts) >= *healthRestartBudget {
+		b.list[container] = restarts
+		return false
+	}
+	b.list[container] = append(restarts, now)
+	return true
+}
+
+// healthy is false once the upstream failed the active checks, the down upstreams don't receive traffic
+func (u *upstreamState) healthy() bool {
+	return u.health.downSince.IsZero()
+}
+
+// dueHealthCheck marks the upstream as being checked if its check interval elapsed
+func (s *upstreamStates) dueHealthCheck(route *Route, upstream *Upstream, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	health := &s.get(upstream).health
+	if health.checking || now.Sub(health.checkedAt) < route.HealthInterval {
+		return false
+	}
+	health.checking = true
+	health.checkedAt = now
+	return true
+}
+
+// healthChecked records the result and returns the event if the upstream state changed or it is acted upon
+func (s *upstreamStates) healthChecked(route *Route, upstream *Upstream, err error) *healthEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	health := &s.get(upstream).health
+	health.checking = false
+
+	event := &healthEvent{Host: route.VirtualHost, Upstream: upstream.String()}
+	if err == nil {
+		wasDown := !health.downSince.IsZero()
+		event.Since, event.Failures = health.downSince, health.failures
+		health.failures = 0
+		health.lastError = ""
+		health.downSince = time.Time{}
+		health.acted = false
+		if wasDown {
+			event.Event = "up"
+			return event
+		}
+		return nil
+	}
+
+	health.failures++
+	health.lastError = err.Error()
+	event.Failures, event.Error = health.failures, health.lastError
+	if health.failures == healthFailThreshold {
+		health.downSince = now
+		event.Event, event.Since = "down", now
+		return event
+	} else if !health.downSince.IsZero() && !health.acted && now.Sub(health.downSince) >= route.HealthDownAfter {
+		health.acted = true
+		event.Event, event.Since = "dead", health.downSince
+		return event
+	}
+	return nil
+}
+
+func checkUpstreamHealth(route *Route, upstream Upstream) error {
+	proto := upstream.Scheme()
+	req, err := http.NewRequest("GET", proto+"://"+upstream.Host()+route.HealthPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = strings.TrimPrefix(route.VirtualHost, "*.")
+	req.Header.Set("User-Agent", "auto-proxy health-check")
+
+	client := http.Client{
+		Transport: upstream.Transport(),
+		Timeout:   route.HealthTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func runHealthCheck(route *Route, upstream Upstream) {
+	err := checkUpstreamHealth(route, upstream)
+	if err != nil {
+		healthChecks.Inc(route.VirtualHost, upstream.Container, "failed")
+	} else {
+		healthChecks.Inc(route.VirtualHost, upstream.Container, "ok")
+	}
+
+	event := upstreamsState.healthChecked(route, &upstream, err)
+	if event == nil {
+		return
+	}
+
+	log := logrus.WithField("host", route.VirtualHost).WithField("upstream", upstream.String())
+	switch event.Event {
+	case "up":
+		log.Infoln("Upstream passes health checks again")
+	case "down":
+		log.WithError(err).Warningln("Upstream failed health checks, marking it down")
+	case "dead":
+		log.WithField("since", event.Since).Errorln("Upstream is down for too long")
+		if route.HealthRestart {
+			restartUnhealthy(upstream)
+		}
+	}
+
+	if *healthWebhook != "" {
+		go func() {
+			if err := postWebhook(*healthWebhook, event); err != nil {
+				log.WithError(err).Warningln("Failed to send health webhook")
+			}
+		}()
+	}
+}
+
+// restartUnhealthy restarts the container of upstream unless it used the restart budget
+func restartUnhealthy(upstream Upstream) {
+	log := logrus.WithField("container", upstream.Container)
+	if upstream.Daemon != "" {
+		log = log.WithField("daemon", upstream.Daemon)
+	}
+
+	// The routes of files and KV don't have containers
+	if !strings.HasPrefix(upstream.Container, "/") {
+		return
+	} else if !restartBudgets.Take(upstream.Container) {
+		healthRestarts.Inc(upstream.Container, "budget")
+		log.Warningln("Container exhausted the restart budget, not restarting")
+		return
+	}
+
+	go func() {
+		client, err := dockerClientOf(&upstream)
+		if err == nil {
+			err = client.RestartContainer(strings.TrimPrefix(upstream.Container, "/"), 10)
+		}
+		if err != nil {
+			healthRestarts.Inc(upstream.Container, "error")
+			log.WithError(err).Errorln("Failed to restart unhealthy container")
+			return
+		}
+		healthRestarts.Inc(upstream.Container, "ok")
+		log.Warningln("Restarted unhealthy container")
+	}()
+}
+
+// watchHealth sends active health checks to upstreams of routes with auto-proxy.health.path
+func (a *theApp) watchHealth() {
+	for {
+		time.Sleep(time.Second)
+
+		a.lock.RLock()
+		routes := a.routes
+		a.lock.RUnlock()
+
+		now := time.Now()
+		for _, route := range routes {
+			if route.HealthPath == "" {
+				continue
+			}
+			for _, upstream := range route.Servers {
+				if upstreamsState.dueHealthCheck(route, &upstream, now) {
+					go runHealthCheck(route, upstream)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hostEntry is the state of virtual host set with admin API, it is forgotten once expired
+type hostEntry struct {
+	Host    string    `json:"host"`
+	Profile string    `json:"profile,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (e *hostEntry) entry() *hostEntry {
+	return e
+}
+
+// key is the key of route in the joined routes of all profiles
+func (e *hostEntry) key() string {
+	return hostKey(e.Profile, e.Host)
+}
+
+func hostKey(profile, host string) string {
+	if profile == "" {
+		return host
+	}
+	return profile + "/" + host
+}
+
+// expiringEntry is the fault or upstream override of host
+type expiringEntry interface {
+	entry() *hostEntry
+	compile() error
+	logFields() logrus.Fields
+
+	// apply returns the route as served with the entry, the audit log shows it as after
+	apply(route *Route) *Route
+}
+
+// hostRegistry keeps one expiring entry per virtual host of profile, the admin API handlers are shared by all kinds
+type hostRegistry[E expiringEntry] struct {
+	name     string
+	newEntry func() E
+
+	// The messages logged when the entry is set, removed with admin API or expired
+	added, removed, expired string
+
+	list map[string]E
+	lock sync.RWMutex
+}
+
+// Set replaces the entry of host, it returns the replaced one
+func (l *hostRegistry[E]) Set(entry E) (E, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.list == nil {
+		l.list = make(map[string]E)
+	}
+	previous, ok := l.list[entry.entry().key()]
+	l.list[entry.entry().key()] = entry
+	return previous, ok && time.Now().Before(previous.entry().Expires)
+}
+
+// Get returns the entry of host in profile which didn't expire yet
+func (l *hostRegistry[E]) Get(profile, host string) (E, bool) {
+	l.lock.RLock()
+	entry, ok := l.list[hostKey(profile, host)]
+	l.lock.RUnlock()
+
+	if ok && !time.Now().Before(entry.entry().Expires) {
+		var none E
+		return none, false
+	}
+	return entry, ok
+}
+
+// Remove forgets the entry of host, the expired ones are left to watchExpired
+func (l *hostRegistry[E]) Remove(profile, host string) (E, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, ok := l.list[hostKey(profile, host)]
+	if !ok || !time.Now().Before(entry.entry().Expires) {
+		var none E
+		return none, false
+	}
+	delete(l.list, hostKey(profile, host))
+	return entry, true
+}
+
+// List returns the entries which didn't expire yet
+func (l *hostRegistry[E]) List() []E {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	list := []E{}
+	for _, entry := range l.list {
+		if time.Now().Before(entry.entry().Expires) {
+			list = append(list, entry)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].entry().key() < list[j].entry().key()
+	})
+	return list
+}
+
+// compileRestored compiles the entries of snapshot keeping their time window, the expired ones are skipped
+func (l *hostRegistry[E]) compileRestored(list []E) ([]E, error) {
+	var compiled []E
+	for _, entry := range list {
+		restored := *entry.entry()
+		if profileApps[restored.Profile] == nil {
+			return nil, errors.New("restore: unknown profile " + restored.Profile + " of " + l.name)
+		} else if err := entry.compile(); err != nil {
+			return nil, err
+		}
+		entry.entry().Created, entry.entry().Expires = restored.Created, restored.Expires
+		if time.Now().Before(restored.Expires) {
+			compiled = append(compiled, entry)
+		}
+	}
+	return compiled, nil
+}
+
+// restore replaces all entries with the compiled ones of snapshot, the changes are audited
+func (l *hostRegistry[E]) restore(trigger string, list []E) {
+	l.lock.Lock()
+	previous := l.list
+	l.list = make(map[string]E, len(list))
+	for _, entry := range list {
+		l.list[entry.entry().key()] = entry
+	}
+	l.lock.Unlock()
+
+	for _, entry := range previous {
+		if time.Now().Before(entry.entry().Expires) {
+			route := findProfileRoute(entry.entry().Profile, entry.entry().Host)
+			l.audit(trigger, "removed", entry, entry.apply(route), route)
+		}
+	}
+	for _, entry := range list {
+		route := findProfileRoute(entry.entry().Profile, entry.entry().Host)
+		l.audit(trigger, "set", entry, route, entry.apply(route))
+	}
+}
+
+// watchExpired forgets the expired entries, so the end of each one is logged and audited
+func (l *hostRegistry[E]) watchExpired() {
+	for {
+		time.Sleep(time.Second)
+
+		var expired []E
+		l.lock.Lock()
+		for key, entry := range l.list {
+			if !time.Now().Before(entry.entry().Expires) {
+				expired = append(expired, entry)
+				delete(l.list, key)
+			}
+		}
+		l.lock.Unlock()
+
+		for _, entry := range expired {
+			logrus.WithField("host", entry.entry().Host).WithField("profile", entry.entry().Profile).Infoln(l.expired)
+			route := findProfileRoute(entry.entry().Profile, entry.entry().Host)
+			l.audit("ttl expired", "removed", entry, entry.apply(route), route)
+		}
+	}
+}
+
+// audit records the change of served route, the route is nil once it is gone
+func (l *hostRegistry[E]) audit(trigger, action string, entry E, before, after *Route) {
+	auditLog.RecordDetails("admin", trigger, RouteChange{
+		Host:   entry.entry().Host,
+		Action: l.name + " " + action,
+		Before: before,
+		After:  after,
+	}, entry)
+}
+
+func findProfileRoute(profile, host string) *Route {
+	app := profileApps[profile]
+	if app == nil {
+		return nil
+	}
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	return app.routes.Find(host)
+}
+
+// put sets the entry of body for the route host of ?profile=
+func (l *hostRegistry[E]) put(a *adminAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app := a.profileApp(w, r)
+		if app == nil {
+			return
+		}
+		route := findProfileRoute(app.profile, r.PathValue("host"))
+		if route == nil {
+			http.Error(w, "unknown host", http.StatusNotFound)
+			return
+		}
+
+		entry := l.newEntry()
+		err := json.NewDecoder(r.Body).Decode(entry)
+		entry.entry().Host = route.VirtualHost
+		entry.entry().Profile = app.profile
+		if err == nil {
+			err = entry.compile()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		before := route
+		if previous, ok := l.Set(entry); ok {
+			before = previous.apply(route)
+		}
+		logrus.WithFields(entry.logFields()).WithField("host", entry.entry().Host).WithField("profile", app.profile).
+			WithField("expires", entry.entry().Expires).WithField("reason", entry.entry().Reason).Warningln(l.added)
+		l.audit(adminTrigger(r), "set", entry, before, entry.apply(route))
+		writeJSON(w, entry)
+	}
+}
+
+func (l *hostRegistry[E]) delete(a *adminAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app := a.profileApp(w, r)
+		if app == nil {
+			return
+		}
+		host := r.PathValue("host")
+		route := findProfileRoute(app.profile, host)
+		if route != nil {
+			host = route.VirtualHost
+		}
+
+		entry, ok := l.Remove(app.profile, host)
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s %s not found", l.name, host), http.StatusNotFound)
+			return
+		}
+		logrus.WithField("host", host).WithField("profile", app.profile).Infoln(l.removed)
+		l.audit(adminTrigger(r), "removed", entry, entry.apply(route), route)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (l *hostRegistry[E]) get(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, l.List())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ImportCertbot = "certbot"
+	ImportTraefik = "traefik"
+	ImportPEM     = "pem"
+)
+
+// importedCertificate is a certificate chain with its private key found in other tool's store
+type importedCertificate struct {
+	source string
+	cert   []byte
+	key    []byte
+}
+
+type traefikCertificate struct {
+	Certificate []byte
+	Key         []byte
+}
+
+type traefikStore struct {
+	Certificates []traefikCertificate
+}
+
+// readCertbot reads <live dir>/<name>/fullchain.pem and privkey.pem
+func readCertbot(directory string) (list []importedCertificate, err error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		source := filepath.Join(directory, entry.Name())
+		cert, err := ioutil.ReadFile(filepath.Join(source, "fullchain.pem"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(filepath.Join(source, "privkey.pem"))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, importedCertificate{source: source, cert: cert, key: key})
+	}
+	return
+}
+
+// readTraefik reads acme.json of traefik v1 (single store) or v2+ (store per resolver)
+func readTraefik(fileName string) (list []importedCertificate, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolvers map[string]json.RawMessage
+	err = json.Unmarshal(data, &resolvers)
+	if err != nil {
+		return nil, err
+	}
+
+	var stores []traefikStore
+	if _, ok := resolvers["Certificates"]; ok {
+		resolvers = map[string]json.RawMessage{"": data}
+	}
+	for name, resolver := range resolvers {
+		var store traefikStore
+		if err := json.Unmarshal(resolver, &store); err != nil {
+			return nil, errors.New("import: invalid traefik resolver " + name + ": " + err.Error())
+		}
+		stores = append(stores, store)
+	}
+
+	for _, store := range stores {
+		for _, certificate := range store.Certificates {
+			list = append(list, importedCertificate{source: fileName, cert: certificate.Certificate, key: certificate.Key})
+		}
+	}
+	return
+}
+
+// readPEMBundle reads file with certificate chain and private key
+func readPEMBundle(fileName string) ([]importedCertificate, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := importedCertificate{source: fileName}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			imported.cert = append(imported.cert, pem.EncodeToMemory(block)...)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			imported.key = pem.EncodeToMemory(block)
+		}
+	}
+	if imported.cert == nil || imported.key == nil {
+		return nil, errors.New("import: " + fileName + " has to contain certificate and private key")
+	}
+	return []importedCertificate{imported}, nil
+}
+
+func readImport(source string) ([]importedCertificate, error) {
+	kindPath := strings.SplitN(source, ":", 2)
+	if len(kindPath) != 2 || kindPath[1] == "" {
+		return nil, errors.New("import: expected certbot:<dir>, traefik:<file> or pem:<file>, got " + source)
+	}
+
+	switch kindPath[0] {
+	case ImportCertbot:
+		return readCertbot(kindPath[1])
+	case ImportTraefik:
+		return readTraefik(kindPath[1])
+	case ImportPEM:
+		return readPEMBundle(kindPath[1])
+	default:
+		return nil, errors.New("import: unknown source " + kindPath[0])
+	}
+}
+
+// store writes the certificate for each of its names, the existing certificates are kept
+func (i importedCertificate) store(directory string) (int, error) {
+	pair, err := tls.X509KeyPair(i.cert, i.key)
+	if err != nil {
+		return 0, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return 0, errors.New("import: certificate expired")
+	}
+
+	keyBlock, _ := pem.Decode(i.key)
+	keyData, err := encryptPEM(keyBlock)
+	if err != nil {
+		return 0, err
+	}
+
+	keyType := KeyRSA
+	if leaf.PublicKeyAlgorithm == x509.ECDSA {
+		keyType = KeyECDSA
+	}
+
+	names := leaf.DNSNames
+	if len(names) == 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	// The certificates are stored by exact name, the wildcard isn't valid for its apex
+	var exact []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, "*.") {
+			exact = append(exact, name)
+		}
+	}
+	if len(exact) == 0 {
+		return 0, errors.New("import: wildcard-only certificates are not supported")
+	}
+
+	imported := 0
+	for _, name := range exact {
+		certificate := NewCertificate(directory, name, keyType)
+		if _, err := os.Stat(certificate.CertificateFile); err == nil {
+			certificate.log().Debugln("Certificate already exists, skipping import.")
+			continue
+		}
+
+		err = ioutil.WriteFile(certificate.KeyFile, keyData, 0600)
+		if err != nil {
+			return imported, err
+		}
+		err = ioutil.WriteFile(certificate.CertificateFile, i.cert, 0600)
+		if err != nil {
+			return imported, err
+		}
+		if err := certificate.publish(); err != nil {
+			certificate.log().WithError(err).Warningln("Failed to publish certificate to shared store")
+		}
+		certificate.log().WithField("source", i.source).WithField("expires", leaf.NotAfter).Infoln("Imported certificate.")
+		imported++
+	}
+	return imported, nil
+}
+
+// importCertificates copies certificates of other tools to the certs directory,
+// so the migration doesn't request them again
+func importCertificates(sources, directory string) error {
+	imported := 0
+	for _, source := range strings.Split(sources, ",") {
+		if source == "" {
+			continue
+		}
+		list, err := readImport(source)
+		if err != nil {
+			return err
+		}
+		for _, certificate := range list {
+			count, err := certificate.store(directory)
+			if err != nil {
+				logrus.WithField("source", certificate.source).WithError(err).Warningln("Failed to import certificate")
+			}
+			imported += count
+		}
+	}
+	logrus.WithField("count", imported).Infoln("Imported certificates.")
+	return nil
+}
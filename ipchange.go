@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// What happens with connections to the previous address of container which got a new IP
+const (
+	IPChangeKeep  = "keep"
+	IPChangeDrain = "drain"
+	IPChangeClose = "close"
+)
+
+// The in-flight requests of drained address are checked with this interval
+const drainPollInterval = 100 * time.Millisecond
+
+var upstreamAddressChanges = newCounter("auto_proxy_upstream_address_changes_total",
+	"Number of upstream containers which changed their address", "host", "action")
+
+func parseIPChange(value string) (string, error) {
+	switch value {
+	case IPChangeKeep, IPChangeDrain, IPChangeClose:
+		return value, nil
+	}
+	return "", errors.New("expected keep, drain or close")
+}
+
+// trackedConn is the connection to upstream address, it is forgotten once closed
+type trackedConn struct {
+	net.Conn
+	addr   string
+	closed sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closed.Do(func() {
+		upstreamConns.forget(c)
+	})
+	return c.Conn.Close()
+}
+
+// upstreamConnections keeps the open connections and the number of in-flight requests of upstream addresses,
+// the latter are used by auto-proxy.balance=least-requests too
+type upstreamConnections struct {
+	conns  map[string]map[*trackedConn]bool
+	active map[string]int
+	lock   sync.Mutex
+}
+
+var upstreamConns upstreamConnections
+
+func (u *upstreamConnections) Track(addr string, conn net.Conn) net.Conn {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.conns == nil {
+		u.conns = make(map[string]map[*trackedConn]bool)
+	}
+	if u.conns[addr] == nil {
+		u.conns[addr] = make(map[*trackedConn]bool)
+	}
+	tracked := &trackedConn{Conn: conn, addr: addr}
+	u.conns[addr][tracked] = true
+	return tracked
+}
+
+func (u *upstreamConnections) forget(conn *trackedConn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	delete(u.conns[conn.addr], conn)
+	if len(u.conns[conn.addr]) == 0 {
+		delete(u.conns, conn.addr)
+	}
+}
+
+// Acquire counts the request proxied to address, it has to be released once finished
+func (u *upstreamConnections) Acquire(addr string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.active == nil {
+		u.active = make(map[string]int)
+	}
+	u.active[addr]++
+}
+
+func (u *upstreamConnections) Release(addr string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.active[addr]--
+	if u.active[addr] <= 0 {
+		delete(u.active, addr)
+	}
+}
+
+func (u *upstreamConnections) Active(addr string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.active[addr]
+}
+
+// Close closes all connections to address, including the ones of in-flight requests
+func (u *upstreamConnections) Close(addr string) int {
+	u.lock.Lock()
+	conns := make([]*trackedConn, 0, len(u.conns[addr]))
+	for conn := range u.conns[addr] {
+		conns = append(conns, conn)
+	}
+	u.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// CloseResolved closes the connections dialed to host name which reach one of the removed addresses,
+// the connections to its other addresses are kept
+func (u *upstreamConnections) CloseResolved(host string, removed []string) int {
+	if len(removed) == 0 {
+		return 0
+	}
+
+	u.lock.Lock()
+	var conns []*trackedConn
+	for addr, list := range u.conns {
+		if name, _, _ := net.SplitHostPort(addr); name != host {
+			continue
+		}
+		for conn := range list {
+			if ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); slices.Contains(removed, ip) {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	u.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// Drain waits till the in-flight requests to address finish, at most for timeout, and closes its connections
+func (u *upstreamConnections) Drain(addr string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for u.Active(addr) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	active := u.Active(addr)
+	closed := u.Close(addr)
+	logrus.WithField("address", addr).WithField("closed", closed).WithField("interrupted", active).
+		Infoln("Drained connections to previous upstream address")
+}
+
+type addressChange struct {
+	route     *Route
+	container string
+	from      string
+	to        string
+}
+
+// addressChanges returns the upstreams of containers routed on another address before,
+// the previous address must not be used by any other upstream
+func addressChanges(previous, current Routes) (list []addressChange) {
+	known := make(map[string]string)
+	for _, route := range previous {
+		for _, upstream := range route.Servers {
+			if upstream.Socket == "" && upstream.IP != "" {
+				known[route.VirtualHost+" "+upstream.Daemon+upstream.Container+" "+upstream.Port] = upstream.Host()
+			}
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, route := range current {
+		for _, upstream := range route.Servers {
+			used[upstream.Host()] = true
+		}
+	}
+
+	for _, route := range current {
+		for _, upstream := range route.Servers {
+			from, ok := known[route.VirtualHost+" "+upstream.Daemon+upstream.Container+" "+upstream.Port]
+			if ok && from != upstream.Host() && !used[from] {
+				list = append(list, addressChange{route, upstream.Container, from, upstream.Host()})
+			}
+		}
+	}
+	return
+}
+
+// handleAddressChanges keeps, drains or closes the connections to the previous addresses of upstreams
+// according to auto-proxy.upstream.ip-change, the routes already point to the new addresses
+func handleAddressChanges(previous, current Routes) {
+	for _, change := range addressChanges(previous, current) {
+		action := change.route.UpstreamIPChange
+		if action == "" {
+			action = IPChangeKeep
+		}
+		upstreamAddressChanges.Inc(change.route.VirtualHost, action)
+		logrus.WithField("host", change.route.VirtualHost).WithField("container", change.container).
+			WithField("from", change.from).WithField("to", change.to).WithField("action", action).
+			Infoln("Upstream address changed")
+
+		switch action {
+		case IPChangeDrain:
+			go upstreamConns.Drain(change.from, *upstreamDrainTimeout)
+		case IPChangeClose:
+			upstreamConns.Close(change.from)
+		}
+	}
+}
+
+// networkEventContainer returns the container connected to or disconnected from network by the event
+func networkEventContainer(event *docker.APIEvents) (string, bool) {
+	if event.Type != "network" || (event.Action != "connect" && event.Action != "disconnect") {
+		return "", false
+	}
+	container := event.Actor.Attributes["container"]
+	return container, len(container) >= 12
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type fingerprintKey struct{}
+
+// isGREASE returns true for the reserved values sent by clients to keep the extension points working
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func joinValues[T uint8 | uint16 | tls.CurveID](values []T) string {
+	var list []string
+	for _, value := range values {
+		if isGREASE(uint16(value)) {
+			continue
+		}
+		list = append(list, strconv.Itoa(int(value)))
+	}
+	return strings.Join(list, "-")
+}
+
+// ja3 returns the MD5 fingerprint of client hello, the same for all clients with the same TLS stack
+func ja3(hello *tls.ClientHelloInfo) string {
+	// The legacy version of hello, the newer ones are sent in supported_versions extension
+	var version uint16
+	for _, supported := range hello.SupportedVersions {
+		if !isGREASE(supported) && supported > version {
+			version = supported
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+
+	fields := []string{
+		strconv.Itoa(int(version)),
+		joinValues(hello.CipherSuites),
+		joinValues(hello.Extensions),
+		joinValues(hello.SupportedCurves),
+		joinValues(hello.SupportedPoints),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprintContext passes the fingerprint of connection peeked by sniListener to its requests
+func fingerprintContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if peeked, ok := conn.(*peekedConn); ok && peeked.fingerprint != "" {
+		return context.WithValue(ctx, fingerprintKey{}, peeked.fingerprint)
+	}
+	return ctx
+}
+
+func requestFingerprint(r *http.Request) string {
+	fingerprint, _ := r.Context().Value(fingerprintKey{}).(string)
+	return fingerprint
+}
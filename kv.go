@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KVRetryTime = 5 * time.Second
+const KVWaitTime = 5 * time.Minute
+
+type kvClient interface {
+	// list returns all values under prefix, it blocks till the index changes
+	list(index uint64) (values map[string]string, newIndex uint64, err error)
+}
+
+func newKVClient(uri string) (kvClient, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "consul":
+		return &consulClient{address: "http://" + u.Host, prefix: prefix, token: u.Query().Get("token")}, nil
+	case "etcd":
+		return &etcdClient{address: "http://" + u.Host, prefix: "/" + prefix}, nil
+	default:
+		return nil, errors.New("kv: unsupported scheme " + u.Scheme)
+	}
+}
+
+type consulClient struct {
+	address string
+	prefix  string
+	token   string
+}
+
+func (c *consulClient) list(index uint64) (values map[string]string, newIndex uint64, err error) {
+	u := fmt.Sprintf("%s/v1/kv/%s/?recurse&index=%d&wait=%s", c.address, c.prefix, index, KVWaitTime)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	client := http.Client{Timeout: KVWaitTime + time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	newIndex, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	values = make(map[string]string)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return
+	default:
+		err = fmt.Errorf("consul: unexpected status %s", resp.Status)
+		return
+	}
+
+	var entries []struct {
+		Key   string
+		Value []byte
+	}
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		values[entry.Key] = string(entry.Value)
+	}
+	return
+}
+
+// etcdClient uses etcd v3 JSON gateway, which doesn't support long lived watches well, so we poll
+type etcdClient struct {
+	address string
+	prefix  string
+}
+
+func (c *etcdClient) rangeEnd() []byte {
+	end := []byte(c.prefix)
+	end[len(end)-1]++
+	return end
+}
+
+func (c *etcdClient) list(index uint64) (values map[string]string, newIndex uint64, err error) {
+	if index != 0 {
+		time.Sleep(KVRetryTime)
+	}
+
+	body, err := json.Marshal(map[string][]byte{
+		"key":       []byte(c.prefix),
+		"range_end": c.rangeEnd(),
+	})
+	if err != nil {
+		return
+	}
+
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Post(c.address+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("etcd: unexpected status %s", resp.Status)
+		return
+	}
+
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return
+	}
+
+	newIndex, _ = strconv.ParseUint(result.Header.Revision, 10, 64)
+	values = make(map[string]string)
+	for _, kv := range result.Kvs {
+		key, _ := base64.StdEncoding.DecodeString(kv.Key)
+		value, _ := base64.StdEncoding.DecodeString(kv.Value)
+		values[string(key)] = string(value)
+	}
+	return
+}
+
+// parseKVRoute reads route in form of VIRTUAL_HOST=... lines with additional UPSTREAM=ip:port
+func parseKVRoute(name, value string) (route RouteBuilder, err error) {
+	route = NewRouteBuilder()
+	route.Upstream.Container = "kv:" + name
+
+	lines := strings.Split(value, "\n")
+	for idx := range lines {
+		lines[idx] = strings.TrimSpace(lines[idx])
+	}
+	route.ParseSchema(lines, nil)
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "UPSTREAM=") {
+			route.Upstream.IP, route.Upstream.Port, err = net.SplitHostPort(strings.TrimPrefix(line, "UPSTREAM="))
+			if err != nil {
+				return
+			}
+		} else if !route.Parse(line) {
+			logrus.WithField("key", name).Warningln("Unknown route option:", line)
+		}
+	}
+
+	if !route.isValid() {
+		err = errors.New("missing VIRTUAL_HOST or UPSTREAM")
+	}
+	return
+}
+
+func createKVRoutes(values map[string]string) Routes {
+	profiled := make(ProfileRoutes)
+	for key, value := range values {
+		if value == "" {
+			// directories
+			continue
+		}
+
+		route, err := parseKVRoute(key, value)
+		if err != nil {
+			logrus.WithField("key", key).WithError(err).Warningln("Invalid route")
+			continue
+		}
+		profiled.Add(route)
+	}
+	return profiled.Join()
+}
+
+func watchKV(uri string, source *routeSource) {
+	client, err := newKVClient(uri)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	var index uint64
+	for {
+		values, newIndex, err := client.list(index)
+		if err != nil {
+			logrus.WithField("uri", uri).WithError(err).Errorln("Unable to read routes from KV store")
+			source.Failed(err)
+			time.Sleep(KVRetryTime)
+			continue
+		}
+
+		// Consul can reset the index
+		if newIndex < index {
+			newIndex = 0
+		}
+		if newIndex == index && index != 0 {
+			continue
+		}
+		index = newIndex
+
+		logrus.WithField("uri", uri).Debugln("Received routes from KV store...")
+		source.Update(createKVRoutes(values), fmt.Sprintf("kv index %d", index))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var invalidMetricLabel = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// The metrics labeled by container labels selected with -metrics-labels
+var containerRequests *metricVec
+var containerRequestBytes *metricVec
+var containerResponseBytes *metricVec
+
+func metricsLabelNames() (names []string) {
+	for _, name := range strings.Split(*metricsLabels, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// initContainerMetrics registers the metrics, it has to be called after the flags are parsed
+func initContainerMetrics() {
+	names := metricsLabelNames()
+	if len(names) == 0 {
+		return
+	}
+
+	labels := []string{"host", "code"}
+	for _, name := range names {
+		labels = append(labels, invalidMetricLabel.ReplaceAllString(name, "_"))
+	}
+
+	containerRequests = newCounter("auto_proxy_container_requests_total",
+		"Number of proxied requests by container labels", labels...)
+	containerRequestBytes = newCounter("auto_proxy_container_request_bytes_total",
+		"Size of proxied request bodies by container labels", labels...)
+	containerResponseBytes = newCounter("auto_proxy_container_response_bytes_total",
+		"Size of proxied response bodies by container labels", labels...)
+}
+
+// selectMetricsLabels returns container labels used by metrics, so the routes don't keep all of them
+func selectMetricsLabels(labels map[string]string) map[string]string {
+	names := metricsLabelNames()
+	if len(names) == 0 {
+		return nil
+	}
+
+	selected := make(map[string]string)
+	for _, name := range names {
+		selected[name] = labels[name]
+	}
+	return selected
+}
+
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(data []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(data)
+	b.read += int64(n)
+	return
+}
+
+// CountRequest measures the size of request body
+func (l *loggingResponseWriter) CountRequest(r *http.Request) {
+	if containerRequests == nil || r.Body == nil {
+		return
+	}
+	l.body = &countingBody{ReadCloser: r.Body}
+	r.Body = l.body
+}
+
+func (l *loggingResponseWriter) observeContainer(route *Route, upstream *Upstream) {
+	if containerRequests == nil {
+		return
+	}
+
+	values := []string{route.VirtualHost, strconv.Itoa(l.status)}
+	for _, name := range metricsLabelNames() {
+		values = append(values, upstream.Labels[name])
+	}
+
+	containerRequests.Inc(values...)
+	containerResponseBytes.Add(float64(l.written), values...)
+	if l.body != nil {
+		containerRequestBytes.Add(float64(l.body.read), values...)
+	}
+}
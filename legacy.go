@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// applyDefaultHost routes HTTP/1.0 requests without Host header to -default-host
+func applyDefaultHost(r *http.Request) {
+	if r.Host == "" && *defaultHost != "" {
+		r.Host = *defaultHost
+	}
+}
+
+// disableChunking makes the server close the connection after the body instead of using chunked encoding,
+// for routes with auto-proxy.chunked=off serving clients which don't support it
+func (r *Route) disableChunking(resp *http.Response) {
+	if !r.ChunkedOff || resp.ContentLength >= 0 {
+		return
+	}
+	resp.Header.Set("Transfer-Encoding", "identity")
+}
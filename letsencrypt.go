@@ -10,11 +10,54 @@ import (
 	"github.com/ericchiang/letsencrypt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const (
+	ACMEProduction = "prod"
+	ACMEStaging    = "staging"
+	ACMEOff        = "off"
+)
+
+var acmeDirectories = map[string]string{
+	ACMEProduction: "https://acme-v01.api.letsencrypt.org/directory",
+	ACMEStaging:    "https://acme-staging.api.letsencrypt.org/directory",
+}
+
+// IssuancePolicy controls how the certificates of the host are requested
+type IssuancePolicy struct {
+	Mode  string
+	Email string
+}
+
 type LetsEncrypt struct {
 	client     *letsencrypt.Client
 	accountKey *rsa.PrivateKey
+	policy     IssuancePolicy
+}
+
+func NewLetsEncrypt(policy IssuancePolicy) *LetsEncrypt {
+	if policy.Mode == "" {
+		policy.Mode = ACMEProduction
+	}
+	if policy.Email == "" {
+		policy.Email = *acmeEmail
+	}
+	return &LetsEncrypt{policy: policy}
+}
+
+// accountKeyFile returns separate account key for each directory and contact email
+func (e *LetsEncrypt) accountKeyFile() string {
+	if e.policy.Mode == ACMEProduction && e.policy.Email == *acmeEmail {
+		return *accountKey
+	}
+
+	name := e.policy.Mode
+	if e.policy.Email != "" {
+		name += "-" + strings.NewReplacer("@", "_at_", "/", "_").Replace(e.policy.Email)
+	}
+	return filepath.Join(filepath.Dir(*accountKey), "account-"+name+".key")
 }
 
 func (e *LetsEncrypt) ensureClient() error {
@@ -22,7 +65,12 @@ func (e *LetsEncrypt) ensureClient() error {
 		return nil
 	}
 
-	client, err := letsencrypt.NewClient("https://acme-v01.api.letsencrypt.org/directory")
+	directory, ok := acmeDirectories[e.policy.Mode]
+	if !ok {
+		return errors.New("unsupported ACME mode " + e.policy.Mode)
+	}
+
+	client, err := letsencrypt.NewClientWithTransport(directory, outboundTransport)
 	if err != nil {
 		return err
 	}
@@ -44,16 +92,28 @@ func (e *LetsEncrypt) createAccountKey() error {
 	}
 
 	// Register the key
-	if _, err := e.client.NewRegistration(key); err != nil {
+	reg, err := e.client.NewRegistration(key)
+	if err != nil {
 		return err
 	}
 
+	// Set the contact email
+	if e.policy.Email != "" {
+		reg.Contact = []string{"mailto:" + e.policy.Email}
+		if _, err := e.client.UpdateRegistration(key, reg); err != nil {
+			return err
+		}
+	}
+
 	// Write account key to file
-	data := pem.EncodeToMemory(&pem.Block{
+	data, err := encryptPEM(&pem.Block{
 		Type:  "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(key),
 	})
-	err = ioutil.WriteFile(*accountKey, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(e.accountKeyFile(), data, 0600)
 	if err != nil {
 		return err
 	}
@@ -63,7 +123,7 @@ func (e *LetsEncrypt) createAccountKey() error {
 }
 
 func (e *LetsEncrypt) loadAccountKey() error {
-	data, err := ioutil.ReadFile(*accountKey)
+	data, err := readKeyFile(e.accountKeyFile())
 	if err != nil {
 		return err
 	}
@@ -142,6 +202,17 @@ func (e *LetsEncrypt) requestHttp(serverName string) (urlPath, resource string,
 	return
 }
 
+func (e *LetsEncrypt) requestDNS(serverName string) (subdomain, txt string, challenge letsencrypt.Challenge, err error) {
+	challenge, err = e.requestChallenge(serverName, letsencrypt.ChallengeDNS)
+	if err != nil {
+		return
+	}
+
+	// Request DNS-01 challenge
+	subdomain, txt, err = challenge.DNS(e.accountKey)
+	return
+}
+
 func (e *LetsEncrypt) finishChallenge(challenge letsencrypt.Challenge) (err error) {
 	err = e.ensureClient()
 	if err != nil {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The lifecycle events of the proxy
+const (
+	LifecycleStarted      = "started"
+	LifecycleRoutesLoaded = "routes-loaded"
+	LifecycleDraining     = "draining"
+	LifecycleStopped      = "stopped"
+)
+
+const lifecycleEventTimeout = 10 * time.Second
+const defaultShutdownHookTimeout = 30 * time.Second
+
+var lifecycleFailures = newCounter("auto_proxy_lifecycle_failures_total",
+	"Number of lifecycle events and shutdown hooks which failed", "name")
+
+// LifecycleEvent is sent to -lifecycle-webhook and -lifecycle-socket
+type LifecycleEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	PID      int       `json:"pid"`
+	Reason   string    `json:"reason,omitempty"`
+	Routes   int       `json:"routes,omitempty"`
+}
+
+// ShutdownHook is the command or webhook called once the proxy starts draining, ie. to deregister it from load balancer
+type ShutdownHook struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command,omitempty"`
+	Webhook string   `json:"webhook,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+func (h *ShutdownHook) compile() (err error) {
+	if h.Name == "" {
+		return errors.New("shutdown hook: name is required")
+	} else if (len(h.Command) == 0) == (h.Webhook == "") {
+		return errors.New("shutdown hook " + h.Name + ": expected command or webhook")
+	}
+	h.timeout = defaultShutdownHookTimeout
+	if h.Timeout != "" {
+		h.timeout, err = time.ParseDuration(h.Timeout)
+		if err != nil || h.timeout <= 0 {
+			return errors.New("shutdown hook " + h.Name + ": invalid timeout " + h.Timeout)
+		}
+	}
+	return nil
+}
+
+// run calls the hook with the draining event, the command receives it in environment and on stdin
+func (h *ShutdownHook) run(event LifecycleEvent) error {
+	if h.Webhook != "" {
+		client := *webhookClient
+		client.Timeout = h.timeout
+		return postWebhookWith(&client, h.Webhook, event)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	data, _ := json.Marshal(event)
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), "AUTO_PROXY_EVENT="+event.Event, "AUTO_PROXY_REASON="+event.Reason)
+	cmd.Env = append(cmd.Env, outboundEnv()...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(err.Error() + ": " + string(output))
+	}
+	return nil
+}
+
+func newLifecycleEvent(event, reason string) LifecycleEvent {
+	hostname, _ := os.Hostname()
+	return LifecycleEvent{Event: event, Time: time.Now().UTC(), Hostname: hostname, PID: os.Getpid(), Reason: reason}
+}
+
+// emitLifecycle sends the event to webhook and unix socket, it waits till they are delivered
+func emitLifecycle(event LifecycleEvent) {
+	logrus.WithField("event", event.Event).WithField("reason", event.Reason).Infoln("Lifecycle event")
+
+	if *lifecycleWebhook != "" {
+		client := *webhookClient
+		client.Timeout = lifecycleEventTimeout
+		if err := postWebhookWith(&client, *lifecycleWebhook, event); err != nil {
+			lifecycleFailures.Inc(event.Event)
+			logrus.WithError(err).WithField("event", event.Event).Warningln("Failed to send lifecycle event to webhook")
+		}
+	}
+	if *lifecycleSocket != "" {
+		if err := sendLifecycleSocket(*lifecycleSocket, event); err != nil {
+			lifecycleFailures.Inc(event.Event)
+			logrus.WithError(err).WithField("event", event.Event).Warningln("Failed to send lifecycle event to socket")
+		}
+	}
+}
+
+// sendLifecycleSocket writes the event as JSON line to the unix socket
+func sendLifecycleSocket(path string, event LifecycleEvent) error {
+	conn, err := net.DialTimeout("unix", path, lifecycleEventTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(lifecycleEventTimeout))
+	data, _ := json.Marshal(event)
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+var shutdownOnce sync.Once
+
+// shutdown emits draining, runs the shutdown hooks in parallel, drains the listeners and emits stopped,
+// the later calls return once the first one finished
+func shutdown(reason string) {
+	shutdownOnce.Do(func() {
+		event := newLifecycleEvent(LifecycleDraining, reason)
+		emitLifecycle(event)
+
+		var wg sync.WaitGroup
+		for _, hook := range config.ShutdownHooks {
+			wg.Add(1)
+			go func(hook *ShutdownHook) {
+				defer wg.Done()
+				log := logrus.WithField("hook", hook.Name)
+				if err := hook.run(event); err != nil {
+					lifecycleFailures.Inc(hook.Name)
+					log.WithError(err).Errorln("Shutdown hook failed")
+					return
+				}
+				log.Infoln("Shutdown hook finished")
+			}(hook)
+		}
+		wg.Wait()
+
+		if *shutdownDelay > 0 {
+			logrus.WithField("delay", shutdownDelay.String()).Infoln("Waiting before draining listeners...")
+			time.Sleep(*shutdownDelay)
+		}
+		drainListeners()
+		accessLog.Close()
+		emitLifecycle(newLifecycleEvent(LifecycleStopped, reason))
+	})
+}
+
+// watchShutdown stops the proxy gracefully on SIGTERM or interrupt
+func watchShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-signals
+	signal.Stop(signals)
+	logrus.WithField("signal", sig.String()).Infoln("Stopping the proxy...")
+	shutdown("signal " + sig.String())
+	os.Exit(0)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var listenerReloads = newCounter("auto_proxy_listener_reloads_total",
+	"Number of reloads of listeners", "result")
+
+// servedListener is the bound address of profile, it is drained when the address changes
+type servedListener struct {
+	Addr   string    `json:"addr"`
+	Since  time.Time `json:"since"`
+	server *http.Server
+}
+
+// profileListeners are the HTTP and HTTPS listeners of profile app
+type profileListeners struct {
+	HTTP  *servedListener `json:"http,omitempty"`
+	HTTPS *servedListener `json:"https,omitempty"`
+
+	app       *theApp
+	tlsConfig *tls.Config
+
+	// The config of HTTPS connections with the settings which are replaced without rebinding
+	connConfig atomic.Value
+	acmeOnly   atomic.Bool
+}
+
+var servedListeners = struct {
+	list map[string]*profileListeners
+	lock sync.Mutex
+}{list: make(map[string]*profileListeners)}
+
+func defaultProfile() Profile {
+	return Profile{ListenHTTP: *listenHttp, ListenHTTPS: *listenHttps, HTTPACMEOnly: *httpACMEOnly}
+}
+
+// readProfiles reads only the profiles of -config file, the other settings are not reloaded
+func readProfiles(fileName string) (map[string]Profile, error) {
+	var reloaded struct {
+		Profiles map[string]Profile `json:"profiles"`
+	}
+	if fileName != "" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &reloaded)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reloaded.Profiles == nil {
+		reloaded.Profiles = make(map[string]Profile)
+	}
+	reloaded.Profiles[""] = defaultProfile()
+	return reloaded.Profiles, nil
+}
+
+// configureTLS derives the config of HTTPS connections from the shared one, so the client CA and
+// minimal version apply to new connections as soon as they are reloaded
+func (p *profileListeners) configureTLS(profile Profile) error {
+	config := &tls.Config{
+		GetCertificate:         p.tlsConfig.GetCertificate,
+		Certificates:           p.tlsConfig.Certificates,
+		NextProtos:             p.tlsConfig.NextProtos,
+		SessionTicketsDisabled: p.tlsConfig.SessionTicketsDisabled,
+	}
+	if profile.TLSMinVersion != "" {
+		version, ok := tlsVersions[profile.TLSMinVersion]
+		if !ok {
+			return errors.New("tlsMinVersion: expected 1.0, 1.1, 1.2 or 1.3")
+		}
+		config.MinVersion = version
+	}
+
+	caFile := profile.ClientCA
+	if caFile == "" {
+		caFile = *clientCA
+	}
+	if err := configureClientCA(config, caFile); err != nil {
+		return err
+	}
+	p.connConfig.Store(config)
+	return nil
+}
+
+// bind listens on address and serves it in background till the listener is drained
+func (p *profileListeners) bind(addr string, secure bool) (*servedListener, error) {
+	var server *http.Server
+	var err error
+	if secure {
+		server, err = newHTTPSServer(addr, p.tlsConfig, p.app)
+	} else {
+		server, err = newHTTPServer(addr, http.HandlerFunc(p.serveHTTP))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	serve := server.Serve
+	if secure {
+		serve = serveTLS(server, p.app)
+	}
+	go func() {
+		err := serveAll(listeners, serve)
+		if err != http.ErrServerClosed {
+			logrus.Fatalln(err)
+		}
+	}()
+	return &servedListener{Addr: addr, Since: time.Now(), server: server}, nil
+}
+
+// replace binds the changed address before the old listener is drained, so no connection is refused meanwhile
+func (p *profileListeners) replace(current **servedListener, addr string, secure bool) error {
+	old := *current
+	if old != nil && old.Addr == addr {
+		return nil
+	}
+
+	*current = nil
+	if addr != "" {
+		listener, err := p.bind(addr, secure)
+		if err != nil {
+			*current = old
+			return err
+		}
+		*current = listener
+	}
+	if old != nil {
+		go old.drain()
+	}
+	return nil
+}
+
+// apply configures TLS first, so the connections of new HTTPS listener use the reloaded settings
+func (p *profileListeners) apply(profile Profile) error {
+	if profile.ListenHTTP == "" && profile.ListenHTTPS == "" {
+		return errors.New("no listeners")
+	}
+	if err := p.configureTLS(profile); err != nil {
+		return err
+	}
+	p.acmeOnly.Store(profile.HTTPACMEOnly)
+	if err := p.replace(&p.HTTP, profile.ListenHTTP, false); err != nil {
+		return err
+	}
+	return p.replace(&p.HTTPS, profile.ListenHTTPS, true)
+}
+
+// serveHTTP passes plain HTTP requests to the app, with httpAcmeOnly only the ACME challenges are answered
+func (p *profileListeners) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !p.acmeOnly.Load() {
+		p.app.ServeHTTP(rw, r)
+		return
+	}
+
+	w := newLoggingResponseWriter(rw)
+	defer w.Log(r)
+
+	applyDefaultHost(r)
+	ensureRequestID(w, r)
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		w.Message = "http disabled"
+		serveError(w, r, ErrorHTTPDisabled, "plain HTTP is disabled, use https://"+r.Host)
+		return
+	}
+	if !p.app.serveWellKnown(w, r) {
+		w.Message = "unknown challenge"
+		http.NotFound(w, r)
+	}
+}
+
+// drain stops accepting connections and waits for pending requests up to -listener-drain-timeout,
+// the passthrough streams and upgraded connections are not interrupted
+func (l *servedListener) drain() {
+	log := logrus.WithField("addr", l.Addr)
+	log.Infoln("Draining old listener...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *listenerDrainTimeout)
+	defer cancel()
+	if err := l.server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warningln("Closing connections of drained listener")
+		l.server.Close()
+		return
+	}
+	log.Infoln("Drained old listener")
+}
+
+// drainListeners drains the listeners of all profiles at once, it returns once all of them are drained
+func drainListeners() {
+	servedListeners.lock.Lock()
+	defer servedListeners.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, listeners := range servedListeners.list {
+		for _, listener := range []*servedListener{listeners.HTTP, listeners.HTTPS} {
+			if listener == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(listener *servedListener) {
+				defer wg.Done()
+				listener.drain()
+			}(listener)
+		}
+	}
+	wg.Wait()
+}
+
+// serveProfile binds the listeners of profile app at start
+func serveProfile(name string, app *theApp, profile Profile) error {
+	p := &profileListeners{app: app, tlsConfig: newTLSConfig(defaultCertificate, app)}
+	p.tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return p.connConfig.Load().(*tls.Config), nil
+	}
+
+	servedListeners.lock.Lock()
+	defer servedListeners.lock.Unlock()
+
+	if err := p.apply(profile); err != nil {
+		return err
+	}
+	servedListeners.list[name] = p
+	return nil
+}
+
+// reloadListeners applies the changed listeners of profiles in -config file, the profiles
+// which were added or removed since start require restart
+func reloadListeners() error {
+	profiles, err := readProfiles(*configFile)
+	if err != nil {
+		listenerReloads.Inc("error")
+		return err
+	}
+
+	servedListeners.lock.Lock()
+	defer servedListeners.lock.Unlock()
+
+	var errs []string
+	for name, listeners := range servedListeners.list {
+		log := logrus.WithField("profile", name)
+		profile, ok := profiles[name]
+		if !ok {
+			log.Warningln("Removed profile keeps serving till restart")
+			continue
+		}
+		if err := listeners.apply(profile); err != nil {
+			log.WithError(err).Errorln("Failed to reload listeners, keeping the old ones")
+			errs = append(errs, "profile "+name+": "+err.Error())
+		}
+	}
+	for name := range profiles {
+		if servedListeners.list[name] == nil {
+			logrus.WithField("profile", name).Warningln("New profile requires restart")
+		}
+	}
+
+	if len(errs) > 0 {
+		listenerReloads.Inc("error")
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	listenerReloads.Inc("ok")
+	return nil
+}
+
+// watchReloads reloads listeners on SIGHUP, it blocks forever
+func watchReloads() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		logrus.Infoln("Reloading listeners...")
+		if err := reloadListeners(); err != nil {
+			logrus.WithError(err).Errorln("Failed to reload listeners")
+		} else {
+			logrus.Infoln("Reloaded listeners")
+		}
+	}
+}
+
+func listListeners() map[string]*profileListeners {
+	servedListeners.lock.Lock()
+	defer servedListeners.lock.Unlock()
+
+	list := make(map[string]*profileListeners)
+	for name, listeners := range servedListeners.list {
+		list[name] = &profileListeners{HTTP: listeners.HTTP, HTTPS: listeners.HTTPS}
+	}
+	return list
+}
+
+func (a *adminAPI) getListeners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listListeners())
+}
+
+func (a *adminAPI) postReload(w http.ResponseWriter, r *http.Request) {
+	if err := reloadListeners(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, listListeners())
+}
@@ -2,63 +2,272 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
 	"github.com/Sirupsen/logrus"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 var listenHttp = flag.String("listen-http", ":80", "The address to listen for HTTP requests")
 var listenHttps = flag.String("listen-https", ":443", "The address to listen for HTTPS requests")
-var accountKey = flag.String("account-key", "/etc/auto-proxy/account.key", "Where to store the account key")
-var certsDirectory = flag.String("certs-dir", "/etc/auto-proxy/certs.d", "Where to store the generated certificates")
+var listenerDrainTimeout = flag.Duration("listener-drain-timeout", 30*time.Second, "The time the requests of listener replaced on reload are allowed to finish")
+var accountKey = flag.String("account-key", filepath.Join(dataDirectory, "account.key"), "Where to store the account key")
+var certsDirectory = flag.String("certs-dir", filepath.Join(dataDirectory, "certs.d"), "Where to store the generated certificates")
 var requestBefore = flag.Duration("request-before", time.Hour*24*31, "When to start certificate renewal")
 var retryInterval = flag.Duration("retry-interval", time.Hour, "Re-read the certificates")
-var defaultCert = flag.String("default-crt", "/etc/auto-proxy/default.crt", "The path to default certificate")
-var defaultKey = flag.String("default-key", "/etc/auto-proxy/default.key", "The path to default certificate key")
+var defaultCert = flag.String("default-crt", filepath.Join(dataDirectory, "default.crt"), "The path to default certificate")
+var defaultKey = flag.String("default-key", filepath.Join(dataDirectory, "default.key"), "The path to default certificate key")
 var useDefaultKey = flag.Bool("use-default-key", true, "All certificates will be generated with the default certificate key")
 var ports = flag.String("ports", "80,8080,3000,5000", "Auto-create mapping for these ports")
 var insecureSkipVerify = flag.Bool("insecure-skip-verify", false, "Disable SSL/TLS checking for proxied requests")
+var httpACMEOnly = flag.Bool("http-acme-only", false, "Answer only ACME HTTP-01 challenges on -listen-http, the sites are served only over HTTPS")
 var http2proto = flag.Bool("http2", true, "Enable HTTP2 support")
+var reusePort = flag.Bool("reuseport", false, "Open multiple HTTP and HTTPS listeners with SO_REUSEPORT")
+var listeners = flag.Int("listeners", 0, "The number of SO_REUSEPORT listeners, defaults to GOMAXPROCS")
+var storeURI = flag.String("store", "", "The shared store used to synchronise replicas, ie. file:///mnt/auto-proxy")
+var storeSyncInterval = flag.Duration("store-sync-interval", time.Minute, "How often to look for certificates issued by other replicas")
+var routesDir = flag.String("routes-dir", filepath.Join(dataDirectory, "routes.d"), "Watch route files (*.yaml) in this directory, empty disables")
+var routesKV = flag.String("routes-kv", "", "Watch manual routes in K/V store, ie. consul://127.0.0.1:8500/auto-proxy/routes or etcd://127.0.0.1:2379/auto-proxy/routes")
+var dnsRefresh = flag.Duration("dns-refresh", 30*time.Second, "How often to re-resolve upstreams specified by hostname when the TTL of their records can't be read")
+var listenAdmin = flag.String("listen-admin", "", "The address to listen for admin API requests, ie. 127.0.0.1:8081")
+var adminTokens = flag.String("admin-tokens", "", "Comma separated list of admin API tokens in form of token[:read|write]")
+var adminTokensFile = flag.String("admin-tokens-file", "", "Comma separated list of files (ie. Docker secrets) with admin API token per line")
+var adminCert = flag.String("admin-crt", "", "The path to certificate to serve admin API over TLS")
+var adminKey = flag.String("admin-key", "", "The path to certificate key to serve admin API over TLS")
+var adminName = flag.String("admin-name", "", "The routable host name of admin API, it is served over TLS with ACME certificate, ie. admin.proxy.bar.com")
+var adminClientCA = flag.String("admin-client-ca", "", "Require admin API clients to present certificate signed by this CA")
+var socketsDirectory = flag.String("sockets-dir", "", "The directory of unix sockets shared by containers for auto-proxy.upstream, empty disables socket upstreams")
+var secretsDirectory = flag.String("secrets-dir", "/run/secrets", "The directory of Docker secrets referenced by middlewares with secret:<name>")
+var captureDirectory = flag.String("capture-dir", "", "The directory to write requests captured with admin API to")
+var auditLogFile = flag.String("audit-log", "", "Append all route changes to this file")
+var enablePprof = flag.Bool("enable-pprof", false, "Expose profiling and runtime diagnostics on admin API")
+var dockerEventBuffer = flag.Int("docker-event-buffer", 100, "The number of docker events buffered while routes are rebuilt, all containers are resynced once it is full")
+var dockerBackoffMax = flag.Duration("docker-backoff-max", 5*time.Minute, "The maximum delay between reconnections to docker daemon")
+var routesSnapshot = flag.String("routes-snapshot", filepath.Join(dataDirectory, "routes.json"), "Where to store the last known routes, served on startup till docker is enumerated")
+var redisURI = flag.String("redis", "", "The Redis shared by replicas, ie. redis://:password@127.0.0.1:6379/0")
+var acmeChallenge = flag.String("acme-challenge", "http-01", "The ACME challenge to use: http-01 or dns-01")
+var acmeHook = flag.String("acme-hook", "", "The script called with present|cleanup <type> <domain> <name> <value> to fulfill ACME challenges")
+var acmeWebhook = flag.String("acme-webhook", "", "The URL receiving present and cleanup of ACME challenges as JSON")
+var alertWebhook = flag.String("alert-webhook", "", "The URL receiving certificate alerts as JSON")
+var alertFailures = flag.Int("alert-failures", 3, "Alert after this many failed certificate requests in a row")
+var alertExpiry = flag.Duration("alert-expiry", 7*24*time.Hour, "Alert when the served certificate expires within this time")
+var ecdsaCertificates = flag.Bool("ecdsa", false, "Generate also ECDSA certificates and serve them to clients supporting them")
+var storageKeyFile = flag.String("storage-key-file", "", "Encrypt private keys with passphrase (or base64:<key>) read from this file")
+var storageKeyCommand = flag.String("storage-key-command", "", "Encrypt private keys with passphrase (or base64:<key>) printed by this command, ie. KMS decrypt")
+var acmeEmail = flag.String("acme-email", "", "The default contact email of ACME account")
+var renewJitter = flag.Duration("renew-jitter", time.Hour*24*7, "Spread certificate renewals over this window before -request-before")
+var sanGroups = flag.String("san-group", "", "Comma separated parent domains whose hosts share SAN certificates, * groups hosts by registered domain")
+var sanGroupSize = flag.Int("san-group-size", 100, "The maximum number of names in SAN certificate of -san-group")
+var sanBatch = flag.Int("san-batch", 1, "Renew up to this number of related hosts as a single SAN certificate")
+var strictSNI = flag.Bool("strict-sni", false, "Abort TLS handshakes for server names which are not routed")
+var defaultName = flag.String("default-name", "", "Serve the certificate of this host for unknown server names instead of -default-crt")
+var sessionTickets = flag.Bool("session-tickets", true, "Enable TLS session resumption with session tickets")
+var sessionTicketRotation = flag.Duration("session-ticket-rotation", time.Hour*12, "How often to rotate session ticket keys, shared by replicas with -store")
+var metricsLabels = flag.String("metrics-labels", "", "Comma separated container labels added to per container metrics, ie. com.docker.compose.project")
+var clientCA = flag.String("client-ca", "", "Request optional client certificates signed by this CA, passed to containers with auto-proxy.tls-headers")
+var unknownHost = flag.String("unknown-host", UnknownHostError, "The response for hosts without route: error, close, 404, page:<file> or redirect:<url>")
+var jsonErrors = flag.Bool("json-errors", false, "Respond with JSON body including the request ID when routing or upstream fails")
+var defaultHost = flag.String("default-host", "", "The virtual host of HTTP/1.0 requests without Host header")
+var defaultWeightBy = flag.String("weight-by", WeightByNone, "Derive load balancing weights from container limits: cpu, memory or none")
+var upstreamPrefer = flag.String("upstream-prefer", defaultUpstreamPrefer, "The order of container addresses to use: hostport, bridge, network, network:<name> and ipv6")
+var killDeregisterTimeout = flag.Duration("kill-deregister-timeout", 5*time.Minute, "Remove routes of container once it receives stop signal, restore them if it still runs after this time, 0 disables")
+var exposePorts = flag.Bool("expose-ports", false, "Use ports EXPOSEd by the image if none of -ports is found")
+var flapThreshold = flag.Int("flap-threshold", 5, "Suppress routes of container dying this many times within -flap-window, 0 disables")
+var flapWindow = flag.Duration("flap-window", time.Minute, "The window to count container deaths")
+var flapHoldDown = flag.Duration("flap-hold-down", 30*time.Second, "The initial time to suppress routes of flapping container")
+var flapHoldDownMax = flag.Duration("flap-hold-down-max", 30*time.Minute, "The maximum time to suppress routes of flapping container")
+var configFile = flag.String("config", "", "The JSON config file with named middlewares")
+var allowedDomains = flag.String("allowed-domains", "", "Comma separated domains which can be claimed by containers, ie. *.apps.example.com")
+var allowUnderscoreHeaders = flag.Bool("allow-underscore-headers", false, "Pass request headers with underscores in the name to upstreams")
+var maintenancePage = flag.String("maintenance-page", "", "The HTML page served during maintenance windows")
+var cacheSize = flag.Int64("cache-size", 64*1024*1024, "The maximum size of cached responses in bytes")
+var cachePurgeAllow = flag.String("cache-purge-allow", "127.0.0.0/8,::1/128", "Comma separated networks allowed to send PURGE requests")
+var waitDocker = flag.Duration("wait-for-docker", 0, "Exit with code 3 if Docker daemon is not available within this time, 0 waits forever")
+var serveBeforeDocker = flag.Bool("serve-before-docker", true, "Serve snapshot and manual routes while waiting for Docker daemon")
+var importSources = flag.String("import", "", "Comma separated certificates to import into -certs-dir on startup: certbot:<live dir>, traefik:<acme.json> or pem:<bundle>")
+var importOnly = flag.Bool("import-only", false, "Exit after importing certificates with -import")
+var outboundProxyURL = flag.String("outbound-proxy", "", "The HTTP proxy used by ACME, webhooks and challenge hooks, defaults to HTTPS_PROXY")
+var outboundNoProxy = flag.String("outbound-no-proxy", "", "Comma separated hosts and networks reached without -outbound-proxy, defaults to NO_PROXY")
+var provider = flag.String("provider", ProviderDocker, "The container engine: docker or podman (its Docker compatible API)")
+var dockerHost = flag.String("docker-host", "", "The Docker daemon endpoint, ie. unix:///var/run/docker.sock or npipe:////./pipe/docker_engine, defaults to DOCKER_HOST, "+
+	"comma separated name=endpoint list to watch multiple daemons")
+var serviceAction = flag.String("service", "", "Install or uninstall auto-proxy as Windows service with the other flags: install or uninstall")
+var accessLogTargets = flag.String("access-log", "stdout", "Comma separated access log sinks: stdout, file path, syslog://, kafka://broker:9092/topic, http:// or loki+http://, off disables")
+var accessLogBatch = flag.Int("access-log-batch", 1000, "The number of access log entries sent at once by syslog, Kafka and HTTP sinks")
+var accessLogFlush = flag.Duration("access-log-flush", time.Second, "The longest time access log entries wait for the batch of syslog, Kafka and HTTP sinks")
+var defaultSchema = flag.String("default-schema", SchemaV1, "The schema of labels of containers without auto-proxy.schema: v1 or v2")
+var logFile = flag.String("log-file", "", "Append logs to this file instead of stderr, defaults to auto-proxy.log in data directory when running as Windows service")
+var prometheusSDFile = flag.String("prometheus-sd-file", "", "Write Prometheus file_sd targets of containers with prometheus.scrape=true label to this file")
+var signKeyFile = flag.String("sign-key-file", "", "The secret shared with backends to verify requests of routes with auto-proxy.sign, ie. Docker secret")
+var healthWebhook = flag.String("health-webhook", "", "The URL receiving JSON events of upstreams failing auto-proxy.health.path checks")
+var healthRestartBudget = flag.Int("health-restart-budget", 3, "The restarts of unhealthy container with auto-proxy.health.restart=on allowed within -health-restart-window")
+var healthRestartWindow = flag.Duration("health-restart-window", time.Hour, "The window of -health-restart-budget")
+var upstreamDrainTimeout = flag.Duration("upstream-drain-timeout", 30*time.Second, "The time the requests to previous address of upstream with auto-proxy.upstream.ip-change=drain are allowed to finish")
+var lifecycleWebhook = flag.String("lifecycle-webhook", "", "The URL receiving JSON lifecycle events: started, routes-loaded, draining and stopped")
+var lifecycleSocket = flag.String("lifecycle-socket", "", "The unix socket receiving JSON lines of lifecycle events")
+var shutdownDelay = flag.Duration("shutdown-delay", 0, "The time to keep serving after shutdown hooks finished, before the listeners are drained")
+var sourcePrecedence = flag.String("source-precedence", "docker,files,kv", "The order of route sources, the options of the first source routing the host win")
+var discoveryTimeout = flag.Duration("discovery-timeout", 10*time.Second, "The time to wait for all route sources before applying the initial routes")
 var verbose = flag.Bool("debug", false, "Be more verbose")
 
 type theApp struct {
+	profile      string
 	routes       Routes
+	sources      map[string]Routes
+	staleSources map[string]bool
 	certificates Certificates
 	wellKnown    map[string]string
 	lock         sync.RWMutex
 }
 
-func (a *theApp) update(routes Routes) {
-	logrus.Infoln("Updating routes...")
-	a.routes = routes
+func (a *theApp) updateSource(source string, routes Routes, trigger string) {
+	a.updateSources(map[string]Routes{source: routes}, trigger)
 }
 
-func (a *theApp) ServeTLS(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if ch.ServerName == "" {
-		return nil, nil
+// updateSources replaces the routes of sources and merges them once
+func (a *theApp) updateSources(sources map[string]Routes, trigger string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	names := make([]string, 0, len(sources))
+	for source := range sources {
+		names = append(names, source)
+	}
+	sortSources(names)
+	source := strings.Join(names, ",")
+
+	logrus.WithField("source", source).WithField("profile", a.profile).Infoln("Updating routes...")
+	if a.sources == nil {
+		a.sources = make(map[string]Routes)
+	}
+	for _, name := range names {
+		auditLog.Record(name, trigger, a.sources[name].Diff(sources[name]))
+		a.sources[name] = sources[name]
+		delete(a.staleSources, name)
+	}
+
+	merged := make(Routes)
+	merged.Merge(a.sources)
+	logRouteChanges(source, trigger, a.routes.Diff(merged))
+	upstreamProtocols.Discovered(a.routes, merged)
+	warmUp(a.routes, merged)
+	handleAddressChanges(a.routes, merged)
+	a.routes = merged
+
+	err := saveSnapshot(a.snapshotFile(), a.sources)
+	if err != nil {
+		logrus.WithError(err).Warningln("Failed to save routes snapshot")
+	}
+}
+
+// restoreSnapshot serves the last known routes, till each source sends fresh ones
+func (a *theApp) restoreSnapshot() {
+	sources, err := loadSnapshot(a.snapshotFile())
+	if err != nil {
+		logrus.WithError(err).Warningln("Failed to load routes snapshot")
+		return
+	} else if len(sources) == 0 {
+		return
 	}
 
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.sources = sources
+	a.staleSources = make(map[string]bool)
+	for source := range sources {
+		a.staleSources[source] = true
+	}
+
+	merged := make(Routes)
+	merged.Merge(a.sources)
+	a.routes = merged
+	logrus.WithField("routes", len(merged)).Infoln("Restored routes from snapshot...")
+}
+
+// markStale keeps serving routes of the source, but reports them as stale
+func (a *theApp) markStale(source string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.staleSources == nil {
+		a.staleSources = make(map[string]bool)
+	}
+	a.staleSources[source] = true
+	logrus.WithField("source", source).Warningln("Routes are stale, serving the last known ones...")
+}
+
+func (a *theApp) staleSourceNames() (names []string) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for source := range a.staleSources {
+		names = append(names, source)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (a *theApp) isStale() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.staleSources) > 0
+}
+
+var errUnknownServerName = errors.New("unknown server name")
+
+func (a *theApp) ServeTLS(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	serverName := ch.ServerName
 
+	// Don't reveal anything to clients connecting to hosts we don't route
+	if serverName == "" || a.routes.Find(serverName) == nil {
+		if *strictSNI {
+			logrus.WithField("name", serverName).WithField("remote", ch.Conn.RemoteAddr()).
+				Debugln("Rejecting TLS handshake for unknown server name")
+			return nil, errUnknownServerName
+		}
+		return a.serveDefaultCertificate(), nil
+	}
+
+	// Prefer smaller ECDSA certificate for clients supporting it
+	if *ecdsaCertificates {
+		tls := a.findCertificate(serverName, KeyECDSA)
+		if tls != nil && ch.SupportsCertificate(tls) == nil {
+			return tls, nil
+		}
+	}
+
+	return a.findCertificate(serverName, KeyRSA), nil
+}
+
+// serveDefaultCertificate returns certificate of -default-name host, the -default-crt is used otherwise
+func (a *theApp) serveDefaultCertificate() *tls.Certificate {
+	if *defaultName == "" {
+		return nil
+	}
+	return a.findCertificate(*defaultName, KeyRSA)
+}
+
+func (a *theApp) findCertificate(serverName, keyType string) *tls.Certificate {
 	// Try to find that certificate
-	tls := a.certificates.Find(serverName)
+	tls := a.certificates.Find(certificateID(serverName, keyType))
 	if tls == nil {
 		// Check if we should request that certificate
 		route := a.routes.Find(serverName)
 		if route != nil {
-			tls, _ = a.certificates.Load(serverName, a)
+			policy := IssuancePolicy{Mode: route.ACME, Email: route.ACMEEmail}
+			tls, _ = a.certificates.Load(serverName, keyType, policy, a)
 		}
 	}
-
-	return tls, nil
+	return tls
 }
 
 func (a *theApp) serveWellKnown(w http.ResponseWriter, r *http.Request) bool {
@@ -76,15 +285,93 @@ func (a *theApp) ServeHTTP(ww http.ResponseWriter, r *http.Request) {
 	w := newLoggingResponseWriter(ww)
 	defer w.Log(r)
 
+	// Tolerate HTTP/1.0 clients without Host header
+	applyDefaultHost(r)
+
+	// Pass request ID to upstream and error responses
+	ensureRequestID(w, r)
+
+	// Record the request for debugging if the host is captured
+	if w.recording = captures.Start(r); w.recording != nil {
+		defer w.recording.Finish(w)
+	}
+
 	// Serve ACME responses
 	if a.serveWellKnown(w, r) {
 		return
 	}
 
+	// Reject requests which can be smuggled to upstreams
+	if !sanitizeRequest(w, r) {
+		w.Message = "rejected ambiguous request"
+		return
+	}
+
 	// Check if we support virtual host
 	route := a.routes.Find(r.Host)
 	if route == nil {
-		httpServerError(w, r, "no route for", r.Host)
+		w.Message = "no route"
+		serveUnknownHost(w, r)
+		return
+	}
+
+	// Invalidate cached responses
+	if route.Cache && servePurge(w, r) {
+		w.Message = "purge"
+		return
+	}
+
+	// Apply maintenance windows and scheduled overrides
+	route, maintenance := schedules.Apply(route, r.Host)
+	route = applyOverride(a.profile, route)
+	w.SampleLog(route)
+	if !maintenance.IsZero() {
+		w.Message = "maintenance"
+		serveMaintenance(w, r, maintenance)
+		return
+	}
+
+	// Reject requests outside of business hours
+	if !restrictHours(w, r, route) {
+		w.Message = "outside allowed hours"
+		return
+	}
+
+	// Protect upstreams from header floods
+	if !limitHeaders(w, r, route) {
+		w.Message = "headers too large"
+		return
+	}
+
+	// Block exploit probes
+	if !filterRequest(w, r, route) {
+		w.Message = "blocked by filtering rule"
+		return
+	}
+
+	// Block or challenge bots
+	if !filterBots(w, r, route) {
+		w.Message = "bot"
+		return
+	}
+
+	// Limit the request rate of clients across replicas
+	if !limitRate(w, r, route) {
+		w.Message = "rate limited"
+		return
+	}
+
+	// Redirect to canonical host
+	if route.CanonicalHost != "" {
+		u := *r.URL
+		u.Scheme = "https"
+		if r.TLS == nil && route.EnableHTTP {
+			u.Scheme = "http"
+		}
+		u.Host = route.CanonicalHost
+		u.User = nil
+
+		http.Redirect(w, r, u.String(), 301)
 		return
 	}
 
@@ -101,7 +388,7 @@ func (a *theApp) ServeHTTP(ww http.ResponseWriter, r *http.Request) {
 
 	// Check if we have servers that we can use
 	if len(route.Servers) == 0 {
-		httpServerError(w, r, "no upstreams for", r.Host)
+		serveError(w, r, ErrorNoUpstreams, "no upstreams for "+r.Host)
 		return
 	}
 
@@ -110,14 +397,57 @@ func (a *theApp) ServeHTTP(ww http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Strict-Transport-Security", route.HSTS)
 	}
 
-	// Update URL
-	upstream := route.Servers[rand.Int()%len(route.Servers)]
-	if upstream.Proto != "" {
-		r.URL.Scheme = upstream.Proto
+	// Delay, drop or fail the requests of host under chaos testing
+	if !injectFault(w, r, a.profile, route) {
+		return
+	}
+
+	// Let the external processor mutate or reject the request
+	if !externalProcess(w, r, route) {
+		w.Message = "external processor"
+		return
+	}
+
+	// Run the middlewares compiled into the proxy, they can respond on their own or wrap the response writer
+	handler := wrapMiddlewares(route, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		a.serveUpstream(w, rw, r, route)
+	}))
+
+	// Inject the outage banner into HTML responses
+	wrapBanner(route, handler).ServeHTTP(w, r)
+}
+
+// serveUpstream proxies the request, the w is used for logging as the rw could be wrapped by middlewares
+func (a *theApp) serveUpstream(w *loggingResponseWriter, rw http.ResponseWriter, r *http.Request, route *Route) {
+	// Serve cached response
+	capture, cached := serveCached(rw, r, route)
+	if cached {
+		w.Message = "cache hit"
+		return
+	}
+
+	// Limit upgraded connections, they don't take the slots of requests
+	if isUpgradeRequest(r) {
+		if !w.LimitUpgrade(r, route) {
+			serveError(rw, r, ErrorOverloaded, "too many upgraded connections to "+r.Host)
+			return
+		}
+		defer upgradeLimits.Release(route)
 	} else {
-		r.URL.Scheme = "http"
+		// Queue requests over max-requests, shed them after queue timeout
+		if !requestLimits.Acquire(rw, r, route) {
+			w.Message = "shed"
+			return
+		}
+		defer requestLimits.Release(route)
 	}
+
+	// Update URL
+	upstream := route.matchUpstreams(r).pickStickyUpstream(rw, r)
+	r.URL.Scheme = upstream.Scheme()
 	r.URL.Host = upstream.Host()
+	upstreamConns.Acquire(upstream.inFlightKey())
+	defer upstreamConns.Release(upstream.inFlightKey())
 
 	// Pass X-Forwarded information to client
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
@@ -131,19 +461,39 @@ func (a *theApp) ServeHTTP(ww http.ResponseWriter, r *http.Request) {
 	}
 
 	proxy := httputil.ReverseProxy{
-		Director:      func(_ *http.Request) {},
-		Transport:     &defaultTransport,
-		FlushInterval: time.Minute,
+		Director:       func(_ *http.Request) {},
+		Transport:      upstream.Transport(),
+		FlushInterval:  time.Minute,
+		ModifyResponse: route.modifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+	}
+	r = traceUpstream(r, route, &upstream)
+	r = requestUpstreamGzip(r, route)
+	setForwardedHeaders(r, route)
+	setTLSHeaders(r, route)
+	setHeaders(r.Header, route.RequestHeaders)
+	w.CountRequest(r)
+	rewriteHost(r, route)
+	signRequest(r, route)
+	if w.recording != nil {
+		w.recording.Proxied(r, &upstream)
+	}
+	if capture != nil {
+		proxy.ServeHTTP(passEarlyHints(throttleRequest(capture, r, route), r, route), r)
+		capture.Store()
+	} else {
+		proxy.ServeHTTP(passEarlyHints(throttleRequest(rw, r, route), r, route), r)
 	}
-	proxy.ServeHTTP(w, r)
 
 	w.Message = upstream.String()
+	w.Observe(route, &upstream)
 }
 
 func (a *theApp) AddCertificate(name string, certificate *tls.Certificate) {
 	a.certificates.Add(&Certificate{
-		Name: name,
-		TLS:  certificate,
+		Name:    name,
+		KeyType: KeyRSA,
+		TLS:     certificate,
 	})
 }
 
@@ -169,8 +519,8 @@ func (a *theApp) RemoveHttpUri(uriPath string) {
 }
 
 func main() {
-	var wg sync.WaitGroup
 	var app theApp
+	var err error
 
 	flag.Parse()
 
@@ -178,31 +528,162 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	// The services don't have console to log to
+	if *logFile == "" && isService() {
+		*logFile = filepath.Join(dataDirectory, "auto-proxy.log")
+	}
+	if *logFile != "" {
+		os.MkdirAll(filepath.Dir(*logFile), 0700)
+		file, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+		logrus.SetOutput(file)
+	}
+
+	// Install, uninstall or run as Windows service
+	exit, err := runService(*serviceAction)
+	if err != nil {
+		logrus.Fatalln(err)
+	} else if exit {
+		return
+	}
+
+	initContainerMetrics()
+
+	upstreamPreference, err = parseUpstreamPrefer(*upstreamPrefer)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	dockerDaemons, err = parseDockerHosts(*dockerHost)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	if *accessLogBatch < 1 || *accessLogFlush <= 0 {
+		logrus.Fatalln("access-log-batch and access-log-flush have to be positive")
+	}
+	_, err = parseSchema(*defaultSchema)
+	if err != nil {
+		logrus.Fatalln("default-schema:", err)
+	}
+	accessLog, err = parseAccessLog(*accessLogTargets)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	err = validateUnknownHost(*unknownHost)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	if *dockerBackoffMax < ReconnectTime {
+		logrus.Fatalln("docker-backoff-max: expected at least", ReconnectTime)
+	}
+	if *sessionTicketRotation < time.Minute {
+		logrus.Fatalln("session-ticket-rotation: expected at least 1m")
+	}
+	if *dockerEventBuffer < 2 {
+		logrus.Fatalln("docker-event-buffer: expected at least 2 events")
+	}
+	if *defaultWeightBy != WeightByCPU && *defaultWeightBy != WeightByMemory && *defaultWeightBy != WeightByNone {
+		logrus.Fatalln("weight-by: expected cpu, memory or none")
+	}
+
+	err = validateProvider(*provider)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	err = configureOutboundProxy(*outboundProxyURL, *outboundNoProxy)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	config, err = loadConfig(*configFile)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
 	// Create directories
 	os.MkdirAll(*certsDirectory, 0700)
-	os.MkdirAll(path.Dir(*accountKey), 0700)
-	os.MkdirAll(path.Dir(*defaultCert), 0700)
-	os.MkdirAll(path.Dir(*defaultKey), 0700)
+	os.MkdirAll(filepath.Dir(*accountKey), 0700)
+	os.MkdirAll(filepath.Dir(*defaultCert), 0700)
+	os.MkdirAll(filepath.Dir(*defaultKey), 0700)
+
+	// Restore the backoff of certificate requests
+	if *sanBatch > 100 || *sanGroupSize > 100 {
+		logrus.Fatalln("Let's Encrypt allows at most 100 names per certificate")
+	}
+	err = acmeRateLimits.Load(filepath.Join(filepath.Dir(*accountKey), "ratelimits.json"))
+	if err != nil {
+		logrus.WithError(err).Warningln("Failed to load ACME rate limits")
+	}
+
+	// Read the key to encrypt private keys
+	privateKeyStorage, err = newStorageKey(*storageKeyFile, *storageKeyCommand)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	err = loadSigningKey(*signKeyFile)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	// Connect to shared store
+	sharedStore, err = newStore(*storeURI)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	// Import certificates of other tools
+	if *importSources != "" {
+		err = importCertificates(*importSources, *certsDirectory)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+		if *importOnly {
+			return
+		}
+	}
 
+	// Connect to Redis
+	redis, err = newRedisClient(*redisURI)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	// Open audit log
+	err = auditLog.Open(*auditLogFile)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	upstreamDialer = &resolvingDialer{net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}}
 	defaultTransport = http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         upstreamDialer.DialContext,
 		TLSHandshakeTimeout: 10 * time.Second,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: *insecureSkipVerify,
 		},
 	}
+	defaultTransport.DialTLSContext = warmDialTLS("", defaultTransport.TLSClientConfig)
+	h2cTransport = http.Transport{
+		DialContext: upstreamDialer.DialContext,
+		Protocols:   new(http.Protocols),
+	}
+	h2cTransport.Protocols.SetUnencryptedHTTP2(true)
 
 	// Load or create default certificate
 	defaultCertificate = &Certificate{
 		Name:            "default",
+		KeyType:         KeyRSA,
 		CertificateFile: *defaultCert,
 		KeyFile:         *defaultKey,
 	}
-	err := defaultCertificate.Load()
+	err = defaultCertificate.Load()
 	if os.IsNotExist(err) {
 		err = defaultCertificate.CreateSelfSigned()
 		if err != nil {
@@ -212,42 +693,135 @@ func main() {
 		logrus.Fatalln(err)
 	}
 
-	// Listen for HTTP
-	if *listenHttp != "" {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := ListenAndServe(*listenHttp, &app)
-			if err != nil {
-				logrus.Fatalln(err)
-			}
-		}()
+	// Create logical proxies of profiles
+	profileApps[""] = &app
+	for name, profile := range config.Profiles {
+		profileApp, err := newProfileApp(name, profile)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+		os.MkdirAll(profileApp.certificates.Directory, 0700)
+		profileApps[name] = profileApp
+	}
+
+	// Serve last known routes till docker is enumerated
+	for _, profileApp := range profileApps {
+		profileApp.restoreSnapshot()
+	}
+
+	// Wait for Docker when the proxy boots before the daemon
+	if *waitDocker > 0 {
+		if *serveBeforeDocker {
+			go gateOnDocker(*waitDocker)
+		} else {
+			logrus.WithField("timeout", waitDocker.String()).Infoln("Waiting for docker daemon...")
+			gateOnDocker(*waitDocker)
+		}
+	}
+
+	// Listen for HTTP and HTTPS
+	err = serveProfile("", &app, defaultProfile())
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	for name, profile := range config.Profiles {
+		err = serveProfile(name, profileApps[name], profile)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
 	}
 
-	// Listen for HTTPS
-	if *listenHttps != "" {
-		wg.Add(1)
+	// Listen for admin API
+	if *listenAdmin != "" {
+		admin, err := newAdminAPI(&app)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+
 		go func() {
-			defer wg.Done()
-			err := ListenAndServeTLS(*listenHttps, defaultCertificate, &app)
+			err := ListenAndServeAdmin(*listenAdmin, admin)
 			if err != nil {
 				logrus.Fatalln(err)
 			}
 		}()
 	}
 
+	// Discover the routes of all sources in parallel, the first results are merged at once
+	dockerSources := make([]*routeSource, len(dockerDaemons))
+	for idx, daemon := range dockerDaemons {
+		dockerSources[idx] = reconciler.Register(daemon.Source())
+	}
+	var filesSource, kvSource *routeSource
+	if *routesDir != "" {
+		filesSource = reconciler.Register(SourceFiles)
+	}
+	if *routesKV != "" {
+		kvSource = reconciler.Register(SourceKV)
+	}
+	reconciler.Start()
+
 	// Watch for docker events to generate routes
-	go func() {
-		watchEvents(app.update)
-	}()
-
-	// Renew certificates
-	go func() {
-		for {
-			time.Sleep(time.Hour)
-			app.certificates.Tick(&app)
+	for idx, daemon := range dockerDaemons {
+		go watchEvents(daemon, dockerSources[idx])
+	}
+
+	// Watch for route files
+	if filesSource != nil {
+		os.MkdirAll(*routesDir, 0700)
+		go watchRoutesDir(*routesDir, filesSource)
+	}
+
+	// Watch for manual routes
+	if kvSource != nil {
+		go watchKV(*routesKV, kvSource)
+	}
+
+	// Expose certificates expiry
+	metrics.OnCollect(collectCertificates)
+	metrics.OnCollect(restartStorms.Collect)
+	metrics.OnCollect(collectConflicts)
+	metrics.OnCollect(reconciler.Collect)
+
+	// Keep pre-established connections to upstreams
+	go watchPrewarm()
+
+	// Forget the state of upstreams removed from all profiles
+	go pruneUpstreamStates()
+
+	// Forget the expired overrides and faults, their end is audited
+	go overrides.watchExpired()
+	go faults.watchExpired()
+
+	for _, profileApp := range profileApps {
+		// Eject upstreams with high latency
+		go profileApp.watchOutliers()
+
+		// Check health of upstreams
+		go profileApp.watchHealth()
+
+		// Renew certificates
+		go func(app *theApp) {
+			for {
+				time.Sleep(time.Hour)
+				app.certificates.Tick(app)
+			}
+		}(profileApp)
+
+		// Receive certificates from other replicas
+		if sharedStore != nil {
+			go func(app *theApp) {
+				for {
+					time.Sleep(*storeSyncInterval)
+					app.certificates.Sync()
+				}
+			}(profileApp)
 		}
-	}()
+	}
+
+	// Stop gracefully on SIGTERM
+	go watchShutdown()
+	go emitLifecycle(newLifecycleEvent(LifecycleStarted, ""))
 
-	wg.Wait()
+	// Apply changed listeners without restart
+	watchReloads()
 }
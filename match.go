@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// parseMatch validates name:value (header) or name=value (cookie) predicate, the value is optional
+func parseMatch(value, separator string) (string, error) {
+	name := strings.TrimSpace(strings.SplitN(value, separator, 2)[0])
+	if name == "" {
+		return "", errors.New("expected name" + separator + "value")
+	}
+	return value, nil
+}
+
+func splitMatch(match, separator string) (name, value string, hasValue bool) {
+	parts := strings.SplitN(match, separator, 2)
+	name = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		return name, strings.TrimSpace(parts[1]), true
+	}
+	return name, "", false
+}
+
+func (u *Upstream) hasMatch() bool {
+	return u.MatchHeader != "" || u.MatchCookie != ""
+}
+
+// Matches returns true if the request matches all predicates of the upstream
+func (u *Upstream) Matches(r *http.Request) bool {
+	if u.MatchHeader != "" {
+		name, value, hasValue := splitMatch(u.MatchHeader, ":")
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || hasValue && strings.Join(values, ",") != value {
+			return false
+		}
+	}
+	if u.MatchCookie != "" {
+		name, value, hasValue := splitMatch(u.MatchCookie, "=")
+		cookie, err := r.Cookie(name)
+		if err != nil || hasValue && cookie.Value != value {
+			return false
+		}
+	}
+	return true
+}
+
+// matchUpstreams returns the route with upstreams matching the request,
+// the requests not matching any predicate are sent to upstreams without predicates
+func (r *Route) matchUpstreams(req *http.Request) *Route {
+	predicates := false
+	for idx := range r.Servers {
+		if r.Servers[idx].hasMatch() {
+			predicates = true
+			break
+		}
+	}
+	if !predicates {
+		return r
+	}
+
+	var matched, stable []Upstream
+	for _, upstream := range r.Servers {
+		if !upstream.hasMatch() {
+			stable = append(stable, upstream)
+		} else if upstream.Matches(req) {
+			matched = append(matched, upstream)
+		}
+	}
+
+	servers := matched
+	if len(servers) == 0 {
+		servers = stable
+	}
+	if len(servers) == 0 {
+		return r
+	}
+
+	copied := *r
+	copied.Servers = servers
+	return &copied
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// metricVec is a family of metrics with the same name, exposed in Prometheus text format
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+	lock    sync.Mutex
+}
+
+type metricsRegistry struct {
+	list       []*metricVec
+	collectors []func()
+	lock       sync.Mutex
+}
+
+var metrics metricsRegistry
+
+func (r *metricsRegistry) register(m *metricVec) *metricVec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.list = append(r.list, m)
+	return m
+}
+
+// OnCollect registers function called before metrics are written, used to update gauges
+func (r *metricsRegistry) OnCollect(collector func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+func (r *metricsRegistry) Write(w io.Writer) {
+	r.lock.Lock()
+	list := append([]*metricVec{}, r.list...)
+	collectors := append([]func(){}, r.collectors...)
+	r.lock.Unlock()
+
+	for _, collector := range collectors {
+		collector()
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return metrics.register(&metricVec{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return metrics.register(&metricVec{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return metrics.register(&metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+func (m *metricVec) get(labels []string) *metricSeries {
+	if len(labels) != len(m.labels) {
+		panic("metrics: wrong number of labels for " + m.name)
+	}
+	if m.series == nil {
+		m.series = make(map[string]*metricSeries)
+	}
+	key := strings.Join(labels, "\x00")
+	series := m.series[key]
+	if series == nil {
+		series = &metricSeries{labels: append([]string{}, labels...)}
+		if m.buckets != nil {
+			series.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = series
+	}
+	return series
+}
+
+func (m *metricVec) Add(value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(labels).value += value
+}
+
+func (m *metricVec) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+func (m *metricVec) Set(value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(labels).value = value
+}
+
+func (m *metricVec) Observe(value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	series := m.get(labels)
+	series.value += value
+	series.count++
+	for idx, bucket := range m.buckets {
+		if value <= bucket {
+			series.counts[idx]++
+		}
+	}
+}
+
+// Sum returns the total of series starting with given labels
+func (m *metricVec) Sum(labels ...string) (sum float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, series := range m.series {
+		matches := len(series.labels) >= len(labels)
+		for idx := 0; matches && idx < len(labels); idx++ {
+			matches = series.labels[idx] == labels[idx]
+		}
+		if matches {
+			sum += series.value
+		}
+	}
+	return
+}
+
+// Reset removes all series, used by gauges which are recalculated on collect
+func (m *metricVec) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.series = nil
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for idx, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[idx]))
+	}
+	for idx := 0; idx+1 < len(extra); idx += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[idx], extra[idx+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, series.labels), formatValue(series.value))
+			continue
+		}
+
+		for idx, bucket := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				formatLabels(m.labels, series.labels, "le", formatValue(bucket)), series.counts[idx])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+			formatLabels(m.labels, series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, series.labels), formatValue(series.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, series.labels), series.count)
+	}
+}
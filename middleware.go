@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const middlewareOptionLabel = "middleware."
+
+// Middleware is a custom request processing compiled into the proxy (ie. tenant lookup or custom auth).
+// Add a file to the package registering it with RegisterMiddleware from init(),
+// the routes enable it by name with auto-proxy.middlewares like the middlewares of -config.
+type Middleware interface {
+	// Wrap returns the handler processing requests of the route before next,
+	// the options are labels auto-proxy.middleware.<name>.<option> of the route
+	Wrap(route *Route, options map[string]string, next http.Handler) http.Handler
+}
+
+// MiddlewareFunc is an adapter to use ordinary function as Middleware
+type MiddlewareFunc func(route *Route, options map[string]string, next http.Handler) http.Handler
+
+func (f MiddlewareFunc) Wrap(route *Route, options map[string]string, next http.Handler) http.Handler {
+	return f(route, options, next)
+}
+
+// OptionsValidator can be implemented by Middleware to reject invalid labels of containers
+type OptionsValidator interface {
+	ValidateOptions(options map[string]string) error
+}
+
+var registeredMiddlewares = make(map[string]Middleware)
+
+// RegisterMiddleware makes the middleware available to routes, it has to be called from init()
+func RegisterMiddleware(name string, middleware Middleware) {
+	if name == "" || strings.ContainsAny(name, ",.") {
+		panic("middleware: invalid name " + name)
+	} else if _, ok := registeredMiddlewares[name]; ok {
+		panic("middleware: " + name + " is already registered")
+	}
+	registeredMiddlewares[name] = middleware
+}
+
+func registeredMiddlewareNames() (names []string) {
+	for name := range registeredMiddlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// parseMiddlewareLabel reads middleware.<name>.<option>
+func (r *RouteBuilder) parseMiddlewareLabel(key, value string) bool {
+	nameOption := strings.SplitN(key, ".", 2)
+	if len(nameOption) != 2 {
+		return false
+	}
+	if r.MiddlewareOptions == nil {
+		r.MiddlewareOptions = make(map[string]map[string]string)
+	}
+	options := r.MiddlewareOptions[nameOption[0]]
+	if options == nil {
+		options = make(map[string]string)
+		r.MiddlewareOptions[nameOption[0]] = options
+	}
+	options[nameOption[1]] = value
+	return true
+}
+
+// validateMiddlewares is called once all labels are parsed, the options of middlewares may come before them
+func (r *RouteBuilder) validateMiddlewares() error {
+	for _, name := range r.Middlewares {
+		if err := checkSecrets(r.VirtualHost, r.MiddlewareOptions[name]); err != nil {
+			return errors.New("middleware " + name + ": " + err.Error())
+		}
+		validator, ok := registeredMiddlewares[name].(OptionsValidator)
+		if !ok {
+			continue
+		}
+		options, err := resolveSecrets(r.MiddlewareOptions[name])
+		if err == nil {
+			err = validator.ValidateOptions(options)
+		}
+		if err != nil {
+			return errors.New("middleware " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// wrapMiddlewares runs the middlewares of route in the order of auto-proxy.middlewares,
+// the middlewares get the content of secrets referenced by their options
+func wrapMiddlewares(route *Route, handler http.Handler) http.Handler {
+	if len(route.Middlewares) == 0 {
+		return handler
+	}
+	options, err := resolveRouteSecrets(route)
+	if err != nil {
+		// Never run the middleware without its credentials
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveError(w, r, ErrorSecretUnavailable, err.Error())
+		})
+	}
+
+	for idx := len(route.Middlewares) - 1; idx >= 0; idx-- {
+		name := route.Middlewares[idx]
+		middleware, ok := registeredMiddlewares[name]
+		if !ok {
+			continue
+		}
+		handler = middleware.Wrap(route, options[name], handler)
+	}
+	return handler
+}
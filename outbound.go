@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/net/http/httpproxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// outboundProxyConfig is used by calls leaving the network (ACME, webhooks, challenge hooks),
+// it defaults to HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+var outboundProxyConfig = httpproxy.FromEnvironment()
+
+var outboundTransport = &http.Transport{
+	Proxy: outboundProxy,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:   true,
+	TLSHandshakeTimeout: 10 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+var outboundProxyFunc = outboundProxyConfig.ProxyFunc()
+
+// configureOutboundProxy overrides the proxy from environment with -outbound-proxy and -outbound-no-proxy
+func configureOutboundProxy(proxy, noProxy string) error {
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return err
+		} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+			return errors.New("outbound-proxy: expected http://host:port, https://host:port or socks5://host:port")
+		}
+		outboundProxyConfig.HTTPProxy = proxy
+		outboundProxyConfig.HTTPSProxy = proxy
+	}
+	if noProxy != "" {
+		outboundProxyConfig.NoProxy = noProxy
+	}
+	outboundProxyFunc = outboundProxyConfig.ProxyFunc()
+	return nil
+}
+
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	return outboundProxyFunc(req.URL)
+}
+
+// outboundEnv passes the proxy to challenge hooks, so DNS provider calls go through it as well
+func outboundEnv() (env []string) {
+	for _, pair := range [][2]string{
+		{"HTTP_PROXY", outboundProxyConfig.HTTPProxy},
+		{"HTTPS_PROXY", outboundProxyConfig.HTTPSProxy},
+		{"NO_PROXY", outboundProxyConfig.NoProxy},
+	} {
+		if pair[1] != "" {
+			env = append(env, pair[0]+"="+pair[1], strings.ToLower(pair[0])+"="+pair[1])
+		}
+	}
+	return
+}
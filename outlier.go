@@ -0,0 +1,244 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+const outlierSamples = 200
+const outlierMinSamples = 20
+const outlierCheckInterval = 5 * time.Second
+const outlierReadmitMinWeight = 0.1
+const outlierMaxEjectedRatio = 0.5
+
+var upstreamEjections = newCounter("auto_proxy_upstream_ejections_total",
+	"Number of upstreams ejected because of high latency", "host", "upstream")
+
+// upstreamState keeps the latency of the upstream, it survives the routes rebuild
+type upstreamState struct {
+	latencies       []float64
+	next            int
+	deviatingSince  time.Time
+	ejectedUntil    time.Time
+	ejectedDuration time.Duration
+	ejections       uint
+	warming         bool
+	readySince      time.Time
+	health          upstreamHealth
+}
+
+type upstreamStates struct {
+	list map[string]*upstreamState
+	lock sync.Mutex
+}
+
+var upstreamsState upstreamStates
+
+func (s *upstreamStates) get(upstream *Upstream) *upstreamState {
+	if s.list == nil {
+		s.list = make(map[string]*upstreamState)
+	}
+	key := upstream.String()
+	state := s.list[key]
+	if state == nil {
+		state = &upstreamState{}
+		s.list[key] = state
+	}
+	return state
+}
+
+func (s *upstreamStates) Observe(upstream *Upstream, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.get(upstream)
+	if len(state.latencies) < outlierSamples {
+		state.latencies = append(state.latencies, latency.Seconds())
+	} else {
+		state.latencies[state.next] = latency.Seconds()
+		state.next = (state.next + 1) % outlierSamples
+	}
+}
+
+func (u *upstreamState) p99() (float64, bool) {
+	if len(u.latencies) < outlierMinSamples {
+		return 0, false
+	}
+	sorted := append([]float64{}, u.latencies...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)*99/100], true
+}
+
+// weight is 0 when upstream is ejected, and slowly grows to 1 after being re-admitted
+func (u *upstreamState) weight(now time.Time) float64 {
+	if u.ejectedUntil.IsZero() {
+		return 1
+	} else if now.Before(u.ejectedUntil) {
+		return 0
+	}
+
+	weight := float64(now.Sub(u.ejectedUntil)) / float64(u.ejectedDuration)
+	if weight >= 1 {
+		return 1
+	} else if weight < outlierReadmitMinWeight {
+		return outlierReadmitMinWeight
+	}
+	return weight
+}
+
+// Weights returns the load balancing weights of the servers
+func (s *upstreamStates) Weights(route *Route) []float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	weights := make([]float64, len(route.Servers))
+	for idx := range route.Servers {
+		weights[idx] = 1
+		if route.Servers[idx].Weight > 0 {
+			weights[idx] = route.Servers[idx].Weight
+		}
+		if route.OutlierFactor > 0 {
+			weights[idx] *= s.get(&route.Servers[idx]).weight(now)
+		}
+		if route.SlowStart > 0 || route.WarmupRequests > 0 {
+			weights[idx] *= s.get(&route.Servers[idx]).slowStart(now, route)
+		}
+		if route.HealthPath != "" && !s.get(&route.Servers[idx]).healthy() {
+			weights[idx] = 0
+		}
+	}
+	return weights
+}
+
+func (s *upstreamStates) check(route *Route) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var p99s []float64
+	states := make([]*upstreamState, len(route.Servers))
+	ejected := 0
+
+	for idx := range route.Servers {
+		states[idx] = s.get(&route.Servers[idx])
+		if states[idx].weight(now) == 0 {
+			ejected++
+		} else if p99, ok := states[idx].p99(); ok {
+			p99s = append(p99s, p99)
+		}
+	}
+
+	// We need siblings to compare with
+	if len(p99s) < 2 {
+		return
+	}
+	sort.Float64s(p99s)
+	median := p99s[len(p99s)/2]
+
+	for idx, state := range states {
+		p99, ok := state.p99()
+		if !ok || state.weight(now) == 0 {
+			continue
+		}
+
+		if p99 <= median*route.OutlierFactor {
+			state.deviatingSince = time.Time{}
+			if state.weight(now) == 1 {
+				state.ejections = 0
+			}
+			continue
+		}
+
+		if state.deviatingSince.IsZero() {
+			state.deviatingSince = now
+		}
+		if now.Sub(state.deviatingSince) < route.OutlierInterval {
+			continue
+		}
+
+		// Never eject too many servers
+		if float64(ejected+1) > float64(len(route.Servers))*outlierMaxEjectedRatio {
+			continue
+		}
+
+		ejected++
+		state.ejectedDuration = route.OutlierEjection << state.ejections
+		if state.ejections < 4 {
+			state.ejections++
+		}
+		state.ejectedUntil = now.Add(state.ejectedDuration)
+		state.deviatingSince = time.Time{}
+		state.latencies = nil
+		state.next = 0
+
+		upstream := &route.Servers[idx]
+		upstreamEjections.Inc(route.VirtualHost, upstream.Container)
+		logrus.WithField("host", route.VirtualHost).WithField("upstream", upstream.String()).
+			WithField("p99", p99).WithField("median", median).WithField("duration", state.ejectedDuration.String()).
+			Warningln("Ejecting upstream because of high latency")
+	}
+}
+
+// prune removes the state of upstreams which are gone from the routes of all profiles
+func (s *upstreamStates) prune(profiles []Routes) {
+	current := make(map[string]bool)
+	for _, routes := range profiles {
+		for _, route := range routes {
+			for idx := range route.Servers {
+				current[route.Servers[idx].String()] = true
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.list {
+		if !current[key] {
+			delete(s.list, key)
+		}
+	}
+}
+
+func (a *theApp) watchOutliers() {
+	for {
+		time.Sleep(outlierCheckInterval)
+
+		a.lock.RLock()
+		routes := a.routes
+		a.lock.RUnlock()
+
+		for _, route := range routes {
+			if route.OutlierFactor > 0 && len(route.Servers) > 1 {
+				upstreamsState.check(route)
+			}
+		}
+	}
+}
+
+// pruneUpstreamStates forgets the upstreams gone from all profiles, the state is shared by profiles
+func pruneUpstreamStates() {
+	names := make([]string, 0, len(profileApps))
+	for name := range profileApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for {
+		time.Sleep(outlierCheckInterval)
+
+		// The routes stay locked, so the upstreams discovered by update are not pruned before being routed
+		profiles := make([]Routes, 0, len(names))
+		for _, name := range names {
+			app := profileApps[name]
+			app.lock.RLock()
+			profiles = append(profiles, app.routes)
+		}
+		upstreamsState.prune(profiles)
+		for _, name := range names {
+			profileApps[name].lock.RUnlock()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"time"
+)
+
+const (
+	defaultOverrideTTL = 15 * time.Minute
+	maxOverrideTTL     = 24 * time.Hour
+)
+
+// The container name of overridden upstream in access log and metrics
+const overrideContainer = "override"
+
+var overrideRequests = newCounter("auto_proxy_override_requests_total",
+	"Number of requests proxied to the upstream override of host", "host")
+
+// Override points the host to an arbitrary address till it expires, then the discovered upstreams are used again
+type Override struct {
+	hostEntry
+	Upstream string `json:"upstream"`
+	Proto    string `json:"proto,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
+
+	upstream Upstream
+}
+
+var overrides = hostRegistry[*Override]{
+	name:     "override",
+	newEntry: func() *Override { return &Override{} },
+	added:    "Upstream of host overridden",
+	removed:  "Upstream override removed, restoring discovered upstreams",
+	expired:  "Upstream override expired, restoring discovered upstreams",
+}
+
+func (o *Override) compile() error {
+	host, port, err := net.SplitHostPort(o.Upstream)
+	if err != nil || host == "" || port == "" {
+		return errors.New("override: expected upstream as host:port")
+	}
+	switch o.Proto {
+	case "", ProtoHTTP, ProtoHTTPS, ProtoH2C:
+	default:
+		return errors.New("override: expected proto http, https or h2c")
+	}
+
+	ttl := defaultOverrideTTL
+	if o.TTL != "" {
+		ttl, err = time.ParseDuration(o.TTL)
+		if err != nil || ttl <= 0 || ttl > maxOverrideTTL {
+			return errors.New("override: expected ttl up to 24h")
+		}
+	}
+	o.Created = time.Now()
+	o.Expires = o.Created.Add(ttl)
+	o.upstream = Upstream{Container: overrideContainer, IP: host, Port: port, Proto: o.Proto}
+	return nil
+}
+
+func (o *Override) logFields() logrus.Fields {
+	return logrus.Fields{"upstream": o.Upstream}
+}
+
+func (o *Override) apply(route *Route) *Route {
+	if route == nil {
+		return nil
+	}
+	copied := *route
+	copied.Servers = []Upstream{o.upstream}
+	copied.ALPNServers = nil
+	return &copied
+}
+
+// applyOverride returns the route with the upstream replaced by active override of its host in profile
+func applyOverride(profile string, route *Route) *Route {
+	override, ok := overrides.Get(profile, route.VirtualHost)
+	if !ok {
+		return route
+	}
+	overrideRequests.Inc(route.VirtualHost)
+	return override.apply(route)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TLSTerminate   = "terminate"
+	TLSPassthrough = "passthrough"
+)
+
+const clientHelloTimeout = 10 * time.Second
+const passthroughDialTimeout = 10 * time.Second
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// readOnlyConn feeds the TLS handshake with data from reader and drops anything written
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
+
+func (c readOnlyConn) Write(data []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekedConn replays the data read when peeking the client hello
+type peekedConn struct {
+	net.Conn
+	peeked      *bytes.Buffer
+	fingerprint string
+	protocols   []string
+}
+
+func (c *peekedConn) Read(data []byte) (int, error) {
+	if c.peeked.Len() > 0 {
+		return c.peeked.Read(data)
+	}
+	return c.Conn.Read(data)
+}
+
+// Unwrap writes the replayed data to upstream and returns the underlying connection,
+// so copying between TCP connections can use splice on Linux
+func (c *peekedConn) Unwrap(upstream io.Writer) (net.Conn, error) {
+	if c.peeked.Len() > 0 {
+		if _, err := c.peeked.WriteTo(upstream); err != nil {
+			return nil, err
+		}
+	}
+	return c.Conn, nil
+}
+
+// peekServerName reads the client hello and returns the requested server name without consuming it
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	var serverName, fingerprint string
+	var protocols []string
+
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	err := tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			fingerprint = ja3(hello)
+			protocols = hello.SupportedProtos
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	wrapped := &peekedConn{Conn: conn, peeked: &peeked, fingerprint: fingerprint, protocols: protocols}
+	if err != nil && serverName == "" && peeked.Len() == 0 {
+		return "", wrapped, err
+	}
+	return serverName, wrapped, nil
+}
+
+// sniListener forwards raw TLS connections of passthrough routes, the other connections are accepted
+type sniListener struct {
+	net.Listener
+	handler TLSHandler
+	conns   chan net.Conn
+	err     chan error
+	closed  chan struct{}
+	close   sync.Once
+}
+
+func newSNIListener(listener net.Listener, handler TLSHandler) *sniListener {
+	l := &sniListener{
+		Listener: listener,
+		handler:  handler,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *sniListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err <- err
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *sniListener) handle(conn net.Conn) {
+	serverName, conn, err := peekServerName(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if route := l.handler.FindPassthrough(serverName); route != nil {
+		passthroughConnection(conn, route)
+		return
+	}
+
+	if peeked, ok := conn.(*peekedConn); ok {
+		if route, protocol := l.handler.FindALPN(serverName, peeked.protocols); route != nil {
+			alpnConnection(conn, route, protocol, l.handler)
+			return
+		}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		// The listener was drained while the client hello was peeked
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.close.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// keep returning the error to all callers
+		l.err <- err
+		return nil, err
+	}
+}
+
+// FindPassthrough returns the route if TLS connections to server name shouldn't be terminated
+func (a *theApp) FindPassthrough(serverName string) *Route {
+	route := a.routes.Find(serverName)
+	if route == nil || route.TLS != TLSPassthrough || len(route.Servers) == 0 {
+		return nil
+	}
+	return route
+}
+
+// dialStream connects to the TCP or unix socket of upstream
+func dialStream(route *Route, upstream Upstream) (net.Conn, error) {
+	network, address := "tcp", upstream.Host()
+	if upstream.Socket != "" {
+		path, err := resolveSocket(upstream.Socket)
+		if err != nil {
+			return nil, err
+		}
+		network, address = "unix", path
+	}
+	conn, err := net.DialTimeout(network, address, passthroughDialTimeout)
+	if err != nil {
+		upstreamConnectFailures.Inc(route.VirtualHost, upstream.Container)
+	}
+	return conn, err
+}
+
+// passthroughConnection copies the TLS stream between client and upstream
+func passthroughConnection(conn net.Conn, route *Route) {
+	defer conn.Close()
+
+	upstream := route.pickUpstream()
+	log := logrus.WithField("host", route.VirtualHost).WithField("upstream", upstream.String()).
+		WithField("remote", conn.RemoteAddr().String())
+
+	if !streamLimits.Acquire(route) {
+		log.Debugln("Too many passthrough connections")
+		return
+	}
+	defer streamLimits.Release(route)
+
+	upstreamConn, err := dialStream(route, upstream)
+	if err != nil {
+		log.WithError(err).Warningln("Failed to connect to passthrough upstream")
+		return
+	}
+	defer upstreamConn.Close()
+
+	client := conn
+	if peeked, ok := conn.(*peekedConn); ok {
+		client, err = peeked.Unwrap(upstreamConn)
+		if err != nil {
+			log.WithError(err).Warningln("Failed to forward client hello to passthrough upstream")
+			return
+		}
+	}
+
+	log.Debugln("Passing through TLS connection...")
+	if err := copyStream(route, client, upstreamConn); err != nil {
+		log.WithError(err).Debugln("Passthrough connection aborted")
+	}
+}
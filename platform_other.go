@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import "net/url"
+
+// The directory with certificates, keys and snapshots
+const dataDirectory = "/etc/auto-proxy"
+
+// localPath returns the path of file:// URL
+func localPath(u *url.URL) string {
+	return u.Path
+}
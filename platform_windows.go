@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The directory with certificates, keys and snapshots, ie. C:\ProgramData\auto-proxy
+var dataDirectory = filepath.Join(programData(), "auto-proxy")
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+// localPath returns the path of file:// URL, the file:///C:/share is C:\share
+func localPath(u *url.URL) string {
+	path := u.Path
+	if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	if u.Host != "" {
+		// UNC path file://server/share
+		path = `\\` + u.Host + path
+	}
+	return filepath.FromSlash(strings.TrimSuffix(path, "/"))
+}
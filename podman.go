@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"github.com/fsouza/go-dockerclient"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ProviderDocker = "docker"
+	ProviderPodman = "podman"
+)
+
+func validateProvider(provider string) error {
+	if provider != ProviderDocker && provider != ProviderPodman {
+		return errors.New("provider: expected docker or podman")
+	}
+	return nil
+}
+
+// podmanSocket returns the API socket of rootless Podman if it is running, the rootful one otherwise
+func podmanSocket() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" && os.Geteuid() != 0 {
+		socket := filepath.Join(runtimeDir, "podman", "podman.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// normalizeEvent fills the fields Podman leaves empty, ie. status of events is in action only
+// and the id is in actor, so the events are handled the same as from Docker.
+// It returns false for the events of other objects than containers (pods, images).
+func normalizeEvent(event *docker.APIEvents) bool {
+	if event.Type != "" && event.Type != "container" {
+		return false
+	}
+	if event.Status == "" {
+		event.Status = event.Action
+	}
+	if event.ID == "" {
+		event.ID = event.Actor.ID
+	}
+	if event.Status == "died" {
+		event.Status = "die"
+	}
+	return len(event.ID) >= 12
+}
+
+// isRootlessNetwork tells if the container runs in user mode networking of rootless Podman,
+// its address (ie. 10.0.2.100 of slirp4netns) is not reachable from host, only the published ports are
+func isRootlessNetwork(container *docker.Container) bool {
+	if container.HostConfig == nil {
+		return false
+	}
+	mode := container.HostConfig.NetworkMode
+	return strings.HasPrefix(mode, "slirp4netns") || strings.HasPrefix(mode, "pasta")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// isAllowedDomain checks the host against -allowed-domains, the *.example.com allows only subdomains
+func isAllowedDomain(host string) bool {
+	if *allowedDomains == "" {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range strings.Split(*allowedDomains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(host, domain[1:]) {
+				return true
+			}
+		} else if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHosts removes hosts which can't be claimed by the upstream
+func allowedHosts(hosts []string, upstream *Upstream) (allowed []string) {
+	for _, host := range hosts {
+		if isAllowedDomain(host) {
+			allowed = append(allowed, host)
+			continue
+		}
+		logrus.WithField("host", host).WithField("upstream", upstream.String()).
+			Warningln("Rejecting route for domain which is not allowed")
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+func (a *adminAPI) getRuntime(w http.ResponseWriter, r *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	var gcStats debug.GCStats
+	debug.ReadGCStats(&gcStats)
+
+	writeJSON(w, map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+		"cpus":       runtime.NumCPU(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"version":    runtime.Version(),
+		"memory":     memStats,
+		"gc": map[string]interface{}{
+			"last":        gcStats.LastGC,
+			"count":       gcStats.NumGC,
+			"pause_total": gcStats.PauseTotal.String(),
+			"pause_last": func() string {
+				if len(gcStats.Pause) == 0 {
+					return time.Duration(0).String()
+				}
+				return gcStats.Pause[0].String()
+			}(),
+		},
+	})
+}
+
+// registerPprof exposes profiling endpoints, the goroutine dump is at /debug/pprof/goroutine?debug=2
+func (a *adminAPI) registerPprof() {
+	a.handle("GET /debug/pprof/", pprof.Index)
+	a.handle("GET /debug/pprof/cmdline", pprof.Cmdline)
+	a.handle("GET /debug/pprof/profile", pprof.Profile)
+	a.handle("GET /debug/pprof/symbol", pprof.Symbol)
+	a.handle("POST /debug/pprof/symbol", pprof.Symbol)
+	a.handle("GET /debug/pprof/trace", pprof.Trace)
+	a.handle("GET /debug/runtime", a.getRuntime)
+}
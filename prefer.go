@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The default order, the host port bindings are the only addresses usable for Swarm nodes
+const defaultUpstreamPrefer = "hostport,bridge,network,ipv6"
+
+var upstreamPreference []string
+
+// parseUpstreamPrefer validates the list of address sources, ie. hostport,network:web,bridge
+func parseUpstreamPrefer(value string) ([]string, error) {
+	var list []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		switch {
+		case source == "hostport", source == "bridge", source == "network", source == "ipv6":
+		case strings.HasPrefix(source, "network:") && source != "network:":
+		default:
+			return nil, errors.New("upstream-prefer: unknown address source " + source)
+		}
+		list = append(list, source)
+	}
+	return list, nil
+}
+
+func sortedNetworks(settings *docker.NetworkSettings) []string {
+	var names []string
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pickUpstreamAddress returns the first address found in order of preference,
+// the port changes only when host port binding is used. The containers of off-host daemon at remote address
+// are reached only on their published ports.
+func pickUpstreamAddress(container *docker.Container, port string, preference []string, remote string) (string, string) {
+	settings := container.NetworkSettings
+	local := container.Node == nil && remote == ""
+	rootless := isRootlessNetwork(container)
+
+	if remote != "" && !slices.Contains(preference, "hostport") {
+		preference = append([]string{"hostport"}, preference...)
+	}
+
+	for _, source := range preference {
+		switch {
+		case source == "hostport":
+			// Try to use bindings in order to access host (useful for Swarm nodes)
+			for _, binding := range settings.Ports[docker.Port(port+"/tcp")] {
+				if remote != "" && isUnspecifiedIP(binding.HostIP) {
+					// The ports published on all addresses are reached on the address of daemon
+					return remote, binding.HostPort
+				} else if remote != "" && isLoopbackIP(binding.HostIP) {
+					continue
+				} else if !isUnspecifiedIP(binding.HostIP) {
+					return binding.HostIP, binding.HostPort
+				} else if rootless && local {
+					// The ports of rootless containers are published on all host addresses
+					return "127.0.0.1", binding.HostPort
+				}
+			}
+		case !local || rootless:
+			// The container addresses make sense only when accessing locally
+		case source == "bridge":
+			if settings.IPAddress != "" {
+				return settings.IPAddress, port
+			}
+		case source == "network":
+			for _, name := range sortedNetworks(settings) {
+				if ip := settings.Networks[name].IPAddress; ip != "" {
+					return ip, port
+				}
+			}
+		case source == "ipv6":
+			if settings.GlobalIPv6Address != "" {
+				return settings.GlobalIPv6Address, port
+			}
+			for _, name := range sortedNetworks(settings) {
+				if ip := settings.Networks[name].GlobalIPv6Address; ip != "" {
+					return ip, port
+				}
+			}
+		case strings.HasPrefix(source, "network:"):
+			network, ok := settings.Networks[strings.TrimPrefix(source, "network:")]
+			if ok && network.IPAddress != "" {
+				return network.IPAddress, port
+			} else if ok && network.GlobalIPv6Address != "" {
+				return network.GlobalIPv6Address, port
+			}
+		}
+	}
+	return "", port
+}
+
+func isLoopbackIP(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.IsLoopback()
+}
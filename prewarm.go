@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The pre-established connections are replaced before upstreams close them as idle
+const prewarmMaxAge = 30 * time.Second
+
+// The pools of upstreams which are no longer routed are closed after this time
+const prewarmForget = 10 * time.Second
+
+const maxPrewarm = 16
+
+var prewarmedRequests = newCounter("auto_proxy_prewarmed_connections_total",
+	"Number of upstream connections dialed without or with pre-established connection", "result")
+
+// upstreamDialer is used by transports of upstreams, it is set in main
+var upstreamDialer *resolvingDialer
+
+type warmConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+// warmPool keeps connections dialed in advance, they are handed over to transport before it dials
+type warmPool struct {
+	size    int
+	conns   []warmConn
+	dialing int
+	seen    time.Time
+	dial    func() (net.Conn, error)
+}
+
+type warmPools struct {
+	list map[string]*warmPool
+	lock sync.Mutex
+}
+
+var upstreamWarmPools warmPools
+
+func parsePrewarm(value string) (int, error) {
+	size, err := strconv.Atoi(value)
+	if err == nil && (size < 0 || size > maxPrewarm) {
+		err = errors.New("expected 0 to 16 connections")
+	}
+	return size, err
+}
+
+// Take returns pre-established connection or nil, the pool is refilled in background
+func (p *warmPools) Take(key string) net.Conn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pool := p.list[key]
+	if pool == nil {
+		return nil
+	}
+	now := time.Now()
+	for len(pool.conns) > 0 {
+		warm := pool.conns[0]
+		pool.conns = pool.conns[1:]
+		if now.Sub(warm.dialed) < prewarmMaxAge {
+			prewarmedRequests.Inc("hit")
+			return warm.conn
+		}
+		warm.conn.Close()
+	}
+	prewarmedRequests.Inc("miss")
+	return nil
+}
+
+// Ensure keeps the pool of size connections, it has to be called repeatedly while the upstream is routed
+func (p *warmPools) Ensure(key string, size int, dial func() (net.Conn, error)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.list == nil {
+		p.list = make(map[string]*warmPool)
+	}
+	pool := p.list[key]
+	if pool == nil {
+		pool = &warmPool{}
+		p.list[key] = pool
+	}
+	pool.size, pool.dial, pool.seen = size, dial, time.Now()
+}
+
+// refill replaces expired connections, dials the missing ones and prunes pools of removed upstreams
+func (p *warmPools) refill() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	for key, pool := range p.list {
+		if now.Sub(pool.seen) > prewarmForget {
+			for _, warm := range pool.conns {
+				warm.conn.Close()
+			}
+			delete(p.list, key)
+			continue
+		}
+
+		fresh := pool.conns[:0]
+		for _, warm := range pool.conns {
+			if now.Sub(warm.dialed) < prewarmMaxAge {
+				fresh = append(fresh, warm)
+			} else {
+				warm.conn.Close()
+			}
+		}
+		pool.conns = fresh
+
+		for missing := pool.size - len(pool.conns) - pool.dialing; missing > 0; missing-- {
+			pool.dialing++
+			go p.dial(key, pool)
+		}
+	}
+}
+
+func (p *warmPools) dial(key string, pool *warmPool) {
+	conn, err := pool.dial()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pool.dialing--
+	if err != nil {
+		return
+	} else if p.list[key] != pool || len(pool.conns) >= pool.size {
+		conn.Close()
+		return
+	}
+	pool.conns = append(pool.conns, warmConn{conn: conn, dialed: time.Now()})
+}
+
+// dialUpstreamTLS does what transport does for SSL backends, the server name defaults to the host of address
+func dialUpstreamTLS(ctx context.Context, config *tls.Config, addr string) (net.Conn, error) {
+	conn, err := upstreamDialer.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultTransport.TLSHandshakeTimeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// warmDialTLS returns DialTLSContext of transport using the pre-established TLS connections
+func warmDialTLS(transportKey string, config *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if conn := upstreamWarmPools.Take("tls " + transportKey + " " + addr); conn != nil {
+			return conn, nil
+		}
+		return dialUpstreamTLS(ctx, config, addr)
+	}
+}
+
+// prewarm keeps the pool of TCP or TLS connections for upstream of route with auto-proxy.upstream.prewarm
+func prewarm(route *Route, upstream Upstream) {
+	if upstream.Socket != "" {
+		return
+	}
+	addr := upstream.Host()
+
+	if upstream.Scheme() != ProtoHTTPS {
+		upstreamWarmPools.Ensure("tcp "+addr, route.UpstreamPrewarm, func() (net.Conn, error) {
+			return upstreamDialer.dial(context.Background(), "tcp", addr)
+		})
+		return
+	}
+
+	transportKey, transport := "", &defaultTransport
+	if upstream.TLSServerName != "" || upstream.TLSPins != "" {
+		transportKey = upstream.TLSServerName + " " + upstream.TLSPins
+		transport = upstreamTLSTransports.get(upstream.TLSServerName, upstream.TLSPins)
+	}
+	config := transport.TLSClientConfig
+	upstreamWarmPools.Ensure("tls "+transportKey+" "+addr, route.UpstreamPrewarm, func() (net.Conn, error) {
+		return dialUpstreamTLS(context.Background(), config, addr)
+	})
+}
+
+// watchPrewarm maintains the pools of pre-established upstream connections of all profiles
+func watchPrewarm() {
+	for {
+		time.Sleep(time.Second)
+
+		for _, app := range profileApps {
+			app.lock.RLock()
+			routes := app.routes
+			app.lock.RUnlock()
+
+			for _, route := range routes {
+				if route.UpstreamPrewarm <= 0 {
+					continue
+				}
+				for _, upstream := range route.Servers {
+					prewarm(route, upstream)
+				}
+			}
+		}
+		upstreamWarmPools.refill()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// Profile is a logical proxy with its own listeners, certificates and routes, selected by auto-proxy.profile
+type Profile struct {
+	ListenHTTP  string `json:"listenHttp"`
+	ListenHTTPS string `json:"listenHttps"`
+	CertsDir    string `json:"certsDir"`
+
+	// The TLS settings of HTTPS listener, the client CA defaults to -client-ca
+	ClientCA      string `json:"clientCa"`
+	TLSMinVersion string `json:"tlsMinVersion"`
+
+	// The HTTP listener answers only ACME HTTP-01 challenges, the sites are served only over HTTPS
+	HTTPACMEOnly bool `json:"httpAcmeOnly"`
+}
+
+// The apps of profiles, the default one is stored under empty name
+var profileApps = map[string]*theApp{}
+
+// ProfileRoutes builds the routes of each profile separately, so the same host can be used by many profiles
+type ProfileRoutes map[string]Routes
+
+func (p ProfileRoutes) Add(b RouteBuilder) bool {
+	routes := p[b.Profile]
+	if routes == nil {
+		routes = make(Routes)
+		p[b.Profile] = routes
+	}
+	return routes.Add(b)
+}
+
+// Join returns routes of all profiles, the keys of non-default profiles are prefixed with profile/
+func (p ProfileRoutes) Join() Routes {
+	joined := make(Routes)
+	for profile, routes := range p {
+		for key, route := range routes {
+			if profile != "" {
+				key = profile + "/" + key
+			}
+			joined[key] = route
+		}
+	}
+	return joined
+}
+
+// Profile returns the routes of the profile only
+func (r Routes) Profile(profile string) Routes {
+	routes := make(Routes)
+	for key, route := range r {
+		name, host := "", key
+		if idx := strings.Index(key, "/"); idx >= 0 {
+			name, host = key[:idx], key[idx+1:]
+		}
+		if name == profile {
+			routes[host] = route
+		}
+	}
+	return routes
+}
+
+func isValidProfile(name string) bool {
+	_, ok := config.Profiles[name]
+	return ok || name == ""
+}
+
+// newProfileApp creates the app of profile, it serves only the routes of containers with auto-proxy.profile=<name>
+func newProfileApp(name string, profile Profile) (*theApp, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errors.New("profile: invalid name " + name)
+	} else if profile.ListenHTTP == "" && profile.ListenHTTPS == "" {
+		return nil, errors.New("profile: " + name + " has no listeners")
+	}
+
+	app := &theApp{profile: name}
+	app.certificates.Directory = profile.CertsDir
+	if app.certificates.Directory == "" {
+		app.certificates.Directory = filepath.Join(*certsDirectory, name)
+	}
+	return app, nil
+}
+
+// snapshotFile returns -routes-snapshot, the profiles store their routes next to it
+func (a *theApp) snapshotFile() string {
+	if a.profile == "" || *routesSnapshot == "" {
+		return *routesSnapshot
+	}
+	ext := filepath.Ext(*routesSnapshot)
+	return strings.TrimSuffix(*routesSnapshot, ext) + "." + a.profile + ext
+}
+
+// collectCertificates exposes expiry of certificates of all profiles
+func collectCertificates() {
+	certificateExpiry.Reset()
+	certificateStates.Reset()
+	for _, app := range profileApps {
+		app.certificates.Collect()
+	}
+}
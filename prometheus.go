@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	prometheusScrapeLabel = "prometheus.scrape"
+	prometheusPortLabel   = "prometheus.port"
+	prometheusPathLabel   = "prometheus.path"
+	prometheusSchemeLabel = "prometheus.scheme"
+	prometheusLabelPrefix = "prometheus.label."
+)
+
+// The label names accepted by Prometheus, the invalid ones would fail the whole file_sd
+var prometheusLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// scrapeTarget is a target group of Prometheus file_sd and http_sd
+type scrapeTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+type scrapeTargetList struct {
+	list    []scrapeTarget
+	daemons map[string][]scrapeTarget
+	lock    sync.RWMutex
+}
+
+var scrapeTargets scrapeTargetList
+
+// newScrapeTarget returns the target of container with prometheus.scrape=true, the port defaults to the proxied one
+func newScrapeTarget(container *docker.Container, route *RouteBuilder, daemon *dockerDaemon) (target scrapeTarget, ok bool) {
+	labels := container.Config.Labels
+	if labels[prometheusScrapeLabel] != "true" {
+		return
+	}
+
+	port := labels[prometheusPortLabel]
+	if port == "" {
+		port = route.Upstream.Port
+	}
+	if port == "" {
+		for _, candidate := range strings.Split(*ports, ",") {
+			if _, found := container.NetworkSettings.Ports[docker.Port(candidate+"/tcp")]; found {
+				port = candidate
+				break
+			}
+		}
+	}
+	if port == "" {
+		logrus.WithField("name", container.Name).Debugln("Couldn't find a port to scrape, use prometheus.port")
+		return
+	}
+
+	ip, port := pickUpstreamAddress(container, port, upstreamPreference, daemon.Address)
+	if ip == "" {
+		return
+	}
+
+	target = scrapeTarget{
+		Targets: []string{net.JoinHostPort(ip, port)},
+		Labels: map[string]string{
+			"container": strings.TrimPrefix(container.Name, "/"),
+			"image":     container.Config.Image,
+		},
+	}
+	if daemon.Name != "" {
+		target.Labels["daemon"] = daemon.Name
+	}
+	if len(route.VirtualHost) > 0 {
+		target.Labels["virtual_host"] = strings.Join(route.VirtualHost, ",")
+	}
+	if path := labels[prometheusPathLabel]; path != "" {
+		target.Labels["__metrics_path__"] = path
+	}
+	if scheme := labels[prometheusSchemeLabel]; scheme != "" {
+		target.Labels["__scheme__"] = scheme
+	}
+	for name, value := range labels {
+		if !strings.HasPrefix(name, prometheusLabelPrefix) {
+			continue
+		} else if label := strings.TrimPrefix(name, prometheusLabelPrefix); !prometheusLabelName.MatchString(label) {
+			logrus.WithField("label", name).Warningln("Invalid Prometheus label name, the label is dropped")
+			route.addError(ValidationInvalidLabel, name, "expected Prometheus label name [a-zA-Z_][a-zA-Z0-9_]*")
+		} else {
+			target.Labels[label] = value
+		}
+	}
+	return target, true
+}
+
+// Update replaces the targets of daemon, the -prometheus-sd-file is rewritten if the targets of all daemons changed
+func (l *scrapeTargetList) Update(daemon string, targets []scrapeTarget) {
+	l.lock.Lock()
+	if l.daemons == nil {
+		l.daemons = make(map[string][]scrapeTarget)
+	}
+	l.daemons[daemon] = targets
+	targets = []scrapeTarget{}
+	for _, list := range l.daemons {
+		targets = append(targets, list...)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Targets[0] < targets[j].Targets[0]
+	})
+	changed := !reflect.DeepEqual(l.list, targets)
+	l.list = targets
+	l.lock.Unlock()
+
+	if changed && *prometheusSDFile != "" {
+		err := writeScrapeTargets(*prometheusSDFile, targets)
+		if err != nil {
+			logrus.WithField("file", *prometheusSDFile).WithError(err).Warningln("Failed to write Prometheus targets")
+		}
+	}
+}
+
+func (l *scrapeTargetList) List() []scrapeTarget {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.list == nil {
+		return []scrapeTarget{}
+	}
+	return l.list
+}
+
+// writeScrapeTargets replaces the file atomically, Prometheus could read partially written file otherwise
+func writeScrapeTargets(fileName string, targets []scrapeTarget) error {
+	data, err := json.MarshalIndent(targets, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fileName+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// getScrapeTargets is the Prometheus HTTP service discovery endpoint
+func (a *adminAPI) getScrapeTargets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, scrapeTargets.List())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The protocols of VIRTUAL_PROTO, the auto one is detected by probing the upstream
+const (
+	ProtoHTTP  = "http"
+	ProtoHTTPS = "https"
+	ProtoH2C   = "h2c"
+	ProtoAuto  = "auto"
+)
+
+// Each probe of upstream has to finish in this time
+const protocolProbeTimeout = 2 * time.Second
+
+// The detected protocols are forgotten if their upstream wasn't used for this time
+const protocolForget = 10 * time.Minute
+
+// The upstreams which are not listening yet are probed again after growing delays
+const (
+	protocolRetryMin = time.Second
+	protocolRetryMax = time.Minute
+)
+
+// The client preface of HTTP/2 with prior knowledge followed by empty SETTINGS frame
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+
+const h2FrameSettings = 0x4
+
+var protocolDetections = newCounter("auto_proxy_upstream_protocol_detections_total",
+	"Number of upstreams with VIRTUAL_PROTO=auto probed for their protocol", "protocol")
+
+// h2cTransport is used by upstreams speaking HTTP/2 without TLS, it is set in main
+var h2cTransport http.Transport
+
+type protocolProbe struct {
+	done  chan struct{}
+	proto string
+	used  time.Time
+
+	// unreachable is set when the upstream didn't accept connection, its requests use http till the retry
+	unreachable bool
+	retry       time.Time
+	backoff     backoff
+}
+
+// detectedProtocols keeps the protocols of upstreams by container and address
+type detectedProtocols struct {
+	list map[string]*protocolProbe
+	lock sync.Mutex
+}
+
+var upstreamProtocols detectedProtocols
+
+func protocolKey(upstream *Upstream) string {
+	return upstream.Container + " " + upstream.Host()
+}
+
+// probe returns the detection of upstream, it is started if the upstream wasn't probed yet or restart is set
+func (d *detectedProtocols) probe(upstream *Upstream, restart bool) *protocolProbe {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.list == nil {
+		d.list = make(map[string]*protocolProbe)
+	}
+	key := protocolKey(upstream)
+	probe := d.list[key]
+	if probe == nil || restart {
+		probe = &protocolProbe{done: make(chan struct{}), backoff: backoff{Min: protocolRetryMin, Max: protocolRetryMax}}
+		d.list[key] = probe
+		go probe.run(*upstream)
+	} else if probe.finished() && probe.unreachable && time.Now().After(probe.retry) {
+		// The unreachable result is never kept, the next probe keeps growing the retry delay
+		probe = &protocolProbe{done: make(chan struct{}), backoff: probe.backoff}
+		d.list[key] = probe
+		go probe.run(*upstream)
+	}
+	probe.used = time.Now()
+	return probe
+}
+
+func (p *protocolProbe) finished() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *protocolProbe) run(upstream Upstream) {
+	defer close(p.done)
+
+	log := logrus.WithField("upstream", upstream.String())
+	proto, reached, err := detectProtocol(upstream.Host())
+	if !reached {
+		p.unreachable = true
+		p.retry = time.Now().Add(p.backoff.Next())
+		log.WithError(err).WithField("retry", p.retry).Warningln("Upstream is not reachable to detect its protocol, using http")
+	} else if err != nil {
+		log.WithError(err).Warningln("Unable to detect upstream protocol, using http")
+	} else {
+		log.WithField("protocol", proto).Infoln("Detected upstream protocol")
+	}
+	if reached {
+		protocolDetections.Inc(proto)
+	}
+	p.proto = proto
+}
+
+// Detect returns the protocol of upstream, the first request waits for the probe to finish
+func (d *detectedProtocols) Detect(upstream *Upstream) string {
+	probe := d.probe(upstream, false)
+	<-probe.done
+	return probe.proto
+}
+
+// Discovered probes the new upstreams with auto protocol before they receive requests
+func (d *detectedProtocols) Discovered(previous, current Routes) {
+	for _, item := range newUpstreams(previous, current) {
+		if item.upstream.Proto == ProtoAuto && item.upstream.Socket == "" {
+			d.probe(&item.upstream, true)
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, probe := range d.list {
+		if time.Since(probe.used) > protocolForget {
+			delete(d.list, key)
+		}
+	}
+}
+
+// detectProtocol tries TLS handshake first, as HTTPS servers may answer plain HTTP requests with an error,
+// then HTTP/1.1 request and the HTTP/2 preface for servers which speak only h2c.
+// It returns false if the upstream didn't accept the connection.
+func detectProtocol(addr string) (string, bool, error) {
+	var errs []error
+	for _, probe := range []struct {
+		proto string
+		fn    func(net.Conn) error
+	}{
+		{ProtoHTTPS, probeTLS},
+		{ProtoHTTP, probeHTTP1},
+		{ProtoH2C, probeH2C},
+	} {
+		conn, err := net.DialTimeout("tcp", addr, protocolProbeTimeout)
+		if err != nil {
+			return ProtoHTTP, false, err
+		}
+		conn.SetDeadline(time.Now().Add(protocolProbeTimeout))
+		err = probe.fn(conn)
+		conn.Close()
+		if err == nil {
+			return probe.proto, true, nil
+		}
+		errs = append(errs, errors.New(probe.proto+": "+err.Error()))
+	}
+	return ProtoHTTP, true, errors.Join(errs...)
+}
+
+func probeTLS(conn net.Conn) error {
+	return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+}
+
+func probeHTTP1(conn net.Conn) error {
+	_, err := io.WriteString(conn, "OPTIONS * HTTP/1.1\r\nHost: "+conn.RemoteAddr().String()+
+		"\r\nUser-Agent: auto-proxy protocol-probe\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	status := make([]byte, 7)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	} else if string(status) != "HTTP/1." {
+		return errors.New("not an HTTP/1.x response")
+	}
+	return nil
+}
+
+func probeH2C(conn net.Conn) error {
+	if _, err := io.WriteString(conn, h2cPreface); err != nil {
+		return err
+	}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	} else if header[3] != h2FrameSettings || !bytes.Equal(header[5:9], []byte{0, 0, 0, 0}) {
+		return errors.New("not an HTTP/2 SETTINGS frame")
+	}
+	return nil
+}
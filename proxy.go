@@ -2,18 +2,39 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
 	"time"
 )
 
 var defaultTransport http.Transport
 
+var requestsTotal = newCounter("auto_proxy_requests_total",
+	"Number of proxied requests", "host", "upstream", "daemon", "code")
+var requestDuration = newHistogram("auto_proxy_request_duration_seconds",
+	"Time spent serving proxied requests", defaultBuckets, "host", "upstream", "daemon")
+var upstreamFirstByte = newHistogram("auto_proxy_upstream_first_byte_seconds",
+	"Time till the first byte of upstream response", defaultBuckets, "host", "upstream")
+var upstreamConnectFailures = newCounter("auto_proxy_upstream_connect_failures_total",
+	"Number of failed connections to upstreams", "host", "upstream")
+
 type loggingResponseWriter struct {
 	rw      http.ResponseWriter
 	status  int
 	written int64
 	started time.Time
+	body    *countingBody
+	sample  float64
+	vhost   string
 	Message string
+
+	upgrade      *Route
+	upgradeProto string
+
+	// The exchange recorded by admin capture of host
+	recording *capturedExchange
 }
 
 func newLoggingResponseWriter(rw http.ResponseWriter) *loggingResponseWriter {
@@ -33,27 +54,88 @@ func (l *loggingResponseWriter) Write(data []byte) (n int, err error) {
 	}
 	n, err = l.rw.Write(data)
 	l.written += int64(n)
+	if l.recording != nil {
+		l.recording.Write(data[:n])
+	}
 	return
 }
 
 func (l *loggingResponseWriter) WriteHeader(status int) {
 	l.rw.WriteHeader(status)
-	if l.status == 0 {
+	if l.status == 0 && !isInformational(status) {
 		l.status = status
 	}
 }
 
+// SampleLog logs only given fraction of requests, the errors are always logged
+func (l *loggingResponseWriter) SampleLog(route *Route) {
+	l.vhost = route.VirtualHost
+	if route.LogOff {
+		l.sample = -1
+	} else {
+		l.sample = route.LogSample
+	}
+}
+
+func (l *loggingResponseWriter) skipLog() bool {
+	if l.sample == 0 || l.status >= 500 {
+		return false
+	}
+	return l.sample < 0 || rand.Float64() >= l.sample
+}
+
 func (l *loggingResponseWriter) Log(r *http.Request) {
 	duration := time.Since(l.started)
-	fmt.Printf("%s %s - - [%s] %q %d %d %q %q %f %q\n",
+	line := fmt.Sprintf("%s %s - - [%s] %q %d %d %q %q %f %q %q\n",
 		r.Host, r.RemoteAddr, l.started,
 		fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto),
 		l.status, l.written, r.Referer(), r.UserAgent(),
-		duration.Seconds(), l.Message,
+		duration.Seconds(), l.Message, requestFingerprint(r),
 	)
+	if !l.skipLog() {
+		accessLog.Write(&accessLogEntry{Time: l.started, Host: r.Host, VirtualHost: l.vhost, Line: line})
+	}
+	accessLogTail.Publish(r.Host, line)
+}
+
+// traceUpstream records upstream connection failures and time to first byte
+func traceUpstream(r *http.Request, route *Route, upstream *Upstream) *http.Request {
+	started := time.Now()
+	trace := &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				upstreamConnectFailures.Inc(route.VirtualHost, upstream.Container)
+			}
+		},
+		GotFirstResponseByte: func() {
+			upstreamFirstByte.Observe(time.Since(started).Seconds(), route.VirtualHost, upstream.Container)
+			if route.OutlierFactor > 0 {
+				upstreamsState.Observe(upstream, time.Since(started))
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+func (l *loggingResponseWriter) Observe(route *Route, upstream *Upstream) {
+	requestsTotal.Inc(route.VirtualHost, upstream.Container, upstream.Daemon, strconv.Itoa(l.status))
+	requestDuration.Observe(time.Since(l.started).Seconds(), route.VirtualHost, upstream.Container, upstream.Daemon)
+	l.observeContainer(route, upstream)
 }
 
-func httpServerError(w http.ResponseWriter, r *http.Request, a ...interface{}) {
-	w.WriteHeader(503)
-	fmt.Fprintln(w, a...)
+// rewriteHost sets the Host header seen by upstream: preserve, upstream or any hostname
+func rewriteHost(r *http.Request, route *Route) {
+	if route.UpstreamHost == "" || route.UpstreamHost == "preserve" {
+		return
+	}
+
+	// The framework compatibility headers are already set
+	if route.Forwarded == ForwardedDefault {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if route.UpstreamHost == "upstream" {
+		r.Host = r.URL.Host
+	} else {
+		r.Host = route.UpstreamHost
+	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var queueDepth = newGauge("auto_proxy_request_queue_depth",
+	"Number of requests waiting for max-requests limit", "host")
+var queueWait = newHistogram("auto_proxy_request_queue_wait_seconds",
+	"Time spent by requests in the queue", defaultBuckets, "host")
+var shedRequests = newCounter("auto_proxy_shed_requests_total",
+	"Number of requests rejected with 503 due to overload", "host", "reason")
+
+type requestLane struct {
+	active  int
+	waiting []chan struct{}
+}
+
+// requestLimiter limits concurrent requests of routes with max-requests, the requests over limit wait in FIFO queue
+type requestLimiter struct {
+	lanes map[string]*requestLane
+	lock  sync.Mutex
+}
+
+var requestLimits requestLimiter
+
+func (l *requestLimiter) lane(route *Route) *requestLane {
+	if l.lanes == nil {
+		l.lanes = make(map[string]*requestLane)
+	}
+	lane := l.lanes[route.VirtualHost]
+	if lane == nil {
+		lane = &requestLane{}
+		l.lanes[route.VirtualHost] = lane
+	}
+	return lane
+}
+
+// dequeue removes the waiting request, it returns false if the slot was already handed over to it
+func (l *requestLimiter) dequeue(route *Route, ready chan struct{}) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lane := l.lane(route)
+	for idx, waiting := range lane.waiting {
+		if waiting == ready {
+			lane.waiting = append(lane.waiting[:idx], lane.waiting[idx+1:]...)
+			queueDepth.Set(float64(len(lane.waiting)), route.VirtualHost)
+			return true
+		}
+	}
+	return false
+}
+
+// Acquire waits for the free slot up to queue timeout, otherwise it sheds the request with 503
+func (l *requestLimiter) Acquire(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if route.MaxRequests <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	lane := l.lane(route)
+	if lane.active < route.MaxRequests {
+		lane.active++
+		l.lock.Unlock()
+		return true
+	}
+	if route.QueueTimeout <= 0 || route.QueueSize > 0 && len(lane.waiting) >= route.QueueSize {
+		l.lock.Unlock()
+		shedRequest(w, r, route, "queue full")
+		return false
+	}
+	ready := make(chan struct{})
+	lane.waiting = append(lane.waiting, ready)
+	queueDepth.Set(float64(len(lane.waiting)), route.VirtualHost)
+	l.lock.Unlock()
+
+	start := time.Now()
+	defer func() {
+		queueWait.Observe(time.Since(start).Seconds(), route.VirtualHost)
+	}()
+
+	timer := time.NewTimer(route.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	if !l.dequeue(route, ready) {
+		// the slot was released to us at the same time
+		l.Release(route)
+	}
+	shedRequest(w, r, route, "queue timeout")
+	return false
+}
+
+// Release hands over the slot to the first waiting request
+func (l *requestLimiter) Release(route *Route) {
+	if route.MaxRequests <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lane := l.lane(route)
+	if len(lane.waiting) > 0 {
+		close(lane.waiting[0])
+		lane.waiting = lane.waiting[1:]
+		queueDepth.Set(float64(len(lane.waiting)), route.VirtualHost)
+		return
+	}
+	lane.active--
+	if lane.active <= 0 {
+		delete(l.lanes, route.VirtualHost)
+	}
+}
+
+func shedRequest(w http.ResponseWriter, r *http.Request, route *Route, reason string) {
+	shedRequests.Inc(route.VirtualHost, reason)
+	retryAfter := int(route.QueueTimeout.Seconds())
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	serveError(w, r, ErrorOverloaded, "service overloaded, try again later")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Waits after Let's Encrypt rate limit errors, the limits use sliding windows so we retry conservatively
+const (
+	duplicateCertificateWait = 24 * time.Hour
+	failedValidationWait     = time.Hour
+	rateLimitedWait          = 3 * time.Hour
+	maxFailureWait           = 24 * time.Hour
+)
+
+type rateLimitState struct {
+	Until    time.Time
+	Reason   string
+	Failures uint
+}
+
+// rateLimits keeps backoff of certificate requests, it is persisted so restarts don't hammer Let's Encrypt
+type rateLimits struct {
+	list     map[string]rateLimitState
+	fileName string
+	lock     sync.Mutex
+}
+
+var acmeRateLimits rateLimits
+
+// classifyACMEError returns the reason and how long to wait before the next request
+func classifyACMEError(err error, failures uint) (string, time.Duration) {
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "ratelimited") && strings.Contains(message, "exact set of domains"):
+		return "duplicate-certificate", duplicateCertificateWait
+	case strings.Contains(message, "ratelimited") && strings.Contains(message, "failed authorizations"):
+		return "failed-validation", failedValidationWait
+	case strings.Contains(message, "ratelimited") || strings.Contains(message, "too many"):
+		return "rate-limited", rateLimitedWait
+	}
+
+	b := backoff{Min: *retryInterval, Max: maxFailureWait, attempt: failures}
+	return "failed", b.Next()
+}
+
+func (r *rateLimits) Load(fileName string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.fileName = fileName
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &r.list)
+}
+
+func (r *rateLimits) save() {
+	if r.fileName == "" {
+		return
+	}
+
+	data, err := json.Marshal(r.list)
+	if err == nil {
+		tmpFile := r.fileName + ".tmp"
+		err = ioutil.WriteFile(tmpFile, data, 0600)
+		if err == nil {
+			err = os.Rename(tmpFile, r.fileName)
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Warningln("Failed to save ACME rate limits")
+	}
+}
+
+// Blocked returns true if the certificate should not be requested yet
+func (r *rateLimits) Blocked(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.list[name]
+	return ok && time.Now().Before(state.Until)
+}
+
+func (r *rateLimits) Failed(names []string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.list == nil {
+		r.list = make(map[string]rateLimitState)
+	}
+	for _, name := range names {
+		state := r.list[name]
+		reason, wait := classifyACMEError(err, state.Failures)
+		state.Until = time.Now().Add(wait)
+		state.Reason = reason
+		state.Failures++
+		r.list[name] = state
+		logrus.WithField("name", name).WithField("reason", reason).WithField("until", state.Until).
+			Infoln("Postponing certificate request")
+	}
+	r.save()
+}
+
+func (r *rateLimits) Succeeded(names []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	changed := false
+	for _, name := range names {
+		if _, ok := r.list[name]; ok {
+			delete(r.list, name)
+			changed = true
+		}
+	}
+	if changed {
+		r.save()
+	}
+}
+
+// renewalJitter spreads renewals of certificates, it is stable across restarts and replicas
+func renewalJitter(name string) time.Duration {
+	if *renewJitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return time.Duration(h.Sum64() % uint64(*renewJitter))
+}
+
+// registeredDomain returns the domain used by Let's Encrypt limits, the public suffix plus one label,
+// ie. foo.co.uk for www.foo.co.uk
+func registeredDomain(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return domain
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitKeyPrefix = "auto-proxy/rate/"
+
+const (
+	RateLimitByIP    = "ip"
+	RateLimitByRoute = "route"
+)
+
+// The counters of the current and previous window are incremented and read in one round trip
+const rateLimitScript = `local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return {n, tonumber(redis.call("GET", KEYS[2]) or "0")}`
+
+var rateLimitedRequests = newCounter("auto_proxy_rate_limited_requests_total",
+	"Number of requests rejected by rate limit of route", "host")
+var rateLimitFallbacks = newCounter("auto_proxy_rate_limit_fallbacks_total",
+	"Number of rate limit checks counted locally because Redis failed", "host")
+
+var rateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// parseRateLimit reads 100/s, 600/m or 1000/h
+func parseRateLimit(value string) (int, time.Duration, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("expected <requests>/s, /m or /h")
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return 0, 0, errors.New("expected positive number of requests")
+	}
+	window, ok := rateUnits[parts[1]]
+	if !ok {
+		return 0, 0, errors.New("expected <requests>/s, /m or /h")
+	}
+	return limit, window, nil
+}
+
+type rateWindow struct {
+	index    int64
+	current  int64
+	previous int64
+}
+
+// localRateCounters count the requests of this instance only
+type localRateCounters struct {
+	list    map[string]*rateWindow
+	cleaned time.Time
+	lock    sync.Mutex
+}
+
+var localRateLimits localRateCounters
+
+func (c *localRateCounters) Hit(key string, index int64, now time.Time) (int64, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.list == nil {
+		c.list = make(map[string]*rateWindow)
+	}
+	window := c.list[key]
+	if window == nil {
+		window = &rateWindow{index: index}
+		c.list[key] = window
+	}
+	switch {
+	case window.index == index-1:
+		window.previous, window.current = window.current, 0
+	case window.index != index:
+		window.previous, window.current = 0, 0
+	}
+	window.index = index
+	window.current++
+
+	// Forget the clients which didn't come back for two windows
+	if now.Sub(c.cleaned) > time.Minute {
+		for key, other := range c.list {
+			if other.index < index-1 {
+				delete(c.list, key)
+			}
+		}
+		c.cleaned = now
+	}
+	return window.current, window.previous
+}
+
+// hitRedis counts the request in counters shared by all replicas
+func hitRedis(key string, index int64, window time.Duration) (int64, int64, error) {
+	reply, err := redis.Do("EVAL", rateLimitScript, "2",
+		key+"/"+strconv.FormatInt(index, 10), key+"/"+strconv.FormatInt(index-1, 10),
+		strconv.FormatInt(int64(2*window/time.Millisecond), 10))
+	if err != nil {
+		return 0, 0, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	current, ok1 := values[0].(int64)
+	previous, ok2 := values[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return current, previous, nil
+}
+
+func rateLimitKey(r *http.Request, route *Route) string {
+	key := rateLimitKeyPrefix + route.VirtualHost
+	if route.RateLimitBy != RateLimitByRoute {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		key += "/" + ip
+	}
+	return key
+}
+
+// allowRate counts the request in sliding window, the previous window is weighted by its overlap,
+// it returns how long to wait if the request is over the limit
+func allowRate(r *http.Request, route *Route, now time.Time) (bool, time.Duration) {
+	window := route.RateLimitWindow
+	index := now.UnixNano() / int64(window)
+	key := rateLimitKey(r, route)
+
+	var current, previous int64
+	var err error
+	if redis != nil && !route.RateLimitLocal {
+		current, previous, err = hitRedis(key, index, window)
+		if err != nil {
+			rateLimitFallbacks.Inc(route.VirtualHost)
+			logrus.WithError(err).WithField("host", route.VirtualHost).Debugln("Counting rate limit locally")
+		}
+	}
+	if redis == nil || route.RateLimitLocal || err != nil {
+		current, previous = localRateLimits.Hit(key, index, now)
+	}
+
+	elapsed := time.Duration(now.UnixNano() - index*int64(window))
+	estimate := float64(previous)*float64(window-elapsed)/float64(window) + float64(current)
+	if estimate <= float64(route.RateLimit) {
+		return true, 0
+	}
+	return false, window - elapsed
+}
+
+// limitRate responds with 429 to requests over auto-proxy.rate-limit
+func limitRate(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if route.RateLimit <= 0 {
+		return true
+	}
+	allowed, wait := allowRate(r, route, time.Now())
+	if allowed {
+		return true
+	}
+
+	rateLimitedRequests.Inc(route.VirtualHost)
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	serveError(w, r, ErrorRateLimited, "too many requests to "+r.Host)
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sources of routes, the first one in -source-precedence decides the options of hosts routed by many sources
+const (
+	SourceDocker = "docker"
+	SourceFiles  = "files"
+	SourceKV     = "kv"
+)
+
+var sourceRoutes = newGauge("auto_proxy_source_routes",
+	"Number of routes discovered by the source", "source")
+var sourceUpdates = newCounter("auto_proxy_source_updates_total",
+	"Number of route updates received from the source", "source")
+var sourceHealthy = newGauge("auto_proxy_source_healthy",
+	"Whether the source delivers routes", "source")
+var sourceLastUpdate = newGauge("auto_proxy_source_last_update_timestamp_seconds",
+	"Time of the last route update of the source", "source")
+
+// routeSource is the discovery of routes (Docker, route files, KV) registered with the reconciler
+type routeSource struct {
+	Name        string    `json:"name"`
+	Precedence  int       `json:"precedence"`
+	Discovered  bool      `json:"discovered"`
+	Healthy     bool      `json:"healthy"`
+	Routes      int       `json:"routes"`
+	Updates     int       `json:"updates"`
+	LastUpdate  time.Time `json:"lastUpdate,omitempty"`
+	LastTrigger string    `json:"lastTrigger,omitempty"`
+	Error       string    `json:"error,omitempty"`
+
+	reconciler *routeReconciler
+}
+
+// routeReconciler merges the routes of all sources and passes them to the apps of profiles,
+// the updates received during the initial discovery are applied at once
+type routeReconciler struct {
+	sources     map[string]*routeSource
+	pending     map[string]Routes
+	triggers    []string
+	discovering bool
+	lock        sync.Mutex
+}
+
+var reconciler = routeReconciler{
+	sources:     make(map[string]*routeSource),
+	pending:     make(map[string]Routes),
+	discovering: true,
+}
+
+// sourceRank orders the sources by -source-precedence, the unknown ones (ie. from snapshot) go last,
+// the daemons of -docker-host (ie. docker:east) share the rank of docker
+func sourceRank(name string) int {
+	name, _, _ = strings.Cut(name, ":")
+	for idx, source := range strings.Split(*sourcePrecedence, ",") {
+		if strings.TrimSpace(source) == name {
+			return idx
+		}
+	}
+	return 1 << 16
+}
+
+func sortSources(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		ri, rj := sourceRank(names[i]), sourceRank(names[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return names[i] < names[j]
+	})
+}
+
+// Register adds the source, all sources have to be registered before Start
+func (r *routeReconciler) Register(name string) *routeSource {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	source := &routeSource{Name: name, Precedence: sourceRank(name), Healthy: true, reconciler: r}
+	r.sources[name] = source
+	return source
+}
+
+// Start ends the initial discovery once all sources delivered routes or after -discovery-timeout
+func (r *routeReconciler) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.sources) == 0 {
+		r.discovering = false
+		return
+	}
+	time.AfterFunc(*discoveryTimeout, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if !r.discovering {
+			return
+		}
+		var missing []string
+		for name, source := range r.sources {
+			if !source.Discovered {
+				missing = append(missing, name)
+			}
+		}
+		sort.Strings(missing)
+		logrus.WithField("missing", missing).Warningln("Initial discovery timed out, applying the routes of other sources")
+		r.finishDiscovery()
+	})
+}
+
+// finishDiscovery applies the staged routes of all sources at once, it has to be called with lock held
+func (r *routeReconciler) finishDiscovery() {
+	r.discovering = false
+	defer r.loaded()
+	if len(r.pending) == 0 {
+		return
+	}
+	trigger := "initial discovery: " + strings.Join(r.triggers, ", ")
+	for name, app := range profileApps {
+		routes := make(map[string]Routes, len(r.pending))
+		for source, joined := range r.pending {
+			routes[source] = joined.Profile(name)
+		}
+		app.updateSources(routes, trigger)
+	}
+	r.pending, r.triggers = nil, nil
+}
+
+// loaded announces the routes of initial discovery are served
+func (r *routeReconciler) loaded() {
+	routes := 0
+	for _, source := range r.sources {
+		routes += source.Routes
+	}
+	event := newLifecycleEvent(LifecycleRoutesLoaded, "")
+	event.Routes = routes
+	go emitLifecycle(event)
+}
+
+// Update replaces the routes of source, the joined routes of all profiles are split to their apps
+func (s *routeSource) Update(routes Routes, trigger string) {
+	r := s.reconciler
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s.Discovered, s.Healthy, s.Error = true, true, ""
+	s.Routes, s.LastUpdate, s.LastTrigger = len(routes), time.Now(), trigger
+	s.Updates++
+	sourceUpdates.Inc(s.Name)
+
+	if r.discovering {
+		r.pending[s.Name] = routes
+		r.triggers = append(r.triggers, trigger)
+		for _, source := range r.sources {
+			if !source.Discovered {
+				logrus.WithField("source", s.Name).Debugln("Waiting for initial discovery of other sources...")
+				return
+			}
+		}
+		r.finishDiscovery()
+		return
+	}
+
+	for name, app := range profileApps {
+		app.updateSources(map[string]Routes{s.Name: routes.Profile(name)}, trigger)
+	}
+}
+
+// Failed reports the source can't deliver routes, the last known ones are still served
+func (s *routeSource) Failed(err error) {
+	r := s.reconciler
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s.Healthy = false
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// Disconnected marks the routes of source stale in all profiles
+func (s *routeSource) Disconnected(err error) {
+	s.Failed(err)
+	for _, app := range profileApps {
+		app.markStale(s.Name)
+	}
+}
+
+func (r *routeReconciler) List() []routeSource {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	list := make([]routeSource, 0, len(r.sources))
+	for _, source := range r.sources {
+		copied := *source
+		copied.reconciler = nil
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Precedence < list[j].Precedence
+	})
+	return list
+}
+
+// Collect exposes the state of sources
+func (r *routeReconciler) Collect() {
+	for _, source := range r.List() {
+		sourceRoutes.Set(float64(source.Routes), source.Name)
+		if source.Healthy {
+			sourceHealthy.Set(1, source.Name)
+		} else {
+			sourceHealthy.Set(0, source.Name)
+		}
+		if !source.LastUpdate.IsZero() {
+			sourceLastUpdate.Set(float64(source.LastUpdate.Unix()), source.Name)
+		}
+	}
+}
+
+func (a *adminAPI) getSources(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, reconciler.List())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redisPoolSize = 16
+const redisTimeout = 5 * time.Second
+
+var redis *redisClient
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisClient is a minimal RESP client with a pool of connections
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+func newRedisClient(uri string) (*redisClient, error) {
+	if uri == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "redis" {
+		return nil, errors.New("redis: unsupported scheme " + u.Scheme)
+	}
+
+	c := &redisClient{
+		address: u.Host,
+		pool:    make(chan *redisConn, redisPoolSize),
+	}
+	if !strings.Contains(c.address, ":") {
+		c.address += ":6379"
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var request []byte
+	request = append(request, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		request = append(request, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	} else if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, count)
+		for idx := range values {
+			values[idx], err = c.readReply()
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, errors.New("redis: unexpected reply " + line)
+	}
+}
+
+// Do executes the command, the nil is returned for missing values
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.pool:
+	default:
+		var err error
+		conn, err = c.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// broken connection
+		conn.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) String(args ...string) (string, bool, error) {
+	reply, err := c.Do(args...)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	return value, ok, nil
+}
+
+func (c *redisClient) Int(args ...string) (int64, error) {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return value, nil
+}
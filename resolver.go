@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The bounds of record TTLs, the upstreams are re-resolved after -dns-refresh if the TTL couldn't be read
+const (
+	dnsMinTTL = 5 * time.Second
+	dnsMaxTTL = time.Hour
+)
+
+const dnsTimeout = 10 * time.Second
+
+type resolverEntry struct {
+	addrs      []string
+	expires    time.Time
+	refreshing bool
+}
+
+// resolverCache keeps addresses of upstreams specified by hostname. The addresses come from the system resolver,
+// which doesn't expose record TTL, so the TTL is queried from the nameservers of /etc/resolv.conf.
+type resolverCache struct {
+	list map[string]*resolverEntry
+	lock sync.Mutex
+}
+
+var upstreamResolver resolverCache
+
+// resolve returns the sorted addresses of host and how long they can be cached
+func (c *resolverCache) resolve(host string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	sort.Strings(addrs)
+
+	ttl, err := lookupTTL(ctx, host)
+	if err != nil {
+		logrus.WithField("host", host).WithError(err).Debugln("Failed to read TTL of upstream, using -dns-refresh")
+		ttl = *dnsRefresh
+	}
+	return addrs, min(max(ttl, dnsMinTTL), dnsMaxTTL), nil
+}
+
+func (c *resolverCache) refresh(host string, entry *resolverEntry) {
+	addrs, ttl, err := c.resolve(host)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry.refreshing = false
+
+	if err != nil {
+		// keep serving stale addresses
+		logrus.WithField("host", host).WithError(err).Warningln("Failed to resolve upstream")
+		entry.expires = time.Now().Add(*dnsRefresh)
+		return
+	}
+
+	if strings.Join(addrs, ",") != strings.Join(entry.addrs, ",") {
+		var removed []string
+		for _, addr := range entry.addrs {
+			if !slices.Contains(addrs, addr) {
+				removed = append(removed, addr)
+			}
+		}
+		closed := upstreamConns.CloseResolved(host, removed)
+		logrus.WithField("host", host).WithField("addrs", addrs).WithField("closed", closed).Infoln("Upstream addresses changed")
+	}
+	entry.addrs = addrs
+	entry.expires = time.Now().Add(ttl)
+}
+
+func (c *resolverCache) Lookup(host string) ([]string, error) {
+	c.lock.Lock()
+	if c.list == nil {
+		c.list = make(map[string]*resolverEntry)
+	}
+	entry := c.list[host]
+	if entry != nil && len(entry.addrs) > 0 {
+		if time.Now().After(entry.expires) && !entry.refreshing {
+			entry.refreshing = true
+			go c.refresh(host, entry)
+		}
+		addrs := entry.addrs
+		c.lock.Unlock()
+		return addrs, nil
+	}
+	c.lock.Unlock()
+
+	addrs, ttl, err := c.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.list[host] = &resolverEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+	return addrs, nil
+}
+
+// nameservers reads the nameservers of /etc/resolv.conf, there are none on Windows
+func nameservers() (servers []string) {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return
+}
+
+// lookupTTL queries the A and AAAA records of host, it returns the lowest TTL of their answers
+func lookupTTL(ctx context.Context, host string) (time.Duration, error) {
+	servers := nameservers()
+	if len(servers) == 0 {
+		return 0, errors.New("no nameservers")
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return 0, err
+	}
+
+	var lowest uint32
+	found := false
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		var ttl uint32
+		var ok bool
+		for _, server := range servers {
+			if ttl, ok, err = queryTTL(ctx, server, name, qtype); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return 0, err
+		} else if ok && (!found || ttl < lowest) {
+			lowest, found = ttl, true
+		}
+	}
+	if !found {
+		return 0, errors.New("no records of " + host)
+	}
+	return time.Duration(lowest) * time.Second, nil
+}
+
+// queryTTL sends the question to nameserver over UDP, the TTL of CNAME records is included
+func queryTTL(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) (uint32, bool, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return 0, false, err
+	}
+
+	buffer := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return 0, false, err
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buffer[:n]); err != nil || resp.ID != id || !resp.Response {
+			// Ignore stray packets
+			continue
+		} else if resp.RCode == dnsmessage.RCodeNameError {
+			return 0, false, nil
+		} else if resp.RCode != dnsmessage.RCodeSuccess {
+			return 0, false, errors.New("dns: " + resp.RCode.String())
+		}
+
+		var lowest uint32
+		found := false
+		for _, answer := range resp.Answers {
+			if answer.Header.Type != qtype && answer.Header.Type != dnsmessage.TypeCNAME {
+				continue
+			}
+			if !found || answer.Header.TTL < lowest {
+				lowest = answer.Header.TTL
+			}
+			found = found || answer.Header.Type == qtype
+		}
+		return lowest, found, nil
+	}
+}
+
+type resolvingDialer struct {
+	net.Dialer
+}
+
+// DialContext hands over the pre-established connection of auto-proxy.upstream.prewarm or dials a new one,
+// the connection attempts are reported to the client trace of request
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := upstreamWarmPools.Take(network + " " + addr); conn != nil {
+		return conn, nil
+	}
+	return d.dial(ctx, network, addr)
+}
+
+// dial connects to one of the addresses of the upstream, trying the other ones on failure
+func (d *resolvingDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		conn, err := d.Dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return upstreamConns.Track(addr, conn), nil
+	}
+
+	addrs, err := upstreamResolver.Lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := rand.Intn(len(addrs))
+	for i := range addrs {
+		var conn net.Conn
+		conn, err = d.Dialer.DialContext(ctx, network, net.JoinHostPort(addrs[(offset+i)%len(addrs)], port))
+		if err == nil {
+			return upstreamConns.Track(addr, conn), nil
+		}
+	}
+	return nil, err
+}
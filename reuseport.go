@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"runtime"
+)
+
+// listen opens -listeners sockets with SO_REUSEPORT, so the kernel spreads connections across accept loops
+func listen(addr string) ([]net.Listener, error) {
+	if !*reusePort {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	count := *listeners
+	if count <= 0 {
+		count = runtime.GOMAXPROCS(0)
+	}
+
+	config := net.ListenConfig{Control: reusePortControl}
+
+	var list []net.Listener
+	for idx := 0; idx < count; idx++ {
+		listener, err := config.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, listener := range list {
+				listener.Close()
+			}
+			return nil, err
+		}
+		list = append(list, listener)
+	}
+	return list, nil
+}
+
+// serveAll runs accept loop for each listener and returns the first error
+func serveAll(list []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(list))
+	for _, listener := range list {
+		go func(listener net.Listener) {
+			errs <- serve(listener)
+		}(listener)
+	}
+	return <-errs
+}
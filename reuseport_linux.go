@@ -0,0 +1,17 @@
+package main
+
+import "syscall"
+
+// SO_REUSEPORT on Linux, the syscall package doesn't define it
+const soReusePort = 0xf
+
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
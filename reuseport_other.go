@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The SO_REUSEPORT of BSDs doesn't spread the connections across sockets
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	return errors.New("reuseport: SO_REUSEPORT is supported only on Linux")
+}
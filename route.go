@@ -1,10 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Upstream struct {
@@ -12,35 +20,224 @@ type Upstream struct {
 	IP        string
 	Port      string
 	Proto     string
+	Socket    string
+	Labels    map[string]string `json:",omitempty"`
+
+	// Daemon is the name of Docker endpoint in -docker-host the container runs on
+	Daemon string `json:",omitempty"`
+
+	MatchHeader string `json:",omitempty"`
+	MatchCookie string `json:",omitempty"`
+
+	ALPN string `json:",omitempty"`
+
+	TLSServerName string `json:",omitempty"`
+	TLSPins       string `json:",omitempty"`
+
+	Weight float64 `json:",omitempty"`
 }
 
 func (u *Upstream) Host() string {
-	return fmt.Sprintf("%s:%s", u.IP, u.Port)
+	if u.Socket != "" {
+		return "unix"
+	}
+	return net.JoinHostPort(u.IP, u.Port)
 }
 
 func (u *Upstream) String() string {
-	return fmt.Sprintf("%s (%s:%s)", u.Container, u.IP, u.Port)
+	if u.Socket != "" {
+		return fmt.Sprintf("%s (unix:%s)", u.Container, u.Socket)
+	}
+	return fmt.Sprintf("%s (%s)", u.Container, u.Host())
+}
+
+// inFlightKey identifies the upstream in counters of in-flight requests, the unix sockets don't have address
+func (u *Upstream) inFlightKey() string {
+	if u.Socket != "" {
+		return "unix:" + u.Socket
+	}
+	return u.Host()
+}
+
+// Protocol returns VIRTUAL_PROTO of upstream, the auto one is detected on first use
+func (u *Upstream) Protocol() string {
+	if u.Proto == ProtoAuto && u.Socket == "" {
+		return upstreamProtocols.Detect(u)
+	} else if u.Proto == "" {
+		return ProtoHTTP
+	}
+	return u.Proto
+}
+
+// Scheme returns the scheme of URLs requested from upstream, h2c is requested as http
+func (u *Upstream) Scheme() string {
+	if proto := u.Protocol(); proto != ProtoH2C {
+		return proto
+	}
+	return ProtoHTTP
+}
+
+func (u *Upstream) Transport() http.RoundTripper {
+	if u.Socket != "" {
+		return socketTransports.get(u.Socket)
+	}
+	switch proto := u.Protocol(); {
+	case proto == ProtoH2C:
+		return &h2cTransport
+	case u.TLSServerName != "" || u.TLSPins != "":
+		return upstreamTLSTransports.get(u.TLSServerName, u.TLSPins)
+	}
+	return &defaultTransport
+}
+
+const LabelPrefix = "auto-proxy."
+
+// RouteOptions are shared by all servers of the virtual host
+type RouteOptions struct {
+	EnableHTTP     bool
+	HSTS           string
+	Bandwidth      int64
+	RouteBandwidth int64
+
+	RateLimit       int           `json:",omitempty"`
+	RateLimitWindow time.Duration `json:",omitempty"`
+	RateLimitBy     string        `json:",omitempty"`
+	RateLimitLocal  bool          `json:",omitempty"`
+
+	OutlierFactor   float64
+	OutlierInterval time.Duration
+	OutlierEjection time.Duration
+
+	HealthPath      string        `json:",omitempty"`
+	HealthInterval  time.Duration `json:",omitempty"`
+	HealthTimeout   time.Duration `json:",omitempty"`
+	HealthDownAfter time.Duration `json:",omitempty"`
+	HealthRestart   bool          `json:",omitempty"`
+
+	SlowStart      time.Duration `json:",omitempty"`
+	WarmupRequests int           `json:",omitempty"`
+	WarmupPath     string        `json:",omitempty"`
+
+	StickyCookie string
+	StickyTTL    time.Duration
+	Balance      string `json:",omitempty"`
+
+	UpstreamHost string
+	Canonical    string
+
+	ACME      string
+	ACMEEmail string
+
+	Forwarded string
+	TLS       string
+
+	TLSHeaders     bool              `json:",omitempty"`
+	TLSHeaderNames map[string]string `json:",omitempty"`
+
+	Rules     string
+	RuleExprs map[string]string `json:",omitempty"`
+	Bots      string
+	BotsDeny  []string `json:",omitempty"`
+
+	ChunkedOff    bool `json:",omitempty"`
+	EarlyHintsOff bool `json:",omitempty"`
+	UpstreamGzip  bool `json:",omitempty"`
+
+	UpstreamPrewarm  int    `json:",omitempty"`
+	UpstreamIPChange string `json:",omitempty"`
+
+	LogOff    bool    `json:",omitempty"`
+	LogSample float64 `json:",omitempty"`
+
+	MaxConnections         int           `json:",omitempty"`
+	StreamIdleTimeout      time.Duration `json:",omitempty"`
+	StreamHalfCloseOff     bool          `json:",omitempty"`
+	StreamHalfCloseTimeout time.Duration `json:",omitempty"`
+
+	MaxUpgrades        int           `json:",omitempty"`
+	UpgradeIdleTimeout time.Duration `json:",omitempty"`
+	UpgradeIgnorePings bool          `json:",omitempty"`
+
+	MaxRequests  int           `json:",omitempty"`
+	QueueSize    int           `json:",omitempty"`
+	QueueTimeout time.Duration `json:",omitempty"`
+
+	Cache    bool `json:",omitempty"`
+	CacheTTL time.Duration
+
+	Profile string `json:",omitempty"`
+
+	Sign string `json:",omitempty"`
+
+	ExtProc        string        `json:",omitempty"`
+	ExtProcBody    int64         `json:",omitempty"`
+	ExtProcTimeout time.Duration `json:",omitempty"`
+	ExtProcFailure string        `json:",omitempty"`
+
+	Middlewares       []string                     `json:",omitempty"`
+	MiddlewareOptions map[string]map[string]string `json:",omitempty"`
+
+	AllowHours       string `json:",omitempty"`
+	AllowHoursStatus int    `json:",omitempty"`
+
+	Banner string `json:",omitempty"`
+
+	HeadersMaxSize  int `json:",omitempty"`
+	HeadersMaxTotal int `json:",omitempty"`
+	HeadersMaxCount int `json:",omitempty"`
+
+	RequestHeaders  map[string]string `json:",omitempty"`
+	ResponseHeaders map[string]string `json:",omitempty"`
+
+	Experimental []string `json:",omitempty"`
 }
 
 type RouteBuilder struct {
 	VirtualHost []string
 	Upstream    Upstream
-	EnableHTTP  bool
-	HSTS        string
+	WeightBy    string
+	Schema      string
+	RouteOptions
+	Errors []ValidationError `json:",omitempty"`
+
+	// The environment variables replaced by labels of schema v2
+	legacyKeys []string
 }
 
 func NewRouteBuilder() RouteBuilder {
 	return RouteBuilder{
+		Schema: *defaultSchema,
 		Upstream: Upstream{
 			Proto: "http",
 		},
-		EnableHTTP: false,
-		HSTS:       "max-age=31536000",
+		RouteOptions: RouteOptions{
+			EnableHTTP:      false,
+			HSTS:            "max-age=31536000",
+			OutlierInterval: time.Minute,
+			OutlierEjection: 30 * time.Second,
+			HealthInterval:  10 * time.Second,
+			HealthTimeout:   2 * time.Second,
+			HealthDownAfter: time.Minute,
+			StickyTTL:       time.Hour,
+			CacheTTL:        time.Minute,
+			ExtProcTimeout:  time.Second,
+			ExtProcFailure:  ExtProcDeny,
+
+			StreamHalfCloseTimeout: 5 * time.Minute,
+		},
 	}
 }
 
+// isValid is false if any of validation errors prevents the route from being served,
+// with strict-labels the invalid labels too
 func (r *RouteBuilder) isValid() bool {
-	return len(r.VirtualHost) > 0 && r.Upstream.IP != "" && r.Upstream.Port != ""
+	strict := r.feature(ExperimentStrictLabels)
+	for _, err := range r.Validate() {
+		if err.blocks() || strict && err.Kind == ValidationInvalidLabel {
+			return false
+		}
+	}
+	return true
 }
 
 func (r *RouteBuilder) Parse(env string) bool {
@@ -49,6 +246,9 @@ func (r *RouteBuilder) Parse(env string) bool {
 		return false
 	}
 
+	if _, ok := legacyEnvKeys[keyValue[0]]; ok {
+		r.legacyKeys = append(r.legacyKeys, keyValue[0])
+	}
 	switch keyValue[0] {
 	case "VIRTUAL_HOST":
 		r.VirtualHost = strings.Split(keyValue[1], ",")
@@ -62,7 +262,7 @@ func (r *RouteBuilder) Parse(env string) bool {
 	case "HTTP_HSTS":
 		r.HSTS = keyValue[1]
 	default:
-		return false
+		return r.ParseLabel(keyValue[0], keyValue[1])
 	}
 
 	return true
@@ -74,30 +274,437 @@ func (r *RouteBuilder) ParseAll(envs ...string) {
 	}
 }
 
+func (r *RouteBuilder) ParseLabel(key, value string) bool {
+	if !strings.HasPrefix(key, LabelPrefix) {
+		return false
+	}
+
+	var err error
+	switch name := strings.TrimPrefix(key, LabelPrefix); name {
+	case "schema":
+		r.Schema, err = parseSchema(value)
+	case "experimental":
+		r.Experimental, err = parseExperimental(value)
+	case "host", "port", "proto", "http", "hsts":
+		err = r.parseSchemaLabel(name, value)
+	case "middlewares":
+		err = r.applyMiddlewares(value)
+	case "upstream":
+		r.Upstream.Socket, err = parseSocketURL(value)
+	case "canonical":
+		if value != "apex" && value != "www" && value != "off" {
+			err = errors.New("expected apex, www or off")
+		}
+		r.Canonical = value
+	case "acme":
+		if value != ACMEProduction && value != ACMEStaging && value != ACMEOff {
+			err = errors.New("expected prod, staging or off")
+		}
+		r.ACME = value
+	case "bots":
+		if value != BotsBlock && value != BotsChallenge && value != "off" {
+			err = errors.New("expected block, challenge or off")
+		} else if value == "off" {
+			value = ""
+		}
+		r.Bots = value
+	case "bots.deny":
+		r.BotsDeny = nil
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				r.BotsDeny = append(r.BotsDeny, name)
+			}
+		}
+	case "upstream.sni":
+		r.Upstream.TLSServerName = value
+	case "upstream.pin":
+		_, err = parsePins(value)
+		r.Upstream.TLSPins = value
+	case "weight":
+		err = r.parseWeight(value)
+	case "match.header":
+		r.Upstream.MatchHeader, err = parseMatch(value, ":")
+	case "alpn":
+		r.Upstream.ALPN, err = parseALPN(value)
+	case "match.cookie":
+		r.Upstream.MatchCookie, err = parseMatch(value, "=")
+	case "chunked":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.ChunkedOff = value == "off"
+	case "early-hints":
+		r.EarlyHintsOff, err = parseEarlyHints(value)
+	case "upstream.prewarm":
+		r.UpstreamPrewarm, err = parsePrewarm(value)
+	case "upstream.ip-change":
+		r.UpstreamIPChange, err = parseIPChange(value)
+	case "upstream.gzip":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.UpstreamGzip = value == "on"
+	case "log":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.LogOff = value == "off"
+	case "log.sample":
+		// The zero sample is unset, the routes without any log use auto-proxy.log=off
+		r.LogSample, err = strconv.ParseFloat(value, 64)
+		if err == nil && (r.LogSample <= 0 || r.LogSample > 1) {
+			err = errors.New("expected value above 0 and up to 1, use " + LabelPrefix + "log=off to disable")
+		}
+		if err != nil {
+			r.LogSample = 0
+		}
+	case "cache":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.Cache = value == "on"
+	case "cache.ttl":
+		r.CacheTTL, err = time.ParseDuration(value)
+	case "profile":
+		if !isValidProfile(value) {
+			err = errors.New("unknown profile, the routes are not served")
+		}
+		r.Profile = value
+	case "sign":
+		r.Sign, err = parseSignMethod(value)
+	case "ext-proc":
+		r.ExtProc, err = parseExtProcURL(value)
+	case "ext-proc.body":
+		r.ExtProcBody, err = strconv.ParseInt(value, 10, 64)
+	case "ext-proc.timeout":
+		r.ExtProcTimeout, err = time.ParseDuration(value)
+	case "ext-proc.failure":
+		r.ExtProcFailure, err = parseExtProcFailure(value)
+	case "max-requests":
+		r.MaxRequests, err = strconv.Atoi(value)
+	case "queue.size":
+		r.QueueSize, err = strconv.Atoi(value)
+	case "queue.timeout":
+		r.QueueTimeout, err = time.ParseDuration(value)
+	case "max-upgrades":
+		r.MaxUpgrades, err = strconv.Atoi(value)
+	case "upgrade.idle-timeout":
+		r.UpgradeIdleTimeout, err = time.ParseDuration(value)
+	case "upgrade.pings":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.UpgradeIgnorePings = value == "off"
+	case "max-connections":
+		r.MaxConnections, err = strconv.Atoi(value)
+	case "stream.idle-timeout":
+		r.StreamIdleTimeout, err = time.ParseDuration(value)
+	case "stream.half-close":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.StreamHalfCloseOff = value == "off"
+	case "stream.half-close-timeout":
+		r.StreamHalfCloseTimeout, err = time.ParseDuration(value)
+	case "allow-hours":
+		_, err = compileAllowHours(value)
+		r.AllowHours = value
+	case "allow-hours.status":
+		r.AllowHoursStatus, err = parseAllowHoursStatus(value)
+	case "banner":
+		r.Banner, err = parseBannerName(value)
+	case "headers.max-size":
+		r.HeadersMaxSize, err = strconv.Atoi(value)
+	case "headers.max-total":
+		r.HeadersMaxTotal, err = strconv.Atoi(value)
+	case "headers.max-count":
+		r.HeadersMaxCount, err = strconv.Atoi(value)
+	case "rules":
+		err = checkRuleSets(value)
+		r.Rules = value
+	case "tls":
+		if value != TLSTerminate && value != TLSPassthrough {
+			err = errors.New("expected terminate or passthrough")
+		}
+		r.TLS = value
+	case "tls-headers":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.TLSHeaders = value == "on"
+	case "forwarded":
+		if !isValidForwarded(value) {
+			err = errors.New("expected rails, django, express, rfc7239 or all")
+		}
+		r.Forwarded = value
+	case "acme.email":
+		r.ACMEEmail = value
+	case "upstream-host":
+		r.UpstreamHost = value
+	case "bandwidth":
+		r.Bandwidth, err = parseBandwidth(value)
+	case "bandwidth.route":
+		r.RouteBandwidth, err = parseBandwidth(value)
+	case "rate-limit":
+		r.RateLimit, r.RateLimitWindow, err = parseRateLimit(value)
+	case "rate-limit.by":
+		if value != RateLimitByIP && value != RateLimitByRoute {
+			err = errors.New("expected ip or route")
+		}
+		r.RateLimitBy = value
+	case "rate-limit.scope":
+		if value != "cluster" && value != "instance" {
+			err = errors.New("expected cluster or instance")
+		}
+		r.RateLimitLocal = value == "instance"
+	case "sticky":
+		if value == "cookie" {
+			r.StickyCookie = "auto_proxy_session"
+		} else if value != "" && value != "off" {
+			err = errors.New("expected cookie or off")
+		}
+	case "balance":
+		r.Balance, err = parseBalance(value)
+	case "sticky.cookie":
+		r.StickyCookie = value
+	case "sticky.ttl":
+		// Redis and the cookie Max-Age keep whole seconds
+		r.StickyTTL, err = time.ParseDuration(value)
+		if err != nil || r.StickyTTL < time.Second {
+			r.StickyTTL, err = time.Hour, errors.New("expected ttl of at least 1s")
+		}
+	case "slow-start":
+		r.SlowStart, err = time.ParseDuration(value)
+	case "warmup.requests":
+		r.WarmupRequests, err = strconv.Atoi(value)
+	case "warmup.path":
+		if !strings.HasPrefix(value, "/") {
+			err = errors.New("expected absolute path")
+		}
+		r.WarmupPath = value
+	case "health.path":
+		if !strings.HasPrefix(value, "/") {
+			err = errors.New("expected absolute path")
+		}
+		r.HealthPath = value
+	case "health.interval":
+		r.HealthInterval, err = time.ParseDuration(value)
+	case "health.timeout":
+		r.HealthTimeout, err = time.ParseDuration(value)
+	case "health.down-after":
+		r.HealthDownAfter, err = time.ParseDuration(value)
+	case "health.restart":
+		if value != "on" && value != "off" {
+			err = errors.New("expected on or off")
+		}
+		r.HealthRestart = value == "on"
+	case "outlier.factor":
+		r.OutlierFactor, err = strconv.ParseFloat(value, 64)
+	case "outlier.interval":
+		r.OutlierInterval, err = time.ParseDuration(value)
+	case "outlier.ejection":
+		r.OutlierEjection, err = time.ParseDuration(value)
+	default:
+		if !r.parseHeaderLabel(strings.TrimPrefix(key, LabelPrefix), value) {
+			r.addError(ValidationInvalidLabel, key, "unknown label")
+			return false
+		}
+		return true
+	}
+
+	if err != nil {
+		logrus.WithField("label", key).WithError(err).Warningln("Invalid label value")
+		r.addError(ValidationInvalidLabel, key, err.Error())
+		return false
+	}
+	return true
+}
+
+// ParseLabels applies the middlewares first, so the labels of container can override them
+func (r *RouteBuilder) ParseLabels(labels map[string]string) {
+	if names, ok := labels[LabelPrefix+"middlewares"]; ok {
+		r.ParseLabel(LabelPrefix+"middlewares", names)
+	}
+	for key, value := range labels {
+		if key != LabelPrefix+"middlewares" {
+			r.ParseLabel(key, value)
+		}
+	}
+}
+
 type Route struct {
 	VirtualHost string
 	Wildcard    bool
-	EnableHTTP  bool
-	HSTS        string
-	Servers     []Upstream
+	RouteOptions
+	Servers       []Upstream
+	ALPNServers   []Upstream `json:",omitempty"`
+	CanonicalHost string     `json:",omitempty"`
+
+	// Conflicts are the options which differ between containers of the host
+	Conflicts []string `json:",omitempty"`
+
+	state *routeState
+}
+
+// routeState is created once the routes are merged, it is shared by the copies of route made per request
+type routeState struct {
+	// scheduled keeps the routes with label overrides of the active schedules
+	scheduled  sync.Map
+	exprRules  []Rule
+	allowHours []*Schedule
+	secrets    routeSecrets
+}
+
+// compile prepares the state of route, it is called again for the copies with changed options
+func (r *Route) compile() {
+	r.state = &routeState{
+		exprRules: compileExprRules(r),
+	}
+	if r.AllowHours != "" {
+		r.state.allowHours, _ = compileAllowHours(r.AllowHours)
+	}
+}
+
+// equal compares the routes without their state
+func (r *Route) equal(other *Route) bool {
+	a, b := *r, *other
+	a.state, b.state = nil, nil
+	return reflect.DeepEqual(&a, &b)
 }
 
 type Routes map[string]*Route
 
 func (r *Routes) Add(b RouteBuilder) bool {
+	b.VirtualHost = allowedHosts(b.VirtualHost, &b.Upstream)
 	if !b.isValid() {
 		return false
 	}
+	if err := b.validateMiddlewares(); err != nil {
+		logrus.WithField("vhost", b.VirtualHost).WithError(err).Warningln("Invalid middleware options, the routes are not served")
+		return false
+	}
+
+	// The upstreams speaking other protocols don't change the options of HTTP upstreams
+	if b.Upstream.ALPN != "" {
+		for _, host := range b.VirtualHost {
+			route := r.GetVhost(host)
+			if len(route.Servers) == 0 && len(route.ALPNServers) == 0 {
+				route.RouteOptions = b.RouteOptions
+			}
+			route.ALPNServers = append(route.ALPNServers, b.Upstream)
+		}
+		return true
+	}
 
 	for _, host := range b.VirtualHost {
 		route := r.GetVhost(host)
+		if len(route.Servers) > 0 {
+			route.addConflicts(optionConflicts(&route.RouteOptions, &b.RouteOptions))
+		}
 		route.Servers = append(route.Servers, b.Upstream)
-		route.EnableHTTP = b.EnableHTTP
-		route.HSTS = b.HSTS
+		route.RouteOptions = b.RouteOptions
+		route.CanonicalHost = ""
+	}
+
+	// Redirect the other name to the canonical one, unless it is claimed by someone else
+	for _, host := range b.VirtualHost {
+		alias := canonicalAlias(host, b.Canonical)
+		if alias == "" || r.Find(alias) != nil || !isAllowedDomain(alias) {
+			continue
+		}
+		route := r.GetVhost(alias)
+		route.RouteOptions = b.RouteOptions
+		route.CanonicalHost = host
 	}
 	return true
 }
 
+// canonicalAlias returns the www or apex counterpart of the host, which should redirect to it
+func canonicalAlias(host, canonical string) string {
+	if strings.HasPrefix(host, "*.") {
+		return ""
+	}
+
+	switch canonical {
+	case "apex":
+		if !strings.HasPrefix(host, "www.") {
+			return "www." + host
+		}
+	case "www":
+		if strings.HasPrefix(host, "www.") {
+			return strings.TrimPrefix(host, "www.")
+		}
+	}
+	return ""
+}
+
+// Merge adds routes from all sources, the servers of the same virtual host are combined
+func (r Routes) Merge(sources map[string]Routes) {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sortSources(names)
+
+	for _, name := range names {
+		for key, source := range sources[name] {
+			route := r[key]
+			if route == nil {
+				copied := *source
+				copied.Servers = append([]Upstream{}, source.Servers...)
+				copied.ALPNServers = append([]Upstream(nil), source.ALPNServers...)
+				copied.Conflicts = append([]string(nil), source.Conflicts...)
+				r[key] = &copied
+			} else if route.CanonicalHost != "" && source.CanonicalHost == "" {
+				// Real routes take precedence over canonical redirects
+				copied := *source
+				copied.Servers = append([]Upstream{}, source.Servers...)
+				copied.ALPNServers = append([]Upstream(nil), source.ALPNServers...)
+				copied.Conflicts = append([]string(nil), source.Conflicts...)
+				r[key] = &copied
+			} else {
+				if len(route.Servers) > 0 && len(source.Servers) > 0 {
+					route.addConflicts(optionConflicts(&route.RouteOptions, &source.RouteOptions))
+				}
+				route.addConflicts(source.Conflicts)
+				route.Servers = append(route.Servers, source.Servers...)
+				route.ALPNServers = append(route.ALPNServers, source.ALPNServers...)
+			}
+		}
+	}
+	for _, route := range r {
+		route.compile()
+	}
+}
+
+type RouteChange struct {
+	Host   string `json:"host"`
+	Action string `json:"action"`
+	Before *Route `json:"before,omitempty"`
+	After  *Route `json:"after,omitempty"`
+}
+
+// Diff returns list of virtual hosts which were added, removed or changed between r and other
+func (r Routes) Diff(other Routes) (changes []RouteChange) {
+	for key, before := range r {
+		after := other[key]
+		if after == nil {
+			changes = append(changes, RouteChange{Host: key, Action: "removed", Before: before})
+		} else if !before.equal(after) {
+			changes = append(changes, RouteChange{Host: key, Action: "changed", Before: before, After: after})
+		}
+	}
+	for key, after := range other {
+		if r[key] == nil {
+			changes = append(changes, RouteChange{Host: key, Action: "added", After: after})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Host < changes[j].Host
+	})
+	return
+}
+
 func (r Routes) GetVhost(vhost string) *Route {
 	key := strings.TrimPrefix(vhost, "*.")
 	route := r[key]
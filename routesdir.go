@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The changes are applied once the directory is quiet for this time, the tools usually write many files at once
+const routesDirSettleTime = 500 * time.Millisecond
+const routesDirRescanInterval = time.Minute
+
+// routeFragment is a document of route file, the values are string, []string or map[string]string
+type routeFragment map[string]interface{}
+
+// unquoteYAML reads plain, single or double quoted scalar
+func unquoteYAML(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strconv.Unquote(value)
+	} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	return value, nil
+}
+
+// stripYAMLComment removes # comment which is not inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for idx := 0; idx < len(line); idx++ {
+		switch c := line[idx]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (idx == 0 || line[idx-1] == ' ' || line[idx-1] == '\t'):
+			return strings.TrimRight(line[:idx], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+func parseYAMLScalarOrList(value string) (interface{}, error) {
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		var list []string
+		for _, item := range strings.Split(value[1:len(value)-1], ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			item, err := unquoteYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	}
+	return unquoteYAML(value)
+}
+
+// parseRouteFile reads the subset of YAML used by route files: documents separated by ---
+// with scalars, lists (block or [flow]) and one level mappings
+func parseRouteFile(data string) (documents []routeFragment, err error) {
+	document := routeFragment{}
+	var key string
+
+	for number, line := range strings.Split(data, "\n") {
+		fail := func(message string) error {
+			return fmt.Errorf("line %d: %s", number+1, message)
+		}
+
+		line = stripYAMLComment(strings.TrimRight(line, "\r"))
+		if strings.TrimSpace(line) == "" {
+			continue
+		} else if line == "---" || line == "..." {
+			if len(document) > 0 {
+				documents = append(documents, document)
+			}
+			document, key = routeFragment{}, ""
+			continue
+		} else if strings.Contains(line, "\t") {
+			return nil, fail("tabs are not allowed")
+		}
+
+		nested := line[0] == ' '
+		line = strings.TrimSpace(line)
+
+		if !nested {
+			nameValue := strings.SplitN(line, ":", 2)
+			if len(nameValue) != 2 {
+				return nil, fail("expected key: value")
+			}
+			key = strings.TrimSpace(nameValue[0])
+			value := strings.TrimSpace(nameValue[1])
+			if value == "" {
+				document[key] = nil
+				continue
+			}
+			if document[key], err = parseYAMLScalarOrList(value); err != nil {
+				return nil, fail(err.Error())
+			}
+			continue
+		}
+
+		if key == "" {
+			return nil, fail("unexpected indentation")
+		}
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			list, ok := document[key].([]string)
+			if document[key] != nil && !ok {
+				return nil, fail("mixed list and mapping in " + key)
+			}
+			item, err := unquoteYAML(strings.TrimPrefix(line, "-"))
+			if err != nil {
+				return nil, fail(err.Error())
+			}
+			document[key] = append(list, item)
+			continue
+		}
+
+		nameValue := strings.SplitN(line, ": ", 2)
+		if len(nameValue) != 2 {
+			nameValue = strings.SplitN(line, ":", 2)
+		}
+		if len(nameValue) != 2 {
+			return nil, fail("expected key: value")
+		}
+		mapping, ok := document[key].(map[string]string)
+		if document[key] != nil && !ok {
+			return nil, fail("mixed list and mapping in " + key)
+		} else if mapping == nil {
+			mapping = make(map[string]string)
+			document[key] = mapping
+		}
+		name, _ := unquoteYAML(nameValue[0])
+		if mapping[name], err = unquoteYAML(nameValue[1]); err != nil {
+			return nil, fail(err.Error())
+		}
+	}
+	if len(document) > 0 {
+		documents = append(documents, document)
+	}
+	return
+}
+
+// list returns the trimmed items of comma separated scalar or list, the empty items are skipped
+func (f routeFragment) list(key string) (items []string) {
+	var values []string
+	switch value := f[key].(type) {
+	case string:
+		values = strings.Split(value, ",")
+	case []string:
+		values = value
+	}
+	for _, item := range values {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func (f routeFragment) mapping(key string) map[string]string {
+	value, _ := f[key].(map[string]string)
+	return value
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lines converts the fragment to the format of manual routes, so the routes from files and K/V store behave the same
+func (f routeFragment) lines(upstream string) (lines []string, err error) {
+	for key := range f {
+		switch key {
+		case "host", "hosts", "upstream", "upstreams", "labels", "env":
+		default:
+			return nil, errors.New("unknown key " + key)
+		}
+	}
+
+	hosts := append(f.list("host"), f.list("hosts")...)
+	lines = append(lines, "VIRTUAL_HOST="+strings.Join(hosts, ","), "UPSTREAM="+upstream)
+	env := f.mapping("env")
+	for _, key := range sortedKeys(env) {
+		lines = append(lines, key+"="+env[key])
+	}
+	labels := f.mapping("labels")
+	for _, key := range sortedKeys(labels) {
+		name := key
+		if !strings.HasPrefix(name, LabelPrefix) {
+			name = LabelPrefix + name
+		}
+		lines = append(lines, name+"="+labels[key])
+	}
+	return
+}
+
+// readRoutesDir reads the *.yaml and *.yml files, the invalid files are skipped
+func readRoutesDir(dir string) Routes {
+	profiled := make(ProfileRoutes)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	yml, _ := filepath.Glob(filepath.Join(dir, "*.yml"))
+	files = append(files, yml...)
+	sort.Strings(files)
+
+	for _, fileName := range files {
+		log := logrus.WithField("file", fileName)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			log.WithError(err).Warningln("Failed to read route file")
+			continue
+		}
+		documents, err := parseRouteFile(string(data))
+		if err != nil {
+			log.WithError(err).Warningln("Invalid route file")
+			continue
+		}
+
+		for idx, document := range documents {
+			upstreams := append(document.list("upstream"), document.list("upstreams")...)
+			if len(upstreams) == 0 {
+				log.WithField("document", idx+1).Warningln("Invalid route: missing upstream")
+				continue
+			}
+			for _, upstream := range upstreams {
+				lines, err := document.lines(strings.TrimSpace(upstream))
+				if err == nil {
+					name := fmt.Sprintf("%s#%d", filepath.Base(fileName), idx+1)
+					var route RouteBuilder
+					route, err = parseKVRoute(name, strings.Join(lines, "\n"))
+					if err == nil {
+						route.Upstream.Container = "file:" + name
+						profiled.Add(route)
+					}
+				}
+				if err != nil {
+					log.WithField("document", idx+1).WithError(err).Warningln("Invalid route")
+				}
+			}
+		}
+	}
+	return profiled.Join()
+}
+
+// watchRoutesDir applies the route files as soon as they change, the directory is re-read
+// every minute as well in case of missed notifications
+func watchRoutesDir(dir string, source *routeSource) {
+	changes := make(chan struct{}, 1)
+	go func() {
+		err := watchDirectory(dir, changes)
+		if err != nil {
+			logrus.WithField("dir", dir).WithError(err).Warningln("Failed to watch routes directory, polling it")
+		}
+	}()
+
+	source.Update(readRoutesDir(dir), "routes directory read")
+	for {
+		trigger := "routes directory rescan"
+		select {
+		case <-changes:
+			// wait till all files are written
+			for settled := false; !settled; {
+				select {
+				case <-changes:
+				case <-time.After(routesDirSettleTime):
+					settled = true
+				}
+			}
+			trigger = "routes directory changed"
+		case <-time.After(routesDirRescanInterval):
+		}
+
+		logrus.WithField("dir", dir).Debugln("Reading routes directory...")
+		source.Update(readRoutesDir(dir), trigger)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// watchDirectory notifies about files written, moved or removed in the directory using inotify
+func watchDirectory(dir string, changes chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_MOVED_FROM|
+		syscall.IN_DELETE|syscall.IN_CREATE)
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buffer)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// the directory was removed
+				return nil
+			}
+		}
+
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
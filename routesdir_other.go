@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// watchDirectory is implemented only on Linux, the routes directory is re-read periodically elsewhere
+func watchDirectory(dir string, changes chan<- struct{}) error {
+	return errors.New("routes-dir: notifications are supported only on Linux")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// The time to collect new hosts of a group before requesting their certificate
+const sanGroupDelay = 5 * time.Second
+
+// sanGroup returns the parent domain of -san-group the host belongs to, * groups hosts by registered domain
+func sanGroup(name string) string {
+	if *sanGroups == "" || strings.HasPrefix(name, "*.") {
+		return ""
+	}
+	for _, parent := range strings.Split(*sanGroups, ",") {
+		parent = strings.TrimSpace(parent)
+		if parent == "*" {
+			return registeredDomain(name)
+		} else if parent != "" && strings.HasSuffix(name, "."+parent) {
+			return parent
+		}
+	}
+	return ""
+}
+
+// queueGroup delays the request of new certificate, so the hosts of the group appearing together
+// (ie. on startup) are requested as SAN certificates of up to -san-group-size names
+func (c *Certificates) queueGroup(group string, certificate *Certificate, challenge CertificateChallenge) {
+	if c.pending == nil {
+		c.pending = make(map[string][]*Certificate)
+	}
+	key := group + " " + certificate.KeyType
+	if len(c.pending[key]) == 0 {
+		time.AfterFunc(sanGroupDelay, func() {
+			c.requestGroup(key, challenge)
+		})
+	}
+	c.pending[key] = append(c.pending[key], certificate)
+}
+
+func (c *Certificates) requestGroup(key string, challenge CertificateChallenge) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending := c.pending[key]
+	delete(c.pending, key)
+
+	for len(pending) > 0 {
+		leader := pending[0]
+		var batch []*Certificate
+		for _, other := range pending[1:] {
+			if len(batch)+1 < *sanGroupSize && other.Policy == leader.Policy {
+				batch = append(batch, other)
+			}
+		}
+		leader.Batch = batch
+		go c.request(leader, challenge)
+
+		batched := make(map[*Certificate]bool)
+		for _, other := range batch {
+			batched[other] = true
+		}
+		var rest []*Certificate
+		for _, other := range pending[1:] {
+			if !batched[other] {
+				rest = append(rest, other)
+			}
+		}
+		pending = rest
+	}
+}
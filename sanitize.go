@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+var rejectedRequests = newCounter("auto_proxy_rejected_requests_total",
+	"Number of ambiguous requests rejected before proxying", "reason")
+
+// Headers set by the proxy, the client can't ask to drop them as hop-by-hop headers
+var protectedHeaders = map[string]bool{
+	"X-Real-Ip":         true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Proto": true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Port":  true,
+	"Forwarded":         true,
+	"Host":              true,
+}
+
+// checkRequest returns the reason if the request can be parsed differently by upstreams with laxer parsers.
+// The conflicting Content-Length and Transfer-Encoding and invalid headers are already rejected by net/http.
+func checkRequest(r *http.Request) string {
+	// Absolute-form is allowed only for http(s) without credentials
+	if !strings.HasPrefix(r.RequestURI, "/") && r.RequestURI != "*" && r.Method != "CONNECT" {
+		if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+			return "invalid-request-target"
+		} else if r.URL.User != nil {
+			return "credentials-in-request-target"
+		}
+	}
+
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if protectedHeaders[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(token))] {
+				return "protected-hop-by-hop-header"
+			}
+		}
+	}
+	return ""
+}
+
+// normalizeRequest removes the headers with underscores, which some upstreams treat the same as dashes
+func normalizeRequest(r *http.Request) {
+	if *allowUnderscoreHeaders {
+		return
+	}
+	for name := range r.Header {
+		if strings.Contains(name, "_") {
+			r.Header.Del(name)
+		}
+	}
+}
+
+// sanitizeRequest rejects ambiguous requests, so they are never smuggled to upstreams
+func sanitizeRequest(w http.ResponseWriter, r *http.Request) bool {
+	if reason := checkRequest(r); reason != "" {
+		rejectedRequests.Inc(reason)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return false
+	}
+	normalizeRequest(r)
+	return true
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMaintenancePage = `<!DOCTYPE html><html><head><title>Maintenance</title></head>
+<body><h1>Scheduled maintenance</h1><p>The service will be back shortly.</p></body></html>
+`
+
+// Schedule applies maintenance or label overrides to routes, either weekly or once between from and until
+type Schedule struct {
+	ID          string            `json:"id"`
+	Hosts       []string          `json:"hosts"`
+	Days        string            `json:"days,omitempty"`
+	Start       string            `json:"start,omitempty"`
+	End         string            `json:"end,omitempty"`
+	Timezone    string            `json:"timezone,omitempty"`
+	From        *time.Time        `json:"from,omitempty"`
+	Until       *time.Time        `json:"until,omitempty"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+
+	location *time.Location
+	start    time.Duration
+	end      time.Duration
+	days     map[time.Weekday]bool
+	labels   map[string]string
+	serial   uint64
+
+	// dynamic schedules are added with admin API, not from config
+	dynamic bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduleSerial identifies the compiled schedule in the routes with applied overrides
+var scheduleSerial atomic.Uint64
+
+// parseClock parses the time of day from 00:00 to 24:00
+func parseClock(value string) (time.Duration, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("schedule: expected HH:MM, got " + value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, errors.New("schedule: invalid hour in " + value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || hours == 24 && minutes > 0 {
+		return 0, errors.New("schedule: invalid minute in " + value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+func (s *Schedule) compile() (err error) {
+	if len(s.Hosts) == 0 {
+		return errors.New("schedule: no hosts")
+	} else if !s.Maintenance && len(s.Labels) == 0 {
+		return errors.New("schedule: expected maintenance or labels")
+	}
+	if s.ID == "" {
+		data := make([]byte, 8)
+		rand.Read(data)
+		s.ID = hex.EncodeToString(data)
+	}
+	if err := s.compileLabels(); err != nil {
+		return err
+	}
+	s.serial = scheduleSerial.Add(1)
+
+	// One-off window
+	if s.Until != nil {
+		if s.Start != "" || s.End != "" || s.Days != "" {
+			return errors.New("schedule: use either from/until or days/start/end")
+		}
+		return nil
+	}
+	return s.compileWeekly()
+}
+
+// compileLabels validates the overrides once, they can change only the options of route, not its hosts or upstreams
+func (s *Schedule) compileLabels() error {
+	keys := make([]string, 0, len(s.Labels))
+	for key := range s.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s.labels = make(map[string]string, len(s.Labels))
+	for _, key := range keys {
+		builder := RouteBuilder{Schema: SchemaV2}
+		builder.ParseLabel(LabelPrefix+key, s.Labels[key])
+		if len(builder.Errors) > 0 {
+			return fmt.Errorf("schedule: label %s: %s", key, builder.Errors[0].Message)
+		} else if !reflect.DeepEqual(builder, RouteBuilder{Schema: SchemaV2, RouteOptions: builder.RouteOptions}) {
+			return errors.New("schedule: label " + key + " can't be overridden")
+		}
+		s.labels[LabelPrefix+key] = s.Labels[key]
+	}
+	return nil
+}
+
+// compileWeekly parses the days, start and end in the timezone of weekly window
+func (s *Schedule) compileWeekly() (err error) {
+	s.location = time.UTC
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return
+		}
+	}
+	if s.start, err = parseClock(s.Start); err != nil {
+		return
+	}
+	if s.end, err = parseClock(s.End); err != nil {
+		return
+	}
+	if s.Days != "" {
+		s.days = make(map[time.Weekday]bool)
+		for _, day := range strings.Split(s.Days, ",") {
+			day = strings.ToLower(strings.TrimSpace(day))
+			if len(day) > 3 {
+				day = day[:3]
+			}
+			weekday, ok := weekdays[day]
+			if !ok {
+				return errors.New("schedule: unknown day " + day)
+			}
+			s.days[weekday] = true
+		}
+	}
+	return nil
+}
+
+// Active returns whether the schedule applies now and when the window ends
+func (s *Schedule) Active(now time.Time) (bool, time.Time) {
+	if s.Until != nil {
+		started := s.From == nil || !now.Before(*s.From)
+		return started && now.Before(*s.Until), *s.Until
+	}
+
+	// The window can start yesterday and cross midnight
+	local := now.In(s.location)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.location)
+	for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+		if s.days != nil && !s.days[day.Weekday()] {
+			continue
+		}
+		start, end := day.Add(s.start), day.Add(s.end)
+		if s.end <= s.start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return true, end
+		}
+	}
+	return false, time.Time{}
+}
+
+func (s *Schedule) Matches(host string) bool {
+	host = stripPort(host)
+	for _, pattern := range s.Hosts {
+		if matched, _ := filepath.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduler holds schedules from config and the ones added with admin API
+type scheduler struct {
+	list []*Schedule
+	lock sync.RWMutex
+}
+
+var schedules scheduler
+
+func (s *scheduler) Add(schedule *Schedule) error {
+	if err := schedule.compile(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, other := range s.list {
+		if other.ID == schedule.ID {
+			return errors.New("schedule: duplicate id " + schedule.ID)
+		}
+	}
+	s.list = append(s.list, schedule)
+	return nil
+}
+
+func (s *scheduler) Remove(id string) *Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for idx, schedule := range s.list {
+		if schedule.ID == id {
+			s.list = append(s.list[:idx], s.list[idx+1:]...)
+			return schedule
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) List() []*Schedule {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*Schedule{}, s.list...)
+}
+
+// Apply returns the route with label overrides of active schedules, and the end of maintenance if any.
+// The overridden route is kept in the state of route till the active schedules change.
+func (s *scheduler) Apply(route *Route, host string) (*Route, time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var maintenance time.Time
+	var applied []*Schedule
+	var key []string
+	now := time.Now()
+
+	for _, schedule := range s.list {
+		if !schedule.Matches(host) {
+			continue
+		}
+		active, until := schedule.Active(now)
+		if !active {
+			continue
+		}
+		if schedule.Maintenance && until.After(maintenance) {
+			maintenance = until
+		}
+		if len(schedule.labels) > 0 {
+			applied = append(applied, schedule)
+			key = append(key, strconv.FormatUint(schedule.serial, 10))
+		}
+	}
+	if len(applied) == 0 {
+		return route, maintenance
+	}
+
+	cacheKey := strings.Join(key, ",")
+	if route.state != nil {
+		if scheduled, ok := route.state.scheduled.Load(cacheKey); ok {
+			return scheduled.(*Route), maintenance
+		}
+	}
+	builder := RouteBuilder{Schema: SchemaV2, RouteOptions: route.RouteOptions}
+	builder.RequestHeaders = copyHeaders(route.RequestHeaders)
+	builder.ResponseHeaders = copyHeaders(route.ResponseHeaders)
+	for _, schedule := range applied {
+		builder.ParseLabels(schedule.labels)
+	}
+	copied := *route
+	copied.RouteOptions = builder.RouteOptions
+	copied.compile()
+	if route.state != nil {
+		scheduled, _ := route.state.scheduled.LoadOrStore(cacheKey, &copied)
+		return scheduled.(*Route), maintenance
+	}
+	return &copied, maintenance
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(headers))
+	for name, value := range headers {
+		copied[name] = value
+	}
+	return copied
+}
+
+// serveMaintenance responds with the maintenance page till the end of window
+func serveMaintenance(w http.ResponseWriter, r *http.Request, until time.Time) {
+	page := []byte(defaultMaintenancePage)
+	if *maintenancePage != "" {
+		if data, err := ioutil.ReadFile(*maintenancePage); err == nil {
+			page = data
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+}
+
+func (a *adminAPI) getSchedules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, schedules.List())
+}
+
+func (a *adminAPI) addSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule Schedule
+	err := json.NewDecoder(r.Body).Decode(&schedule)
+	schedule.dynamic = true
+	if err == nil {
+		err = schedules.Add(&schedule)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditSchedule(adminTrigger(r), "added", &schedule)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, &schedule)
+}
+
+func (a *adminAPI) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule := schedules.Remove(r.PathValue("id"))
+	if schedule == nil {
+		http.Error(w, fmt.Sprintf("schedule %s not found", r.PathValue("id")), http.StatusNotFound)
+		return
+	}
+	auditSchedule(adminTrigger(r), "removed", schedule)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditSchedule records the schedule added or removed with admin API, it changes the routes of its hosts
+func auditSchedule(trigger, action string, schedule *Schedule) {
+	auditLog.RecordDetails("admin", trigger, RouteChange{
+		Host:   strings.Join(schedule.Hosts, ","),
+		Action: "schedule " + action,
+	}, schedule)
+}
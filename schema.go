@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// The schemas of labels set with auto-proxy.schema, the v2 keeps the route in auto-proxy.* labels only
+const (
+	SchemaV1 = "v1"
+	SchemaV2 = "v2"
+)
+
+// The experimental features enabled per route with auto-proxy.experimental
+const (
+	ExperimentStrictLabels = "strict-labels"
+)
+
+// experimentalFeatures are tried on some routes first, then they become the default of the next schema
+var experimentalFeatures = map[string]string{
+	ExperimentStrictLabels: "invalid and unknown labels prevent the route from being served",
+}
+
+// schemaFeatures are the former experiments enabled by the schema
+var schemaFeatures = map[string][]string{
+	SchemaV1: nil,
+	SchemaV2: {ExperimentStrictLabels},
+}
+
+// The schema v2 labels of environment variables, the variables are still read with deprecation warning
+var legacyEnvKeys = map[string]string{
+	"VIRTUAL_HOST":  "host",
+	"VIRTUAL_PORT":  "port",
+	"VIRTUAL_PROTO": "proto",
+	"ENABLE_HTTP":   "http",
+	"HTTP_HSTS":     "hsts",
+}
+
+var containerSchemas = newGauge("auto_proxy_container_schemas",
+	"Number of discovered containers by the schema of their labels", "schema")
+
+func parseSchema(value string) (string, error) {
+	if _, ok := schemaFeatures[value]; !ok {
+		return "", errors.New("expected v1 or v2")
+	}
+	return value, nil
+}
+
+func parseExperimental(value string) ([]string, error) {
+	var list []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := experimentalFeatures[name]; !ok {
+			return nil, errors.New("unknown experiment " + name)
+		}
+		list = append(list, name)
+	}
+	return list, nil
+}
+
+// ParseSchema reads auto-proxy.schema before the other labels and variables, so they are parsed by it
+func (r *RouteBuilder) ParseSchema(envs []string, labels map[string]string) {
+	for _, env := range envs {
+		if strings.HasPrefix(env, LabelPrefix+"schema=") {
+			r.Parse(env)
+		}
+	}
+	if value, ok := labels[LabelPrefix+"schema"]; ok {
+		r.ParseLabel(LabelPrefix+"schema", value)
+	}
+}
+
+// feature tells whether the experiment is enabled for the route by auto-proxy.experimental or by the schema
+func (r *RouteBuilder) feature(name string) bool {
+	return slices.Contains(r.Experimental, name) || slices.Contains(schemaFeatures[r.Schema], name)
+}
+
+// parseSchemaLabel applies the v2 label of route basics, the same as its environment variable
+func (r *RouteBuilder) parseSchemaLabel(name, value string) error {
+	if r.Schema != SchemaV2 {
+		return errors.New("requires " + LabelPrefix + "schema=v2")
+	}
+	switch name {
+	case "host":
+		r.VirtualHost = strings.Split(value, ",")
+	case "port":
+		r.Upstream.Port = value
+	case "proto":
+		r.Upstream.Proto = value
+	case "http":
+		if value != "on" && value != "off" {
+			return errors.New("expected on or off")
+		}
+		r.EnableHTTP = value == "on"
+	case "hsts":
+		r.HSTS = value
+	}
+	return nil
+}
+
+// deprecatedKeys reports the environment variables replaced by labels of the schema
+func (r *RouteBuilder) deprecatedKeys() (errs []ValidationError) {
+	if r.Schema != SchemaV2 {
+		return
+	}
+	for _, key := range r.legacyKeys {
+		errs = append(errs, ValidationError{Kind: ValidationDeprecatedKey, Label: key,
+			Message: "replaced by " + LabelPrefix + legacyEnvKeys[key] + " in schema " + r.Schema})
+	}
+	return
+}
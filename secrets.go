@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The options of middlewares reference the secrets with secret:<name>
+const secretPrefix = "secret:"
+
+// The secrets are re-read after this time, so rotated Docker secrets and files apply without restart
+const secretRefresh = 10 * time.Second
+
+// Secret is a Docker secret or a file mounted into the proxy which the middlewares of hosts can reference,
+// the file defaults to <name> in -secrets-dir
+type Secret struct {
+	File  string   `json:"file,omitempty"`
+	Hosts []string `json:"hosts"`
+}
+
+type cachedSecret struct {
+	value string
+	read  time.Time
+}
+
+type secretCache struct {
+	list map[string]cachedSecret
+	lock sync.Mutex
+}
+
+var secrets secretCache
+
+func (s *Secret) validate(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return errors.New("config: invalid secret name " + name)
+	} else if len(s.Hosts) == 0 {
+		return errors.New("config: secret " + name + " has no hosts allowed to use it")
+	}
+	for _, pattern := range s.Hosts {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.New("config: secret " + name + " has invalid host pattern " + pattern)
+		}
+	}
+	return nil
+}
+
+func (s *Secret) allows(host string) bool {
+	for _, pattern := range s.Hosts {
+		if matched, _ := filepath.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Secret) fileName(name string) string {
+	if s.File != "" {
+		return s.File
+	}
+	return filepath.Join(*secretsDirectory, name)
+}
+
+// Read returns the content of secret without the trailing newline, the last read value is kept if the file fails
+func (c *secretCache) Read(name string) (string, error) {
+	secret := config.Secrets[name]
+	if secret == nil {
+		return "", errors.New("unknown secret " + name)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cached, ok := c.list[name]
+	if ok && time.Since(cached.read) < secretRefresh {
+		return cached.value, nil
+	}
+	data, err := ioutil.ReadFile(secret.fileName(name))
+	if err != nil {
+		if ok {
+			return cached.value, nil
+		}
+		return "", err
+	}
+	if c.list == nil {
+		c.list = make(map[string]cachedSecret)
+	}
+	cached = cachedSecret{value: strings.TrimRight(string(data), "\r\n"), read: time.Now()}
+	c.list[name] = cached
+	return cached.value, nil
+}
+
+// checkSecrets verifies all hosts of route are allowed to use the secrets of options and the secrets can be read
+func checkSecrets(hosts []string, options map[string]string) error {
+	for option, value := range options {
+		if !strings.HasPrefix(value, secretPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(value, secretPrefix)
+		secret := config.Secrets[name]
+		if secret == nil {
+			return errors.New(option + " references unknown secret " + name)
+		}
+		for _, host := range hosts {
+			if !secret.allows(host) {
+				return errors.New(host + " is not allowed to use secret " + name)
+			}
+		}
+		if _, err := secrets.Read(name); err != nil {
+			return errors.New("secret " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// resolveSecrets returns the options with secret references replaced by their content,
+// the routes keep the references, so the secrets are not exposed by admin API, snapshots or audit log
+func resolveSecrets(options map[string]string) (map[string]string, error) {
+	resolved, copied := options, false
+	for option, value := range options {
+		if !strings.HasPrefix(value, secretPrefix) {
+			continue
+		}
+		if !copied {
+			resolved, copied = make(map[string]string, len(options)), true
+			for key, value := range options {
+				resolved[key] = value
+			}
+		}
+		content, err := secrets.Read(strings.TrimPrefix(value, secretPrefix))
+		if err != nil {
+			return nil, err
+		}
+		resolved[option] = content
+	}
+	return resolved, nil
+}
+
+// routeSecrets keeps the options of middlewares of route with resolved secrets,
+// they are resolved again after secretRefresh, so the rotated secrets apply
+type routeSecrets struct {
+	options  map[string]map[string]string
+	err      error
+	resolved time.Time
+	lock     sync.Mutex
+}
+
+func (s *routeSecrets) resolve(route *Route) (map[string]map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.resolved.IsZero() && time.Since(s.resolved) < secretRefresh {
+		return s.options, s.err
+	}
+	s.options, s.err, s.resolved = make(map[string]map[string]string, len(route.Middlewares)), nil, time.Now()
+	for _, name := range route.Middlewares {
+		options, err := resolveSecrets(route.MiddlewareOptions[name])
+		if err != nil {
+			s.options, s.err = nil, errors.New("middleware "+name+": "+err.Error())
+			break
+		}
+		s.options[name] = options
+	}
+	return s.options, s.err
+}
+
+// resolveRouteSecrets returns the options of middlewares of route with resolved secrets
+func resolveRouteSecrets(route *Route) (map[string]map[string]string, error) {
+	if route.state == nil {
+		var resolved routeSecrets
+		return resolved.resolve(route)
+	}
+	return route.state.secrets.resolve(route)
+}
@@ -2,41 +2,113 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 )
 
 type TLSHandler interface {
 	http.Handler
 	ServeTLS(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	FindPassthrough(serverName string) *Route
+	FindALPN(serverName string, protocols []string) (*Route, string)
 }
 
-func ListenAndServe(addr string, handler http.Handler) error {
-	// create server
+// newHTTPServer creates the server of plain HTTP listener
+func newHTTPServer(addr string, handler http.Handler) (*http.Server, error) {
 	server := &http.Server{Addr: addr, Handler: handler}
 
 	if *http2proto {
 		err := http2.ConfigureServer(server, &http2.Server{})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return server, nil
+}
+
+// newTLSConfig creates the config shared by HTTPS listeners of handler, it outlives the listeners,
+// so the session tickets rotated once are resumed by the listeners bound on reload
+func newTLSConfig(certificate *Certificate, handler TLSHandler) *tls.Config {
+	config := &tls.Config{GetCertificate: handler.ServeTLS}
+
+	// The key can be encrypted at rest, so use the loaded one
+	config.Certificates = []tls.Certificate{*certificate.TLS}
+
+	if *http2proto {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
 
-	return server.ListenAndServe()
+	if !*sessionTickets {
+		config.SessionTicketsDisabled = true
+	} else if *sessionTicketRotation > 0 {
+		go rotateSessionTickets(config, *sessionTicketRotation)
+	}
+	return config
 }
 
-func ListenAndServeTLS(addr string, certificate *Certificate, handler TLSHandler) error {
-	// create server
-	server := &http.Server{Addr: addr, Handler: handler}
-	server.TLSConfig = &tls.Config{}
-	server.TLSConfig.GetCertificate = handler.ServeTLS
+// newHTTPSServer creates the server of HTTPS listener using the shared config
+func newHTTPSServer(addr string, config *tls.Config, handler TLSHandler) (*http.Server, error) {
+	server := &http.Server{Addr: addr, Handler: handler, ConnContext: fingerprintContext, TLSConfig: config}
 
 	if *http2proto {
 		err := http2.ConfigureServer(server, &http2.Server{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// serveTLS peeks the server name first, so passthrough routes can receive raw TLS stream
+func serveTLS(server *http.Server, handler TLSHandler) func(net.Listener) error {
+	return func(listener net.Listener) error {
+		return server.Serve(tls.NewListener(newSNIListener(listener, handler), server.TLSConfig))
+	}
+}
+
+func ListenAndServeAdmin(addr string, admin *adminAPI) error {
+	server := &http.Server{Addr: addr, Handler: admin}
+	if *adminCert == "" && *adminName == "" {
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = &tls.Config{}
+	if *adminName != "" {
+		// Request the certificate before the first client connects
+		admin.ServeTLS(&tls.ClientHelloInfo{ServerName: *adminName})
+		server.TLSConfig.GetCertificate = admin.ServeTLS
+	}
+
+	// Require client certificates signed by given CA
+	if *adminClientCA != "" {
+		data, err := ioutil.ReadFile(*adminClientCA)
 		if err != nil {
 			return err
 		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("admin: no certificates found in " + *adminClientCA)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
-	return server.ListenAndServeTLS(certificate.CertificateFile, certificate.KeyFile)
+	return server.ListenAndServeTLS(*adminCert, *adminKey)
+}
+
+// ServeTLS returns the certificate of -admin-name, it is issued and renewed with the certificates of routes
+func (a *adminAPI) ServeTLS(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if ch.ServerName != "" && !strings.EqualFold(ch.ServerName, *adminName) {
+		return nil, errUnknownServerName
+	}
+	certificate, err := a.app.certificates.Load(*adminName, KeyRSA, IssuancePolicy{}, a.app)
+	if certificate == nil && err == nil {
+		err = errors.New("admin: certificate of " + *adminName + " is not issued yet")
+	}
+	return certificate, err
 }
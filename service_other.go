@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// runService handles -service, it returns true if the proxy should exit
+func runService(action string) (bool, error) {
+	if action != "" {
+		return true, errors.New("service: Windows services are not supported on " + runtime.GOOS)
+	}
+	return false, nil
+}
+
+func isService() bool {
+	return false
+}
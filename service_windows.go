@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const serviceName = "auto-proxy"
+
+type windowsService struct{}
+
+// Execute reports the proxy as running till the service control manager stops it
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			logrus.Infoln("Stopping the service...")
+			status <- svc.Status{State: svc.StopPending}
+			shutdown("service stop")
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// serviceArgs are the flags of installing command without -service
+func serviceArgs() (args []string) {
+	skipValue := false
+	for _, arg := range os.Args[1:] {
+		if skipValue {
+			skipValue = false
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "service" {
+			skipValue = true
+			continue
+		} else if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		args = append(args, arg)
+	}
+	return
+}
+
+func installService() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.Abs(executable)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("service: " + serviceName + " is already installed")
+	}
+	s, err := m.CreateService(serviceName, executable, mgr.Config{
+		DisplayName: "auto-proxy",
+		Description: "Reverse proxy for Docker containers with automatic Let's Encrypt certificates",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs()...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	logrus.WithField("args", serviceArgs()).Infoln("Installed the service.")
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("service: " + serviceName + " is not installed")
+	}
+	defer s.Close()
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+	logrus.Infoln("Removed the service.")
+	return nil
+}
+
+// runService handles -service, it returns true if the proxy should exit.
+// Under the service control manager the proxy keeps running and exits once the service is stopped.
+func runService(action string) (bool, error) {
+	switch action {
+	case "install":
+		return true, installService()
+	case "uninstall":
+		return true, uninstallService()
+	case "":
+	default:
+		return true, errors.New("service: expected install or uninstall")
+	}
+
+	if isService() {
+		go func() {
+			err := svc.Run(serviceName, windowsService{})
+			if err != nil {
+				logrus.WithError(err).Errorln("Service failed")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}()
+	}
+	return false, nil
+}
+
+func isService() bool {
+	service, err := svc.IsWindowsService()
+	return err == nil && service
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignHMAC = "hmac"
+	SignJWT  = "jwt"
+)
+
+const (
+	signatureHeader = "X-Auto-Proxy-Signature"
+	timestampHeader = "X-Auto-Proxy-Timestamp"
+	identityHeader  = "X-Auto-Proxy-Identity"
+)
+
+const signedTokenTTL = time.Minute
+
+var signingKey []byte
+
+// loadSigningKey reads the secret shared with backends, ie. from Docker secret
+func loadSigningKey(fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	signingKey = []byte(strings.TrimSpace(string(data)))
+	if len(signingKey) < 32 {
+		return errors.New("sign: the key has to be at least 32 bytes")
+	}
+	return nil
+}
+
+func parseSignMethod(value string) (string, error) {
+	if value == "off" {
+		return "", nil
+	} else if value != SignHMAC && value != SignJWT {
+		return "", errors.New("expected hmac, jwt or off")
+	} else if signingKey == nil {
+		return "", errors.New("requires -sign-key-file")
+	}
+	return value, nil
+}
+
+// hmacSignature signs the timestamp, method, host and request URI which the backend can verify
+func hmacSignature(key []byte, timestamp string, r *http.Request) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + r.Method + "\n" + r.Host + "\n" + r.URL.RequestURI()))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedToken issues HS256 JWT with the virtual host as audience
+func signedToken(key []byte, route *Route, r *http.Request, now time.Time) string {
+	encoding := base64.RawURLEncoding
+	header := encoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":    "auto-proxy",
+		"aud":    route.VirtualHost,
+		"sub":    r.Host,
+		"iat":    now.Unix(),
+		"exp":    now.Add(signedTokenTTL).Unix(),
+		"jti":    r.Header.Get(requestIDHeader),
+		"method": r.Method,
+		"uri":    r.URL.RequestURI(),
+	})
+	payload := header + "." + encoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return payload + "." + encoding.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest proves to the backends of routes with auto-proxy.sign that the request came through the proxy,
+// the headers sent by clients are always removed so they can't be replayed
+func signRequest(r *http.Request, route *Route) {
+	r.Header.Del(signatureHeader)
+	r.Header.Del(timestampHeader)
+	r.Header.Del(identityHeader)
+
+	if route.Sign == "" || signingKey == nil {
+		return
+	}
+
+	now := time.Now()
+	switch route.Sign {
+	case SignHMAC:
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		r.Header.Set(timestampHeader, timestamp)
+		r.Header.Set(signatureHeader, hmacSignature(signingKey, timestamp, r))
+	case SignJWT:
+		r.Header.Set(identityHeader, signedToken(signingKey, route, r, now))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// saveSnapshot persists routes of all sources, so they can be served right after restart
+func saveSnapshot(fileName string, sources map[string]Routes) error {
+	if fileName == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
+
+func loadSnapshot(fileName string) (sources map[string]Routes, err error) {
+	if fileName == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &sources)
+	return
+}
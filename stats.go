@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const statsTimeout = 5 * time.Second
+
+type containerStats struct {
+	CPUPercent    float64 `json:"cpuPercent"`
+	MemoryUsage   uint64  `json:"memoryUsage"`
+	MemoryLimit   uint64  `json:"memoryLimit"`
+	MemoryPercent float64 `json:"memoryPercent"`
+}
+
+type upstreamStatus struct {
+	Upstream
+	EffectiveWeight float64         `json:"effectiveWeight"`
+	Requests        float64         `json:"requests"`
+	InFlight        int             `json:"inFlight"`
+	Stats           *containerStats `json:"stats,omitempty"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// fetchContainerStats reads single sample of container stats from Docker
+func fetchContainerStats(client *docker.Client, name string) (*containerStats, error) {
+	ch := make(chan *docker.Stats, 1)
+	done := make(chan bool)
+	defer close(done)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Stats(docker.StatsOptions{
+			ID:      name,
+			Stats:   ch,
+			Stream:  false,
+			Done:    done,
+			Timeout: statsTimeout,
+		})
+	}()
+
+	sample, ok := <-ch
+	if !ok || sample == nil {
+		return nil, <-errCh
+	}
+
+	stats := &containerStats{
+		MemoryUsage: sample.MemoryStats.Usage,
+		MemoryLimit: sample.MemoryStats.Limit,
+	}
+	if sample.MemoryStats.Limit > 0 {
+		stats.MemoryPercent = float64(sample.MemoryStats.Usage) / float64(sample.MemoryStats.Limit) * 100
+	}
+
+	// The same as docker stats, the usage since previous sample relative to the whole system
+	cpuDelta := float64(sample.CPUStats.CPUUsage.TotalUsage) - float64(sample.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(sample.CPUStats.SystemCPUUsage) - float64(sample.PreCPUStats.SystemCPUUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		cpus := float64(sample.CPUStats.OnlineCPUs)
+		if cpus == 0 {
+			cpus = 1
+		}
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+	return stats, nil
+}
+
+// getUpstreams lists upstreams of the host with their traffic and live resource usage
+func (a *adminAPI) getUpstreams(w http.ResponseWriter, r *http.Request) {
+	a.app.lock.RLock()
+	route := a.app.routes.Find(r.PathValue("host"))
+	a.app.lock.RUnlock()
+	if route == nil {
+		http.Error(w, "unknown host", http.StatusNotFound)
+		return
+	}
+
+	weights := upstreamsState.Weights(route)
+	list := make([]upstreamStatus, len(route.Servers))
+	for idx, upstream := range route.Servers {
+		list[idx] = upstreamStatus{
+			Upstream:        upstream,
+			EffectiveWeight: weights[idx],
+			Requests:        requestsTotal.Sum(route.VirtualHost, upstream.Container, upstream.Daemon),
+			InFlight:        upstreamConns.Active(upstream.inFlightKey()),
+		}
+	}
+
+	if r.URL.Query().Get("stats") != "false" {
+		var wg sync.WaitGroup
+		for idx := range list {
+			client, err := dockerClientOf(&list[idx].Upstream)
+			if err != nil {
+				list[idx].Error = err.Error()
+				continue
+			}
+			wg.Add(1)
+			go func(status *upstreamStatus) {
+				defer wg.Done()
+				stats, err := fetchContainerStats(client, strings.TrimPrefix(status.Container, "/"))
+				if err != nil {
+					status.Error = err.Error()
+				}
+				status.Stats = stats
+			}(&list[idx])
+		}
+		wg.Wait()
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signals which are used to reload the configuration, not to stop the container
+var reloadSignals = map[string]bool{
+	"1": true, "10": true, "12": true, "28": true,
+	"HUP": true, "USR1": true, "USR2": true, "WINCH": true,
+}
+
+// stoppingContainers remembers containers in their stop grace period, so they don't receive new requests
+type stoppingContainers struct {
+	list map[string]time.Time
+	lock sync.Mutex
+}
+
+var terminating stoppingContainers
+
+// Killed marks the container as stopping, it returns true if its routes have to be removed
+func (s *stoppingContainers) Killed(id, name, signal string) bool {
+	if *killDeregisterTimeout <= 0 || reloadSignals[strings.TrimPrefix(strings.ToUpper(signal), "SIG")] {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.list == nil {
+		s.list = make(map[string]time.Time)
+	}
+	if _, ok := s.list[id]; ok {
+		return false
+	}
+	s.list[id] = time.Now()
+	logrus.WithField("name", name).WithField("id", id[:12]).WithField("signal", signal).
+		Infoln("Container is stopping, removing its routes")
+	return true
+}
+
+// Forget is called once the container died or started again
+func (s *stoppingContainers) Forget(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.list, id)
+}
+
+// Stopping returns true if the routes of container should not be added
+func (s *stoppingContainers) Stopping(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.list[id]
+	return ok
+}
+
+// Expired returns true if some container survived the signal for -kill-deregister-timeout and routes have to be rebuilt
+func (s *stoppingContainers) Expired() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	expired := false
+	for id, killed := range s.list {
+		if time.Since(killed) > *killDeregisterTimeout {
+			delete(s.list, id)
+			expired = true
+		}
+	}
+	return expired
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const encryptedKeyType = "AUTO-PROXY ENCRYPTED KEY"
+const storageKeyIterations = 600000
+
+// storageKey encrypts private keys at rest, it is either a passphrase or a raw key provided by KMS
+type storageKey struct {
+	passphrase string
+	raw        []byte
+	derived    map[string][]byte
+	lock       sync.Mutex
+}
+
+var privateKeyStorage *storageKey
+
+// newStorageKey reads the key from file (ie. Docker secret) or from the output of command (ie. KMS decrypt),
+// the raw 32 byte keys are specified as base64:<key>
+func newStorageKey(fileName, command string) (*storageKey, error) {
+	var data []byte
+	var err error
+
+	if fileName != "" {
+		data, err = ioutil.ReadFile(fileName)
+	} else if command != "" {
+		data, err = exec.Command("sh", "-c", command).Output()
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return nil, errors.New("storage: empty key")
+	}
+
+	if strings.HasPrefix(secret, "base64:") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "base64:"))
+		if err != nil {
+			return nil, err
+		} else if len(raw) != 32 {
+			return nil, errors.New("storage: raw key has to be 32 bytes")
+		}
+		return &storageKey{raw: raw}, nil
+	}
+	return &storageKey{passphrase: secret}, nil
+}
+
+func (s *storageKey) key(salt []byte) ([]byte, error) {
+	if s.raw != nil {
+		return s.raw, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if key, ok := s.derived[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, s.passphrase, salt, storageKeyIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	if s.derived == nil {
+		s.derived = make(map[string][]byte)
+	}
+	s.derived[string(salt)] = key
+	return key, nil
+}
+
+func (s *storageKey) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := s.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPEM encodes the block, encrypting it if storage key is configured
+func encryptPEM(block *pem.Block) ([]byte, error) {
+	data := pem.EncodeToMemory(block)
+	s := privateKeyStorage
+	if s == nil {
+		return data, nil
+	}
+
+	headers := map[string]string{}
+	var salt []byte
+	if s.raw == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		headers["Salt"] = base64.StdEncoding.EncodeToString(salt)
+	}
+
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedKeyType,
+		Headers: headers,
+		Bytes:   aead.Seal(nonce, nonce, data, []byte(encryptedKeyType)),
+	}), nil
+}
+
+// decryptPEM returns plain PEM data, unencrypted data is returned as is
+func decryptPEM(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return data, nil
+	}
+
+	s := privateKeyStorage
+	if s == nil {
+		return nil, errors.New("storage: key is encrypted, specify -storage-key-file or -storage-key-command")
+	}
+
+	var salt []byte
+	if value, ok := block.Headers["Salt"]; ok {
+		var err error
+		salt, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, errors.New("storage: encrypted key is too short")
+	}
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(encryptedKeyType))
+	if err != nil {
+		return nil, errors.New("storage: failed to decrypt key, wrong storage key?")
+	}
+	return plain, nil
+}
+
+func readKeyFile(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return decryptPEM(data)
+}
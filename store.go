@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errStoreLocked = errors.New("store: key is locked by other instance")
+
+// Store is a shared key/value storage used to synchronise state between proxy replicas
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Lock(key string, ttl time.Duration) (bool, error)
+	Unlock(key string) error
+}
+
+var sharedStore Store
+
+func newStore(uri string) (Store, error) {
+	if uri == "" {
+		return nil, nil
+	}
+
+	// The Windows paths (C:\share) would be parsed as URL with scheme
+	if filepath.IsAbs(uri) {
+		return &fileStore{dir: uri}, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		return &fileStore{dir: localPath(u)}, nil
+	default:
+		return nil, errors.New("store: unsupported scheme " + u.Scheme)
+	}
+}
+
+// fileStore keeps all keys in a directory, usually mounted from a shared volume
+type fileStore struct {
+	dir string
+}
+
+func (s *fileStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(strings.TrimPrefix(key, "/")))
+}
+
+func (s *fileStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s *fileStore) Put(key string, value []byte) error {
+	fileName := s.path(key)
+	err := os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Write to temporary file first to never expose partially written values
+	tmpFile := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFile, value, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
+
+func (s *fileStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) Lock(key string, ttl time.Duration) (bool, error) {
+	fileName := s.path(key + ".lock")
+	err := os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < 2; i++ {
+		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return true, nil
+		} else if !os.IsExist(err) {
+			return false, err
+		}
+
+		// Remove stale lock left by crashed instance
+		fi, err := os.Stat(fileName)
+		if err != nil || time.Since(fi.ModTime()) < ttl {
+			return false, nil
+		}
+		os.Remove(fileName)
+	}
+	return false, nil
+}
+
+func (s *fileStore) Unlock(key string) error {
+	return s.Delete(key + ".lock")
+}
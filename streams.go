@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var streamConnections = newGauge("auto_proxy_stream_connections",
+	"Number of active connections of stream routes", "host")
+var streamConnectionsTotal = newCounter("auto_proxy_stream_connections_total",
+	"Number of accepted connections of stream routes", "host")
+var streamRejected = newCounter("auto_proxy_stream_rejected_total",
+	"Number of connections rejected by max-connections limit", "host")
+var streamBytes = newCounter("auto_proxy_stream_bytes_total",
+	"Number of bytes transferred by stream routes", "host", "direction")
+
+// connectionLimiter counts active long-lived connections of routes
+type connectionLimiter struct {
+	limit    func(route *Route) int
+	active   *metricVec
+	total    *metricVec
+	rejected *metricVec
+	counts   map[string]int
+	lock     sync.Mutex
+}
+
+var streamLimits = connectionLimiter{
+	limit:    func(route *Route) int { return route.MaxConnections },
+	active:   streamConnections,
+	total:    streamConnectionsTotal,
+	rejected: streamRejected,
+}
+
+// Acquire returns false if the route has already reached its limit
+func (s *connectionLimiter) Acquire(route *Route) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+	if limit := s.limit(route); limit > 0 && s.counts[route.VirtualHost] >= limit {
+		s.rejected.Inc(route.VirtualHost)
+		return false
+	}
+	s.counts[route.VirtualHost]++
+	s.total.Inc(route.VirtualHost)
+	s.active.Set(float64(s.counts[route.VirtualHost]), route.VirtualHost)
+	return true
+}
+
+func (s *connectionLimiter) Release(route *Route) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counts[route.VirtualHost]--
+	s.active.Set(float64(s.counts[route.VirtualHost]), route.VirtualHost)
+	if s.counts[route.VirtualHost] <= 0 {
+		delete(s.counts, route.VirtualHost)
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// streamActivity is the last time any direction of the stream transferred data
+type streamActivity struct {
+	timeout time.Duration
+	last    atomic.Int64
+
+	// The shorter timeout applies once one direction is half-closed
+	halfCloseTimeout time.Duration
+	halfClosed       atomic.Bool
+}
+
+// limit returns the idle timeout of the directions still transferring data
+func (a *streamActivity) limit() time.Duration {
+	if a.halfClosed.Load() && a.halfCloseTimeout > 0 && (a.timeout == 0 || a.halfCloseTimeout < a.timeout) {
+		return a.halfCloseTimeout
+	}
+	return a.timeout
+}
+
+func (a *streamActivity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *streamActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// idleReader fails with timeout once neither direction transferred data for the idle timeout,
+// the reads waiting while the other direction is busy are extended
+type idleReader struct {
+	conn     net.Conn
+	activity *streamActivity
+}
+
+func (r *idleReader) Read(data []byte) (int, error) {
+	for {
+		limit := r.activity.limit()
+		r.conn.SetReadDeadline(time.Now().Add(limit))
+		n, err := r.conn.Read(data)
+		if n > 0 {
+			r.activity.touch()
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && n == 0 && r.activity.idle() < limit {
+			continue
+		}
+		return n, err
+	}
+}
+
+// abortStream closes the connections with RST, so the peers don't take the unfinished stream as complete
+func abortStream(conns ...net.Conn) {
+	for _, conn := range conns {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// copyStream copies data in both directions counting transferred bytes, the raw TCP and unix connections
+// are copied with splice by the kernel on Linux unless auto-proxy.stream.idle-timeout is used.
+// The end of one direction is propagated with half-close (FIN) and the other one continues till it ends too
+// or stays idle for auto-proxy.stream.half-close-timeout, an error of any direction aborts both connections.
+func copyStream(route *Route, client, upstream net.Conn) error {
+	activity := &streamActivity{timeout: route.StreamIdleTimeout, halfCloseTimeout: route.StreamHalfCloseTimeout}
+	activity.touch()
+
+	type result struct {
+		err        error
+		halfClosed bool
+	}
+	done := make(chan result, 2)
+	pipe := func(dst, src net.Conn, direction string) {
+		var reader io.Reader = src
+		if activity.timeout > 0 {
+			reader = &idleReader{conn: src, activity: activity}
+		}
+		var n int64
+		var err error
+		for {
+			var copied int64
+			copied, err = io.Copy(dst, reader)
+			n += copied
+
+			// Without the idle reader the half-closed stream is read with deadline, the data moved in time extends it
+			netErr, ok := err.(net.Error)
+			if ok && netErr.Timeout() && copied > 0 && activity.timeout == 0 && activity.halfClosed.Load() {
+				src.SetReadDeadline(time.Now().Add(activity.halfCloseTimeout))
+				continue
+			}
+			break
+		}
+		streamBytes.Add(float64(n), route.VirtualHost, direction)
+
+		halfClosed := false
+		if writer, ok := dst.(closeWriter); ok && err == nil && !route.StreamHalfCloseOff {
+			err = writer.CloseWrite()
+			halfClosed = err == nil
+		}
+		if halfClosed && activity.halfCloseTimeout > 0 && activity.halfClosed.CompareAndSwap(false, true) {
+			// The opposite direction reads from dst
+			activity.touch()
+			if activity.timeout == 0 {
+				dst.SetReadDeadline(time.Now().Add(activity.halfCloseTimeout))
+			}
+		}
+		done <- result{err, halfClosed}
+	}
+	go pipe(upstream, client, "rx")
+	go pipe(client, upstream, "tx")
+
+	first := <-done
+	if first.err == nil && first.halfClosed {
+		first = <-done
+	}
+	if first.err != nil {
+		abortStream(client, upstream)
+	}
+	return first.err
+}
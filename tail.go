@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tailKeepAlive = 15 * time.Second
+
+type tailSubscriber struct {
+	host   string
+	sample float64
+	ch     chan string
+}
+
+// logTail broadcasts access log entries to admin API clients
+type logTail struct {
+	subscribers map[*tailSubscriber]struct{}
+	lock        sync.RWMutex
+}
+
+var accessLogTail logTail
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (t *logTail) Publish(host, line string) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for subscriber := range t.subscribers {
+		if subscriber.host != "" && subscriber.host != stripPort(host) {
+			continue
+		}
+		if subscriber.sample < 1 && rand.Float64() >= subscriber.sample {
+			continue
+		}
+
+		// Don't block requests for slow readers
+		select {
+		case subscriber.ch <- line:
+		default:
+		}
+	}
+}
+
+func (t *logTail) subscribe(host string, sample float64) *tailSubscriber {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	subscriber := &tailSubscriber{host: host, sample: sample, ch: make(chan string, 100)}
+	if t.subscribers == nil {
+		t.subscribers = make(map[*tailSubscriber]struct{})
+	}
+	t.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (t *logTail) unsubscribe(subscriber *tailSubscriber) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.subscribers, subscriber)
+}
+
+// getTail streams access log as Server-Sent Events, ie. /admin/tail?host=app.example.com&sample=0.1
+func (a *adminAPI) getTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sample := 1.0
+	if value := r.URL.Query().Get("sample"); value != "" {
+		var err error
+		sample, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, "invalid sample: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	subscriber := accessLogTail.subscribe(r.URL.Query().Get("host"), sample)
+	defer accessLogTail.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case line := <-subscriber.ch:
+			fmt.Fprintf(w, "data: %s\n\n", strings.TrimRight(line, "\n"))
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"os"
+	"time"
+)
+
+const sessionTicketKeysStoreKey = "tls/session-ticket-keys"
+const sessionTicketKeysBlock = "SESSION TICKET KEYS"
+
+// Keep previous keys, so tickets issued before the rotation can still be resumed
+const sessionTicketKeysCount = 3
+
+type sessionTicketKey struct {
+	Key     [32]byte
+	Created time.Time
+}
+
+// rotateKeys adds a new key if the newest one is older than the rotation interval
+func rotateKeys(keys []sessionTicketKey, rotation time.Duration) ([]sessionTicketKey, bool, error) {
+	if len(keys) > 0 && time.Since(keys[0].Created) < rotation {
+		return keys, false, nil
+	}
+
+	key := sessionTicketKey{Created: time.Now()}
+	if _, err := rand.Read(key.Key[:]); err != nil {
+		return nil, false, err
+	}
+	keys = append([]sessionTicketKey{key}, keys...)
+	if len(keys) > sessionTicketKeysCount {
+		keys = keys[:sessionTicketKeysCount]
+	}
+	return keys, true, nil
+}
+
+// sharedSessionTicketKeys rotates the keys stored in shared store, so all replicas resume the same tickets
+func sharedSessionTicketKeys(rotation time.Duration) ([]sessionTicketKey, error) {
+	locked, err := sharedStore.Lock(sessionTicketKeysStoreKey, time.Minute)
+	if err != nil {
+		return nil, err
+	} else if !locked {
+		return nil, errStoreLocked
+	}
+	defer sharedStore.Unlock(sessionTicketKeysStoreKey)
+
+	var keys []sessionTicketKey
+	data, err := sharedStore.Get(sessionTicketKeysStoreKey)
+	if err == nil {
+		// The keys are encrypted with storage key if it is configured
+		data, err = decryptPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != sessionTicketKeysBlock {
+			return nil, errors.New("tickets: invalid session ticket keys")
+		}
+		err = json.Unmarshal(block.Bytes, &keys)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	keys, rotated, err := rotateKeys(keys, rotation)
+	if err != nil || !rotated {
+		return keys, err
+	}
+
+	value, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	data, err = encryptPEM(&pem.Block{Type: sessionTicketKeysBlock, Bytes: value})
+	if err != nil {
+		return nil, err
+	}
+	return keys, sharedStore.Put(sessionTicketKeysStoreKey, data)
+}
+
+// rotateSessionTickets periodically replaces session ticket keys of the TLS server
+func rotateSessionTickets(config *tls.Config, rotation time.Duration) {
+	var keys []sessionTicketKey
+	var previous time.Time
+
+	for {
+		var err error
+		if sharedStore != nil {
+			var shared []sessionTicketKey
+			shared, err = sharedSessionTicketKeys(rotation)
+			if err == nil {
+				keys = shared
+			}
+		} else {
+			keys, _, err = rotateKeys(keys, rotation)
+		}
+
+		if err == errStoreLocked {
+			logrus.Debugln("Session ticket keys are rotated by other replica")
+		} else if err != nil {
+			logrus.WithError(err).Warningln("Failed to rotate session ticket keys")
+		}
+
+		if len(keys) > 0 && !keys[0].Created.Equal(previous) {
+			list := make([][32]byte, len(keys))
+			for idx, key := range keys {
+				list[idx] = key.Key
+			}
+			config.SetSessionTicketKeys(list)
+			previous = keys[0].Created
+			logrus.WithField("created", previous).Debugln("Updated session ticket keys")
+		}
+
+		// Check often enough to pick up keys rotated by other replica
+		interval := rotation / 4
+		if sharedStore != nil && *storeSyncInterval < interval {
+			interval = *storeSyncInterval
+		}
+		time.Sleep(interval)
+	}
+}
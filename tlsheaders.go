@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const tlsHeaderLabel = "tls-headers."
+
+// The headers with TLS attributes of client connection, they can be renamed with tls-headers.<attribute>
+var defaultTLSHeaders = map[string]string{
+	"version":            "X-TLS-Version",
+	"cipher":             "X-TLS-Cipher",
+	"sni":                "X-TLS-SNI",
+	"client-subject":     "X-Client-Cert-Subject",
+	"client-san":         "X-Client-Cert-SAN",
+	"client-fingerprint": "X-Client-Cert-Fingerprint",
+}
+
+// tlsHeaderNames returns the headers used by route, the attributes renamed to empty value are not sent
+func (r *Route) tlsHeaderNames() map[string]string {
+	names := make(map[string]string, len(defaultTLSHeaders))
+	for attribute, name := range defaultTLSHeaders {
+		if renamed, ok := r.TLSHeaderNames[attribute]; ok {
+			name = renamed
+		}
+		names[attribute] = name
+	}
+	return names
+}
+
+func (r *RouteBuilder) parseTLSHeaderLabel(attribute, value string) bool {
+	if _, ok := defaultTLSHeaders[attribute]; !ok {
+		return false
+	}
+	if r.TLSHeaderNames == nil {
+		r.TLSHeaderNames = make(map[string]string)
+	}
+	r.TLSHeaderNames[attribute] = http.CanonicalHeaderKey(value)
+	return true
+}
+
+func clientCertificateSANs(certificate *x509.Certificate) string {
+	var names []string
+	names = append(names, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// setTLSHeaders passes the negotiated TLS attributes to upstream, the headers sent by client are always removed
+func setTLSHeaders(r *http.Request, route *Route) {
+	if !route.TLSHeaders {
+		return
+	}
+
+	names := route.tlsHeaderNames()
+	for _, name := range names {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+	if r.TLS == nil {
+		return
+	}
+
+	values := map[string]string{
+		"version": tls.VersionName(r.TLS.Version),
+		"cipher":  tls.CipherSuiteName(r.TLS.CipherSuite),
+		"sni":     r.TLS.ServerName,
+	}
+	if len(r.TLS.VerifiedChains) > 0 {
+		certificate := r.TLS.VerifiedChains[0][0]
+		fingerprint := sha256.Sum256(certificate.Raw)
+		values["client-subject"] = certificate.Subject.String()
+		values["client-san"] = clientCertificateSANs(certificate)
+		values["client-fingerprint"] = hex.EncodeToString(fingerprint[:])
+	}
+
+	for attribute, value := range values {
+		if name := names[attribute]; name != "" && value != "" {
+			r.Header.Set(name, value)
+		}
+	}
+}
+
+// configureClientCA requests client certificates signed by -client-ca, they are optional and exposed with tls-headers
+func configureClientCA(config *tls.Config, fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("tls: no certificates found in " + fileName)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type unixTransports struct {
+	list map[string]*http.Transport
+	lock sync.Mutex
+}
+
+var socketTransports unixTransports
+
+// get returns transport dialing the socket, each socket has its own pool of keep-alive connections
+func (u *unixTransports) get(socket string) *http.Transport {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.list == nil {
+		u.list = make(map[string]*http.Transport)
+	}
+	transport := u.list[socket]
+	if transport == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				// The socket could have been replaced by symlink since the route was built
+				path, err := resolveSocket(socket)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, "unix", path)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: defaultTransport.TLSHandshakeTimeout,
+			TLSClientConfig:     defaultTransport.TLSClientConfig,
+		}
+		u.list[socket] = transport
+	}
+	return transport
+}
+
+func parseSocketURL(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	} else if u.Scheme != "unix" || u.Path == "" {
+		return "", errors.New("expected unix:///path/to/socket")
+	}
+	return resolveSocket(u.Path)
+}
+
+// resolveSocket follows the symlinks of socket path, the socket has to be in -sockets-dir so containers can't
+// reach sockets of the host, ie. /var/run/docker.sock
+func resolveSocket(socket string) (string, error) {
+	if *socketsDirectory == "" {
+		return "", errors.New("unix socket upstreams are disabled, see -sockets-dir")
+	}
+	dir, err := filepath.EvalSymlinks(*socketsDirectory)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(socket)
+	if _, lerr := os.Lstat(socket); os.IsNotExist(err) && os.IsNotExist(lerr) {
+		// The container could create the socket later, its directory has to exist
+		path, err = filepath.EvalSymlinks(filepath.Dir(socket))
+		path = filepath.Join(path, filepath.Base(socket))
+	}
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("socket " + socket + " is not in " + *socketsDirectory)
+	}
+	return path, nil
+}
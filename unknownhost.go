@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	UnknownHostError    = "error"
+	UnknownHostClose    = "close"
+	UnknownHostNotFound = "404"
+	UnknownHostPage     = "page"
+	UnknownHostRedirect = "redirect"
+)
+
+// validateUnknownHost checks -unknown-host: error, close, 404, page:<file> or redirect:<url>
+func validateUnknownHost(value string) error {
+	mode, arg, _ := strings.Cut(value, ":")
+	switch mode {
+	case UnknownHostError, UnknownHostClose, UnknownHostNotFound:
+		if arg != "" {
+			return errors.New("unknown-host: " + mode + " doesn't take any argument")
+		}
+	case UnknownHostPage:
+		if _, err := ioutil.ReadFile(arg); err != nil {
+			return err
+		}
+	case UnknownHostRedirect:
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		} else if u.Host == "" {
+			return errors.New("unknown-host: redirect requires absolute URL")
+		}
+	default:
+		return errors.New("unknown-host: expected error, close, 404, page:<file> or redirect:<url>")
+	}
+	return nil
+}
+
+// serveUnknownHost responds to requests for hosts without route, only the error mode reveals the proxy
+func serveUnknownHost(w http.ResponseWriter, r *http.Request) {
+	mode, arg, _ := strings.Cut(*unknownHost, ":")
+	if mode == UnknownHostError {
+		serveError(w, r, ErrorNoRoute, "no route for "+r.Host)
+		return
+	}
+
+	w.Header().Del(requestIDHeader)
+	proxyErrors.Inc(stripPort(r.Host), ErrorNoRoute)
+
+	switch mode {
+	case UnknownHostClose:
+		// closes the connection, works with HTTP/2 as well
+		panic(http.ErrAbortHandler)
+	case UnknownHostPage:
+		page, err := ioutil.ReadFile(arg)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(page)
+	case UnknownHostRedirect:
+		http.Redirect(w, r, arg, http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
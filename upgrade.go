@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var upgradedConnections = newGauge("auto_proxy_upgraded_connections",
+	"Number of active upgraded connections, ie. websockets", "host")
+var upgradedConnectionsTotal = newCounter("auto_proxy_upgraded_connections_total",
+	"Number of upgraded connections", "host")
+var upgradedRejected = newCounter("auto_proxy_upgraded_rejected_total",
+	"Number of upgrades rejected by max-upgrades limit", "host")
+var upgradedIdleClosed = newCounter("auto_proxy_upgraded_idle_closed_total",
+	"Number of upgraded connections closed by idle timeout", "host")
+
+var upgradeLimits = connectionLimiter{
+	limit:    func(route *Route) int { return route.MaxUpgrades },
+	active:   upgradedConnections,
+	total:    upgradedConnectionsTotal,
+	rejected: upgradedRejected,
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// websocketFrames follows the frame boundaries of the stream to tell the data frames from pings and pongs
+type websocketFrames struct {
+	header    []byte
+	remaining uint64
+	control   bool
+}
+
+func (f *websocketFrames) headerSize() int {
+	if len(f.header) < 2 {
+		return 2
+	}
+	size := 2
+	switch f.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if f.header[1]&0x80 != 0 {
+		// masked by client
+		size += 4
+	}
+	return size
+}
+
+func (f *websocketFrames) payloadSize() uint64 {
+	switch length := f.header[1] & 0x7f; length {
+	case 126:
+		return uint64(f.header[2])<<8 | uint64(f.header[3])
+	case 127:
+		var size uint64
+		for _, b := range f.header[2:10] {
+			size = size<<8 | uint64(b)
+		}
+		return size
+	default:
+		return uint64(length)
+	}
+}
+
+// Feed returns true if the data contain any part of data frame
+func (f *websocketFrames) Feed(data []byte) (active bool) {
+	for len(data) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(data))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			data = data[n:]
+			active = active || !f.control
+			continue
+		}
+
+		f.header = append(f.header, data[0])
+		data = data[1:]
+		if len(f.header) < f.headerSize() {
+			continue
+		}
+		f.control = f.header[0]&0x0f >= 8
+		f.remaining = f.payloadSize()
+		f.header = f.header[:0]
+		active = active || !f.control
+	}
+	return
+}
+
+// idleConn closes the hijacked client connection if nothing was transferred for the idle timeout
+type idleConn struct {
+	net.Conn
+	route      *Route
+	timer      *time.Timer
+	websocket  bool
+	read       websocketFrames
+	written    websocketFrames
+	lock       sync.Mutex
+	lastActive time.Time
+}
+
+func newIdleConn(conn net.Conn, route *Route, websocket bool) *idleConn {
+	c := &idleConn{Conn: conn, route: route, websocket: websocket, lastActive: time.Now()}
+	c.timer = time.AfterFunc(route.UpgradeIdleTimeout, c.check)
+	return c
+}
+
+func (c *idleConn) check() {
+	c.lock.Lock()
+	idle := time.Since(c.lastActive)
+	c.lock.Unlock()
+
+	if idle < c.route.UpgradeIdleTimeout {
+		c.timer.Reset(c.route.UpgradeIdleTimeout - idle)
+		return
+	}
+	upgradedIdleClosed.Inc(c.route.VirtualHost)
+	logrus.WithField("host", c.route.VirtualHost).WithField("remote", c.RemoteAddr().String()).
+		WithField("idle", idle.String()).Debugln("Closing idle upgraded connection")
+	c.Conn.Close()
+}
+
+// touch records activity, the pings and pongs keep the connection alive only with upgrade.pings=on
+func (c *idleConn) touch(frames *websocketFrames, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.websocket || !c.route.UpgradeIgnorePings {
+		c.lastActive = time.Now()
+	} else if frames.Feed(data) {
+		c.lastActive = time.Now()
+	}
+}
+
+func (c *idleConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+	if n > 0 {
+		c.touch(&c.read, data[:n])
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+	if n > 0 {
+		c.touch(&c.written, data[:n])
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// Hijack is used by reverse proxy for upgraded connections, they are reaped when idle
+func (l *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(l.rw).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if l.status == 0 {
+		l.status = http.StatusSwitchingProtocols
+	}
+	if l.upgrade == nil || l.upgrade.UpgradeIdleTimeout <= 0 {
+		return conn, rw, nil
+	}
+
+	return newIdleConn(conn, l.upgrade, strings.EqualFold(l.upgradeProto, "websocket")), rw, nil
+}
+
+func (l *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return l.rw
+}
+
+// LimitUpgrade returns false if the route has already max-upgrades connections,
+// the caller has to release the slot once the request is served
+func (l *loggingResponseWriter) LimitUpgrade(r *http.Request, route *Route) bool {
+	if !upgradeLimits.Acquire(route) {
+		return false
+	}
+	l.upgrade = route
+	l.upgradeProto = r.Header.Get("Upgrade")
+	return true
+}
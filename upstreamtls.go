@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var upstreamPinFailures = newCounter("auto_proxy_upstream_pin_failures_total",
+	"Number of TLS connections to upstreams with not matching pinned certificate", "server_name")
+
+type certificatePin struct {
+	spki bool
+	hash []byte
+}
+
+// parsePins reads comma separated sha256/<base64 SPKI hash> or sha256:<hex certificate fingerprint>
+func parsePins(value string) (pins []certificatePin, err error) {
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.TrimSpace(pin)
+		var parsed certificatePin
+		switch {
+		case strings.HasPrefix(pin, "sha256/"):
+			parsed.spki = true
+			parsed.hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		case strings.HasPrefix(pin, "sha256:"):
+			parsed.hash, err = hex.DecodeString(strings.Replace(strings.TrimPrefix(pin, "sha256:"), ":", "", -1))
+		default:
+			err = errors.New("expected sha256/<base64 SPKI hash> or sha256:<hex fingerprint>")
+		}
+		if err != nil {
+			return nil, err
+		} else if len(parsed.hash) != sha256.Size {
+			return nil, errors.New("invalid length of sha256 hash in " + pin)
+		}
+		pins = append(pins, parsed)
+	}
+	return
+}
+
+func (p *certificatePin) matches(certificate *x509.Certificate) bool {
+	var hash [sha256.Size]byte
+	if p.spki {
+		hash = sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	} else {
+		hash = sha256.Sum256(certificate.Raw)
+	}
+	return bytes.Equal(hash[:], p.hash)
+}
+
+// verifyPins accepts the connection if the leaf certificate matches any of pins, the CA is not verified
+var errPinMismatch = errors.New("upstream certificate doesn't match pinned certificates")
+
+func verifyPins(serverName string, pins []certificatePin) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) > 0 {
+			for _, pin := range pins {
+				if pin.matches(state.PeerCertificates[0]) {
+					return nil
+				}
+			}
+		}
+		upstreamPinFailures.Inc(serverName)
+		logrus.WithField("server_name", serverName).Warningln("Upstream certificate doesn't match pinned certificates")
+		return errPinMismatch
+	}
+}
+
+type tlsTransports struct {
+	list map[string]*http.Transport
+	lock sync.Mutex
+}
+
+var upstreamTLSTransports tlsTransports
+
+// get returns transport verifying upstream with given server name and pins
+func (t *tlsTransports) get(serverName, pins string) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := serverName + " " + pins
+	if t.list == nil {
+		t.list = make(map[string]*http.Transport)
+	}
+	transport := t.list[key]
+	if transport != nil {
+		return transport
+	}
+
+	transport = defaultTransport.Clone()
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: *insecureSkipVerify,
+	}
+	if pins != "" {
+		// the pins are validated when parsing labels
+		parsed, _ := parsePins(pins)
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyPins(serverName, parsed)
+	}
+	transport.TLSClientConfig = config
+	transport.DialTLSContext = warmDialTLS(key, config)
+	t.list[key] = transport
+	return transport
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The kinds of route validation errors
+const (
+	ValidationMissingHost       = "missing_host"
+	ValidationMissingPort       = "missing_port"
+	ValidationInvalidPort       = "invalid_port"
+	ValidationMissingAddress    = "missing_address"
+	ValidationInvalidLabel      = "invalid_label"
+	ValidationInvalidMiddleware = "invalid_middleware"
+	ValidationConflictingLabels = "conflicting_labels"
+	ValidationDomainNotAllowed  = "domain_not_allowed"
+	ValidationDeprecatedKey     = "deprecated_key"
+)
+
+var routeValidationErrors = newGauge("auto_proxy_route_validation_errors",
+	"Number of validation errors of discovered containers", "kind")
+
+// ValidationError explains why the container is not served or some of its labels were ignored
+type ValidationError struct {
+	Kind    string `json:"kind"`
+	Label   string `json:"label,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Label != "" {
+		return e.Kind + ": " + e.Label + ": " + e.Message
+	}
+	return e.Kind + ": " + e.Message
+}
+
+// blocks is true for errors which prevent the route from being served
+func (e ValidationError) blocks() bool {
+	switch e.Kind {
+	case ValidationMissingHost, ValidationMissingPort, ValidationInvalidPort, ValidationMissingAddress, ValidationInvalidMiddleware:
+		return true
+	}
+	return false
+}
+
+func (r *RouteBuilder) addError(kind, label, message string) {
+	r.Errors = append(r.Errors, ValidationError{Kind: kind, Label: label, Message: message})
+}
+
+// Validate returns the errors of parsed labels and of the resulting route
+func (r *RouteBuilder) Validate() []ValidationError {
+	errs := append([]ValidationError{}, r.Errors...)
+	add := func(kind, label, message string) {
+		errs = append(errs, ValidationError{Kind: kind, Label: label, Message: message})
+	}
+
+	if len(r.VirtualHost) == 0 {
+		add(ValidationMissingHost, "VIRTUAL_HOST", "no virtual host")
+	}
+	for _, host := range r.VirtualHost {
+		if !isAllowedDomain(host) {
+			add(ValidationDomainNotAllowed, "VIRTUAL_HOST", host+" is not in -allowed-domains")
+		}
+	}
+
+	if r.Upstream.Socket == "" {
+		if r.Upstream.Port == "" {
+			add(ValidationMissingPort, "VIRTUAL_PORT", "no port to expose")
+		} else if port, err := strconv.Atoi(r.Upstream.Port); err != nil || port <= 0 || port > 65535 {
+			add(ValidationInvalidPort, "VIRTUAL_PORT", "invalid port "+r.Upstream.Port)
+		} else if r.Upstream.IP == "" {
+			add(ValidationMissingAddress, "", "no address to access the container")
+		}
+	}
+
+	if err := r.validateMiddlewares(); err != nil {
+		add(ValidationInvalidMiddleware, LabelPrefix+"middlewares", err.Error())
+	}
+
+	// The HTTP features don't apply to TLS streams
+	if r.TLS == TLSPassthrough {
+		if r.Cache || r.ExtProc != "" || len(r.Middlewares) > 0 {
+			add(ValidationConflictingLabels, LabelPrefix+"tls", "cache, ext-proc and middlewares don't apply to passthrough")
+		}
+		if r.Upstream.ALPN != "" {
+			add(ValidationConflictingLabels, LabelPrefix+"alpn", "the passthrough routes can't route by ALPN")
+		}
+	}
+	if r.Canonical != "" && r.Canonical != "off" {
+		for _, host := range r.VirtualHost {
+			if strings.HasPrefix(host, "*.") {
+				add(ValidationConflictingLabels, LabelPrefix+"canonical", "wildcard host "+host+" has no canonical name")
+			}
+		}
+	}
+	return append(errs, r.deprecatedKeys()...)
+}
+
+// containerValidation is the discovery result of the container configured for proxy
+type containerValidation struct {
+	Name   string            `json:"name"`
+	ID     string            `json:"id"`
+	Daemon string            `json:"daemon,omitempty"`
+	Schema string            `json:"schema"`
+	Hosts  []string          `json:"hosts,omitempty"`
+	Served bool              `json:"served"`
+	Errors []ValidationError `json:"errors,omitempty"`
+}
+
+type containerValidations struct {
+	list    []containerValidation
+	daemons map[string][]containerValidation
+	lock    sync.RWMutex
+}
+
+var discoveredContainers containerValidations
+
+// Update replaces the results of the last container enumeration of daemon and counts the errors by kind
+func (c *containerValidations) Update(daemon string, list []containerValidation) {
+	c.lock.Lock()
+	if c.daemons == nil {
+		c.daemons = make(map[string][]containerValidation)
+	}
+	c.daemons[daemon] = list
+	list = nil
+	for _, validations := range c.daemons {
+		list = append(list, validations...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Daemon < list[j].Daemon
+	})
+	c.list = list
+	c.lock.Unlock()
+
+	counts := make(map[string]int)
+	schemas := make(map[string]int)
+	for _, container := range list {
+		for _, err := range container.Errors {
+			counts[err.Kind]++
+		}
+		schemas[container.Schema]++
+	}
+	routeValidationErrors.Reset()
+	for kind, count := range counts {
+		routeValidationErrors.Set(float64(count), kind)
+	}
+	containerSchemas.Reset()
+	for schema, count := range schemas {
+		containerSchemas.Set(float64(count), schema)
+	}
+}
+
+func (c *containerValidations) List(failed bool) (list []containerValidation) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, container := range c.list {
+		if !failed || len(container.Errors) > 0 {
+			list = append(list, container)
+		}
+	}
+	return
+}
+
+// isProxied checks whether the container is meant to be served, the other ones are not validated
+func isProxied(env []string, labels map[string]string) bool {
+	for _, value := range env {
+		if strings.HasPrefix(value, "VIRTUAL_HOST=") {
+			return true
+		}
+	}
+	for key := range labels {
+		if strings.HasPrefix(key, LabelPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adminAPI) getContainers(w http.ResponseWriter, r *http.Request) {
+	list := discoveredContainers.List(r.URL.Query().Get("errors") == "true")
+	if list == nil {
+		list = []containerValidation{}
+	}
+	writeJSON(w, list)
+}
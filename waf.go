@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	RuleBlock = "block"
+	RuleLog   = "log"
+	RuleAllow = "allow"
+)
+
+// The size of body inspected by rules, the rest of body is not matched
+const ruleBodyLimit = 64 * 1024
+
+const crsLitePreset = "crs-lite"
+
+const ruleLabel = "rule."
+
+var ruleMatches = newCounter("auto_proxy_rule_matches_total",
+	"Number of requests matched by filtering rules", "host", "rule", "action")
+
+// Rule matches the request if all specified conditions match
+type Rule struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Header string `json:"header"`
+	Value  string `json:"value"`
+	Body   string `json:"body"`
+	JA3    string `json:"ja3"`
+	Expr   string `json:"expr"`
+	Action string `json:"action"`
+
+	path  *regexp.Regexp
+	expr  exprNode
+	value *regexp.Regexp
+	body  *regexp.Regexp
+}
+
+// The most common exploit probes, inspired by OWASP Core Rule Set
+var crsLiteRules = []Rule{
+	{Name: "path-traversal", Path: `(?i)(\.\./|\.\.\\|%2e%2e(%2f|%5c|/))`},
+	{Name: "sensitive-files", Path: `(?i)^[^?]*(/\.(git|svn|hg|env|htpasswd|aws|ssh)|\.(bak|sql|swp))(/|\?|$)`},
+	{Name: "sql-injection", Path: `(?i)(union(\s|%20|\+)+(all(\s|%20|\+)+)?select|(\s|%20|\+|')or(\s|%20|\+)+1=1|sleep\(\d+\)|benchmark\()`},
+	{Name: "xss", Path: `(?i)(<|%3c)script|javascript:|on(error|load)(=|%3d)`},
+	{Name: "shell-injection", Path: `(?i)(;|%3b|\|)(\s|%20)*(cat|wget|curl|bash|sh)(\s|%20)`},
+	{Name: "shellshock", Header: "User-Agent", Value: `\(\)\s*\{`},
+	{Name: "log4shell", Path: `(?i)\$\{jndi:`},
+	{Name: "log4shell-header", Header: "User-Agent", Value: `(?i)\$\{jndi:`},
+}
+
+func (rule *Rule) compile() (err error) {
+	if rule.Action == "" {
+		rule.Action = RuleBlock
+	} else if rule.Action != RuleBlock && rule.Action != RuleLog && rule.Action != RuleAllow {
+		return errors.New("rules: unknown action " + rule.Action)
+	}
+	if rule.Value != "" && rule.Header == "" {
+		return errors.New("rules: value requires header")
+	}
+
+	compile := func(expr string) (*regexp.Regexp, error) {
+		if expr == "" {
+			return nil, nil
+		}
+		return regexp.Compile(expr)
+	}
+	if rule.path, err = compile(rule.Path); err != nil {
+		return
+	}
+	if rule.value, err = compile(rule.Value); err != nil {
+		return
+	}
+	if rule.body, err = compile(rule.Body); err != nil {
+		return
+	}
+	if rule.Expr != "" {
+		rule.expr, err = compileExpr(rule.Expr)
+	}
+	return
+}
+
+func (rule *Rule) matches(r *http.Request, body []byte) bool {
+	if rule.Method != "" && !matchesList(rule.Method, r.Method) {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.RequestURI()) {
+		return false
+	}
+	if rule.Header != "" {
+		values, ok := r.Header[http.CanonicalHeaderKey(rule.Header)]
+		if !ok {
+			return false
+		}
+		if rule.value != nil && !rule.value.MatchString(strings.Join(values, ",")) {
+			return false
+		}
+	}
+	if rule.body != nil && !rule.body.Match(body) {
+		return false
+	}
+	if rule.JA3 != "" && !matchesList(rule.JA3, requestFingerprint(r)) {
+		return false
+	}
+	if rule.expr != nil {
+		matched, err := evalExpr(rule.expr, r)
+		if err != nil {
+			logrus.WithField("rule", rule.Name).WithError(err).Debugln("Failed to evaluate rule expression")
+		}
+		return matched
+	}
+	return true
+}
+
+func matchesList(list, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRules prepares the rule sets from config and the built-in preset
+func compileRules(sets map[string][]Rule) (map[string][]Rule, error) {
+	compiled := make(map[string][]Rule)
+	if _, ok := sets[crsLitePreset]; !ok {
+		compiled[crsLitePreset] = append([]Rule{}, crsLiteRules...)
+	}
+	for name, rules := range sets {
+		compiled[name] = append([]Rule{}, rules...)
+	}
+
+	for name, rules := range compiled {
+		for idx := range rules {
+			if rules[idx].Name == "" {
+				rules[idx].Name = strconv.Itoa(idx + 1)
+			}
+			rules[idx].Name = name + "/" + rules[idx].Name
+			if err := rules[idx].compile(); err != nil {
+				return nil, errors.New(err.Error() + " in " + rules[idx].Name)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+// checkRuleSets rejects unknown names of auto-proxy.rules, so a typo doesn't disable the filtering
+func checkRuleSets(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if _, ok := config.compiledRules[strings.TrimSpace(name)]; !ok {
+			return errors.New("unknown rule set " + strings.TrimSpace(name))
+		}
+	}
+	return nil
+}
+
+// routeRules returns global rules followed by the rules of the route
+func routeRules(route *Route) (rules []Rule) {
+	names := append([]string{}, config.GlobalRules...)
+	if route.Rules != "" {
+		names = append(names, strings.Split(route.Rules, ",")...)
+	}
+	for _, name := range names {
+		rules = append(rules, config.compiledRules[strings.TrimSpace(name)]...)
+	}
+
+	if route.state != nil {
+		return append(rules, route.state.exprRules...)
+	}
+	return append(rules, compileExprRules(route)...)
+}
+
+// compileExprRules compiles the rule.<name> labels, they block requests matching the expression
+func compileExprRules(route *Route) (rules []Rule) {
+	names := make([]string, 0, len(route.RuleExprs))
+	for name := range route.RuleExprs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rule := Rule{Name: "label/" + name, Expr: route.RuleExprs[name], Action: RuleBlock}
+		if err := rule.compile(); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return
+}
+
+// parseRuleLabel reads rule.<name>=<expression>
+func (r *RouteBuilder) parseRuleLabel(name, value string) bool {
+	if _, err := compileExpr(value); err != nil {
+		logrus.WithField("label", LabelPrefix+ruleLabel+name).WithError(err).Warningln("Invalid label value")
+		return false
+	}
+	if r.RuleExprs == nil {
+		r.RuleExprs = make(map[string]string)
+	}
+	r.RuleExprs[name] = value
+	return true
+}
+
+// readBodyPrefix returns the beginning of body, the body is restored so it can be still proxied
+func readBodyPrefix(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	prefix, _ := ioutil.ReadAll(io.LimitReader(r.Body, ruleBodyLimit))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+	return prefix
+}
+
+// filterRequest applies filtering rules, it returns false if the request was blocked
+func filterRequest(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	rules := routeRules(route)
+	if len(rules) == 0 {
+		return true
+	}
+
+	var body []byte
+	for idx := range rules {
+		if rules[idx].body != nil {
+			body = readBodyPrefix(r)
+			break
+		}
+	}
+
+	for idx := range rules {
+		rule := &rules[idx]
+		if !rule.matches(r, body) {
+			continue
+		}
+
+		ruleMatches.Inc(route.VirtualHost, rule.Name, rule.Action)
+		logrus.WithField("host", r.Host).WithField("remote", r.RemoteAddr).WithField("uri", r.RequestURI).
+			WithField("rule", rule.Name).WithField("action", rule.Action).Infoln("Request matched filtering rule")
+		if rule.Action == RuleBlock {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return false
+		} else if rule.Action == RuleAllow {
+			// skip the remaining rules
+			return true
+		}
+	}
+	return true
+}
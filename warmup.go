@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const warmupRequestTimeout = 10 * time.Second
+const warmupTimeout = time.Minute
+
+// The weight of upstream at the beginning of slow start
+const slowStartMinWeight = 0.05
+
+var warmupRequests = newCounter("auto_proxy_warmup_requests_total",
+	"Number of warm-up requests sent to new upstreams", "host", "upstream", "result")
+
+type routeUpstream struct {
+	route    *Route
+	upstream Upstream
+}
+
+// newUpstreams returns the servers of routes which were not present in the previous routes
+func newUpstreams(previous, current Routes) (list []routeUpstream) {
+	known := make(map[string]bool)
+	for _, route := range previous {
+		for _, upstream := range route.Servers {
+			known[route.VirtualHost+" "+upstream.String()] = true
+		}
+	}
+	for _, route := range current {
+		for _, upstream := range route.Servers {
+			if !known[route.VirtualHost+" "+upstream.String()] {
+				list = append(list, routeUpstream{route, upstream})
+			}
+		}
+	}
+	return
+}
+
+// warmUp prepares new upstreams before they receive traffic, they are warmed up and then slowly ramped up
+func warmUp(previous, current Routes) {
+	for _, item := range newUpstreams(previous, current) {
+		if item.route.WarmupRequests <= 0 && item.route.SlowStart <= 0 {
+			continue
+		}
+
+		upstreamsState.Discovered(&item.upstream, item.route.WarmupRequests > 0)
+		if item.route.WarmupRequests > 0 {
+			go sendWarmupRequests(item.route, item.upstream)
+		}
+	}
+}
+
+func sendWarmupRequests(route *Route, upstream Upstream) {
+	defer upstreamsState.Warmed(&upstream)
+
+	ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+	defer cancel()
+
+	path := route.WarmupPath
+	if path == "" {
+		path = "/"
+	}
+	proto := upstream.Scheme()
+	client := http.Client{Transport: upstream.Transport(), Timeout: warmupRequestTimeout}
+	log := logrus.WithField("host", route.VirtualHost).WithField("upstream", upstream.String())
+
+	for idx := 0; idx < route.WarmupRequests && ctx.Err() == nil; idx++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", proto+"://"+upstream.Host()+path, nil)
+		if err != nil {
+			log.WithError(err).Warningln("Invalid warm-up request")
+			return
+		}
+		req.Host = strings.TrimPrefix(route.VirtualHost, "*.")
+		req.Header.Set("User-Agent", "auto-proxy warm-up")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			warmupRequests.Inc(route.VirtualHost, upstream.Container, "error")
+			log.WithError(err).Debugln("Warm-up request failed")
+			// not ready yet
+			time.Sleep(time.Second)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		warmupRequests.Inc(route.VirtualHost, upstream.Container, "ok")
+	}
+	log.Debugln("Upstream is warmed up")
+}
+
+// Discovered starts the slow start of the upstream, the warming upstreams don't receive any traffic
+func (s *upstreamStates) Discovered(upstream *Upstream, warming bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.get(upstream)
+	state.warming = warming
+	state.readySince = time.Now()
+}
+
+func (s *upstreamStates) Warmed(upstream *Upstream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.get(upstream)
+	state.warming = false
+	state.readySince = time.Now()
+}
+
+// slowStart scales the weight of upstream ready for less than slow-start
+func (u *upstreamState) slowStart(now time.Time, route *Route) float64 {
+	if u.warming {
+		return 0
+	} else if route.SlowStart <= 0 || u.readySince.IsZero() {
+		return 1
+	}
+
+	weight := float64(now.Sub(u.readySince)) / float64(route.SlowStart)
+	if weight >= 1 {
+		return 1
+	} else if weight < slowStartMinWeight {
+		return slowStartMinWeight
+	}
+	return weight
+}
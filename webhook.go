@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Transport: outboundTransport, Timeout: 30 * time.Second}
+
+// postWebhook sends the payload as JSON, any non-2xx response is an error
+func postWebhook(url string, payload interface{}) error {
+	return postWebhookWith(webhookClient, url, payload)
+}
+
+// postWebhookWith sends the payload with client of other timeout
+func postWebhookWith(client *http.Client, url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"github.com/fsouza/go-dockerclient"
+	"strconv"
+)
+
+const (
+	WeightByCPU    = "cpu"
+	WeightByMemory = "memory"
+	WeightByNone   = "none"
+)
+
+const gigabyte = 1024 * 1024 * 1024
+
+// parseWeight reads auto-proxy.weight: cpu, memory or a fixed number
+func (r *RouteBuilder) parseWeight(value string) error {
+	switch value {
+	case WeightByCPU, WeightByMemory, WeightByNone:
+		r.WeightBy = value
+		return nil
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil || weight <= 0 {
+		return errors.New("expected cpu, memory, none or positive number")
+	}
+	r.WeightBy = WeightByNone
+	r.Upstream.Weight = weight
+	return nil
+}
+
+// resourceWeight derives the weight from limits of container, the containers without limit count as 1 CPU or 1GB
+func resourceWeight(container *docker.Container, weightBy string) float64 {
+	config := container.HostConfig
+	if config == nil {
+		return 0
+	}
+
+	switch weightBy {
+	case WeightByCPU:
+		if config.NanoCPUs > 0 {
+			return float64(config.NanoCPUs) / 1e9
+		} else if config.CPUQuota > 0 && config.CPUPeriod > 0 {
+			return float64(config.CPUQuota) / float64(config.CPUPeriod)
+		}
+		return 1
+	case WeightByMemory:
+		if config.Memory > 0 {
+			return float64(config.Memory) / gigabyte
+		}
+		return 1
+	}
+	return 0
+}
+
+// applyResourceWeight sets the weight of upstream by -weight-by or auto-proxy.weight
+func (r *RouteBuilder) applyResourceWeight(container *docker.Container) {
+	weightBy := r.WeightBy
+	if weightBy == "" {
+		weightBy = *defaultWeightBy
+	}
+	if weight := resourceWeight(container, weightBy); weight > 0 {
+		r.Upstream.Weight = weight
+	}
+}